@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/whywaita/shoes-vz/internal/agent/vm"
+	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+func runCpCommand() {
+	cpFlags := flag.NewFlagSet("cp", flag.ExitOnError)
+	runnersPath := cpFlags.String("runners-path", "/opt/myshoes/vz/runners", "Path to runners directory")
+	sshInsecure := cpFlags.Bool("ssh-insecure-ignore-host-key", false, "Accept runners that did not report an SSH host key")
+	authSecretFile := cpFlags.String("auth-secret-file", "", "Path to shared secret for authenticating runner-agent requests")
+	insecureNoAuth := cpFlags.Bool("insecure-no-auth", false, "Send runner-agent requests unsigned when no -auth-secret-file is given")
+	maxSize := cpFlags.Int64("max-size", 0, "Maximum total bytes to copy (0 for the default of 4GiB)")
+
+	if err := cpFlags.Parse(os.Args[2:]); err != nil {
+		logger := logging.WithComponent("agent")
+		logger.Error("Failed to parse flags", "error", err)
+		os.Exit(1)
+	}
+
+	logger := logging.WithComponent("agent")
+
+	args := cpFlags.Args()
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Error: source and destination are required\n")
+		printCpUsage(cpFlags)
+		os.Exit(1)
+	}
+
+	srcRunner, srcPath, srcRemote := parseCopyTarget(args[0])
+	dstRunner, dstPath, dstRemote := parseCopyTarget(args[1])
+	if srcRemote == dstRemote {
+		fmt.Fprintf(os.Stderr, "Error: exactly one of source and destination must be <runner-id>:<path>\n")
+		printCpUsage(cpFlags)
+		os.Exit(1)
+	}
+
+	// Load shared secret for runner-agent authentication
+	authSecret, err := loadAuthSecret(*authSecretFile, *insecureNoAuth)
+	if err != nil {
+		logger.Error("Failed to load auth secret", "error", err)
+		os.Exit(1)
+	}
+
+	config := &model.AgentConfig{
+		RunnersPath:     *runnersPath,
+		AuthSecret:      authSecret,
+		SSHInsecure:     *sshInsecure,
+		MaxTransferSize: *maxSize,
+	}
+	vmManager := vm.NewManager(config, nil)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var (
+		runnerID string
+		dest     string
+	)
+	if srcRemote {
+		runnerID = srcRunner
+		dest, err = vmManager.CopyFromVM(ctx, srcRunner, srcPath, dstPath)
+	} else {
+		runnerID = dstRunner
+		dest, err = vmManager.CopyToVM(ctx, dstRunner, srcPath, dstPath)
+	}
+	if err != nil {
+		logger.Error("Failed to copy", "runner_id", runnerID, "error", err)
+		os.Exit(1)
+	}
+
+	logger.Debug("Copied", "runner_id", runnerID, "source", args[0], "destination", dest)
+}
+
+// parseCopyTarget splits a <runner-id>:<path> argument. Anything without
+// a colon before the first slash is a local path.
+func parseCopyTarget(arg string) (runnerID, path string, remote bool) {
+	i := strings.Index(arg, ":")
+	if i <= 0 || strings.Contains(arg[:i], "/") {
+		return "", arg, false
+	}
+	return arg[:i], arg[i+1:], true
+}
+
+func printCpUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: shoes-vz-agent cp [options] <runner-id>:<path> <local-path>\n")
+	fmt.Fprintf(os.Stderr, "       shoes-vz-agent cp [options] <local-path> <runner-id>:<path>\n")
+	fs.PrintDefaults()
+}
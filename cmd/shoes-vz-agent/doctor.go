@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/whywaita/shoes-vz/internal/agent/doctor"
+	"github.com/whywaita/shoes-vz/internal/agent/vm"
+)
+
+func runDoctorCommand() {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	templatesDir := fs.String("templates-dir", defaultTemplatesDir, "Directory of VM templates")
+	defaultTmpl := fs.String("default-template", "macos-26", "Template used when the server does not ask for one")
+	requireMeta := fs.Bool("require-template-metadata", false, "Refuse templates without a TemplateMetadata.json")
+	runnersPath := fs.String("runners-path", "/opt/myshoes/vz/runners", "Path to runners directory")
+	sshKeyPath := fs.String("ssh-key", "", "Path to SSH private key shared by all runners")
+	ipNotifyPort := fs.Uint("ip-notify-port", 8081, "Port for IP notification HTTP server")
+	serverAddr := fs.String("server", "localhost:50051", "Server gRPC address")
+	checksums := fs.Bool("checksums", true, "Verify template files against the checksums in their metadata (reads every file)")
+	minFree := fs.Uint64("min-free-space", doctor.DefaultMinFreeBytes, "Free bytes on the runners volume below which a warning is given")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout for reaching the server")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Failed to find the agent binary: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report := doctor.New(doctor.Config{
+		TemplatesDir:            *templatesDir,
+		DefaultTemplate:         *defaultTmpl,
+		RequireTemplateMetadata: *requireMeta,
+		RunnersPath:             *runnersPath,
+		SSHKeyPath:              *sshKeyPath,
+		IPNotifyPort:            *ipNotifyPort,
+		ServerAddr:              *serverAddr,
+		Executable:              exe,
+		VMCPUCount:              vm.VMCPUCount,
+		VMMemoryBytes:           vm.VMMemorySize,
+		VerifyChecksums:         *checksums,
+		MinFreeBytes:            *minFree,
+		Timeout:                 *timeout,
+		LoadHardwareModel:       loadHardwareModel,
+	}).Run(ctx)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("Failed to encode report: %v", err)
+		}
+	} else {
+		printDoctorReport(report)
+	}
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+// loadHardwareModel fails unless Virtualization.framework can run VMs of
+// the hardware model on this host
+func loadHardwareModel(path string) error {
+	m, err := vm.LoadHardwareModel(path)
+	if err != nil {
+		return err
+	}
+	if !m.Supported() {
+		return errors.New("hardware model is not supported on this host")
+	}
+	return nil
+}
+
+func printDoctorReport(report *doctor.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL"); err != nil {
+		log.Fatalf("Failed to write header: %v", err)
+	}
+	if _, err := fmt.Fprintln(w, "-----\t------\t------"); err != nil {
+		log.Fatalf("Failed to write separator: %v", err)
+	}
+	for _, r := range report.Results {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", r.Check, r.Status, r.Detail); err != nil {
+			log.Fatalf("Failed to write result: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to flush output: %v", err)
+	}
+}
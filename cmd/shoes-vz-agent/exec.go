@@ -4,19 +4,43 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/whywaita/shoes-vz/internal/agent/vm"
+	"github.com/whywaita/shoes-vz/pkg/execstream"
 	"github.com/whywaita/shoes-vz/pkg/logging"
 	"github.com/whywaita/shoes-vz/pkg/model"
 )
 
+// stringSliceFlag collects the values of a flag given multiple times
+type stringSliceFlag []string
+
+func (f *stringSliceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringSliceFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func runExecCommand() {
 	execFlags := flag.NewFlagSet("exec", flag.ExitOnError)
 	runnersPath := execFlags.String("runners-path", "/opt/myshoes/vz/runners", "Path to runners directory")
 	sshKeyPath := execFlags.String("ssh-key", "", "Path to SSH private key")
+	sshInsecure := execFlags.Bool("ssh-insecure-ignore-host-key", false, "Accept runners that did not report an SSH host key")
+	authSecretFile := execFlags.String("auth-secret-file", "", "Path to shared secret for authenticating runner-agent requests")
+	insecureNoAuth := execFlags.Bool("insecure-no-auth", false, "Send runner-agent requests unsigned when no -auth-secret-file is given")
+	workDir := execFlags.String("dir", "", "Working directory for the command in the VM")
+	timeout := execFlags.Duration("timeout", 0, "Kill the command and its children after this duration (0 for no limit)")
+	interactive := execFlags.Bool("i", false, "Stream local stdin to the command")
+	var env stringSliceFlag
+	execFlags.Var(&env, "env", "Environment variable KEY=VALUE for the command (repeatable)")
 
 	if err := execFlags.Parse(os.Args[2:]); err != nil {
 		logger := logging.WithComponent("agent")
@@ -39,41 +63,76 @@ func runExecCommand() {
 	command := args[1]
 	cmdArgs := args[2:]
 
+	for _, kv := range env {
+		if !strings.Contains(kv, "=") {
+			fmt.Fprintf(os.Stderr, "Error: --env must be KEY=VALUE, got %q\n", kv)
+			os.Exit(1)
+		}
+	}
+
+	// Load shared secret for runner-agent authentication
+	authSecret, err := loadAuthSecret(*authSecretFile, *insecureNoAuth)
+	if err != nil {
+		logger.Error("Failed to load auth secret", "error", err)
+		os.Exit(1)
+	}
+
 	// Create VM manager
 	config := &model.AgentConfig{
 		RunnersPath: *runnersPath,
 		SSHKeyPath:  *sshKeyPath,
+		AuthSecret:  authSecret,
+		SSHInsecure: *sshInsecure,
 	}
 	vmManager := vm.NewManager(config, nil)
 
-	// Execute command
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	// Interrupting the CLI aborts the stream, which kills the remote command
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	logger.Info("Executing command on VM",
+	logger.Debug("Executing command on VM",
 		"runner_id", runnerID,
 		"command", command,
 		"args", strings.Join(cmdArgs, " "),
 	)
 
-	output, exitCode, err := vmManager.Exec(ctx, runnerID, command, cmdArgs)
+	req := execstream.Request{
+		Command:        command,
+		Args:           cmdArgs,
+		Env:            env,
+		Dir:            *workDir,
+		TimeoutSeconds: int((*timeout + time.Second - 1) / time.Second),
+	}
+
+	var stdin io.Reader
+	if *interactive {
+		stdin = os.Stdin
+	}
+
+	result, err := vmManager.ExecStream(ctx, runnerID, req, stdin, os.Stdout, os.Stderr)
 	if err != nil {
-		logger.Error("Failed to execute command",
-			"error", err,
-			"exit_code", exitCode,
-		)
-		// Print output even on error (might contain useful error messages)
-		if len(output) > 0 {
-			fmt.Fprintf(os.Stderr, "Output:\n%s\n", string(output))
-		}
-		os.Exit(exitCode)
+		logger.Error("Failed to execute command", "runner_id", runnerID, "error", err)
+		os.Exit(1)
+	}
+
+	if result.Error != "" {
+		logger.Error("Command could not be run", "runner_id", runnerID, "error", result.Error)
+	}
+	if result.TimedOut {
+		logger.Error("Command timed out and was killed", "runner_id", runnerID, "timeout", *timeout)
 	}
 
-	// Print output
-	fmt.Print(string(output))
+	os.Exit(exitCodeFor(result))
+}
 
-	logger.Info("Command executed successfully",
-		"runner_id", runnerID,
-		"exit_code", exitCode,
-	)
+// exitCodeFor maps a remote result to the exit code of the CLI
+func exitCodeFor(result *execstream.Result) int {
+	switch {
+	case result.TimedOut:
+		return 124 // Same as timeout(1)
+	case result.ExitCode < 0:
+		return 255
+	default:
+		return result.ExitCode
+	}
 }
@@ -32,10 +32,10 @@ func runListCommand() {
 
 	// Print VMs in a table format
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	if _, err := fmt.Fprintln(w, "RUNNER ID\tIP ADDRESS\tSTATE\tCREATED AT\tUPDATED AT\tBUNDLE PATH"); err != nil {
+	if _, err := fmt.Fprintln(w, "RUNNER ID\tIP ADDRESS\tSTATE\tTEMPLATE\tCREATED AT\tUPDATED AT\tBUNDLE PATH"); err != nil {
 		log.Fatalf("Failed to write header: %v", err)
 	}
-	if _, err := fmt.Fprintln(w, "---------\t----------\t-----\t----------\t----------\t-----------"); err != nil {
+	if _, err := fmt.Fprintln(w, "---------\t----------\t-----\t--------\t----------\t----------\t-----------"); err != nil {
 		log.Fatalf("Failed to write separator: %v", err)
 	}
 
@@ -55,10 +55,16 @@ func runListCommand() {
 			updatedAt = "<not set>"
 		}
 
-		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+		tmpl := v.Template
+		if tmpl == "" {
+			tmpl = "<unknown>"
+		}
+
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			v.RunnerID,
 			ipAddr,
 			state,
+			tmpl,
 			v.CreatedAt,
 			updatedAt,
 			v.BundlePath,
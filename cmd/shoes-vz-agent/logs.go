@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/whywaita/shoes-vz/internal/agent/vm"
+	"github.com/whywaita/shoes-vz/pkg/logging"
+)
+
+func runLogsCommand() {
+	logsFlags := flag.NewFlagSet("logs", flag.ExitOnError)
+	runnersPath := logsFlags.String("runners-path", "/opt/myshoes/vz/runners", "Path to runners directory")
+	console := logsFlags.Bool("console", false, "Show the serial console output of the VM")
+	setup := logsFlags.Bool("setup", false, "Show the output of the setup script")
+	tail := logsFlags.Int("tail", 0, "Show only the last N lines (0 for all)")
+
+	// Flags may come before or after the runner ID
+	if err := logsFlags.Parse(os.Args[2:]); err != nil {
+		logger := logging.WithComponent("agent")
+		logger.Error("Failed to parse flags", "error", err)
+		os.Exit(1)
+	}
+	args := logsFlags.Args()
+	if len(args) > 0 {
+		if err := logsFlags.Parse(args[1:]); err != nil {
+			logger := logging.WithComponent("agent")
+			logger.Error("Failed to parse flags", "error", err)
+			os.Exit(1)
+		}
+		args = append(args[:1], logsFlags.Args()...)
+	}
+
+	logger := logging.WithComponent("agent")
+
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Error: runner-id is required\n")
+		printLogsUsage(logsFlags)
+		os.Exit(1)
+	}
+	if *console && *setup {
+		fmt.Fprintf(os.Stderr, "Error: specify at most one of --console or --setup\n")
+		printLogsUsage(logsFlags)
+		os.Exit(1)
+	}
+	runnerID := args[0]
+
+	var data []byte
+	var err error
+	switch {
+	case *console:
+		data, err = vm.ReadConsoleLog(*runnersPath, runnerID, 0)
+	case *setup:
+		var bundleConfig *vm.BundleConfig
+		bundleConfig, err = vm.LoadBundleConfig(filepath.Join(*runnersPath, fmt.Sprintf("%s.bundle", runnerID)))
+		if err == nil {
+			data, err = os.ReadFile(bundleConfig.SetupLogPath)
+		}
+	default:
+		data, err = vm.ReadAgentLog(*runnersPath, runnerID, 0)
+	}
+	if err != nil {
+		logger.Error("Failed to read log", "runner_id", runnerID, "error", err)
+		os.Exit(1)
+	}
+
+	if _, err := os.Stdout.Write(tailLines(data, *tail)); err != nil {
+		os.Exit(1)
+	}
+}
+
+// tailLines returns the last n lines of data, or all of it if n is 0
+func tailLines(data []byte, n int) []byte {
+	if n <= 0 {
+		return data
+	}
+
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := 0; i < n; i++ {
+		idx := bytes.LastIndexByte(data[:end], '\n')
+		if idx < 0 {
+			return data
+		}
+		end = idx
+	}
+	return data[end+1:]
+}
+
+func printLogsUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: shoes-vz-agent logs [options] <runner-id> [--console | --setup]\n")
+	fmt.Fprintf(os.Stderr, "\nShows the agent's log for the runner unless --console or --setup is given.\n\n")
+	fs.PrintDefaults()
+}
@@ -2,21 +2,40 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
 	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/internal/agent/capability"
 	"github.com/whywaita/shoes-vz/internal/agent/ipnotify"
 	"github.com/whywaita/shoes-vz/internal/agent/runner"
 	"github.com/whywaita/shoes-vz/internal/agent/sync"
+	"github.com/whywaita/shoes-vz/internal/agent/template"
 	"github.com/whywaita/shoes-vz/internal/agent/vm"
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/grpcmetrics"
 	"github.com/whywaita/shoes-vz/pkg/logging"
 	"github.com/whywaita/shoes-vz/pkg/model"
+	"github.com/whywaita/shoes-vz/pkg/tlsconfig"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
 )
 
 func main() {
@@ -38,6 +57,18 @@ func main() {
 		case "exec":
 			runExecCommand()
 			return
+		case "cp":
+			runCpCommand()
+			return
+		case "logs":
+			runLogsCommand()
+			return
+		case "template":
+			runTemplateCommand()
+			return
+		case "doctor":
+			runDoctorCommand()
+			return
 		case "run":
 			// Explicit "run" subcommand
 			// Remove "run" from args and continue to runAgentCommand
@@ -68,7 +99,11 @@ Commands:
   start       Start a stopped VM
   stop        Stop a running VM
   delete      Delete a VM and its bundle
-  exec        Execute a command on a VM via SSH
+  exec        Execute a command on a VM, streaming its output
+  cp          Copy files between the host and a VM
+  logs        Show the agent, console or setup log of a runner
+  template    List, verify and describe VM templates
+  doctor      Check templates and host setup before running the agent
   help        Show this help message
 
 Run Options:
@@ -81,11 +116,34 @@ func runAgentCommand() {
 		serverAddr     = flag.String("server", "localhost:50051", "Server gRPC address")
 		hostname       = flag.String("hostname", "", "Agent hostname (default: system hostname)")
 		maxRunners     = flag.Uint("max-runners", 2, "Maximum number of concurrent runners (max: 2)")
-		templatePath   = flag.String("template-path", "/opt/myshoes/vz/templates/macos-26", "Path to VM template")
+		templatesDir   = flag.String("templates-dir", defaultTemplatesDir, "Directory of VM templates, one subdirectory per template name")
+		defaultTmpl    = flag.String("default-template", "macos-26", "Template used when the server does not ask for one")
+		templatePath   = flag.String("template-path", "", "Deprecated: path to a single VM template; sets -templates-dir and -default-template")
+		requireMeta    = flag.Bool("require-template-metadata", false, "Refuse templates without a TemplateMetadata.json")
 		runnersPath    = flag.String("runners-path", "/opt/myshoes/vz/runners", "Path to runners directory")
-		sshKeyPath     = flag.String("ssh-key", "", "Path to SSH private key")
+		sshKeyPath     = flag.String("ssh-key", "", "Path to SSH private key shared by all runners (used when a runner's own key is not accepted)")
+		sshUser        = flag.String("ssh-user", "runner", "SSH user on runner VMs")
+		sshPort        = flag.Int("ssh-port", 22, "SSH port on runner VMs")
+		sshInsecure    = flag.Bool("ssh-insecure-ignore-host-key", false, "Connect to runners that did not report an SSH host key without verifying it")
+		setupTimeout   = flag.Duration("setup-timeout", vm.DefaultSetupTimeout, "Maximum time the setup script may run before the runner is marked as failed")
 		ipNotifyPort   = flag.Uint("ip-notify-port", 8081, "Port for IP notification HTTP server")
+		callbackHost   = flag.String("callback-host", "192.168.64.1", "Host address guests use to reach the IP notification server, written to each runner's config disk")
 		enableGraphics = flag.Bool("enable-graphics", false, "Enable graphics display for VMs (opens GUI window)")
+		consoleLogSize = flag.Int64("console-log-size", vm.DefaultConsoleLogSize, "Size in bytes at which each VM's console.log is rotated")
+		authSecretFile = flag.String("auth-secret-file", "", "Path to shared secret for authenticating runner-agent requests")
+		insecureNoAuth = flag.Bool("insecure-no-auth", false, "Run without -auth-secret-file, leaving runner-agent requests and IP notifications unauthenticated")
+		legacyGuests   = flag.Bool("allow-legacy-guests", false, "Accept IP notifications signed with the shared secret from guests that do not read the config disk, matched by IOPlatformUUID or to the oldest pending runner")
+		metricsAddr    = flag.String("metrics-addr", ":9091", "Metrics server listen address (empty to disable)")
+		otlpEndpoint   = flag.String("otlp-endpoint", "", "OTLP/gRPC collector address (host:port) to export traces to; tracing is off if empty")
+		otlpInsecure   = flag.Bool("otlp-insecure", false, "Connect to the OTLP collector without TLS")
+		useTLS         = flag.Bool("tls", false, "Connect to the server over TLS, verified with the system roots unless -tls-ca is set (implied by the other -tls flags)")
+		tlsCA          = flag.String("tls-ca", "", "Path to a CA bundle (PEM) to verify the server certificate")
+		tlsCert        = flag.String("tls-cert", "", "Path to the agent's client certificate (PEM) for mutual TLS")
+		tlsKey         = flag.String("tls-key", "", "Path to the agent's client private key (PEM)")
+		tlsServerName  = flag.String("tls-server-name", "", "Name to verify the server certificate against (default: host of -server)")
+		credentialFile = flag.String("credential-file", "/opt/myshoes/vz/agent-credential.json", "Path to the credential the agent authenticates to the server with, written at enrollment")
+		bootstrapToken = flag.String("bootstrap-token-file", "", "Path to a bootstrap token used to enroll when -credential-file does not exist")
+		labels         = flag.String("labels", "", "Comma-separated labels runners on this agent satisfy, in addition to those detected from the host (e.g. xcode-16 when the template has it)")
 	)
 	flag.Parse()
 
@@ -111,28 +169,94 @@ func runAgentCommand() {
 		*hostname = h
 	}
 
+	if *templatePath != "" {
+		*templatesDir = filepath.Dir(filepath.Clean(*templatePath))
+		*defaultTmpl = filepath.Base(filepath.Clean(*templatePath))
+	}
+
 	logger.Info("Starting shoes-vz-agent",
 		"server", *serverAddr,
 		"hostname", *hostname,
 		"max_runners", *maxRunners,
-		"template_path", *templatePath,
+		"templates_dir", *templatesDir,
+		"default_template", *defaultTmpl,
 		"runners_path", *runnersPath,
 	)
 
+	// Load shared secret for runner-agent authentication
+	authSecret, err := loadAuthSecret(*authSecretFile, *insecureNoAuth)
+	if err != nil {
+		logger.Error("Failed to load auth secret", "error", err)
+		os.Exit(1)
+	}
+	if authSecret == nil {
+		logger.Warn("Authentication is disabled; runner-agent requests and IP notifications are not signed")
+	}
+
 	// Create agent configuration
 	config := &model.AgentConfig{
 		ServerAddr:     *serverAddr,
 		Hostname:       *hostname,
 		MaxRunners:     uint32(*maxRunners),
-		TemplatePath:   *templatePath,
 		RunnersPath:    *runnersPath,
 		SSHKeyPath:     *sshKeyPath,
+		SSHUser:        *sshUser,
+		SSHPort:        *sshPort,
+		SSHInsecure:    *sshInsecure,
 		SyncInterval:   5 * time.Second,
+		SetupTimeout:   *setupTimeout,
+		CallbackAddr:   net.JoinHostPort(*callbackHost, strconv.FormatUint(uint64(*ipNotifyPort), 10)),
 		EnableGraphics: *enableGraphics,
+		AuthSecret:     authSecret,
+		ConsoleLogSize: *consoleLogSize,
+
+		TemplatesDir:            *templatesDir,
+		DefaultTemplate:         *defaultTmpl,
+		RequireTemplateMetadata: *requireMeta,
+	}
+
+	// Start metrics HTTP server
+	if *metricsAddr != "" {
+		metricsServer := &http.Server{
+			Addr:    *metricsAddr,
+			Handler: promhttp.Handler(),
+		}
+		go func() {
+			logger.Info("Metrics server starting", "addr", *metricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Metrics server error", "error", err)
+			}
+		}()
+		defer func() {
+			if err := metricsServer.Close(); err != nil {
+				logger.Error("Failed to close metrics server", "error", err)
+			}
+		}()
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		OTLPEndpoint: *otlpEndpoint,
+		Insecure:     *otlpInsecure,
+		ServiceName:  "shoes-vz-agent",
+	})
+	if err != nil {
+		logger.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to shut down tracing", "error", err)
+		}
+	}()
 
 	// Create IP notification server
-	ipNotifyServer := ipnotify.NewServer(int(*ipNotifyPort))
+	var ipNotifyOpts []ipnotify.Option
+	if *legacyGuests {
+		ipNotifyOpts = append(ipNotifyOpts, ipnotify.AllowLegacyGuests())
+	}
+	ipNotifyServer := ipnotify.NewServer(int(*ipNotifyPort), auth.NewSigner(authSecret), ipNotifyOpts...)
 	if err := ipNotifyServer.Start(); err != nil {
 		logger.Error("Failed to start IP notification server", "error", err)
 		os.Exit(1)
@@ -144,15 +268,62 @@ func runAgentCommand() {
 		}
 	}()
 
+	// Plaintext unless TLS to the server is configured
+	creds := insecure.NewCredentials()
+	if *useTLS || *tlsCA != "" || *tlsCert != "" || *tlsKey != "" || *tlsServerName != "" {
+		tlsConfig, err := tlsconfig.NewClientConfig(tlsconfig.Files{
+			CertFile: *tlsCert,
+			KeyFile:  *tlsKey,
+			CAFile:   *tlsCA,
+		}, *tlsServerName)
+		if err != nil {
+			logger.Error("Failed to set up TLS", "error", err)
+			os.Exit(1)
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	// Authenticate to the server once enrolled, or when asked to enroll
+	var agentCredentials *sync.Credentials
+	if _, err := os.Stat(*credentialFile); err == nil || *bootstrapToken != "" {
+		var token []byte
+		if *bootstrapToken != "" {
+			token, err = auth.LoadSecret(*bootstrapToken)
+			if err != nil {
+				logger.Error("Failed to load bootstrap token", "error", err)
+				os.Exit(1)
+			}
+		}
+		agentCredentials, err = sync.LoadCredentials(*credentialFile, string(token))
+		if err != nil {
+			logger.Error("Failed to load agent credential", "error", err)
+			os.Exit(1)
+		}
+		if creds.Info().SecurityProtocol != "tls" {
+			logger.Warn("Agent credential is sent without TLS; use -tls or -tls-ca to protect it")
+		}
+	}
+
 	// Create components
 	runnerManager := runner.NewManager()
 	vmManager := vm.NewManager(config, ipNotifyServer)
+	grpcMetrics := grpcmetrics.NewClientMetrics(prometheus.DefaultRegisterer)
 	syncClient := sync.NewClient(
 		config.ServerAddr,
 		config.SyncInterval,
 		runnerManager,
 		vmManager,
+		agentCredentials,
 		logger,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(
+			logging.UnaryClientInterceptor(logger),
+			grpcMetrics.UnaryClientInterceptor(),
+		),
+		grpc.WithChainStreamInterceptor(
+			logging.StreamClientInterceptor(logger),
+			grpcMetrics.StreamClientInterceptor(),
+		),
 	)
 
 	// Connect to server
@@ -165,7 +336,47 @@ func runAgentCommand() {
 		MemoryBytes: 0, // TODO: Get actual memory size
 	}
 
-	if err := syncClient.Connect(ctx, config.Hostname, capacity); err != nil {
+	templates := vmManager.Templates()
+	localTemplates, err := templates.All()
+	if err != nil {
+		logger.Error("Failed to list templates", "error", err)
+		os.Exit(1)
+	}
+	var registeredTemplates []*agentv1.Template
+	for _, t := range localTemplates {
+		if t.Err != nil {
+			logger.Warn("Skipping invalid template", "template", t.String(), "error", t.Err)
+			continue
+		}
+		registeredTemplates = append(registeredTemplates, t.Proto())
+	}
+
+	if !hasTemplate(registeredTemplates, config.DefaultTemplate) {
+		logger.Warn("Default template is not available, runners must name a template", "default_template", config.DefaultTemplate)
+	}
+
+	// Read the template files now rather than on the first runner
+	go verifyTemplates(logger, templates, localTemplates)
+
+	// Versions replaced while the agent was stopped are no longer in use
+	if _, err := vmManager.CollectTemplates(ctx); err != nil {
+		logger.Warn("Failed to collect unused template versions", "error", err)
+	}
+
+	capabilities := capability.NewDetector().Detect(ctx, registeredTemplates)
+	logger.Info("Detected host capabilities",
+		"macos_version", capabilities.MacosVersion,
+		"xcode_versions", capabilities.XcodeVersions,
+		"chip", capabilities.Chip,
+		"templates", templateNames(registeredTemplates),
+	)
+
+	if err := syncClient.Connect(ctx, &agentv1.RegisterAgentRequest{
+		Hostname:     config.Hostname,
+		Capacity:     capacity,
+		Labels:       splitLabels(*labels),
+		Capabilities: capabilities,
+	}); err != nil {
 		logger.Error("Failed to connect to server", "error", err)
 		os.Exit(1)
 	}
@@ -196,3 +407,64 @@ func runAgentCommand() {
 
 	logger.Info("Shutting down agent")
 }
+
+// splitLabels parses the -labels flag
+func splitLabels(s string) []string {
+	var labels []string
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// templateNames formats registered templates for logging
+func templateNames(templates []*agentv1.Template) []string {
+	names := make([]string, 0, len(templates))
+	for _, t := range templates {
+		name := t.Name
+		if t.Version != "" {
+			name += "@" + t.Version
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func hasTemplate(templates []*agentv1.Template, name string) bool {
+	for _, t := range templates {
+		if t.Active && strings.EqualFold(t.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyTemplates checks the files of valid templates against their
+// checksums, so that the first runner does not wait for it
+func verifyTemplates(logger *slog.Logger, store *template.Store, templates []*template.Template) {
+	for _, t := range templates {
+		if t.Err != nil || t.Metadata == nil {
+			continue
+		}
+		start := time.Now()
+		if err := store.Verify(t); err != nil {
+			logger.Error("Template verification failed", "template", t.String(), "error", err)
+			continue
+		}
+		logger.Info("Template verified", "template", t.String(), "duration", time.Since(start))
+	}
+}
+
+// loadAuthSecret loads the secret shared with runner-agents. Running
+// without one has to be asked for with -insecure-no-auth.
+func loadAuthSecret(path string, insecureNoAuth bool) ([]byte, error) {
+	if path == "" {
+		if !insecureNoAuth {
+			return nil, errors.New("-auth-secret-file is required unless -insecure-no-auth is set")
+		}
+		return nil, nil
+	}
+	return auth.LoadSecret(path)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+	"github.com/whywaita/shoes-vz/internal/agent/template/oci"
+	"github.com/whywaita/shoes-vz/internal/agent/vm"
+)
+
+const defaultTemplatesDir = "/opt/myshoes/vz/templates"
+
+func printTemplateUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: shoes-vz-agent template <command> [options]
+
+Commands:
+  list       List templates and whether they can be served
+  versions   List the versions of a template and the runners cloned from them: versions [options] <name>
+  activate   Clone new runners from another version: activate [options] <name> <version>
+  verify     Check the files of a template against its checksums: verify [options] <name>
+  metadata   Write TemplateMetadata.json with checksums: metadata [options] <template-version-dir>
+  import     Create a template version from a stopped Tart VM: import [options] --from-tart <dir>
+  push       Upload a template version to an OCI registry: push [options] <template-version-dir> <ref>
+  pull       Download a template version from an OCI registry: pull [options] <ref>
+
+Run "shoes-vz-agent template <command> -h" for the options of a command.
+`)
+}
+
+func runTemplateCommand() {
+	if len(os.Args) < 3 {
+		printTemplateUsage()
+		os.Exit(1)
+	}
+
+	switch os.Args[2] {
+	case "list":
+		runTemplateListCommand(os.Args[3:])
+	case "versions":
+		runTemplateVersionsCommand(os.Args[3:])
+	case "activate":
+		runTemplateActivateCommand(os.Args[3:])
+	case "verify":
+		runTemplateVerifyCommand(os.Args[3:])
+	case "metadata":
+		runTemplateMetadataCommand(os.Args[3:])
+	case "import":
+		runTemplateImportCommand(os.Args[3:])
+	case "push":
+		runTemplatePushCommand(os.Args[3:])
+	case "pull":
+		runTemplatePullCommand(os.Args[3:])
+	case "-h", "--help", "help":
+		printTemplateUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown template command: %s\n", os.Args[2])
+		printTemplateUsage()
+		os.Exit(1)
+	}
+}
+
+func runTemplateListCommand(args []string) {
+	fs := flag.NewFlagSet("template list", flag.ExitOnError)
+	templatesDir := fs.String("templates-dir", defaultTemplatesDir, "Directory of VM templates")
+	requireMeta := fs.Bool("require-template-metadata", false, "Treat templates without a TemplateMetadata.json as invalid")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	templates, err := newCLITemplateStore(*templatesDir, *requireMeta).List()
+	if err != nil {
+		log.Fatalf("Failed to list templates: %v", err)
+	}
+	if len(templates) == 0 {
+		fmt.Println("No templates found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(w, "NAME\tVERSION\tMACOS BUILD\tCREATED AT\tSTATUS"); err != nil {
+		log.Fatalf("Failed to write header: %v", err)
+	}
+	for _, t := range templates {
+		version, build, createdAt, status := t.Version, "-", "-", "ok"
+		if version == "" {
+			version = "-"
+		}
+		if t.Metadata != nil {
+			build = t.Metadata.MacOSBuild
+			createdAt = t.Metadata.CreatedAt.Local().Format(time.RFC3339)
+		} else {
+			status = "no metadata"
+		}
+		if t.Err != nil {
+			status = t.Err.Error()
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Name, version, build, createdAt, status); err != nil {
+			log.Fatalf("Failed to write template info: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to flush output: %v", err)
+	}
+}
+
+func runTemplateVersionsCommand(args []string) {
+	fs := flag.NewFlagSet("template versions", flag.ExitOnError)
+	templatesDir := fs.String("templates-dir", defaultTemplatesDir, "Directory of VM templates")
+	runnersPath := fs.String("runners-path", "/opt/myshoes/vz/runners", "Path to runners directory")
+	requireMeta := fs.Bool("require-template-metadata", false, "Treat templates without a TemplateMetadata.json as invalid")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: template name is required\n")
+		printTemplateUsage()
+		os.Exit(1)
+	}
+
+	store := newCLITemplateStore(*templatesDir, *requireMeta)
+	versions, err := store.Versions(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to list versions: %v", err)
+	}
+	active, err := store.Active(fs.Arg(0))
+	activeVersion := ""
+	if err == nil {
+		activeVersion = active.Version
+	}
+	vms, err := vm.ListVMs(*runnersPath)
+	if err != nil {
+		log.Fatalf("Failed to list VMs: %v", err)
+	}
+	runners := make(map[string]int)
+	for _, v := range vms {
+		runners[v.Template]++
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(w, "VERSION\tACTIVE\tMACOS BUILD\tRUNNERS\tSTATUS"); err != nil {
+		log.Fatalf("Failed to write header: %v", err)
+	}
+	for _, t := range versions {
+		version, isActive, build, status := t.Version, "", "-", "ok"
+		if version == "" {
+			version = "-"
+		}
+		if t.Version == activeVersion {
+			isActive = "*"
+		}
+		if t.Metadata != nil {
+			build = t.Metadata.MacOSBuild
+		} else {
+			status = "no metadata"
+		}
+		if t.Err != nil {
+			status = t.Err.Error()
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", version, isActive, build, runners[t.String()], status); err != nil {
+			log.Fatalf("Failed to write version info: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to flush output: %v", err)
+	}
+}
+
+func runTemplateActivateCommand(args []string) {
+	fs := flag.NewFlagSet("template activate", flag.ExitOnError)
+	templatesDir := fs.String("templates-dir", defaultTemplatesDir, "Directory of VM templates")
+	requireMeta := fs.Bool("require-template-metadata", false, "Refuse a version without a TemplateMetadata.json")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Error: template name and version are required\n")
+		printTemplateUsage()
+		os.Exit(1)
+	}
+
+	t, err := newCLITemplateStore(*templatesDir, *requireMeta).Activate(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Failed to activate template: %v", err)
+	}
+	fmt.Printf("New runners of %s are cloned from %s\n", t.Name, t)
+	fmt.Println("Older versions are removed by the agent once no runner uses them")
+}
+
+func runTemplateVerifyCommand(args []string) {
+	fs := flag.NewFlagSet("template verify", flag.ExitOnError)
+	templatesDir := fs.String("templates-dir", defaultTemplatesDir, "Directory of VM templates")
+	requireMeta := fs.Bool("require-template-metadata", false, "Fail if the template has no TemplateMetadata.json")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: template name is required\n")
+		printTemplateUsage()
+		os.Exit(1)
+	}
+
+	t, err := newCLITemplateStore(*templatesDir, *requireMeta).Resolve(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Template verification failed: %v", err)
+	}
+	if t.Metadata == nil {
+		fmt.Printf("Template %s has no %s, nothing to verify\n", t, template.MetadataFile)
+		return
+	}
+	fmt.Printf("Template %s verified\n", t)
+}
+
+func runTemplateMetadataCommand(args []string) {
+	fs := flag.NewFlagSet("template metadata", flag.ExitOnError)
+	name := fs.String("name", "", "Template name (default: name of the parent directory)")
+	version := fs.String("version", "", "Template version (default: name of the directory)")
+	macOSVersion := fs.String("macos-version", "", "Guest macOS version, e.g. 15.2")
+	macOSBuild := fs.String("macos-build", "", "Guest macOS build, e.g. 24C101 (required)")
+	minCPU := fs.Uint("min-cpu", 0, "Minimum number of CPUs the guest needs")
+	minMemory := fs.Uint64("min-memory", 0, "Minimum memory in bytes the guest needs")
+	authorizedKey := fs.String("authorized-key", "", "Public key file the guest accepts, e.g. ~/.ssh/shoes-vz-runner.pub")
+	description := fs.String("description", "", "Note about the template")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: template version directory is required\n")
+		printTemplateUsage()
+		os.Exit(1)
+	}
+	dir := filepath.Clean(fs.Arg(0))
+
+	if *name == "" {
+		*name = filepath.Base(filepath.Dir(dir))
+	}
+	if *version == "" {
+		*version = filepath.Base(dir)
+	}
+
+	m := &template.Metadata{
+		Name:           *name,
+		Version:        *version,
+		MacOSVersion:   *macOSVersion,
+		MacOSBuild:     *macOSBuild,
+		MinCPUCount:    *minCPU,
+		MinMemoryBytes: *minMemory,
+		CreatedAt:      time.Now().UTC().Truncate(time.Second),
+		Description:    *description,
+		AuthorizedKey:  readAuthorizedKey(*authorizedKey),
+	}
+	fmt.Fprintf(os.Stderr, "Computing checksums of %s, this reads the whole disk image...\n", dir)
+	if err := template.WriteMetadata(dir, m); err != nil {
+		log.Fatalf("Failed to write metadata: %v", err)
+	}
+	fmt.Printf("Wrote %s for %s@%s\n", filepath.Join(dir, template.MetadataFile), m.Name, m.Version)
+}
+
+// readAuthorizedKey reads the public key file given to -authorized-key
+func readAuthorizedKey(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read authorized key: %v", err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func runTemplateImportCommand(args []string) {
+	fs := flag.NewFlagSet("template import", flag.ExitOnError)
+	fromTart := fs.String("from-tart", "", "Directory of the Tart VM to import, e.g. ~/.tart/vms/<name> (required)")
+	templatesDir := fs.String("templates-dir", defaultTemplatesDir, "Directory of VM templates")
+	name := fs.String("name", "", "Template name (required)")
+	version := fs.String("version", time.Now().Format("2006.01.02"), "Template version")
+	macOSVersion := fs.String("macos-version", "", "Guest macOS version, e.g. 15.2")
+	macOSBuild := fs.String("macos-build", "", "Guest macOS build, e.g. 24C101 (required)")
+	minCPU := fs.Uint("min-cpu", 0, "Minimum number of CPUs the guest needs")
+	minMemory := fs.Uint64("min-memory", 0, "Minimum memory in bytes the guest needs")
+	authorizedKey := fs.String("authorized-key", "", "Public key file the guest accepts, e.g. ~/.ssh/shoes-vz-runner.pub")
+	description := fs.String("description", "", "Note about the template")
+	activate := fs.Bool("activate", false, "Clone new runners from the imported version")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if *fromTart == "" || *name == "" || fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Error: --from-tart and -name are required\n")
+		printTemplateUsage()
+		os.Exit(1)
+	}
+
+	dir := filepath.Join(*templatesDir, *name, *version)
+	m := &template.Metadata{
+		Name:           *name,
+		Version:        *version,
+		MacOSVersion:   *macOSVersion,
+		MacOSBuild:     *macOSBuild,
+		MinCPUCount:    *minCPU,
+		MinMemoryBytes: *minMemory,
+		Description:    *description,
+		AuthorizedKey:  readAuthorizedKey(*authorizedKey),
+	}
+	fmt.Fprintf(os.Stderr, "Importing %s, computing checksums reads the whole disk image...\n", *fromTart)
+	if err := template.ImportTart(filepath.Clean(*fromTart), dir, m); err != nil {
+		log.Fatalf("Failed to import Tart VM: %v", err)
+	}
+	fmt.Printf("Imported %s as %s@%s in %s\n", *fromTart, m.Name, m.Version, dir)
+
+	if !*activate {
+		return
+	}
+	t, err := newCLITemplateStore(*templatesDir, false).Activate(m.Name, m.Version)
+	if err != nil {
+		log.Fatalf("Failed to activate template: %v", err)
+	}
+	fmt.Printf("New runners of %s are cloned from %s\n", t.Name, t)
+}
+
+func runTemplatePushCommand(args []string) {
+	fs := flag.NewFlagSet("template push", flag.ExitOnError)
+	chunkSize := fs.Int64("chunk-size", oci.DefaultChunkSize, "Uncompressed size of the chunks files are split into")
+	insecure := fs.Bool("insecure", false, "Talk to the registry over plain HTTP")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Error: template version directory and reference are required\n")
+		printTemplateUsage()
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	opts := []oci.Option{oci.WithChunkSize(*chunkSize), oci.WithProgress(printTransferProgress("Pushed"))}
+	if *insecure {
+		opts = append(opts, oci.Insecure())
+	}
+	digest, err := oci.Push(ctx, filepath.Clean(fs.Arg(0)), fs.Arg(1), opts...)
+	if err != nil {
+		log.Fatalf("Failed to push template: %v", err)
+	}
+	fmt.Printf("Pushed %s as %s\n", fs.Arg(1), digest)
+}
+
+func runTemplatePullCommand(args []string) {
+	fs := flag.NewFlagSet("template pull", flag.ExitOnError)
+	templatesDir := fs.String("templates-dir", defaultTemplatesDir, "Directory of VM templates")
+	jobs := fs.Int("jobs", oci.DefaultJobs, "Number of chunks to download at once")
+	insecure := fs.Bool("insecure", false, "Talk to the registry over plain HTTP")
+	activate := fs.Bool("activate", false, "Clone new runners from the pulled version")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: reference is required\n")
+		printTemplateUsage()
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	opts := []oci.Option{oci.WithJobs(*jobs), oci.WithProgress(printTransferProgress("Pulled"))}
+	if *insecure {
+		opts = append(opts, oci.Insecure())
+	}
+	t, err := oci.Pull(ctx, fs.Arg(0), *templatesDir, opts...)
+	if err != nil {
+		log.Fatalf("Failed to pull template: %v", err)
+	}
+	fmt.Printf("Pulled %s into %s\n", t, t.Path)
+
+	if !*activate {
+		return
+	}
+	if _, err := newCLITemplateStore(*templatesDir, false).Activate(t.Name, t.Version); err != nil {
+		log.Fatalf("Failed to activate template: %v", err)
+	}
+	fmt.Printf("New runners of %s are cloned from %s\n", t.Name, t)
+}
+
+// printTransferProgress returns a progress callback that prints a line per
+// chunk to stderr
+func printTransferProgress(verb string) func(oci.Progress) {
+	return func(p oci.Progress) {
+		fmt.Fprintf(os.Stderr, "%s %d/%d chunks (%.1f of %.1f GiB)\n", verb, p.Chunks, p.Total, float64(p.Bytes)/(1<<30), float64(p.TotalBytes)/(1<<30))
+	}
+}
+
+func newCLITemplateStore(dir string, requireMetadata bool) *template.Store {
+	var opts []template.Option
+	if requireMetadata {
+		opts = append(opts, template.RequireMetadata())
+	}
+	return template.NewStore(dir, "", opts...)
+}
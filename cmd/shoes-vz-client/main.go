@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
+	"os"
 
 	"github.com/hashicorp/go-plugin"
 	myshoespb "github.com/whywaita/myshoes/api/proto.go"
 	"github.com/whywaita/shoes-vz/internal/client"
+	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
 	"google.golang.org/grpc"
 )
 
@@ -41,8 +45,26 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// Export traces if a collector is configured
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		OTLPEndpoint: config.OTLPEndpoint,
+		Insecure:     config.OTLPInsecure,
+		ServiceName:  "shoes-vz-client",
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Printf("Failed to shut down tracing: %v", err)
+		}
+	}()
+
+	// go-plugin owns stdout for its handshake, so log to stderr
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil)).With("component", "client")
+
 	// Create client
-	shoesClient, err := client.NewClient(config)
+	shoesClient, err := client.NewClient(config, logger)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
@@ -58,6 +80,11 @@ func main() {
 		Plugins: map[string]plugin.Plugin{
 			"shoes_grpc": &ShoesGRPCPlugin{Impl: shoesClient},
 		},
-		GRPCServer: plugin.DefaultGRPCServer,
+		// Pick up x-request-id from myshoes so it is passed on to the server
+		GRPCServer: func(opts []grpc.ServerOption) *grpc.Server {
+			return plugin.DefaultGRPCServer(append(opts,
+				grpc.UnaryInterceptor(logging.UnaryServerInterceptor(logger)),
+			))
+		},
 	})
 }
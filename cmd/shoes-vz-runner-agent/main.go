@@ -2,23 +2,42 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	"golang.org/x/crypto/ssh"
+
 	"github.com/whywaita/shoes-vz/internal/monitor"
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/configdisk"
 	"github.com/whywaita/shoes-vz/pkg/logging"
 	"github.com/whywaita/shoes-vz/pkg/model"
 )
 
 func main() {
 	var (
-		listenAddr = flag.String("listen", ":8080", "HTTP server listen address")
-		runnerPath = flag.String("runner-path", "", "Path to GitHub Actions runner directory")
-		runnerID   = flag.String("runner-id", "", "Runner ID for IP notification")
-		hostIP     = flag.String("host-ip", "192.168.64.1", "Host IP for IP notification")
-		agentPort  = flag.Int("agent-port", 8081, "shoes-vz-agent HTTP port")
+		listenAddr  = flag.String("listen", ":8080", "HTTP server listen address")
+		runnerPath  = flag.String("runner-path", "", "Path to GitHub Actions runner directory")
+		runnerID    = flag.String("runner-id", "", "Runner ID for IP notification")
+		hostIP      = flag.String("host-ip", "", "Host IP for IP notification (default: the default route gateway, or 192.168.64.1)")
+		guestSubnet = flag.String("guest-subnet", "", "CIDR the guest address to notify must be in (default: the network that routes to the host)")
+		guestIface  = flag.String("interface", "", "Interface to take the guest address from (default: the one that routes to the host)")
+		agentPort   = flag.Int("agent-port", 8081, "shoes-vz-agent HTTP port")
+		secretFile  = flag.String("auth-secret-file", "", "Path to shared secret for authenticating with shoes-vz-agent")
+		noAuth      = flag.Bool("insecure-no-auth", false, "Serve /exec, /status and /files without authentication when no secret is configured")
+		authKeys    = flag.String("authorized-keys", "", "authorized_keys file replaced with the key sent by shoes-vz-agent (default ~/.ssh/authorized_keys)")
+		maxFileSize = flag.Int64("max-file-transfer-size", 0, "Maximum bytes per file transfer (0 for the default of 4GiB)")
+		hostKeyDir  = flag.String("host-key-dir", monitor.DefaultHostKeyDir, "Directory, writable by this user, of the SSH host key sshd is configured to use")
+		configDisk  = flag.String("config-disk-dir", monitor.DefaultConfigDiskDir, "Mount point of the config disk attached by shoes-vz-agent (empty to disable)")
+		configWait  = flag.Duration("config-disk-timeout", 30*time.Second, "How long to wait for the config disk at boot")
+		vsockPort   = flag.Uint("vsock-port", monitor.DefaultVsockPort, "vsock port for the HTTP server (0 to use TCP only)")
+		agentVsock  = flag.Uint("agent-vsock-port", monitor.DefaultAgentVsockPort, "vsock port of the shoes-vz-agent IP notification server")
 	)
 	flag.Parse()
 
@@ -33,16 +52,111 @@ func main() {
 		}
 		*runnerPath = filepath.Join(home, "_work", "_runner")
 	}
+	if *authKeys == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			logger.Error("Failed to get home directory", "error", err)
+			os.Exit(1)
+		}
+		*authKeys = filepath.Join(home, ".ssh", "authorized_keys")
+	}
 
 	// Check environment variable for runner ID
 	if *runnerID == "" {
 		*runnerID = os.Getenv("SHOES_VZ_RUNNER_ID")
 	}
 
+	// The config disk is written by shoes-vz-agent for this VM, so its
+	// settings take precedence over flags baked into the template
+	var manifest *configdisk.Manifest
+	if *configDisk != "" {
+		m, err := monitor.LoadConfigDisk(context.Background(), *configDisk, *configWait)
+		switch {
+		case err == nil:
+			manifest = m
+			logger.Info("Loaded config disk", "runner_id", m.RunnerID, "runner_name", m.RunnerName)
+		case errors.Is(err, monitor.ErrNoConfigDisk):
+			logger.Info("No config disk found; using flags and machine UUID")
+		default:
+			logger.Error("Failed to read config disk; using flags and machine UUID", "error", err)
+		}
+	}
+	if manifest != nil {
+		*runnerID = manifest.RunnerID
+		if manifest.CallbackAddr != "" {
+			host, port, _ := net.SplitHostPort(manifest.CallbackAddr) // Validated when parsed
+			if p, err := strconv.Atoi(port); err == nil {
+				*hostIP = host
+				*agentPort = p
+			}
+		}
+	}
+
+	// Load shared secret from file or environment variable
+	var authSecret []byte
+	if *secretFile != "" {
+		secret, err := auth.LoadSecret(*secretFile)
+		if err != nil {
+			logger.Error("Failed to load auth secret", "error", err)
+			os.Exit(1)
+		}
+		authSecret = secret
+	} else if env := os.Getenv("SHOES_VZ_AUTH_SECRET"); env != "" {
+		authSecret = []byte(env)
+	}
+	if manifest != nil && len(manifest.AuthToken) > 0 {
+		authSecret = manifest.AuthToken
+	}
+	if len(authSecret) == 0 {
+		if !*noAuth {
+			logger.Error("No auth secret on the config disk, in -auth-secret-file or SHOES_VZ_AUTH_SECRET; set -insecure-no-auth to run without authentication")
+			os.Exit(1)
+		}
+		logger.Warn("Authentication is disabled; /exec and /status are open to anyone on the network")
+	}
+	signer := auth.NewSigner(authSecret)
+
 	logger.Info("Starting shoes-vz-runner-agent")
-	logger.Info("Starting on TCP", "listen_addr", *listenAddr)
 	logger.Info("Using runner path", "path", *runnerPath)
 
+	netConfig := monitor.NetworkConfig{
+		HostIP:    *hostIP,
+		Interface: *guestIface,
+	}
+	if *guestSubnet != "" {
+		subnet, err := netip.ParsePrefix(*guestSubnet)
+		if err != nil {
+			logger.Error("Invalid guest subnet", "guest_subnet", *guestSubnet, "error", err)
+			os.Exit(1)
+		}
+		netConfig.Subnet = subnet
+	}
+	network, err := monitor.DiscoverNetwork(netConfig)
+	hostAddr := *hostIP
+	if err != nil {
+		logger.Error("Failed to discover guest network; the agent can only reach this runner over vsock", "error", err)
+		if hostAddr == "" {
+			hostAddr = monitor.DefaultHostIP
+		}
+	} else {
+		hostAddr = network.HostIP.String()
+		logger.Info("Discovered guest network", "host_ip", hostAddr, "guest_ip", network.GuestIP.String(), "interface", network.Interface)
+	}
+
+	// vsock reaches the host without depending on the guest network; TCP
+	// stays as a fallback for hosts that do not attach a socket device
+	var transports []monitor.Transport
+	if *vsockPort != 0 {
+		transports = append(transports, &monitor.VsockTransport{
+			Port:      uint32(*vsockPort),
+			AgentPort: uint32(*agentVsock),
+		})
+	}
+	transports = append(transports, &monitor.TCPTransport{
+		ListenAddr: *listenAddr,
+		HostAddr:   net.JoinHostPort(hostAddr, strconv.Itoa(*agentPort)),
+	})
+
 	// Get machine UUID from IOPlatformUUID (set by Virtualization Framework)
 	runnerIDToUse := *runnerID
 	if runnerIDToUse == "" {
@@ -62,27 +176,96 @@ func main() {
 		logger.Info("Runner ID configured", "runner_id", runnerIDToUse)
 	}
 
+	// Regenerate the SSH host key inherited from the template. The machine
+	// UUID is unique per clone, so it tells us whether this is the first
+	// boot. The agent refuses runners that report no host key.
+	machineID, err := monitor.GetMachineUUID()
+	if err != nil {
+		machineID = runnerIDToUse
+	}
+	hostKey, err := monitor.EnsureHostKey(*hostKeyDir, machineID)
+	if err != nil {
+		logger.Error("Failed to ensure SSH host key", "dir", *hostKeyDir, "error", err)
+		os.Exit(1)
+	}
+	hostKeyString := auth.FormatPublicKey(hostKey.PublicKey())
+	logger.Info("SSH host key ready", "fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey()))
+
+	// Install what the config disk carries before telling the agent we are up
+	setupReady := false
+	if manifest != nil {
+		if manifest.AuthorizedKey != "" {
+			// The agent only offers this key, so without it the runner is unreachable
+			if err := monitor.InstallAuthorizedKey(*authKeys, manifest.AuthorizedKey); err != nil {
+				logger.Error("Failed to install runner SSH key from config disk", "path", *authKeys, "error", err)
+				os.Exit(1)
+			}
+			logger.Info("Installed runner SSH key from config disk", "path", *authKeys)
+		}
+		if manifest.SetupScript != "" {
+			if err := monitor.InstallSetupScript(manifest); err != nil {
+				logger.Error("Failed to install setup script from config disk; the agent will upload it", "error", err)
+			} else {
+				setupReady = true
+			}
+		}
+	}
+
+	var guestIP string
+	if network != nil {
+		guestIP = network.GuestIP.String()
+	}
+
 	// Start IP notification in the background
 	go func() {
 		// Send IP notification
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 		defer cancel()
-		if err := monitor.NotifyIP(ctx, runnerIDToUse, *hostIP, *agentPort); err != nil {
+		notification := monitor.Notification{
+			RunnerID:   runnerIDToUse,
+			IPAddress:  guestIP,
+			HostKey:    hostKeyString,
+			ConfigDisk: setupReady,
+		}
+		if err := monitor.NotifyIP(ctx, transports, notification, signer); err != nil {
 			logger.Error("Failed to notify IP", "error", err)
-		} else {
-			logger.Info("Successfully notified IP to shoes-vz-agent")
+			return
 		}
+		logger.Info("Successfully notified IP to shoes-vz-agent")
 	}()
 
 	config := &model.MonitorConfig{
 		ListenAddr:   *listenAddr,
 		RunnerPath:   *runnerPath,
 		PollInterval: 10 * time.Second,
+		AuthSecret:   authSecret,
+
+		MaxTransferSize: *maxFileSize,
 	}
 
 	server := monitor.NewServer(config)
-	if err := server.Start(); err != nil {
-		logger.Error("Failed to start server", "error", err)
+	server.SetHostKey(hostKey)
+
+	errCh := make(chan error, len(transports))
+	serving := 0
+	for _, t := range transports {
+		l, err := t.Listen()
+		if err != nil {
+			logger.Warn("Failed to listen", "transport", t.String(), "error", err)
+			continue
+		}
+		logger.Info("Listening", "transport", t.String(), "addr", l.Addr().String())
+		serving++
+		go func() {
+			errCh <- server.Serve(l)
+		}()
+	}
+	if serving == 0 {
+		logger.Error("No transport to serve on")
+		os.Exit(1)
+	}
+	if err := <-errCh; err != nil {
+		logger.Error("Failed to serve", "error", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	adminv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/admin/v1"
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/tlsconfig"
+)
+
+func printAdminUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: shoes-vz-server admin <command> [options]
+
+Commands:
+  create-token   Create a bootstrap token for agent enrollment
+  list-agents    List enrolled agents
+  revoke-agent   Revoke the credential of an agent: revoke-agent [options] <agent-id>
+  set-canary     Send a share of new runners to a template version: set-canary [options] <template> <version>
+  list-rollouts  List canary template versions and how their runners fare
+  delete-canary  End the canary of a template: delete-canary [options] <template>
+
+Run "shoes-vz-server admin <command> -h" for the options of a command.
+`)
+}
+
+// adminConn holds the flags every admin command uses to reach the server
+type adminConn struct {
+	server         *string
+	adminTokenFile *string
+	useTLS         *bool
+	tlsCA          *string
+	tlsCert        *string
+	tlsKey         *string
+	tlsServerName  *string
+}
+
+func addAdminConnFlags(fs *flag.FlagSet) *adminConn {
+	return &adminConn{
+		server:         fs.String("server", "localhost:50051", "Server gRPC address"),
+		adminTokenFile: fs.String("admin-token-file", "", "Path to the admin token given to the server with -admin-token-file"),
+		useTLS:         fs.Bool("tls", false, "Connect over TLS, verified with the system roots unless -tls-ca is set (implied by the other -tls flags)"),
+		tlsCA:          fs.String("tls-ca", "", "Path to a CA bundle (PEM) to verify the server certificate"),
+		tlsCert:        fs.String("tls-cert", "", "Path to a client certificate (PEM) for mutual TLS"),
+		tlsKey:         fs.String("tls-key", "", "Path to the client private key (PEM)"),
+		tlsServerName:  fs.String("tls-server-name", "", "Name to verify the server certificate against (default: host of -server)"),
+	}
+}
+
+func (c *adminConn) dial() (adminv1.AdminServiceClient, func(), error) {
+	if *c.adminTokenFile == "" {
+		return nil, nil, fmt.Errorf("-admin-token-file is required")
+	}
+	token, err := auth.LoadSecret(*c.adminTokenFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	creds := insecure.NewCredentials()
+	if *c.useTLS || *c.tlsCA != "" || *c.tlsCert != "" || *c.tlsKey != "" || *c.tlsServerName != "" {
+		tlsConfig, err := tlsconfig.NewClientConfig(tlsconfig.Files{
+			CertFile: *c.tlsCert,
+			KeyFile:  *c.tlsKey,
+			CAFile:   *c.tlsCA,
+		}, *c.tlsServerName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to set up TLS: %w", err)
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient(*c.server,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithPerRPCCredentials(auth.NewBearer(string(token))),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	return adminv1.NewAdminServiceClient(conn), func() { _ = conn.Close() }, nil
+}
+
+func runAdminCommand() {
+	if len(os.Args) < 3 {
+		printAdminUsage()
+		os.Exit(1)
+	}
+
+	switch os.Args[2] {
+	case "create-token":
+		runCreateTokenCommand(os.Args[3:])
+	case "list-agents":
+		runListAgentsCommand(os.Args[3:])
+	case "revoke-agent":
+		runRevokeAgentCommand(os.Args[3:])
+	case "set-canary":
+		runSetCanaryCommand(os.Args[3:])
+	case "list-rollouts":
+		runListRolloutsCommand(os.Args[3:])
+	case "delete-canary":
+		runDeleteCanaryCommand(os.Args[3:])
+	case "-h", "--help", "help":
+		printAdminUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown admin command: %s\n", os.Args[2])
+		printAdminUsage()
+		os.Exit(1)
+	}
+}
+
+func runCreateTokenCommand(args []string) {
+	fs := flag.NewFlagSet("create-token", flag.ExitOnError)
+	conn := addAdminConnFlags(fs)
+	ttl := fs.Duration("ttl", 24*time.Hour, "How long the token can be used")
+	maxUses := fs.Uint("max-uses", 1, "Number of agents that can enroll with the token (0 for no limit)")
+	description := fs.String("description", "", "Note about what the token is for")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	client, closeConn, err := conn.dial()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer closeConn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := client.CreateBootstrapToken(ctx, &adminv1.CreateBootstrapTokenRequest{
+		TtlSeconds:  int64(ttl.Seconds()),
+		MaxUses:     uint32(*maxUses),
+		Description: *description,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create bootstrap token: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Token %s expires at %s\n", resp.TokenId, resp.ExpiresAt.AsTime().Local().Format(time.RFC3339))
+	fmt.Println(resp.Token)
+}
+
+func runListAgentsCommand(args []string) {
+	fs := flag.NewFlagSet("list-agents", flag.ExitOnError)
+	conn := addAdminConnFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	client, closeConn, err := conn.dial()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer closeConn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := client.ListEnrolledAgents(ctx, &adminv1.ListEnrolledAgentsRequest{})
+	if err != nil {
+		log.Fatalf("Failed to list agents: %v", err)
+	}
+
+	if len(resp.Agents) == 0 {
+		fmt.Println("No agents enrolled")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(w, "AGENT ID\tHOSTNAME\tTOKEN ID\tENROLLED AT\tSTATUS"); err != nil {
+		log.Fatalf("Failed to write header: %v", err)
+	}
+	for _, a := range resp.Agents {
+		agentStatus := "disconnected"
+		switch {
+		case a.RevokedAt != nil:
+			agentStatus = "revoked " + a.RevokedAt.AsTime().Local().Format(time.RFC3339)
+		case a.Connected:
+			agentStatus = "connected"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			a.AgentId,
+			a.Hostname,
+			a.TokenId,
+			a.EnrolledAt.AsTime().Local().Format(time.RFC3339),
+			agentStatus,
+		); err != nil {
+			log.Fatalf("Failed to write agent info: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to flush output: %v", err)
+	}
+}
+
+func runRevokeAgentCommand(args []string) {
+	fs := flag.NewFlagSet("revoke-agent", flag.ExitOnError)
+	conn := addAdminConnFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: agent-id is required\n")
+		printAdminUsage()
+		os.Exit(1)
+	}
+	agentID := fs.Arg(0)
+
+	client, closeConn, err := conn.dial()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer closeConn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := client.RevokeAgent(ctx, &adminv1.RevokeAgentRequest{AgentId: agentID}); err != nil {
+		log.Fatalf("Failed to revoke agent: %v", err)
+	}
+	fmt.Printf("Agent %s revoked\n", agentID)
+}
+
+func runSetCanaryCommand(args []string) {
+	fs := flag.NewFlagSet("set-canary", flag.ExitOnError)
+	conn := addAdminConnFlags(fs)
+	weight := fs.Uint("weight", 10, "Percentage of new runners cloned from the canary version")
+	maxFailureDelta := fs.Float64("max-failure-delta", 0, "How much higher than the stable version's the canary failure rate may be, e.g. 0.1 (default: the server's -canary-max-failure-delta)")
+	minRunners := fs.Uint("min-runners", 0, "Canary runners to start before the canary is judged (default: the server's -canary-min-runners)")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Error: template and version are required\n")
+		printAdminUsage()
+		os.Exit(1)
+	}
+
+	client, closeConn, err := conn.dial()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer closeConn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := client.SetTemplateCanary(ctx, &adminv1.SetTemplateCanaryRequest{
+		Template:            fs.Arg(0),
+		Version:             fs.Arg(1),
+		WeightPercent:       uint32(*weight),
+		MaxFailureRateDelta: *maxFailureDelta,
+		MinRunners:          uint32(*minRunners),
+	})
+	if err != nil {
+		log.Fatalf("Failed to set canary: %v", err)
+	}
+	r := resp.Rollout
+	fmt.Printf("%d%% of new %s runners are cloned from %s\n", r.WeightPercent, r.Template, r.CanaryVersion)
+	fmt.Printf("Rolled back if its failure rate exceeds the stable one by %.0f points after %d runners\n", r.MaxFailureRateDelta*100, r.MinRunners)
+}
+
+func runListRolloutsCommand(args []string) {
+	fs := flag.NewFlagSet("list-rollouts", flag.ExitOnError)
+	conn := addAdminConnFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	client, closeConn, err := conn.dial()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer closeConn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := client.ListTemplateRollouts(ctx, &adminv1.ListTemplateRolloutsRequest{})
+	if err != nil {
+		log.Fatalf("Failed to list rollouts: %v", err)
+	}
+
+	if len(resp.Rollouts) == 0 {
+		fmt.Println("No canaries")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(w, "TEMPLATE\tCANARY\tWEIGHT\tSTATE\tCANARY FAILED/RUNNERS\tSTABLE FAILED/RUNNERS\tREASON"); err != nil {
+		log.Fatalf("Failed to write header: %v", err)
+	}
+	for _, r := range resp.Rollouts {
+		state, reason := "canary", r.Reason
+		if r.State == adminv1.TemplateRolloutState_TEMPLATE_ROLLOUT_STATE_ROLLED_BACK {
+			state = "rolled back " + r.RolledBackAt.AsTime().Local().Format(time.RFC3339)
+		}
+		if reason == "" {
+			reason = "-"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%d%%\t%s\t%d/%d\t%d/%d\t%s\n",
+			r.Template,
+			r.CanaryVersion,
+			r.WeightPercent,
+			state,
+			r.Canary.GetFailures(), r.Canary.GetRunners(),
+			r.Stable.GetFailures(), r.Stable.GetRunners(),
+			reason,
+		); err != nil {
+			log.Fatalf("Failed to write rollout info: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to flush output: %v", err)
+	}
+}
+
+func runDeleteCanaryCommand(args []string) {
+	fs := flag.NewFlagSet("delete-canary", flag.ExitOnError)
+	conn := addAdminConnFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: template is required\n")
+		printAdminUsage()
+		os.Exit(1)
+	}
+
+	client, closeConn, err := conn.dial()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer closeConn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := client.DeleteTemplateCanary(ctx, &adminv1.DeleteTemplateCanaryRequest{Template: fs.Arg(0)})
+	if err != nil {
+		log.Fatalf("Failed to delete canary: %v", err)
+	}
+	fmt.Printf("Canary %s of %s ended, new runners use the active version\n", resp.Rollout.CanaryVersion, resp.Rollout.Template)
+}
@@ -10,21 +10,47 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	adminv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/admin/v1"
 	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
 	shoesv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/shoes/v1"
+	"github.com/whywaita/shoes-vz/internal/server/agentauth"
 	grpcserver "github.com/whywaita/shoes-vz/internal/server/grpc"
 	"github.com/whywaita/shoes-vz/internal/server/metrics"
+	"github.com/whywaita/shoes-vz/internal/server/rollout"
+	"github.com/whywaita/shoes-vz/internal/server/scheduler"
 	"github.com/whywaita/shoes-vz/internal/server/store"
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/grpcmetrics"
 	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/tlsconfig"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		runAdminCommand()
+		return
+	}
+
 	var (
-		grpcAddr    = flag.String("grpc-addr", ":50051", "gRPC server listen address")
-		metricsAddr = flag.String("metrics-addr", ":9090", "Metrics server listen address")
+		grpcAddr     = flag.String("grpc-addr", ":50051", "gRPC server listen address")
+		metricsAddr  = flag.String("metrics-addr", ":9090", "Metrics server listen address")
+		otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/gRPC collector address (host:port) to export traces to; tracing is off if empty")
+		otlpInsecure = flag.Bool("otlp-insecure", false, "Connect to the OTLP collector without TLS")
+		tlsCert      = flag.String("tls-cert", "", "Path to the gRPC server certificate (PEM); the server listens in plaintext if empty")
+		tlsKey       = flag.String("tls-key", "", "Path to the gRPC server private key (PEM)")
+		tlsClientCA  = flag.String("tls-client-ca", "", "Path to a CA bundle (PEM); if set, agents and the myshoes plugin must present a client certificate signed by it")
+		agentAuth    = flag.String("agent-auth-file", "", "Path to the file keeping bootstrap tokens and agent credentials; if set, agents must enroll and authenticate")
+		adminToken   = flag.String("admin-token-file", "", "Path to the token required by the admin API; the admin API is disabled if empty")
+		strategy     = flag.String("scheduler", scheduler.DefaultStrategy, "Scheduling strategy: spread, bin-pack, round-robin or least-recently-used")
+		resTemplates = flag.String("resource-templates", "", "Template for each resource type, e.g. small=macos-15,large=macos-15-xcode; agents use their default template for unlisted types")
+		canaryDelta  = flag.Float64("canary-max-failure-delta", rollout.DefaultMaxFailureRateDelta, "Default for how much higher than the stable version's the failure rate of a canary template version may be before it is rolled back")
+		canaryMin    = flag.Int("canary-min-runners", rollout.DefaultMinRunners, "Default number of canary runners to start before a canary template version is judged")
 	)
 	flag.Parse()
 
@@ -33,15 +59,59 @@ func main() {
 	logger.Info("Starting shoes-vz-server",
 		"grpc_addr", *grpcAddr,
 		"metrics_addr", *metricsAddr,
+		"scheduler", *strategy,
 	)
 
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		OTLPEndpoint: *otlpEndpoint,
+		Insecure:     *otlpInsecure,
+		ServiceName:  "shoes-vz-server",
+	})
+	if err != nil {
+		logger.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+
 	// Create metrics
 	m := metrics.NewMetrics()
 	st := store.NewStore()
 	collector := metrics.NewCollector(m, st)
 
+	sch, err := scheduler.New(*strategy, st)
+	if err != nil {
+		logger.Error("Failed to create scheduler", "error", err)
+		os.Exit(1)
+	}
+	resourceTemplates, err := scheduler.ParseResourceTemplates(*resTemplates)
+	if err != nil {
+		logger.Error("Invalid -resource-templates", "error", err)
+		os.Exit(1)
+	}
+	serverOpts := []grpcserver.Option{
+		grpcserver.WithScheduler(sch),
+		grpcserver.WithResourceTemplates(resourceTemplates),
+		grpcserver.WithRollouts(rollout.NewManager(*canaryDelta, *canaryMin)),
+	}
+	if *agentAuth != "" {
+		a, err := agentauth.Open(*agentAuth)
+		if err != nil {
+			logger.Error("Failed to open agent auth file", "error", err)
+			os.Exit(1)
+		}
+		serverOpts = append(serverOpts, grpcserver.WithAgentAuth(a))
+		logger.Info("Agent authentication enabled", "agent_auth_file", *agentAuth)
+	}
+	if *adminToken != "" {
+		token, err := auth.LoadSecret(*adminToken)
+		if err != nil {
+			logger.Error("Failed to load admin token", "error", err)
+			os.Exit(1)
+		}
+		serverOpts = append(serverOpts, grpcserver.WithAdminToken(token))
+	}
+
 	// Create gRPC server with store and metrics collector
-	server := grpcserver.NewServer(st, collector, logger)
+	server := grpcserver.NewServer(st, collector, logger, serverOpts...)
 
 	// Start metrics collection loop
 	ctx, cancel := context.WithCancel(context.Background())
@@ -69,11 +139,37 @@ func main() {
 		os.Exit(1)
 	}
 
-	grpcServer := grpc.NewServer(
-		grpc.UnaryInterceptor(logging.UnaryServerInterceptor(logger)),
-	)
+	grpcMetrics := grpcmetrics.NewServerMetrics(prometheus.DefaultRegisterer)
+	grpcOpts := []grpc.ServerOption{
+		grpc.StatsHandler(tracing.ServerHandler()),
+		grpc.ChainUnaryInterceptor(
+			logging.UnaryServerInterceptor(logger),
+			grpcMetrics.UnaryServerInterceptor(),
+			logging.RecoveryUnaryServerInterceptor(logger),
+		),
+		grpc.ChainStreamInterceptor(
+			logging.StreamServerInterceptor(logger),
+			grpcMetrics.StreamServerInterceptor(),
+			logging.RecoveryStreamServerInterceptor(logger),
+		),
+	}
+	if *tlsCert != "" || *tlsKey != "" || *tlsClientCA != "" {
+		tlsConfig, err := tlsconfig.NewServerConfig(tlsconfig.Files{
+			CertFile: *tlsCert,
+			KeyFile:  *tlsKey,
+			CAFile:   *tlsClientCA,
+		})
+		if err != nil {
+			logger.Error("Failed to set up TLS", "error", err)
+			os.Exit(1)
+		}
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		logger.Info("gRPC TLS enabled", "mutual_tls", *tlsClientCA != "")
+	}
+	grpcServer := grpc.NewServer(grpcOpts...)
 	shoesv1.RegisterShoesServiceServer(grpcServer, server)
 	agentv1.RegisterAgentServiceServer(grpcServer, server)
+	adminv1.RegisterAdminServiceServer(grpcServer, server)
 
 	go func() {
 		logger.Info("gRPC server starting", "addr", *grpcAddr)
@@ -119,5 +215,9 @@ func main() {
 		grpcServer.Stop()
 	}
 
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("Tracing shutdown error", "error", err)
+	}
+
 	logger.Info("Server stopped")
 }
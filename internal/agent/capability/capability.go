@@ -0,0 +1,79 @@
+// Package capability reports what an agent's host can run, for the server
+// to match runner labels against.
+package capability
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+)
+
+// Detector reads host facts with the macOS command line tools
+type Detector struct {
+	// ApplicationsDir is searched for Xcode*.app bundles
+	ApplicationsDir string
+
+	// run runs a command and returns its trimmed output
+	run func(ctx context.Context, name string, args ...string) (string, error)
+}
+
+// NewDetector creates a Detector for the local host
+func NewDetector() *Detector {
+	return &Detector{
+		ApplicationsDir: "/Applications",
+		run:             runCommand,
+	}
+}
+
+func runCommand(ctx context.Context, name string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Detect returns the capabilities of the host. Facts that cannot be read
+// are left empty rather than failing registration.
+func (d *Detector) Detect(ctx context.Context, templates []*agentv1.Template) *agentv1.AgentCapabilities {
+	c := &agentv1.AgentCapabilities{
+		Templates: templates,
+	}
+
+	if v, err := d.run(ctx, "sw_vers", "-productVersion"); err == nil {
+		c.MacosVersion = v
+	}
+	if v, err := d.run(ctx, "sysctl", "-n", "machdep.cpu.brand_string"); err == nil {
+		c.Chip = v
+	}
+	c.XcodeVersions = d.xcodeVersions(ctx)
+
+	return c
+}
+
+// xcodeVersions returns the sorted, distinct versions of the installed
+// Xcode bundles
+func (d *Detector) xcodeVersions(ctx context.Context) []string {
+	apps, err := filepath.Glob(filepath.Join(d.ApplicationsDir, "Xcode*.app"))
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var versions []string
+	for _, app := range apps {
+		v, err := d.run(ctx, "plutil", "-extract", "CFBundleShortVersionString", "raw", "-o", "-",
+			filepath.Join(app, "Contents", "Info.plist"))
+		if err != nil || v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	return versions
+}
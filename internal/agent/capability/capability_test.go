@@ -0,0 +1,73 @@
+package capability
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+)
+
+func TestDetector_Detect(t *testing.T) {
+	apps := t.TempDir()
+	for _, name := range []string{"Xcode.app", "Xcode-16.1.app", "Xcode-15.4.app", "Xcode-beta.app", "Safari.app"} {
+		if err := os.MkdirAll(filepath.Join(apps, name, "Contents"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outputs := map[string]string{
+		"sw_vers -productVersion":            "15.2",
+		"sysctl -n machdep.cpu.brand_string": "Apple M2 Pro",
+		"Xcode.app":                          "16.1",
+		"Xcode-16.1.app":                     "16.1",
+		"Xcode-15.4.app":                     "15.4",
+		"Safari.app":                         "18.2",
+	}
+	d := &Detector{
+		ApplicationsDir: apps,
+		run: func(_ context.Context, name string, args ...string) (string, error) {
+			key := strings.Join(append([]string{name}, args...), " ")
+			if name == "plutil" {
+				key = filepath.Base(filepath.Dir(filepath.Dir(args[len(args)-1])))
+			}
+			out, ok := outputs[key]
+			if !ok {
+				return "", fmt.Errorf("%s: not found", key)
+			}
+			return out, nil
+		},
+	}
+
+	c := d.Detect(context.Background(), []*agentv1.Template{{Name: "macos-15"}})
+
+	if c.MacosVersion != "15.2" {
+		t.Errorf("MacosVersion = %v, want %v", c.MacosVersion, "15.2")
+	}
+	if c.Chip != "Apple M2 Pro" {
+		t.Errorf("Chip = %v, want %v", c.Chip, "Apple M2 Pro")
+	}
+	if got, want := fmt.Sprint(c.XcodeVersions), "[15.4 16.1]"; got != want {
+		t.Errorf("XcodeVersions = %v, want %v", got, want)
+	}
+	if len(c.Templates) != 1 || c.Templates[0].Name != "macos-15" {
+		t.Errorf("Templates = %v, want [macos-15]", c.Templates)
+	}
+}
+
+func TestDetector_DetectWithoutTools(t *testing.T) {
+	d := &Detector{
+		ApplicationsDir: t.TempDir(),
+		run: func(context.Context, string, ...string) (string, error) {
+			return "", fmt.Errorf("not macOS")
+		},
+	}
+
+	c := d.Detect(context.Background(), nil)
+	if c.MacosVersion != "" || c.Chip != "" || len(c.XcodeVersions) != 0 {
+		t.Errorf("Detect() = %v, want empty capabilities", c)
+	}
+}
@@ -0,0 +1,391 @@
+// Package doctor checks that a host can run runners before the agent
+// tries to, so that broken templates and host setup are found up front
+// rather than as errors when a runner is created.
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	StatusOK   Status = "ok"
+	StatusWarn Status = "warn" // The agent runs, but something is off
+	StatusFail Status = "fail" // Runners will fail to start
+)
+
+// Result is the outcome of one check
+type Result struct {
+	Check  string `json:"check"`
+	Status Status `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// Report is the outcome of every check, in the order they ran
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Failed reports whether any check failed
+func (r *Report) Failed() bool {
+	for _, res := range r.Results {
+		if res.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// entitlement lets a binary use Virtualization.framework
+const entitlement = "com.apple.security.virtualization"
+
+// DefaultMinFreeBytes is the free space on the runners volume below which
+// the disk check warns
+const DefaultMinFreeBytes = 50 << 30
+
+// Config is what the agent would run with
+type Config struct {
+	TemplatesDir            string
+	DefaultTemplate         string
+	RequireTemplateMetadata bool
+	RunnersPath             string
+	SSHKeyPath              string
+	IPNotifyPort            uint
+	ServerAddr              string
+	Executable              string // Binary whose entitlements are checked
+
+	// VMCPUCount and VMMemoryBytes are the resources of a runner VM, which
+	// templates must not need more of
+	VMCPUCount    uint
+	VMMemoryBytes uint64
+
+	// VerifyChecksums reads every template file to compare it with its
+	// metadata, which takes a while for large disks
+	VerifyChecksums bool
+	MinFreeBytes    uint64
+	Timeout         time.Duration // For reaching the server
+
+	// LoadHardwareModel loads a HardwareModel.json with
+	// Virtualization.framework; the hardware model is only decoded if nil
+	LoadHardwareModel func(path string) error
+}
+
+// Doctor runs the checks
+type Doctor struct {
+	config Config
+
+	// run runs a command and returns its standard output
+	run func(ctx context.Context, name string, args ...string) (string, error)
+}
+
+// New creates a Doctor for config
+func New(config Config) *Doctor {
+	if config.MinFreeBytes == 0 {
+		config.MinFreeBytes = DefaultMinFreeBytes
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	return &Doctor{config: config, run: runCommand}
+}
+
+func runCommand(ctx context.Context, name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Kept on one line for the report
+		if msg := strings.Join(strings.Fields(stderr.String()), " "); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Run runs every check
+func (d *Doctor) Run(ctx context.Context) *Report {
+	r := &Report{}
+	r.Results = append(r.Results, d.checkTemplates()...)
+	r.Results = append(r.Results,
+		d.checkClone(ctx),
+		d.checkDiskSpace(),
+		d.checkEntitlements(ctx),
+		d.checkSSHKey(),
+		d.checkIPNotifyPort(),
+		d.checkServer(ctx),
+	)
+	return r
+}
+
+func ok(check, format string, args ...any) Result {
+	return Result{Check: check, Status: StatusOK, Detail: fmt.Sprintf(format, args...)}
+}
+
+func warn(check, format string, args ...any) Result {
+	return Result{Check: check, Status: StatusWarn, Detail: fmt.Sprintf(format, args...)}
+}
+
+func fail(check, format string, args ...any) Result {
+	return Result{Check: check, Status: StatusFail, Detail: fmt.Sprintf(format, args...)}
+}
+
+// checkTemplates checks every version of every template, then that the
+// default template is there
+// templateStore returns the store the agent would serve templates from
+func (d *Doctor) templateStore() *template.Store {
+	var opts []template.Option
+	if d.config.RequireTemplateMetadata {
+		opts = append(opts, template.RequireMetadata())
+	}
+	return template.NewStore(d.config.TemplatesDir, d.config.DefaultTemplate, opts...)
+}
+
+func (d *Doctor) checkTemplates() []Result {
+	store := d.templateStore()
+	templates, err := store.All()
+	if err != nil {
+		return []Result{fail("templates", "%v", err)}
+	}
+	if len(templates) == 0 {
+		return []Result{fail("templates", "no templates in %s", d.config.TemplatesDir)}
+	}
+
+	var results []Result
+	defaultFound := false
+	for _, t := range templates {
+		res := d.checkTemplate(store, t)
+		results = append(results, res)
+		if t.Name == d.config.DefaultTemplate && t.Active && res.Status != StatusFail {
+			defaultFound = true
+		}
+	}
+
+	switch {
+	case d.config.DefaultTemplate == "":
+	case defaultFound:
+		results = append(results, ok("default template", "%s", d.config.DefaultTemplate))
+	default:
+		results = append(results, warn("default template", "%s is not available, runners must name a template", d.config.DefaultTemplate))
+	}
+	return results
+}
+
+func (d *Doctor) checkTemplate(store *template.Store, t *template.Template) Result {
+	check := "template " + t.String()
+	if t.Err != nil {
+		return fail(check, "%v", t.Err)
+	}
+	for _, f := range template.RequiredFiles {
+		info, err := os.Stat(filepath.Join(t.Path, f))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return fail(check, "%s is missing", f)
+		case err != nil:
+			return fail(check, "%v", err)
+		case !info.Mode().IsRegular() || info.Size() == 0:
+			return fail(check, "%s is empty or not a file", f)
+		}
+	}
+	if err := template.CheckHardwareModel(t.Path); err != nil {
+		return fail(check, "%v", err)
+	}
+	if d.config.LoadHardwareModel != nil {
+		if err := d.config.LoadHardwareModel(filepath.Join(t.Path, "HardwareModel.json")); err != nil {
+			return fail(check, "Virtualization.framework cannot use the hardware model: %v", err)
+		}
+	}
+
+	if t.Metadata == nil {
+		return warn(check, "no %s, files cannot be verified", template.MetadataFile)
+	}
+	if err := t.CheckResources(d.config.VMCPUCount, d.config.VMMemoryBytes); err != nil {
+		return fail(check, "%v", err)
+	}
+	if !d.config.VerifyChecksums {
+		return ok(check, "macOS build %s, checksums not verified", t.Metadata.MacOSBuild)
+	}
+	if err := store.Verify(t); err != nil {
+		return fail(check, "%v", err)
+	}
+	return ok(check, "macOS build %s, checksums match", t.Metadata.MacOSBuild)
+}
+
+// checkClone clones a file from the templates directory into the runners
+// path with cp -c, as runners are created. It fails unless both are on the
+// same APFS volume.
+func (d *Doctor) checkClone(ctx context.Context) Result {
+	const check = "clone"
+	runners, err := existingDir(d.config.RunnersPath)
+	if err != nil {
+		return fail(check, "%v", err)
+	}
+
+	src, err := os.CreateTemp(d.config.TemplatesDir, ".doctor-*")
+	if err != nil {
+		return fail(check, "failed to create a file to clone: %v", err)
+	}
+	defer func() { _ = os.Remove(src.Name()) }()
+	_, err = src.WriteString("shoes-vz doctor\n")
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fail(check, "failed to write a file to clone: %v", err)
+	}
+
+	dst := filepath.Join(runners, filepath.Base(src.Name()))
+	defer func() { _ = os.Remove(dst) }()
+	if _, err := d.run(ctx, "cp", "-c", src.Name(), dst); err != nil {
+		return fail(check, "cannot clone from %s to %s, both must be on the same APFS volume: %v", d.config.TemplatesDir, d.config.RunnersPath, err)
+	}
+	return ok(check, "%s can be cloned to %s", d.config.TemplatesDir, d.config.RunnersPath)
+}
+
+// checkDiskSpace checks the free space on the volume of the runners path.
+// Clones share blocks with the template until runners write to them.
+func (d *Doctor) checkDiskSpace() Result {
+	const check = "disk space"
+	dir, err := existingDir(d.config.RunnersPath)
+	if err != nil {
+		return fail(check, "%v", err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fail(check, "failed to stat the file system of %s: %v", dir, err)
+	}
+
+	free := st.Bavail * uint64(st.Bsize)
+	if free < d.config.MinFreeBytes {
+		return warn(check, "%s free on %s, want at least %s", formatBytes(free), dir, formatBytes(d.config.MinFreeBytes))
+	}
+	return ok(check, "%s free on %s", formatBytes(free), dir)
+}
+
+// checkEntitlements checks that the binary is signed with the
+// virtualization entitlement, without which no VM starts
+func (d *Doctor) checkEntitlements(ctx context.Context) Result {
+	const check = "entitlements"
+	out, err := d.run(ctx, "codesign", "-d", "--entitlements", "-", "--xml", d.config.Executable)
+	if err != nil {
+		return fail(check, "failed to read the code signature of %s: %v", d.config.Executable, err)
+	}
+	if !strings.Contains(out, entitlement) {
+		return fail(check, "%s is not signed with %s", d.config.Executable, entitlement)
+	}
+	return ok(check, "%s has %s", d.config.Executable, entitlement)
+}
+
+// checkSSHKey checks that the shared SSH key can be read and used, and
+// that the templates recording the key their guest accepts have its public
+// key. Runners without their own key can only be reached with it.
+func (d *Doctor) checkSSHKey() Result {
+	const check = "ssh key"
+	if d.config.SSHKeyPath == "" {
+		return ok(check, "not set, runners use their own keys")
+	}
+	data, err := os.ReadFile(d.config.SSHKeyPath)
+	if err != nil {
+		return fail(check, "failed to read %s: %v", d.config.SSHKeyPath, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return fail(check, "%s is protected by a passphrase", d.config.SSHKeyPath)
+	}
+	if err != nil {
+		return fail(check, "failed to parse %s: %v", d.config.SSHKeyPath, err)
+	}
+	pub := signer.PublicKey()
+	key := fmt.Sprintf("%s %s", pub.Type(), ssh.FingerprintSHA256(pub))
+
+	templates, err := d.templateStore().All()
+	if err != nil {
+		return warn(check, "%s, cannot compare it with the templates: %v", key, err)
+	}
+	var matched int
+	var mismatched []string
+	for _, t := range templates {
+		if t.Metadata == nil || t.Metadata.AuthorizedKey == "" {
+			continue
+		}
+		accepted, _, _, _, err := ssh.ParseAuthorizedKey([]byte(t.Metadata.AuthorizedKey))
+		if err != nil || !bytes.Equal(accepted.Marshal(), pub.Marshal()) {
+			mismatched = append(mismatched, t.String())
+			continue
+		}
+		matched++
+	}
+	switch {
+	case len(mismatched) > 0:
+		return fail(check, "%s is not the authorized key of %s", key, strings.Join(mismatched, ", "))
+	case matched == 0:
+		return warn(check, "%s, no template records its authorized key to compare with", key)
+	}
+	return ok(check, "%s is the authorized key of %d template versions", key, matched)
+}
+
+// checkIPNotifyPort checks that the IP notification server can listen
+func (d *Doctor) checkIPNotifyPort() Result {
+	const check = "ip-notify port"
+	l, err := net.Listen("tcp", ":"+strconv.FormatUint(uint64(d.config.IPNotifyPort), 10))
+	if err != nil {
+		return fail(check, "cannot listen on %d, is the agent already running? %v", d.config.IPNotifyPort, err)
+	}
+	_ = l.Close()
+	return ok(check, "%d is free", d.config.IPNotifyPort)
+}
+
+// checkServer checks that the server address accepts connections
+func (d *Doctor) checkServer(ctx context.Context) Result {
+	const check = "server"
+	if d.config.ServerAddr == "" {
+		return warn(check, "no server address")
+	}
+	dialer := &net.Dialer{Timeout: d.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", d.config.ServerAddr)
+	if err != nil {
+		return fail(check, "cannot reach %s: %v", d.config.ServerAddr, err)
+	}
+	_ = conn.Close()
+	return ok(check, "%s accepts connections", d.config.ServerAddr)
+}
+
+// existingDir returns path, or its closest existing parent since the agent
+// creates the runners path when it first needs it
+func existingDir(path string) (string, error) {
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", dir)
+			}
+			return dir, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) || dir == filepath.Dir(dir) {
+			return "", err
+		}
+	}
+}
+
+func formatBytes(n uint64) string {
+	return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+}
@@ -0,0 +1,383 @@
+package doctor
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+)
+
+const testHardwareModel = `{"hardwareModel":"YnBsaXN0MDDUAQIDBGZpeHR1cmUtaGFyZHdhcmUtbW9kZWw="}`
+
+// writeTemplate writes a template version with metadata and lets change
+// alter it afterwards
+func writeTemplate(t *testing.T, templatesDir, name string, change func(dir string)) {
+	t.Helper()
+	dir := filepath.Join(templatesDir, name, "2025.02.01")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string]string{
+		"Disk.img":           "disk",
+		"AuxiliaryStorage":   "aux",
+		"HardwareModel.json": testHardwareModel,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := template.WriteMetadata(dir, &template.Metadata{
+		Name:       name,
+		Version:    "2025.02.01",
+		MacOSBuild: "24C101",
+		CreatedAt:  time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if change != nil {
+		change(dir)
+	}
+}
+
+func writeFile(name, data string) func(dir string) {
+	return func(dir string) {
+		_ = os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+	}
+}
+
+// editMetadata rewrites the TemplateMetadata.json of the template
+func editMetadata(edit func(m *template.Metadata)) func(dir string) {
+	return func(dir string) {
+		m, err := template.LoadMetadata(dir)
+		if err != nil {
+			return
+		}
+		edit(m)
+		_ = template.WriteMetadata(dir, m)
+	}
+}
+
+func TestDoctor_Templates(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    func(dir string)
+		loadErr   error
+		verify    bool
+		want      Status
+		wantInErr string
+	}{
+		{name: "valid", verify: true, want: StatusOK},
+		{name: "checksums not verified", change: writeFile("Disk.img", "changed"), want: StatusOK},
+		{name: "checksum mismatch", change: writeFile("Disk.img", "changed"), verify: true, want: StatusFail, wantInErr: "checksum mismatch"},
+		{
+			name:      "missing AuxiliaryStorage",
+			change:    func(dir string) { _ = os.Remove(filepath.Join(dir, "AuxiliaryStorage")) },
+			want:      StatusFail,
+			wantInErr: "AuxiliaryStorage is missing",
+		},
+		{name: "hardware model not base64", change: writeFile("HardwareModel.json", `{"hardwareModel":"not base64!"}`), want: StatusFail, wantInErr: "not base64"},
+		{name: "hardware model not JSON", change: writeFile("HardwareModel.json", "bplist00"), want: StatusFail, wantInErr: "failed to parse"},
+		{name: "unsupported hardware model", loadErr: errors.New("unsupported"), want: StatusFail, wantInErr: "unsupported"},
+		{
+			name:   "no metadata",
+			change: func(dir string) { _ = os.Remove(filepath.Join(dir, template.MetadataFile)) },
+			want:   StatusWarn,
+		},
+		{
+			name:      "needs more CPUs than runner VMs have",
+			change:    editMetadata(func(m *template.Metadata) { m.MinCPUCount = 4 }),
+			want:      StatusFail,
+			wantInErr: "needs 4 CPUs",
+		},
+		{
+			name:      "needs more memory than runner VMs have",
+			change:    editMetadata(func(m *template.Metadata) { m.MinMemoryBytes = 8 << 30 }),
+			want:      StatusFail,
+			wantInErr: "bytes of memory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templatesDir := t.TempDir()
+			writeTemplate(t, templatesDir, "macos-15", tt.change)
+
+			var loaded string
+			d := New(Config{
+				TemplatesDir:    templatesDir,
+				VerifyChecksums: tt.verify,
+				VMCPUCount:      2,
+				VMMemoryBytes:   4 << 30,
+				LoadHardwareModel: func(path string) error {
+					loaded = path
+					return tt.loadErr
+				},
+			})
+			results := d.checkTemplates()
+			if len(results) != 1 {
+				t.Fatalf("checkTemplates() = %+v, want one result", results)
+			}
+			got := results[0]
+			if got.Status != tt.want || !strings.Contains(got.Detail, tt.wantInErr) {
+				t.Errorf("checkTemplates() = %+v, want %s with %q", got, tt.want, tt.wantInErr)
+			}
+			if got.Check != "template macos-15@2025.02.01" {
+				t.Errorf("Check = %q, want template macos-15@2025.02.01", got.Check)
+			}
+			if tt.want == StatusOK && filepath.Base(loaded) != "HardwareModel.json" {
+				t.Errorf("LoadHardwareModel() called with %q, want the HardwareModel.json", loaded)
+			}
+		})
+	}
+}
+
+func TestDoctor_DefaultTemplate(t *testing.T) {
+	templatesDir := t.TempDir()
+	writeTemplate(t, templatesDir, "macos-15", nil)
+	writeTemplate(t, templatesDir, "macos-26", writeFile("HardwareModel.json", "{}"))
+
+	tests := []struct {
+		defaultTemplate string
+		want            Status
+	}{
+		{defaultTemplate: "macos-15", want: StatusOK},
+		{defaultTemplate: "macos-26", want: StatusWarn},
+		{defaultTemplate: "missing", want: StatusWarn},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.defaultTemplate, func(t *testing.T) {
+			results := New(Config{TemplatesDir: templatesDir, DefaultTemplate: tt.defaultTemplate}).checkTemplates()
+			got := results[len(results)-1]
+			if got.Check != "default template" || got.Status != tt.want {
+				t.Errorf("last result = %+v, want default template %s", got, tt.want)
+			}
+		})
+	}
+
+	if results := New(Config{TemplatesDir: t.TempDir()}).checkTemplates(); len(results) != 1 || results[0].Status != StatusFail {
+		t.Errorf("checkTemplates() of an empty directory = %+v, want a failure", results)
+	}
+}
+
+func TestDoctor_Clone(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpErr   error
+		runners string
+		want    Status
+	}{
+		{name: "clone", want: StatusOK},
+		{name: "runners path not created yet", runners: "missing/runners", want: StatusOK},
+		{name: "clone not supported", cpErr: errors.New("clonefile failed: Operation not supported"), want: StatusFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templatesDir, runnersPath := t.TempDir(), t.TempDir()
+			d := New(Config{TemplatesDir: templatesDir, RunnersPath: filepath.Join(runnersPath, tt.runners)})
+			var args []string
+			d.run = func(ctx context.Context, name string, a ...string) (string, error) {
+				args = append([]string{name}, a...)
+				return "", tt.cpErr
+			}
+
+			if got := d.checkClone(context.Background()); got.Status != tt.want {
+				t.Errorf("checkClone() = %+v, want %s", got, tt.want)
+			}
+			if len(args) != 4 || args[0] != "cp" || args[1] != "-c" || filepath.Dir(args[2]) != templatesDir || filepath.Dir(args[3]) != runnersPath {
+				t.Errorf("checkClone() ran %v, want cp -c from %s to %s", args, templatesDir, runnersPath)
+			}
+			for _, dir := range []string{templatesDir, runnersPath} {
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("checkClone() left %d files in %s", len(entries), dir)
+				}
+			}
+		})
+	}
+}
+
+func TestDoctor_DiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if got := New(Config{RunnersPath: dir, MinFreeBytes: 1}).checkDiskSpace(); got.Status != StatusOK {
+		t.Errorf("checkDiskSpace() = %+v, want %s", got, StatusOK)
+	}
+	if got := New(Config{RunnersPath: dir, MinFreeBytes: 1 << 62}).checkDiskSpace(); got.Status != StatusWarn {
+		t.Errorf("checkDiskSpace() below the minimum = %+v, want %s", got, StatusWarn)
+	}
+}
+
+func TestDoctor_Entitlements(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		err  error
+		want Status
+	}{
+		{name: "entitled", out: `<plist><dict><key>com.apple.security.virtualization</key><true/></dict></plist>`, want: StatusOK},
+		{name: "other entitlements", out: `<plist><dict><key>com.apple.security.network.client</key><true/></dict></plist>`, want: StatusFail},
+		{name: "not signed", err: errors.New("code object is not signed at all"), want: StatusFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(Config{Executable: "/usr/local/bin/shoes-vz-agent"})
+			d.run = func(ctx context.Context, name string, args ...string) (string, error) {
+				return tt.out, tt.err
+			}
+			if got := d.checkEntitlements(context.Background()); got.Status != tt.want {
+				t.Errorf("checkEntitlements() = %+v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoctor_SSHKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keys := map[string][]byte{
+		"key":       pem.EncodeToMemory(block),
+		"encrypted": pem.EncodeToMemory(encrypted),
+		"garbage":   []byte("not a key"),
+	}
+	for name, data := range keys {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		authorizedKey ssh.PublicKey // Recorded in the template metadata if set
+		want          Status
+		wantInErr     string
+	}{
+		{name: "not set", want: StatusOK},
+		{name: "authorized by the template", path: filepath.Join(dir, "key"), authorizedKey: pub, want: StatusOK, wantInErr: "SHA256:"},
+		{name: "template authorizes another key", path: filepath.Join(dir, "key"), authorizedKey: other, want: StatusFail, wantInErr: "macos-15@2025.02.01"},
+		{name: "template records no key", path: filepath.Join(dir, "key"), want: StatusWarn, wantInErr: "SHA256:"},
+		{name: "passphrase", path: filepath.Join(dir, "encrypted"), want: StatusFail, wantInErr: "passphrase"},
+		{name: "not a key", path: filepath.Join(dir, "garbage"), want: StatusFail},
+		{name: "missing", path: filepath.Join(dir, "missing"), want: StatusFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templatesDir := t.TempDir()
+			writeTemplate(t, templatesDir, "macos-15", editMetadata(func(m *template.Metadata) {
+				if tt.authorizedKey != nil {
+					m.AuthorizedKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(tt.authorizedKey)))
+				}
+			}))
+
+			got := New(Config{SSHKeyPath: tt.path, TemplatesDir: templatesDir}).checkSSHKey()
+			if got.Status != tt.want || !strings.Contains(got.Detail, tt.wantInErr) {
+				t.Errorf("checkSSHKey() = %+v, want %s with %q", got, tt.want, tt.wantInErr)
+			}
+		})
+	}
+}
+
+func TestDoctor_IPNotifyPort(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint(l.Addr().(*net.TCPAddr).Port)
+
+	d := New(Config{IPNotifyPort: port})
+	if got := d.checkIPNotifyPort(); got.Status != StatusFail {
+		t.Errorf("checkIPNotifyPort() of a port in use = %+v, want %s", got, StatusFail)
+	}
+	_ = l.Close()
+	if got := d.checkIPNotifyPort(); got.Status != StatusOK {
+		t.Errorf("checkIPNotifyPort() of a free port = %+v, want %s", got, StatusOK)
+	}
+}
+
+func TestDoctor_Server(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	ctx := context.Background()
+	d := New(Config{ServerAddr: addr, Timeout: time.Second})
+	if got := d.checkServer(ctx); got.Status != StatusOK {
+		t.Errorf("checkServer() = %+v, want %s", got, StatusOK)
+	}
+	_ = l.Close()
+	if got := d.checkServer(ctx); got.Status != StatusFail {
+		t.Errorf("checkServer() of a closed port = %+v, want %s", got, StatusFail)
+	}
+}
+
+func TestReport_Failed(t *testing.T) {
+	tests := []struct {
+		statuses []Status
+		want     bool
+	}{
+		{statuses: []Status{StatusOK, StatusOK}, want: false},
+		{statuses: []Status{StatusOK, StatusWarn}, want: false},
+		{statuses: []Status{StatusWarn, StatusFail}, want: true},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			r := &Report{}
+			for _, s := range tt.statuses {
+				r.Results = append(r.Results, Result{Status: s})
+			}
+			if got := r.Failed(); got != tt.want {
+				t.Errorf("Failed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
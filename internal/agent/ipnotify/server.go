@@ -3,18 +3,45 @@ package ipnotify
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/netip"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
 	"github.com/whywaita/shoes-vz/pkg/logging"
 )
 
+// rejectedNotifications counts IP notifications rejected by authentication
+var rejectedNotifications = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "shoesvz_agent_ipnotify_rejected_total",
+		Help: "Total number of IP notifications rejected by authentication",
+	},
+	[]string{"reason"},
+)
+
+// errUnknownRunner rejects a notification that names no pending runner when
+// legacy guests are not allowed
+var errUnknownRunner = errors.New("notification names no pending runner")
+
+// maxNotificationSize limits how much of a notification body is read
+const maxNotificationSize = 64 << 10
+
 // IPNotification represents the JSON payload sent from runner-agent to shoes-vz-agent
 type IPNotification struct {
 	RunnerID  string `json:"runner_id"`
 	IPAddress string `json:"ip_address"`
+	HostKey   string `json:"host_key,omitempty"` // Guest SSH host key in authorized_keys format
+
+	ConfigDisk bool `json:"config_disk,omitempty"` // Guest read its identity and setup script from the config disk
 }
 
 // PendingRequest represents a pending IP notification request
@@ -23,44 +50,109 @@ type PendingRequest struct {
 	Ch       chan IPInfo
 }
 
-// IPInfo contains IP address and the UUID from the guest
+// NotificationResponse is returned to the runner-agent for an accepted notification
+type NotificationResponse struct {
+	Status string `json:"status"`
+}
+
+// IPInfo contains IP address, the UUID and the SSH host key from the guest
 type IPInfo struct {
-	IPAddress string
-	UUID      string
+	IPAddress  string
+	UUID       string
+	HostKey    string
+	ConfigDisk bool
+
+	// RunnerToken is set if the notification was signed with the runner's
+	// own token rather than the agent's secret
+	RunnerToken bool
 }
 
 // Server is an HTTP server that receives IP notifications from runner-agents
 type Server struct {
 	listenAddr     string
 	server         *http.Server
+	signer         *auth.Signer
 	pendingQueue   []PendingRequest  // Queue of pending requests (FIFO)
 	uuidToRunnerID map[string]string // Maps guest UUID to runner ID
+	legacyGuests   bool
 	mu             sync.RWMutex
 }
 
-// NewServer creates a new IP notification server
-func NewServer(port int) *Server {
-	return &Server{
+// Option configures a Server
+type Option func(*Server)
+
+// AllowLegacyGuests accepts notifications signed with the agent's secret from
+// guests that do not read the config disk. Over TCP they are matched by
+// IOPlatformUUID or handed to the first pending runner, so a guest holding the
+// secret can take another runner's slot.
+func AllowLegacyGuests() Option {
+	return func(s *Server) {
+		s.legacyGuests = true
+	}
+}
+
+// NewServer creates a new IP notification server.
+// If signer is enabled, notifications without a valid signature are rejected.
+func NewServer(port int, signer *auth.Signer, opts ...Option) *Server {
+	s := &Server{
 		listenAddr:     fmt.Sprintf(":%d", port),
+		signer:         signer,
 		pendingQueue:   make([]PendingRequest, 0),
 		uuidToRunnerID: make(map[string]string),
 	}
-}
-
-// Start starts the HTTP server
-func (s *Server) Start() error {
-	logger := logging.WithComponent("ipnotify")
+	for _, opt := range opts {
+		opt(s)
+	}
 
 	mux := http.NewServeMux()
+	// Authenticated by the handler, which picks the key from the runner claimed
 	mux.HandleFunc("/notify-ip", s.handleIPNotification)
-
 	s.server = &http.Server{
 		Addr:    s.listenAddr,
 		Handler: mux,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if rc, ok := c.(*runnerConn); ok {
+				return context.WithValue(ctx, runnerIDKey{}, rc.runnerID)
+			}
+			return ctx
+		},
+	}
+	return s
+}
+
+// runnerIDKey is the context key of the runner a connection is bound to
+type runnerIDKey struct{}
+
+// runnerConn is a connection that can only come from the VM of runnerID
+type runnerConn struct {
+	net.Conn
+	runnerID string
+}
+
+// runnerListener binds every connection it accepts to runnerID
+type runnerListener struct {
+	net.Listener
+	runnerID string
+}
+
+func (l *runnerListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &runnerConn{Conn: c, runnerID: l.runnerID}, nil
+}
+
+// Start starts the HTTP server
+func (s *Server) Start() error {
+	logger := logging.WithComponent("ipnotify")
+
+	if !s.signer.Enabled() {
+		logger.Warn("IP notification authentication is disabled; any guest can claim a pending runner")
 	}
 
 	go func() {
-		logger.Info("Starting IP notification server", "listen_addr", s.listenAddr)
+		logger.Info("Starting IP notification server", "listen_addr", s.listenAddr, "auth_enabled", s.signer.Enabled())
 		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			logger.Error("IP notification server error", "error", err)
 		}
@@ -69,17 +161,27 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// ServeRunner accepts notifications on l, a listener only the VM of
+// runnerID can reach such as its vsock listener, until l is closed or the
+// server is stopped. Notifications on l are for runnerID whatever runner
+// they name, and need not carry an IP address since the agent reaches the
+// runner-agent over the same socket device.
+func (s *Server) ServeRunner(l net.Listener, runnerID string) error {
+	err := s.server.Serve(&runnerListener{Listener: l, runnerID: runnerID})
+	if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
 // Stop stops the HTTP server
 func (s *Server) Stop(ctx context.Context) error {
-	if s.server == nil {
-		return nil
-	}
 	return s.server.Shutdown(ctx)
 }
 
 // WaitForIP waits for an IP notification from any runner and associates it with the given runner ID
 // This handles the case where the guest UUID is different from the runner ID
-func (s *Server) WaitForIP(ctx context.Context, runnerID string, timeout time.Duration) (string, error) {
+func (s *Server) WaitForIP(ctx context.Context, runnerID string, timeout time.Duration) (IPInfo, error) {
 	ch := make(chan IPInfo, 1)
 
 	s.mu.Lock()
@@ -114,12 +216,24 @@ func (s *Server) WaitForIP(ctx context.Context, runnerID string, timeout time.Du
 
 		logger := logging.WithComponent("ipnotify")
 		logger.Info("Mapped UUID to runner", "uuid", info.UUID, "runner_id", runnerID, "ip_address", info.IPAddress)
-		return info.IPAddress, nil
+		return info, nil
 	case <-timeoutCtx.Done():
-		return "", fmt.Errorf("timeout waiting for IP notification for runner %s", runnerID)
+		return IPInfo{}, fmt.Errorf("timeout waiting for IP notification for runner %s", runnerID)
 	}
 }
 
+// rejectNotification records an IP notification that failed authentication or
+// names no pending runner
+func (s *Server) rejectNotification(r *http.Request, err error) {
+	logger := logging.WithComponent("ipnotify")
+	logger.Warn("Rejected unauthenticated IP notification", "remote_addr", r.RemoteAddr, "error", err)
+	reason := auth.Reason(err)
+	if errors.Is(err, errUnknownRunner) {
+		reason = "unknown_runner"
+	}
+	rejectedNotifications.WithLabelValues(reason).Inc()
+}
+
 // handleIPNotification handles POST /notify-ip requests
 func (s *Server) handleIPNotification(w http.ResponseWriter, r *http.Request) {
 	logger := logging.WithComponent("ipnotify")
@@ -129,24 +243,86 @@ func (s *Server) handleIPNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxNotificationSize))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
 	var notification IPNotification
-	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+	if err := json.Unmarshal(body, &notification); err != nil {
 		logger.Error("Failed to decode IP notification", "error", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	if notification.RunnerID == "" || notification.IPAddress == "" {
+	boundRunnerID, bound := r.Context().Value(runnerIDKey{}).(string)
+	if !bound && (notification.RunnerID == "" || notification.IPAddress == "") {
 		logger.Warn("Missing runner_id or ip_address in notification")
 		http.Error(w, "Missing runner_id or ip_address", http.StatusBadRequest)
 		return
 	}
 
-	logger.Info("Received IP notification", "uuid", notification.RunnerID, "ip_address", notification.IPAddress)
+	if notification.HostKey != "" {
+		if _, err := auth.ParseHostKey(notification.HostKey); err != nil {
+			logger.Warn("Invalid host key in notification", "uuid", notification.RunnerID, "error", err)
+			http.Error(w, "Invalid host_key", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ipAddress := withZone(notification.IPAddress, r.RemoteAddr)
+	logger.Info("Received IP notification", "uuid", notification.RunnerID, "ip_address", ipAddress, "has_host_key", notification.HostKey != "")
+
+	info := IPInfo{
+		IPAddress:  ipAddress,
+		UUID:       notification.RunnerID,
+		HostKey:    notification.HostKey,
+		ConfigDisk: notification.ConfigDisk,
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if bound {
+		s.deliverBound(w, r, body, boundRunnerID, info)
+		return
+	}
+
+	// Guests that read their config disk know their runner ID, and sign
+	// with its token so that they cannot claim another runner
+	for _, req := range s.pendingQueue {
+		if req.RunnerID == notification.RunnerID {
+			if err := s.signer.ForRunner(req.RunnerID).Verify(r, body); err != nil {
+				s.rejectNotification(r, err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			info.RunnerToken = s.signer.Enabled()
+			select {
+			case req.Ch <- info:
+				writeAccepted(w, req)
+			default:
+				logger.Error("Channel full or closed", "runner_id", req.RunnerID)
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	if !s.legacyGuests {
+		s.rejectNotification(r, fmt.Errorf("%w: %s", errUnknownRunner, notification.RunnerID))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Older guests only have the agent's secret
+	if err := s.signer.Verify(r, body); err != nil {
+		s.rejectNotification(r, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	// Check if UUID is already mapped to a runner ID
 	if runnerID, exists := s.uuidToRunnerID[notification.RunnerID]; exists {
 		logger.Info("UUID already mapped", "uuid", notification.RunnerID, "runner_id", runnerID)
@@ -154,11 +330,8 @@ func (s *Server) handleIPNotification(w http.ResponseWriter, r *http.Request) {
 		for _, req := range s.pendingQueue {
 			if req.RunnerID == runnerID {
 				select {
-				case req.Ch <- IPInfo{IPAddress: notification.IPAddress, UUID: notification.RunnerID}:
-					w.WriteHeader(http.StatusOK)
-					if err := json.NewEncoder(w).Encode(map[string]string{"status": "ok"}); err != nil {
-						logger.Error("Failed to encode response", "error", err)
-					}
+				case req.Ch <- info:
+					writeAccepted(w, req)
 					return
 				default:
 					logger.Warn("Channel full or closed", "runner_id", runnerID)
@@ -179,13 +352,76 @@ func (s *Server) handleIPNotification(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Assigning UUID to first pending runner", "uuid", notification.RunnerID, "runner_id", req.RunnerID)
 
 	select {
-	case req.Ch <- IPInfo{IPAddress: notification.IPAddress, UUID: notification.RunnerID}:
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(map[string]string{"status": "ok"}); err != nil {
-			logger.Error("Failed to encode response", "error", err)
-		}
+	case req.Ch <- info:
+		writeAccepted(w, req)
 	default:
 		logger.Error("Channel full or closed", "runner_id", req.RunnerID)
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 	}
 }
+
+// deliverBound delivers a notification that arrived on a connection bound to
+// runnerID, ignoring the runner the guest names. Guests without a runner
+// token may sign with the agent's secret only if legacy guests are allowed.
+// s.mu must be held.
+func (s *Server) deliverBound(w http.ResponseWriter, r *http.Request, body []byte, runnerID string, info IPInfo) {
+	logger := logging.WithComponent("ipnotify")
+
+	err := s.signer.ForRunner(runnerID).Verify(r, body)
+	if errors.Is(err, auth.ErrInvalidSignature) && s.legacyGuests {
+		err = s.signer.Verify(r, body)
+	} else if err == nil {
+		info.RunnerToken = s.signer.Enabled()
+	}
+	if err != nil {
+		s.rejectNotification(r, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if info.UUID != runnerID {
+		logger.Info("Notification on a runner's socket names another runner; using the socket's", "uuid", info.UUID, "runner_id", runnerID)
+	}
+
+	for _, req := range s.pendingQueue {
+		if req.RunnerID != runnerID {
+			continue
+		}
+		select {
+		case req.Ch <- info:
+			writeAccepted(w, req)
+		default:
+			logger.Error("Channel full or closed", "runner_id", req.RunnerID)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	logger.Warn("No pending request for runner", "runner_id", runnerID)
+	http.Error(w, "No pending request", http.StatusNotFound)
+}
+
+// writeAccepted responds to a notification that was matched to req
+func writeAccepted(w http.ResponseWriter, req PendingRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	resp := NotificationResponse{Status: "ok"}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.WithComponent("ipnotify").Error("Failed to encode response", "error", err)
+	}
+}
+
+// withZone adds the zone of remoteAddr to an IPv6 link-local address sent by
+// the guest, which cannot know the name of the host's interface
+func withZone(ipAddress, remoteAddr string) string {
+	addr, err := netip.ParseAddr(ipAddress)
+	if err != nil || !addr.Is6() || !addr.IsLinkLocalUnicast() || addr.Zone() != "" {
+		return ipAddress
+	}
+
+	remote, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil || remote.Addr().WithZone("") != addr {
+		return ipAddress
+	}
+	return remote.Addr().String()
+}
@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"testing"
 	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
 )
 
 func TestServer_StartStop(t *testing.T) {
-	server := NewServer(0) // Use port 0 to get random available port
+	server := NewServer(0, nil) // Use port 0 to get random available port
 
 	if err := server.Start(); err != nil {
 		t.Fatalf("Start() error = %v", err)
@@ -25,7 +29,7 @@ func TestServer_StartStop(t *testing.T) {
 }
 
 func TestServer_WaitForIP(t *testing.T) {
-	server := NewServer(18081)
+	server := NewServer(18081, nil)
 
 	if err := server.Start(); err != nil {
 		t.Fatalf("Start() error = %v", err)
@@ -41,6 +45,7 @@ func TestServer_WaitForIP(t *testing.T) {
 
 	runnerID := "test-runner-123"
 	expectedIP := "192.168.64.5"
+	expectedHostKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
 
 	// Send notification in a goroutine
 	go func() {
@@ -49,6 +54,7 @@ func TestServer_WaitForIP(t *testing.T) {
 		notification := IPNotification{
 			RunnerID:  runnerID,
 			IPAddress: expectedIP,
+			HostKey:   expectedHostKey,
 		}
 
 		body, _ := json.Marshal(notification)
@@ -66,24 +72,36 @@ func TestServer_WaitForIP(t *testing.T) {
 		if resp.StatusCode != http.StatusOK {
 			t.Errorf("Expected status 200, got %d", resp.StatusCode)
 		}
+
+		var notificationResp NotificationResponse
+		if err := json.NewDecoder(resp.Body).Decode(&notificationResp); err != nil {
+			t.Errorf("Failed to decode response: %v", err)
+			return
+		}
+		if notificationResp.Status != "ok" {
+			t.Errorf("status = %s, want ok", notificationResp.Status)
+		}
 	}()
 
 	// Wait for IP
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	ip, err := server.WaitForIP(ctx, runnerID, 5*time.Second)
+	info, err := server.WaitForIP(ctx, runnerID, 5*time.Second)
 	if err != nil {
 		t.Fatalf("WaitForIP() error = %v", err)
 	}
 
-	if ip != expectedIP {
-		t.Errorf("WaitForIP() = %s, want %s", ip, expectedIP)
+	if info.IPAddress != expectedIP {
+		t.Errorf("WaitForIP() = %s, want %s", info.IPAddress, expectedIP)
+	}
+	if info.HostKey != expectedHostKey {
+		t.Errorf("WaitForIP() host key = %s, want %s", info.HostKey, expectedHostKey)
 	}
 }
 
 func TestServer_WaitForIPTimeout(t *testing.T) {
-	server := NewServer(18082)
+	server := NewServer(18082, nil)
 
 	if err := server.Start(); err != nil {
 		t.Fatalf("Start() error = %v", err)
@@ -105,7 +123,7 @@ func TestServer_WaitForIPTimeout(t *testing.T) {
 }
 
 func TestServer_HandleIPNotification_InvalidMethod(t *testing.T) {
-	server := NewServer(18083)
+	server := NewServer(18083, nil)
 
 	if err := server.Start(); err != nil {
 		t.Fatalf("Start() error = %v", err)
@@ -135,7 +153,7 @@ func TestServer_HandleIPNotification_InvalidMethod(t *testing.T) {
 }
 
 func TestServer_HandleIPNotification_InvalidJSON(t *testing.T) {
-	server := NewServer(18084)
+	server := NewServer(18084, nil)
 
 	if err := server.Start(); err != nil {
 		t.Fatalf("Start() error = %v", err)
@@ -165,7 +183,7 @@ func TestServer_HandleIPNotification_InvalidJSON(t *testing.T) {
 }
 
 func TestServer_HandleIPNotification_MissingFields(t *testing.T) {
-	server := NewServer(18085)
+	server := NewServer(18085, nil)
 
 	if err := server.Start(); err != nil {
 		t.Fatalf("Start() error = %v", err)
@@ -195,6 +213,14 @@ func TestServer_HandleIPNotification_MissingFields(t *testing.T) {
 				RunnerID: "test-runner",
 			},
 		},
+		{
+			name: "invalid host_key",
+			notification: IPNotification{
+				RunnerID:  "test-runner",
+				IPAddress: "192.168.64.5",
+				HostKey:   "not-a-key",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -216,3 +242,358 @@ func TestServer_HandleIPNotification_MissingFields(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_HandleIPNotification_Authentication(t *testing.T) {
+	signer := auth.NewSigner([]byte("test-secret"))
+	server := NewServer(18086, signer)
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer func() {
+		if err := server.Stop(context.Background()); err != nil {
+			t.Logf("Stop() error = %v", err)
+		}
+	}()
+
+	// Give server time to start
+	time.Sleep(100 * time.Millisecond)
+
+	runnerID := "test-runner-auth"
+	expectedIP := "192.168.64.7"
+
+	body, _ := json.Marshal(IPNotification{
+		RunnerID:  runnerID,
+		IPAddress: expectedIP,
+	})
+
+	// Unsigned notification must be rejected
+	resp, err := http.Post("http://localhost:18086/notify-ip", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Logf("Failed to close response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", resp.StatusCode)
+	}
+
+	// A runner ID claim must be signed with that runner's token
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		tests := []struct {
+			name       string
+			signer     *auth.Signer
+			wantStatus int
+		}{
+			{
+				name:       "agent secret",
+				signer:     signer,
+				wantStatus: http.StatusUnauthorized,
+			},
+			{
+				name:       "token of another runner",
+				signer:     auth.NewSigner(auth.RunnerToken([]byte("test-secret"), "other-runner")),
+				wantStatus: http.StatusUnauthorized,
+			},
+			{
+				name:       "token of the runner",
+				signer:     auth.NewSigner(auth.RunnerToken([]byte("test-secret"), runnerID)),
+				wantStatus: http.StatusOK,
+			},
+		}
+
+		for _, tt := range tests {
+			req, err := http.NewRequest(http.MethodPost, "http://localhost:18086/notify-ip", bytes.NewReader(body))
+			if err != nil {
+				t.Errorf("Failed to create request: %v", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			tt.signer.Sign(req, body)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("Failed to send notification: %v", err)
+				return
+			}
+			if err := resp.Body.Close(); err != nil {
+				t.Logf("Failed to close response body: %v", err)
+			}
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantStatus, resp.StatusCode)
+			}
+		}
+	}()
+
+	info, err := server.WaitForIP(context.Background(), runnerID, 5*time.Second)
+	if err != nil {
+		t.Fatalf("WaitForIP() error = %v", err)
+	}
+
+	if info.IPAddress != expectedIP {
+		t.Errorf("WaitForIP() = %s, want %s", info.IPAddress, expectedIP)
+	}
+	if !info.RunnerToken {
+		t.Error("WaitForIP() RunnerToken = false, want true")
+	}
+}
+
+func TestServer_HandleIPNotification_LegacyGuests(t *testing.T) {
+	secret := []byte("test-secret")
+	tests := []struct {
+		name       string
+		port       int
+		opts       []Option
+		wantStatus int
+	}{
+		{
+			name:       "legacy guests not allowed",
+			port:       18088,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "legacy guests allowed",
+			port:       18089,
+			opts:       []Option{AllowLegacyGuests()},
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(tt.port, auth.NewSigner(secret), tt.opts...)
+			if err := server.Start(); err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			defer func() {
+				if err := server.Stop(context.Background()); err != nil {
+					t.Logf("Stop() error = %v", err)
+				}
+			}()
+
+			// Give server time to start
+			time.Sleep(100 * time.Millisecond)
+
+			// A guest identified by its UUID, signing with the agent's secret
+			body, _ := json.Marshal(IPNotification{
+				RunnerID:  "guest-uuid",
+				IPAddress: "192.168.64.9",
+			})
+			status := make(chan int, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d/notify-ip", tt.port), bytes.NewReader(body))
+				if err != nil {
+					t.Errorf("Failed to create request: %v", err)
+					status <- 0
+					return
+				}
+				auth.NewSigner(secret).Sign(req, body)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Errorf("Failed to send notification: %v", err)
+					status <- 0
+					return
+				}
+				_ = resp.Body.Close()
+				status <- resp.StatusCode
+			}()
+
+			info, err := server.WaitForIP(context.Background(), "runner-a", 1*time.Second)
+			if got := <-status; got != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, got)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if err == nil {
+					t.Error("WaitForIP() error = nil, want timeout")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WaitForIP() error = %v", err)
+			}
+			if info.UUID != "guest-uuid" {
+				t.Errorf("WaitForIP() UUID = %s, want guest-uuid", info.UUID)
+			}
+			if info.RunnerToken {
+				t.Error("WaitForIP() RunnerToken = true, want false")
+			}
+		})
+	}
+}
+
+func TestServer_HandleIPNotification_MatchesRunnerID(t *testing.T) {
+	server := NewServer(18087, nil)
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer func() {
+		if err := server.Stop(context.Background()); err != nil {
+			t.Logf("Stop() error = %v", err)
+		}
+	}()
+
+	// Give server time to start
+	time.Sleep(100 * time.Millisecond)
+
+	// Two runners are pending; the notification names the second one, so it
+	// must not be handed to the first runner in the queue
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := server.WaitForIP(context.Background(), "runner-first", 1*time.Second)
+		firstDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		body, _ := json.Marshal(IPNotification{
+			RunnerID:   "runner-second",
+			IPAddress:  "192.168.64.8",
+			ConfigDisk: true,
+		})
+		resp, err := http.Post("http://localhost:18087/notify-ip", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("Failed to send notification: %v", err)
+			return
+		}
+		if err := resp.Body.Close(); err != nil {
+			t.Logf("Failed to close response body: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+	}()
+
+	info, err := server.WaitForIP(context.Background(), "runner-second", 5*time.Second)
+	if err != nil {
+		t.Fatalf("WaitForIP() error = %v", err)
+	}
+	if info.IPAddress != "192.168.64.8" {
+		t.Errorf("WaitForIP() = %s, want %s", info.IPAddress, "192.168.64.8")
+	}
+	if !info.ConfigDisk {
+		t.Error("WaitForIP() ConfigDisk = false, want true")
+	}
+
+	if err := <-firstDone; err == nil {
+		t.Error("WaitForIP() for the first runner error = nil, want timeout")
+	}
+}
+
+func TestWithZone(t *testing.T) {
+	tests := []struct {
+		name       string
+		ipAddress  string
+		remoteAddr string
+		want       string
+	}{
+		{
+			name:       "IPv4 is unchanged",
+			ipAddress:  "192.168.64.5",
+			remoteAddr: "192.168.64.5:50000",
+			want:       "192.168.64.5",
+		},
+		{
+			name:       "link-local gets the zone of the connection",
+			ipAddress:  "fe80::1c2d:3eff:fe4f:5a6b",
+			remoteAddr: "[fe80::1c2d:3eff:fe4f:5a6b%bridge100]:50000",
+			want:       "fe80::1c2d:3eff:fe4f:5a6b%bridge100",
+		},
+		{
+			name:       "link-local from another address is unchanged",
+			ipAddress:  "fe80::1c2d:3eff:fe4f:5a6b",
+			remoteAddr: "[fe80::2%bridge100]:50000",
+			want:       "fe80::1c2d:3eff:fe4f:5a6b",
+		},
+		{
+			name:       "notification over vsock is unchanged",
+			ipAddress:  "fe80::1c2d:3eff:fe4f:5a6b",
+			remoteAddr: "3:1024",
+			want:       "fe80::1c2d:3eff:fe4f:5a6b",
+		},
+		{
+			name:       "global IPv6 is unchanged",
+			ipAddress:  "2001:db8::23",
+			remoteAddr: "[2001:db8::23]:50000",
+			want:       "2001:db8::23",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withZone(tt.ipAddress, tt.remoteAddr); got != tt.want {
+				t.Errorf("withZone() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_ServeRunner(t *testing.T) {
+	secret := []byte("test-secret")
+	server := NewServer(0, auth.NewSigner(secret))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go func() {
+		_ = server.ServeRunner(l, "runner-a")
+	}()
+	defer func() {
+		if err := server.Stop(context.Background()); err != nil {
+			t.Logf("Stop() error = %v", err)
+		}
+	}()
+
+	// The guest names another runner and has no IP address yet
+	body, _ := json.Marshal(IPNotification{RunnerID: "runner-b"})
+	sendSigned := func(signer *auth.Signer) int {
+		req, err := http.NewRequest(http.MethodPost, "http://"+l.Addr().String()+"/notify-ip", bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("Failed to create request: %v", err)
+			return 0
+		}
+		signer.Sign(req, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Failed to send notification: %v", err)
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	send := func(token string) int {
+		return sendSigned(auth.NewSigner(auth.RunnerToken(secret, token)))
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if status := send("runner-b"); status != http.StatusUnauthorized {
+			t.Errorf("token of the named runner: expected status 401, got %d", status)
+		}
+		if status := sendSigned(auth.NewSigner(secret)); status != http.StatusUnauthorized {
+			t.Errorf("agent secret: expected status 401, got %d", status)
+		}
+		if status := send("runner-a"); status != http.StatusOK {
+			t.Errorf("token of the socket's runner: expected status 200, got %d", status)
+		}
+	}()
+
+	info, err := server.WaitForIP(context.Background(), "runner-a", 5*time.Second)
+	if err != nil {
+		t.Fatalf("WaitForIP() error = %v", err)
+	}
+	if info.IPAddress != "" {
+		t.Errorf("WaitForIP() = %s, want no address", info.IPAddress)
+	}
+	if !info.RunnerToken {
+		t.Error("WaitForIP() RunnerToken = false, want true")
+	}
+}
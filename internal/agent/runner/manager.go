@@ -100,6 +100,20 @@ func (m *Manager) UpdateGuestState(runnerID string, guestState agentv1.GuestRunn
 	return nil
 }
 
+// SetTemplate records the template version a runner was cloned from
+func (m *Manager) SetTemplate(runnerID string, template *agentv1.Template) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	runner, exists := m.runners[runnerID]
+	if !exists {
+		return model.ErrRunnerNotFound
+	}
+
+	runner.Template = template
+	return nil
+}
+
 // SetError sets an error for a runner
 func (m *Manager) SetError(runnerID string, errMsg string) error {
 	m.mu.Lock()
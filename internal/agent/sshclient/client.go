@@ -0,0 +1,390 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	// DefaultUser is the default user for SSH connections to runner VMs
+	DefaultUser = "runner"
+
+	// DefaultPort is the default SSH port of runner VMs
+	DefaultPort = 22
+
+	// DefaultDialTimeout is the default timeout for establishing an SSH connection
+	DefaultDialTimeout = 10 * time.Second
+)
+
+// ErrNoHostKey is returned when connecting to a runner whose host key is not pinned
+var ErrNoHostKey = errors.New("no SSH host key pinned for runner")
+
+// HostKeyFunc returns the pinned SSH host key of a runner, or nil if none is known
+type HostKeyFunc func(runnerID string) (ssh.PublicKey, error)
+
+// ClientKeyFunc returns the private key dedicated to a runner, or nil if it has none
+type ClientKeyFunc func(runnerID string) (ssh.Signer, error)
+
+// Config contains SSH connection settings shared by all runners
+type Config struct {
+	User        string
+	Port        int
+	KeyPath     string        // Path to private key (falls back to ssh-agent if empty)
+	DialTimeout time.Duration // Timeout for TCP connect and SSH handshake
+
+	// ClientKey looks up the per-runner key. KeyPath is only used for
+	// runners that have none.
+	ClientKey ClientKeyFunc
+
+	// HostKey looks up the pinned host key of a runner. Connections to a
+	// runner presenting any other key are refused.
+	HostKey HostKeyFunc
+
+	// InsecureIgnoreHostKey accepts any host key when none is pinned.
+	// It exists for templates whose runner-agent does not report a host key.
+	InsecureIgnoreHostKey bool
+}
+
+// Result contains the captured output of a remote command
+type Result struct {
+	Stdout     []byte
+	Stderr     []byte
+	ExitStatus int
+}
+
+// ExitError is returned when a remote command exits with a non-zero status
+// or is terminated by a signal
+type ExitError struct {
+	ExitStatus int
+	Signal     string
+	Stderr     []byte
+}
+
+// Error implements error
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("remote command killed by signal %s", e.Signal)
+	}
+	return fmt.Sprintf("remote command exited with status %d", e.ExitStatus)
+}
+
+// Pool keeps one SSH connection per runner and reuses it across commands
+type Pool struct {
+	config Config
+
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+}
+
+// pooledClient is an SSH connection along with the address it was dialed to
+type pooledClient struct {
+	client *ssh.Client
+	addr   string
+}
+
+// NewPool creates a new connection pool
+func NewPool(config Config) *Pool {
+	if config.User == "" {
+		config.User = DefaultUser
+	}
+	if config.Port == 0 {
+		config.Port = DefaultPort
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = DefaultDialTimeout
+	}
+
+	return &Pool{
+		config:  config,
+		clients: make(map[string]*pooledClient),
+	}
+}
+
+// Check verifies that an SSH session can be established and a trivial command succeeds
+func (p *Pool) Check(ctx context.Context, runnerID, host string) error {
+	_, err := p.Run(ctx, runnerID, host, "true", nil)
+	return err
+}
+
+// Run executes command on the runner and returns its output.
+// stdin, if not nil, is streamed to the remote command's standard input.
+// A non-zero exit status is reported as *ExitError along with the Result.
+func (p *Pool) Run(ctx context.Context, runnerID, host, command string, stdin io.Reader) (*Result, error) {
+	client, err := p.get(ctx, runnerID, host)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		// The pooled connection is likely dead; reconnect once
+		p.Close(runnerID)
+		client, err = p.get(ctx, runnerID, host)
+		if err != nil {
+			return nil, err
+		}
+		session, err = client.NewSession()
+		if err != nil {
+			p.Close(runnerID)
+			return nil, fmt.Errorf("failed to open SSH session: %w", err)
+		}
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if stdin != nil {
+		session.Stdin = stdin
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+
+	select {
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+		return nil, fmt.Errorf("SSH command canceled: %w", ctx.Err())
+	case err = <-done:
+	}
+
+	result := &Result{
+		Stdout: stdout.Bytes(),
+		Stderr: stderr.Bytes(),
+	}
+
+	if err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitStatus = exitErr.ExitStatus()
+			return result, &ExitError{
+				ExitStatus: exitErr.ExitStatus(),
+				Signal:     exitErr.Signal(),
+				Stderr:     result.Stderr,
+			}
+		}
+
+		var missingErr *ssh.ExitMissingError
+		if errors.As(err, &missingErr) {
+			p.Close(runnerID)
+			return result, fmt.Errorf("SSH session closed without exit status: %w", err)
+		}
+
+		p.Close(runnerID)
+		return result, fmt.Errorf("SSH command failed: %w", err)
+	}
+
+	return result, nil
+}
+
+// Close closes and forgets the pooled connection for a runner
+func (p *Pool) Close(runnerID string) {
+	p.mu.Lock()
+	pooled, exists := p.clients[runnerID]
+	delete(p.clients, runnerID)
+	p.mu.Unlock()
+
+	if exists {
+		_ = pooled.client.Close()
+	}
+}
+
+// CloseAll closes all pooled connections
+func (p *Pool) CloseAll() {
+	p.mu.Lock()
+	clients := p.clients
+	p.clients = make(map[string]*pooledClient)
+	p.mu.Unlock()
+
+	for _, pooled := range clients {
+		_ = pooled.client.Close()
+	}
+}
+
+// get returns the pooled connection for a runner, dialing a new one if needed
+func (p *Pool) get(ctx context.Context, runnerID, host string) (*ssh.Client, error) {
+	addr := p.addr(host)
+
+	p.mu.Lock()
+	pooled, exists := p.clients[runnerID]
+	p.mu.Unlock()
+
+	if exists && pooled.addr == addr {
+		return pooled.client, nil
+	}
+	if exists {
+		// Runner got a new address; drop the stale connection
+		p.Close(runnerID)
+	}
+
+	client, err := p.dial(ctx, runnerID, host)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if existing, ok := p.clients[runnerID]; ok && existing.addr == addr {
+		// Another goroutine won the race; keep its connection
+		p.mu.Unlock()
+		_ = client.Close()
+		return existing.client, nil
+	}
+	p.clients[runnerID] = &pooledClient{client: client, addr: addr}
+	p.mu.Unlock()
+
+	return client, nil
+}
+
+// dial establishes a new SSH connection to host
+func (p *Pool) dial(ctx context.Context, runnerID, host string) (*ssh.Client, error) {
+	if host == "" {
+		return nil, fmt.Errorf("IP address is empty")
+	}
+
+	hostKeyCallback, hostKeyAlgorithms, err := p.hostKeyCallback(runnerID)
+	if err != nil {
+		return nil, err
+	}
+
+	authMethods, closeAuth, err := p.authMethods(runnerID)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAuth()
+
+	clientConfig := &ssh.ClientConfig{
+		User:              p.config.User,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           p.config.DialTimeout,
+	}
+
+	addr := p.addr(host)
+	dialCtx, cancel := context.WithTimeout(ctx, p.config.DialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	// Bound the handshake by the same deadline as the dial
+	if deadline, ok := dialCtx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %w", addr, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// hostKeyCallback returns a callback accepting only the pinned host key of
+// the runner, along with the host key algorithms to negotiate for it
+func (p *Pool) hostKeyCallback(runnerID string) (ssh.HostKeyCallback, []string, error) {
+	var key ssh.PublicKey
+	if p.config.HostKey != nil {
+		var err error
+		key, err = p.config.HostKey(runnerID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to look up host key: %w", err)
+		}
+	}
+
+	if key == nil {
+		if p.config.InsecureIgnoreHostKey {
+			return ssh.InsecureIgnoreHostKey(), nil, nil
+		}
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoHostKey, runnerID)
+	}
+
+	// Ask the server for the pinned key type so a guest that still has
+	// other host keys does not present one of those instead
+	algorithms := []string{key.Type()}
+	if key.Type() == ssh.KeyAlgoRSA {
+		algorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return ssh.FixedHostKey(key), algorithms, nil
+}
+
+// authMethods returns the configured SSH authentication methods and a function
+// releasing any resources they hold once the handshake is done.
+// A runner with its own key is only offered that key; the shared key is
+// for runners created before per-runner keys, which have none.
+func (p *Pool) authMethods(runnerID string) ([]ssh.AuthMethod, func(), error) {
+	if p.config.ClientKey != nil {
+		runnerKey, err := p.config.ClientKey(runnerID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load runner SSH key: %w", err)
+		}
+		if runnerKey != nil {
+			return []ssh.AuthMethod{ssh.PublicKeys(runnerKey)}, func() {}, nil
+		}
+	}
+
+	sharedSigners, closeAuth, err := p.sharedSigners()
+	if err != nil {
+		return nil, nil, err
+	}
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(sharedSigners)}, closeAuth, nil
+}
+
+// sharedSigners returns the signers for the key shared by all runners, read
+// from KeyPath or ssh-agent, and a function releasing the ssh-agent connection
+func (p *Pool) sharedSigners() (func() ([]ssh.Signer, error), func(), error) {
+	if p.config.KeyPath != "" {
+		keyData, err := os.ReadFile(p.config.KeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read SSH key: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(keyData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse SSH key: %w", err)
+		}
+
+		return func() ([]ssh.Signer, error) { return []ssh.Signer{signer}, nil }, func() {}, nil
+	}
+
+	// Fall back to ssh-agent, matching the behavior of the ssh binary
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		agentConn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+		}
+		closeAgent := func() {
+			_ = agentConn.Close()
+		}
+		return agent.NewClient(agentConn).Signers, closeAgent, nil
+	}
+
+	return nil, nil, fmt.Errorf("no SSH key configured and SSH_AUTH_SOCK is not set")
+}
+
+// addr returns the host:port address for host
+func (p *Pool) addr(host string) string {
+	return net.JoinHostPort(host, strconv.Itoa(p.config.Port))
+}
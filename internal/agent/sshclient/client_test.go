@@ -0,0 +1,480 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SSH server that runs exec requests with sh -c
+type testServer struct {
+	listener    net.Listener
+	hostKey     ssh.PublicKey
+	connections atomic.Int32
+}
+
+// startTestServer starts an SSH server and returns it with the path of an authorized client key
+func startTestServer(t *testing.T) (*testServer, string) {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("Failed to create host signer: %v", err)
+	}
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatalf("Failed to marshal client key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write client key: %v", err)
+	}
+	authorizedKey, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == DefaultUser && bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	server := &testServer{listener: listener, hostKey: hostSigner.PublicKey()}
+	go server.serve(config)
+
+	return server, keyPath
+}
+
+func (s *testServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// pinnedHostKey returns a HostKeyFunc pinning the server's host key for every runner
+func (s *testServer) pinnedHostKey() HostKeyFunc {
+	return func(runnerID string) (ssh.PublicKey, error) {
+		return s.hostKey, nil
+	}
+}
+
+func (s *testServer) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			s.connections.Add(1)
+			go ssh.DiscardRequests(reqs)
+
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go handleSession(channel, requests)
+			}
+		}()
+	}
+}
+
+func handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer func() {
+		_ = channel.Close()
+	}()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+
+		command := string(req.Payload[4:])
+		_ = req.Reply(true, nil)
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+
+		status := 0
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				status = exitErr.ExitCode()
+			} else {
+				status = 255
+			}
+		}
+
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(status))
+		_, _ = channel.SendRequest("exit-status", false, payload)
+		return
+	}
+}
+
+func TestPool_Run(t *testing.T) {
+	server, keyPath := startTestServer(t)
+
+	pool := NewPool(Config{
+		Port:    server.port(),
+		KeyPath: keyPath,
+		HostKey: server.pinnedHostKey(),
+	})
+	defer pool.CloseAll()
+
+	ctx := context.Background()
+
+	tests := []struct {
+		name           string
+		command        string
+		stdin          string
+		wantStdout     string
+		wantStderr     string
+		wantExitStatus int
+	}{
+		{
+			name:       "stdout and stderr are captured separately",
+			command:    "echo out; echo err >&2",
+			wantStdout: "out\n",
+			wantStderr: "err\n",
+		},
+		{
+			name:       "stdin is streamed to the command",
+			command:    "cat",
+			stdin:      "hello from stdin",
+			wantStdout: "hello from stdin",
+		},
+		{
+			name:           "non-zero exit status is typed",
+			command:        "echo failing >&2; exit 3",
+			wantStderr:     "failing\n",
+			wantExitStatus: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdin io.Reader
+			if tt.stdin != "" {
+				stdin = strings.NewReader(tt.stdin)
+			}
+
+			result, err := pool.Run(ctx, "runner-1", "127.0.0.1", tt.command, stdin)
+
+			if tt.wantExitStatus != 0 {
+				var exitErr *ExitError
+				if !errors.As(err, &exitErr) {
+					t.Fatalf("Run() error = %v, want *ExitError", err)
+				}
+				if exitErr.ExitStatus != tt.wantExitStatus {
+					t.Errorf("ExitStatus = %d, want %d", exitErr.ExitStatus, tt.wantExitStatus)
+				}
+			} else if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if result == nil {
+				t.Fatal("Run() result = nil")
+			}
+			if string(result.Stdout) != tt.wantStdout {
+				t.Errorf("Stdout = %q, want %q", result.Stdout, tt.wantStdout)
+			}
+			if string(result.Stderr) != tt.wantStderr {
+				t.Errorf("Stderr = %q, want %q", result.Stderr, tt.wantStderr)
+			}
+			if result.ExitStatus != tt.wantExitStatus {
+				t.Errorf("Result.ExitStatus = %d, want %d", result.ExitStatus, tt.wantExitStatus)
+			}
+		})
+	}
+
+	// All commands for the same runner share one connection
+	if got := server.connections.Load(); got != 1 {
+		t.Errorf("connections = %d, want 1", got)
+	}
+}
+
+func TestPool_RunLargeScript(t *testing.T) {
+	server, keyPath := startTestServer(t)
+
+	pool := NewPool(Config{
+		Port:    server.port(),
+		KeyPath: keyPath,
+		HostKey: server.pinnedHostKey(),
+	})
+	defer pool.CloseAll()
+
+	// A script far larger than ARG_MAX would break when passed as an argument
+	var script strings.Builder
+	for i := 0; i < 100000; i++ {
+		script.WriteString("# padding line to make the script large\n")
+	}
+	script.WriteString("echo done\n")
+
+	result, err := pool.Run(context.Background(), "runner-1", "127.0.0.1", "sh -s", strings.NewReader(script.String()))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if string(result.Stdout) != "done\n" {
+		t.Errorf("Stdout = %q, want %q", result.Stdout, "done\n")
+	}
+}
+
+func TestPool_RunCanceled(t *testing.T) {
+	server, keyPath := startTestServer(t)
+
+	pool := NewPool(Config{
+		Port:    server.port(),
+		KeyPath: keyPath,
+		HostKey: server.pinnedHostKey(),
+	})
+	defer pool.CloseAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := pool.Run(ctx, "runner-1", "127.0.0.1", "sleep 10", nil)
+	if err == nil {
+		t.Fatal("Run() error = nil, want cancellation error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run() took %v after cancellation", elapsed)
+	}
+}
+
+func TestPool_Check(t *testing.T) {
+	server, keyPath := startTestServer(t)
+
+	pool := NewPool(Config{
+		Port:        server.port(),
+		KeyPath:     keyPath,
+		DialTimeout: time.Second,
+		HostKey:     server.pinnedHostKey(),
+	})
+	defer pool.CloseAll()
+
+	if err := pool.Check(context.Background(), "runner-1", "127.0.0.1"); err != nil {
+		t.Errorf("Check() error = %v", err)
+	}
+
+	// Unknown user is rejected
+	badUserPool := NewPool(Config{
+		User:        "someone-else",
+		Port:        server.port(),
+		KeyPath:     keyPath,
+		DialTimeout: time.Second,
+		HostKey:     server.pinnedHostKey(),
+	})
+	if err := badUserPool.Check(context.Background(), "runner-1", "127.0.0.1"); err == nil {
+		t.Error("Check() with wrong user error = nil, want error")
+	}
+
+	// Nothing listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	closedPool := NewPool(Config{
+		Port:        closedPort,
+		KeyPath:     keyPath,
+		DialTimeout: time.Second,
+		HostKey:     server.pinnedHostKey(),
+	})
+	if err := closedPool.Check(context.Background(), "runner-1", "127.0.0.1"); err == nil {
+		t.Errorf("Check() against closed port %d error = nil, want error", closedPort)
+	}
+}
+
+func TestPool_HostKeyPinning(t *testing.T) {
+	server, keyPath := startTestServer(t)
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		hostKey  ssh.PublicKey
+		insecure bool
+		wantErr  bool
+	}{
+		{
+			name:    "pinned key is accepted",
+			hostKey: server.hostKey,
+			wantErr: false,
+		},
+		{
+			name:    "mismatched key is refused",
+			hostKey: otherKey,
+			wantErr: true,
+		},
+		{
+			name:    "missing key is refused",
+			hostKey: nil,
+			wantErr: true,
+		},
+		{
+			name:     "missing key is accepted when insecure",
+			hostKey:  nil,
+			insecure: true,
+			wantErr:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewPool(Config{
+				Port:        server.port(),
+				KeyPath:     keyPath,
+				DialTimeout: time.Second,
+				HostKey: func(runnerID string) (ssh.PublicKey, error) {
+					return tt.hostKey, nil
+				},
+				InsecureIgnoreHostKey: tt.insecure,
+			})
+			defer pool.CloseAll()
+
+			err := pool.Check(context.Background(), "runner-1", "127.0.0.1")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPool_ClientKey(t *testing.T) {
+	server, keyPath := startTestServer(t)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	authorizedKey, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherKey, err := ssh.NewSignerFromKey(otherPriv)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		clientKey ssh.Signer
+		keyPath   string
+		wantErr   bool
+	}{
+		{
+			name:      "runner key alone",
+			clientKey: authorizedKey,
+			wantErr:   false,
+		},
+		{
+			name:    "shared key without runner key",
+			keyPath: keyPath,
+			wantErr: false,
+		},
+		{
+			name:      "shared key is not offered once a runner key exists",
+			clientKey: otherKey,
+			keyPath:   keyPath,
+			wantErr:   true,
+		},
+		{
+			name:      "unauthorized runner key without shared key",
+			clientKey: otherKey,
+			wantErr:   true,
+		},
+		{
+			name:    "no key at all",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewPool(Config{
+				Port:        server.port(),
+				KeyPath:     tt.keyPath,
+				DialTimeout: time.Second,
+				HostKey:     server.pinnedHostKey(),
+				ClientKey: func(runnerID string) (ssh.Signer, error) {
+					return tt.clientKey, nil
+				},
+			})
+			defer pool.CloseAll()
+
+			err := pool.Check(context.Background(), "runner-1", "127.0.0.1")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
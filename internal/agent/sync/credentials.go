@@ -0,0 +1,90 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/pkg/auth"
+)
+
+// credentialFile is the content of the file an agent keeps its credential in
+type credentialFile struct {
+	AgentID    string `json:"agent_id"`
+	Credential string `json:"credential"`
+}
+
+// Credentials authenticate the agent to the server. They are read from a
+// file, or obtained with a bootstrap token on the first connect and then
+// saved to it.
+type Credentials struct {
+	path           string
+	bootstrapToken string
+	agentID        string
+	bearer         *auth.Bearer
+}
+
+// LoadCredentials reads the credential at path. bootstrapToken is used to
+// enroll if the file does not exist yet.
+func LoadCredentials(path, bootstrapToken string) (*Credentials, error) {
+	c := &Credentials{
+		path:           path,
+		bootstrapToken: bootstrapToken,
+		bearer:         auth.NewBearer(""),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if bootstrapToken == "" {
+			return nil, fmt.Errorf("no credential at %s and no bootstrap token to enroll with", path)
+		}
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential file: %w", err)
+	}
+
+	var f credentialFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse credential file: %w", err)
+	}
+	if f.AgentID == "" || f.Credential == "" {
+		return nil, fmt.Errorf("credential file %s is incomplete", path)
+	}
+	c.agentID = f.AgentID
+	c.bearer.Set(f.Credential)
+	return c, nil
+}
+
+// enroll obtains a credential if the agent does not have one yet
+func (c *Credentials) enroll(ctx context.Context, client agentv1.AgentServiceClient, hostname string) (bool, error) {
+	if c.agentID != "" {
+		return false, nil
+	}
+
+	resp, err := client.Enroll(ctx, &agentv1.EnrollRequest{
+		BootstrapToken: c.bootstrapToken,
+		Hostname:       hostname,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to enroll: %w", err)
+	}
+
+	data, err := json.MarshalIndent(credentialFile{AgentID: resp.AgentId, Credential: resp.Credential}, "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("failed to encode credential: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return false, fmt.Errorf("failed to create credential directory: %w", err)
+	}
+	if err := os.WriteFile(c.path, data, 0600); err != nil {
+		return false, fmt.Errorf("failed to write credential file: %w", err)
+	}
+
+	c.agentID = resp.AgentId
+	c.bearer.Set(resp.Credential)
+	return true, nil
+}
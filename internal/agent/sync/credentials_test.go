@@ -0,0 +1,66 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+)
+
+type fakeEnrollClient struct {
+	agentv1.AgentServiceClient
+	calls int
+}
+
+func (f *fakeEnrollClient) Enroll(_ context.Context, req *agentv1.EnrollRequest, _ ...grpc.CallOption) (*agentv1.EnrollResponse, error) {
+	f.calls++
+	return &agentv1.EnrollResponse{AgentId: "agent-1", Credential: "agent-1.secret"}, nil
+}
+
+func TestCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent", "credential.json")
+
+	if _, err := LoadCredentials(path, ""); err == nil {
+		t.Fatal("LoadCredentials() without file or token should fail")
+	}
+
+	c, err := LoadCredentials(path, "token-id.token-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeEnrollClient{}
+	if enrolled, err := c.enroll(context.Background(), client, "mac-1"); err != nil || !enrolled {
+		t.Fatalf("enroll() = %v, %v, want true", enrolled, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("credential file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// After a restart the saved credential is used without enrolling again
+	c, err = LoadCredentials(path, "token-id.token-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enrolled, err := c.enroll(context.Background(), client, "mac-1"); err != nil || enrolled {
+		t.Errorf("enroll() with saved credential = %v, %v, want false", enrolled, err)
+	}
+	if client.calls != 1 {
+		t.Errorf("Enroll called %d times, want 1", client.calls)
+	}
+	md, err := c.bearer.GetRequestMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := md["authorization"]; got != "Bearer agent-1.secret" {
+		t.Errorf("authorization = %q, want %q", got, "Bearer agent-1.secret")
+	}
+}
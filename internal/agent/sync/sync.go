@@ -6,18 +6,24 @@ import (
 	"io"
 	"log/slog"
 	"strings"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
 	"github.com/whywaita/shoes-vz/internal/agent/runner"
 	"github.com/whywaita/shoes-vz/internal/agent/vm"
 	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
 )
 
+var tracer = tracing.Tracer("agent")
+
 // Client manages bidirectional sync with the server
 type Client struct {
 	agentID       string
@@ -29,41 +35,73 @@ type Client struct {
 	client        agentv1.AgentServiceClient
 	commandChan   chan *agentv1.SyncResponse
 	logger        *slog.Logger
+	dialOpts      []grpc.DialOption
+	credentials   *Credentials
+
+	// Logs requested by the server, sent with the next sync
+	logMu       sync.Mutex
+	pendingLogs []*agentv1.RunnerLog
+	syncNow     chan struct{}
 }
 
-// NewClient creates a new sync client
+// NewClient creates a new sync client. credentials may be nil if the server
+// does not authenticate agents. dialOpts are used to connect to the server
+// and must include its transport credentials.
 func NewClient(
 	serverAddr string,
 	syncInterval time.Duration,
 	runnerManager *runner.Manager,
 	vmManager vm.Manager,
+	credentials *Credentials,
 	logger *slog.Logger,
+	dialOpts ...grpc.DialOption,
 ) *Client {
 	return &Client{
 		serverAddr:    serverAddr,
 		syncInterval:  syncInterval,
 		runnerManager: runnerManager,
 		vmManager:     vmManager,
+		credentials:   credentials,
 		commandChan:   make(chan *agentv1.SyncResponse, 10),
 		logger:        logger,
+		dialOpts:      dialOpts,
+		syncNow:       make(chan struct{}, 1),
 	}
 }
 
 // Connect establishes connection to the server and registers the agent
-func (c *Client) Connect(ctx context.Context, hostname string, capacity *agentv1.AgentCapacity) error {
-	conn, err := grpc.NewClient(c.serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+// with reg
+func (c *Client) Connect(ctx context.Context, reg *agentv1.RegisterAgentRequest) error {
+	opts := append([]grpc.DialOption{grpc.WithStatsHandler(tracing.ClientHandler())}, c.dialOpts...)
+	if c.credentials != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(c.credentials.bearer))
+	}
+	conn, err := grpc.NewClient(c.serverAddr, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to connect to server: %w", err)
 	}
 	c.conn = conn
 	c.client = agentv1.NewAgentServiceClient(conn)
 
+	if c.credentials != nil {
+		enrolled, err := c.credentials.enroll(ctx, c.client, reg.Hostname)
+		if err != nil {
+			return err
+		}
+		if enrolled {
+			c.logger.Info("Agent enrolled",
+				"agent_id", c.credentials.agentID,
+				"credential_file", c.credentials.path,
+			)
+		}
+	}
+
 	// Register agent
-	resp, err := c.client.RegisterAgent(ctx, &agentv1.RegisterAgentRequest{
-		Hostname: hostname,
-		Capacity: capacity,
-	})
+	resp, err := c.client.RegisterAgent(ctx, reg)
 	if err != nil {
+		if c.credentials != nil && status.Code(err) == codes.PermissionDenied {
+			return fmt.Errorf("failed to register agent, remove %s and enroll with a new bootstrap token if it was revoked: %w", c.credentials.path, err)
+		}
 		return fmt.Errorf("failed to register agent: %w", err)
 	}
 
@@ -103,15 +141,16 @@ func (c *Client) Start(ctx context.Context) error {
 
 // receiveCommands receives commands from the server
 func (c *Client) receiveCommands(stream grpc.BidiStreamingClient[agentv1.SyncRequest, agentv1.SyncResponse]) {
+	logger := logging.FromContext(stream.Context(), c.logger)
 	for {
 		resp, err := stream.Recv()
 		if err == io.EOF {
-			c.logger.Info("Server closed the stream")
+			logger.Info("Server closed the stream")
 			close(c.commandChan)
 			return
 		}
 		if err != nil {
-			c.logger.Error("Error receiving from stream", "error", err)
+			logger.Error("Error receiving from stream", "error", err)
 			close(c.commandChan)
 			return
 		}
@@ -122,6 +161,7 @@ func (c *Client) receiveCommands(stream grpc.BidiStreamingClient[agentv1.SyncReq
 
 // periodicSync sends periodic status updates to the server
 func (c *Client) periodicSync(ctx context.Context, stream grpc.BidiStreamingClient[agentv1.SyncRequest, agentv1.SyncResponse]) {
+	logger := logging.FromContext(stream.Context(), c.logger)
 	ticker := time.NewTicker(c.syncInterval)
 	defer ticker.Stop()
 
@@ -131,7 +171,11 @@ func (c *Client) periodicSync(ctx context.Context, stream grpc.BidiStreamingClie
 			return
 		case <-ticker.C:
 			if err := c.sendSync(stream); err != nil {
-				c.logger.Error("Error sending sync", "error", err)
+				logger.Error("Error sending sync", "error", err)
+			}
+		case <-c.syncNow:
+			if err := c.sendSync(stream); err != nil {
+				logger.Error("Error sending sync", "error", err)
 			}
 		}
 	}
@@ -152,18 +196,42 @@ func (c *Client) sendSync(stream grpc.BidiStreamingClient[agentv1.SyncRequest, a
 			CreatedAt:        timestamppb.New(r.CreatedAt),
 			ErrorMessage:     r.ErrorMessage,
 			GuestRunnerState: r.GuestState,
+			Template:         r.Template,
 		}
 	}
 
+	c.logMu.Lock()
+	logs := c.pendingLogs
+	c.pendingLogs = nil
+	c.logMu.Unlock()
+
 	req := &agentv1.SyncRequest{
 		AgentId:       c.agentID,
 		ActiveRunners: uint32(c.runnerManager.Count()),
 		Runners:       protoRunners,
+		RunnerLogs:    logs,
+		Templates:     c.templates(),
 	}
 
 	return stream.Send(req)
 }
 
+// templates returns the valid versions of the agent's templates
+func (c *Client) templates() []*agentv1.Template {
+	all, err := c.vmManager.Templates().All()
+	if err != nil {
+		c.logger.Warn("Failed to list templates", "error", err)
+		return nil
+	}
+	var templates []*agentv1.Template
+	for _, t := range all {
+		if t.Err == nil {
+			templates = append(templates, t.Proto())
+		}
+	}
+	return templates
+}
+
 // SendImmediateSync sends an immediate sync (for state changes)
 func (c *Client) SendImmediateSync(ctx context.Context, stream grpc.BidiStreamingClient[agentv1.SyncRequest, agentv1.SyncResponse]) error {
 	return c.sendSync(stream)
@@ -194,6 +262,8 @@ func (c *Client) handleCommand(ctx context.Context, cmd *agentv1.SyncResponse) e
 		return c.handleCreateRunner(ctx, cmdType.CreateRunner)
 	case *agentv1.SyncResponse_DeleteRunner:
 		return c.handleDeleteRunner(ctx, cmdType.DeleteRunner)
+	case *agentv1.SyncResponse_GetRunnerLog:
+		return c.handleGetRunnerLog(cmdType.GetRunnerLog)
 	case *agentv1.SyncResponse_Noop:
 		// No operation
 		return nil
@@ -204,59 +274,87 @@ func (c *Client) handleCommand(ctx context.Context, cmd *agentv1.SyncResponse) e
 
 // handleCreateRunner handles a create runner command
 func (c *Client) handleCreateRunner(ctx context.Context, cmd *agentv1.CreateRunnerCommand) error {
+	// Continue the trace of the AddInstance request
+	ctx, span := tracer.Start(tracing.Extract(ctx, cmd.TraceContext), "agent.CreateRunner", trace.WithAttributes(
+		tracing.RunnerIDKey.String(cmd.RunnerId),
+		tracing.AgentIDKey.String(c.agentID),
+	))
+
 	// Create context with request_id for logging
 	ctx = logging.WithRequestID(ctx, cmd.RequestId)
-	logger := logging.FromContext(ctx, c.logger)
+	ctx = logging.WithLogger(ctx, logging.FromContext(ctx, c.logger))
+	logger := c.vmManager.Logger(ctx, cmd.RunnerId)
 
-	logger.Info("Creating runner",
-		"runner_id", cmd.RunnerId,
-		"runner_name", cmd.RunnerName,
-	)
+	logger.Info("Creating runner", "runner_name", cmd.RunnerName, "template", cmd.Template, "template_version", cmd.TemplateVersion)
 
 	// Create runner in manager
 	if err := c.runnerManager.Create(ctx, cmd.RunnerId, cmd.RunnerName, cmd.SetupScript); err != nil {
 		logger.Error("Failed to create runner", "error", err)
+		tracing.End(span, err)
 		return fmt.Errorf("failed to create runner: %w", err)
 	}
 
 	// Start runner creation in background
-	go c.createRunnerAsync(ctx, cmd.RunnerId, cmd.RunnerName, cmd.SetupScript)
+	go func() {
+		tracing.End(span, c.createRunnerAsync(ctx, cmd.RunnerId, vm.CreateOptions{
+			RunnerName:  cmd.RunnerName,
+			SetupScript: cmd.SetupScript,
+			Template:    cmd.Template,
+
+			TemplateVersion: cmd.TemplateVersion,
+		}))
+	}()
 
 	return nil
 }
 
-// createRunnerAsync creates a runner asynchronously
-func (c *Client) createRunnerAsync(ctx context.Context, runnerID, runnerName, setupScript string) {
-	logger := logging.FromContext(ctx, c.logger)
+// createRunnerAsync creates a runner asynchronously. The returned error has
+// already been recorded on the runner.
+func (c *Client) createRunnerAsync(ctx context.Context, runnerID string, opts vm.CreateOptions) (err error) {
+	logger := c.vmManager.Logger(ctx, runnerID)
+
+	// A failed runner keeps its bundle until it is deleted, but nothing
+	// logs to it any more
+	defer func() {
+		if err != nil {
+			c.vmManager.CloseLog(runnerID)
+		}
+	}()
 
 	// Update state: CREATING
 	if err := c.runnerManager.UpdateState(runnerID, agentv1.RunnerState_RUNNER_STATE_CREATING); err != nil {
-		logger.Error("Failed to update state to CREATING", "runner_id", runnerID, "error", err)
+		logger.Error("Failed to update state to CREATING", "error", err)
 	}
 
 	// Create VM
-	_, err := c.vmManager.Create(ctx, runnerID)
+	info, err := c.vmManager.Create(ctx, runnerID, opts)
 	if err != nil {
-		logger.Error("VM creation failed", "runner_id", runnerID, "error", err)
+		logger.Error("VM creation failed", "error", err)
 		if setErr := c.runnerManager.SetError(runnerID, fmt.Sprintf("VM creation failed: %v", err)); setErr != nil {
-			logger.Error("Failed to set error", "runner_id", runnerID, "error", setErr)
+			logger.Error("Failed to set error", "error", setErr)
 		}
-		return
+		return err
 	}
+	if err := c.runnerManager.SetTemplate(runnerID, info.Template.Proto()); err != nil {
+		logger.Warn("Failed to record template", "error", err)
+	}
+
+	// The bundle exists from here on, so the logger also writes to agent.log
+	logger = c.vmManager.Logger(ctx, runnerID)
 
 	// Update state: BOOTING
 	if err := c.runnerManager.UpdateState(runnerID, agentv1.RunnerState_RUNNER_STATE_BOOTING); err != nil {
-		logger.Error("Failed to update state to BOOTING", "runner_id", runnerID, "error", err)
+		logger.Error("Failed to update state to BOOTING", "error", err)
 	}
 
 	// Start VM
 	ipAddress, err := c.vmManager.Start(ctx, runnerID)
 	if err != nil {
-		logger.Error("VM start failed", "runner_id", runnerID, "error", err)
+		logger.Error("VM start failed", "error", err)
 		if setErr := c.runnerManager.SetError(runnerID, fmt.Sprintf("VM start failed: %v", err)); setErr != nil {
-			logger.Error("Failed to set error", "runner_id", runnerID, "error", setErr)
+			logger.Error("Failed to set error", "error", setErr)
 		}
-		return
+		return err
 	}
 
 	// Update runner IP address
@@ -266,68 +364,73 @@ func (c *Client) createRunnerAsync(ctx context.Context, runnerID, runnerName, se
 
 	// Wait for SSH
 	if err := c.vmManager.WaitForSSH(ctx, runnerID); err != nil {
-		logger.Error("SSH wait failed", "runner_id", runnerID, "error", err)
+		logger.Error("SSH wait failed", "error", err)
 		if setErr := c.runnerManager.SetError(runnerID, fmt.Sprintf("SSH wait failed: %v", err)); setErr != nil {
-			logger.Error("Failed to set error", "runner_id", runnerID, "error", setErr)
+			logger.Error("Failed to set error", "error", setErr)
 		}
-		return
+		return err
 	}
 
 	// Update state: SSH_READY
 	if err := c.runnerManager.UpdateState(runnerID, agentv1.RunnerState_RUNNER_STATE_SSH_READY); err != nil {
-		logger.Error("Failed to update state to SSH_READY", "runner_id", runnerID, "error", err)
+		logger.Error("Failed to update state to SSH_READY", "error", err)
 	}
-	logger.Info("Runner SSH ready", "runner_id", runnerID)
+	logger.Info("Runner SSH ready")
 
 	// Run setup script
-	if err := c.vmManager.RunSetupScript(ctx, runnerID, setupScript); err != nil {
-		logger.Error("Setup script failed", "runner_id", runnerID, "error", err)
+	if err := c.vmManager.RunSetupScript(ctx, runnerID, opts.SetupScript); err != nil {
+		logger.Error("Setup script failed", "error", err)
 		if setErr := c.runnerManager.SetError(runnerID, fmt.Sprintf("Setup script failed: %v", err)); setErr != nil {
-			logger.Error("Failed to set error", "runner_id", runnerID, "error", setErr)
+			logger.Error("Failed to set error", "error", setErr)
 		}
-		return
+		return err
 	}
 
 	// Update state: RUNNING
 	if err := c.runnerManager.UpdateState(runnerID, agentv1.RunnerState_RUNNER_STATE_RUNNING); err != nil {
-		logger.Error("Failed to update state to RUNNING", "runner_id", runnerID, "error", err)
+		logger.Error("Failed to update state to RUNNING", "error", err)
 	}
 
-	logger.Info("Runner is now running",
-		"runner_id", runnerID,
-		"ip_address", ipAddress,
-	)
+	logger.Info("Runner is now running", "ip_address", ipAddress)
+	return nil
 }
 
 // handleDeleteRunner handles a delete runner command
-func (c *Client) handleDeleteRunner(ctx context.Context, cmd *agentv1.DeleteRunnerCommand) error {
+func (c *Client) handleDeleteRunner(ctx context.Context, cmd *agentv1.DeleteRunnerCommand) (err error) {
+	ctx, span := tracer.Start(tracing.Extract(ctx, cmd.TraceContext), "agent.DeleteRunner", trace.WithAttributes(
+		tracing.RunnerIDKey.String(cmd.RunnerId),
+		tracing.AgentIDKey.String(c.agentID),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	// Create context with request_id for logging
 	ctx = logging.WithRequestID(ctx, cmd.RequestId)
-	logger := logging.FromContext(ctx, c.logger)
+	ctx = logging.WithLogger(ctx, logging.FromContext(ctx, c.logger))
+	logger := c.vmManager.Logger(ctx, cmd.RunnerId)
 
-	logger.Info("Deleting runner", "runner_id", cmd.RunnerId)
+	logger.Info("Deleting runner")
 
 	// Update state: TEARING_DOWN
 	if err := c.runnerManager.UpdateState(cmd.RunnerId, agentv1.RunnerState_RUNNER_STATE_TEARING_DOWN); err != nil {
-		logger.Error("Failed to update state to TEARING_DOWN", "runner_id", cmd.RunnerId, "error", err)
+		logger.Error("Failed to update state to TEARING_DOWN", "error", err)
 	}
 
 	// Stop VM
 	if err := c.vmManager.Stop(ctx, cmd.RunnerId); err != nil {
-		logger.Warn("Failed to stop VM", "runner_id", cmd.RunnerId, "error", err)
+		logger.Warn("Failed to stop VM", "error", err)
 		// Continue with deletion even if stop fails
 	}
 
 	// Delete VM
 	if err := c.vmManager.Delete(ctx, cmd.RunnerId); err != nil {
-		logger.Error("Failed to delete VM", "runner_id", cmd.RunnerId, "error", err)
+		logger.Error("Failed to delete VM", "error", err)
 		// Don't return error if bundle directory was already deleted
 		// This can happen if the VM was cleaned up externally
 		errMsg := err.Error()
 		if !strings.Contains(errMsg, "no such file") && !strings.Contains(errMsg, "not exist") {
 			return fmt.Errorf("failed to delete VM: %w", err)
 		}
-		logger.Warn("VM bundle already deleted, continuing", "runner_id", cmd.RunnerId)
+		logger.Warn("VM bundle already deleted, continuing")
 	}
 
 	// Remove from manager
@@ -335,14 +438,43 @@ func (c *Client) handleDeleteRunner(ctx context.Context, cmd *agentv1.DeleteRunn
 	if err := c.runnerManager.Delete(cmd.RunnerId); err != nil {
 		errMsg := err.Error()
 		if strings.Contains(errMsg, "not found") {
-			logger.Info("Runner already removed from manager", "runner_id", cmd.RunnerId)
+			logger.Info("Runner already removed from manager")
 		} else {
-			logger.Error("Failed to remove runner", "runner_id", cmd.RunnerId, "error", err)
+			logger.Error("Failed to remove runner", "error", err)
 			return fmt.Errorf("failed to remove runner: %w", err)
 		}
 	}
 
-	logger.Info("Runner deleted successfully", "runner_id", cmd.RunnerId)
+	logger.Info("Runner deleted successfully")
+	return nil
+}
+
+// handleGetRunnerLog reads the requested log and sends it with an immediate sync
+func (c *Client) handleGetRunnerLog(cmd *agentv1.GetRunnerLogCommand) error {
+	log := &agentv1.RunnerLog{
+		RequestId: cmd.RequestId,
+		RunnerId:  cmd.RunnerId,
+	}
+
+	switch cmd.Kind {
+	case agentv1.RunnerLogKind_RUNNER_LOG_KIND_CONSOLE:
+		content, err := c.vmManager.ReadConsoleLog(cmd.RunnerId, cmd.LimitBytes)
+		if err != nil {
+			log.ErrorMessage = err.Error()
+		}
+		log.Content = content
+	default:
+		log.ErrorMessage = fmt.Sprintf("unknown log kind: %v", cmd.Kind)
+	}
+
+	c.logMu.Lock()
+	c.pendingLogs = append(c.pendingLogs, log)
+	c.logMu.Unlock()
+
+	select {
+	case c.syncNow <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
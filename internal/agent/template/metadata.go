@@ -0,0 +1,152 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// MetadataFile describes a template version
+const MetadataFile = "TemplateMetadata.json"
+
+// MetadataSchemaVersion is the TemplateMetadata.json format this agent reads
+const MetadataSchemaVersion = 1
+
+// checksumPrefix is the only supported checksum algorithm
+const checksumPrefix = "sha256:"
+
+// RequiredFiles must be in every template and covered by its checksums
+var RequiredFiles = []string{"Disk.img", "AuxiliaryStorage", "HardwareModel.json"}
+
+// Metadata is the content of TemplateMetadata.json
+type Metadata struct {
+	SchemaVersion  int       `json:"schema_version"`
+	Name           string    `json:"name"`
+	Version        string    `json:"version"`
+	MacOSVersion   string    `json:"macos_version,omitempty"`
+	MacOSBuild     string    `json:"macos_build"`
+	MinCPUCount    uint      `json:"min_cpu_count,omitempty"`
+	MinMemoryBytes uint64    `json:"min_memory_bytes,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	Description    string    `json:"description,omitempty"`
+
+	// AuthorizedKey is the public key in authorized_keys format the guest
+	// accepts until a runner's own key replaces it
+	AuthorizedKey string `json:"authorized_key,omitempty"`
+
+	// Checksums maps file names in the template to "sha256:<hex>"
+	Checksums map[string]string `json:"checksums"`
+}
+
+// LoadMetadata reads the TemplateMetadata.json in dir. The error wraps
+// fs.ErrNotExist if there is none.
+func LoadMetadata(dir string) (*Metadata, error) {
+	data, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", MetadataFile, err)
+	}
+
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse %s: %v", model.ErrTemplateInvalid, MetadataFile, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Validate checks that the metadata is complete
+func (m *Metadata) Validate() error {
+	var problems []string
+	if m.SchemaVersion != MetadataSchemaVersion {
+		problems = append(problems, fmt.Sprintf("unsupported schema_version %d", m.SchemaVersion))
+	}
+	if m.Name == "" {
+		problems = append(problems, "name is empty")
+	}
+	if m.Version == "" {
+		problems = append(problems, "version is empty")
+	}
+	if m.MacOSBuild == "" {
+		problems = append(problems, "macos_build is empty")
+	}
+	if m.CreatedAt.IsZero() {
+		problems = append(problems, "created_at is not set")
+	}
+	if m.AuthorizedKey != "" {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(m.AuthorizedKey)); err != nil {
+			problems = append(problems, "authorized_key is not an SSH public key")
+		}
+	}
+	for _, f := range RequiredFiles {
+		if _, ok := m.Checksums[f]; !ok {
+			problems = append(problems, fmt.Sprintf("no checksum for %s", f))
+		}
+	}
+	for f, sum := range m.Checksums {
+		if f != filepath.Base(f) || strings.HasPrefix(f, ".") {
+			problems = append(problems, fmt.Sprintf("checksum for %q is not a file in the template", f))
+		}
+		hexSum, ok := strings.CutPrefix(sum, checksumPrefix)
+		if b, err := hex.DecodeString(hexSum); !ok || err != nil || len(b) != sha256.Size {
+			problems = append(problems, fmt.Sprintf("checksum for %s is not sha256:<hex>", f))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s: %s", model.ErrTemplateInvalid, MetadataFile, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// WriteMetadata computes the checksums of the required files in dir and
+// writes m to its TemplateMetadata.json
+func WriteMetadata(dir string, m *Metadata) error {
+	m.SchemaVersion = MetadataSchemaVersion
+	m.Checksums = make(map[string]string)
+	for _, f := range RequiredFiles {
+		sum, err := fileChecksum(filepath.Join(dir, f))
+		if err != nil {
+			return err
+		}
+		m.Checksums[f] = sum
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, MetadataFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", MetadataFile, err)
+	}
+	return nil
+}
+
+// fileChecksum returns the sha256:<hex> checksum of a file
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return checksumPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,184 @@
+// Package oci pushes template versions to and pulls them from an OCI
+// registry.
+//
+// A template version is stored as an OCI artifact. Its config is the
+// TemplateMetadata.json of the version, and each layer is a zstd-compressed
+// chunk of one of the files covered by the checksums in it:
+//
+//	config: application/vnd.shoes-vz.template.config.v1+json
+//	layers: application/vnd.shoes-vz.template.chunk.v1+zstd
+//	        annotated with the file, offset and uncompressed digest
+//
+// Chunks let a pull resume after the last chunk written and keep the
+// unchanged parts of a disk image from being uploaded again.
+package oci
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// ConfigMediaType is the media type of the TemplateMetadata.json config
+	ConfigMediaType types.MediaType = "application/vnd.shoes-vz.template.config.v1+json"
+
+	// ChunkMediaType is the media type of a compressed chunk of a file
+	ChunkMediaType types.MediaType = "application/vnd.shoes-vz.template.chunk.v1+zstd"
+
+	// DefaultChunkSize is the uncompressed size of a chunk
+	DefaultChunkSize = 256 << 20
+
+	// DefaultJobs is how many chunks are pulled at once
+	DefaultJobs = 4
+)
+
+// Layer annotations
+const (
+	annotationPrefix   = "io.github.whywaita.shoes-vz."
+	annotationFile     = annotationPrefix + "file"
+	annotationFileSize = annotationPrefix + "file-size"
+	annotationOffset   = annotationPrefix + "offset"
+	annotationSize     = annotationPrefix + "size"
+	annotationDigest   = annotationPrefix + "uncompressed-digest"
+)
+
+// Progress reports how far a push or pull is
+type Progress struct {
+	Chunks     int // Chunks done
+	Total      int
+	Bytes      int64 // Uncompressed bytes done
+	TotalBytes int64
+}
+
+// Option configures a push or pull
+type Option func(*options)
+
+type options struct {
+	insecure  bool
+	chunkSize int64
+	jobs      int
+	keychain  authn.Keychain
+	progress  func(Progress)
+}
+
+// Insecure allows talking to the registry over plain HTTP. Registries on
+// localhost are always allowed to.
+func Insecure() Option {
+	return func(o *options) {
+		o.insecure = true
+	}
+}
+
+// WithChunkSize sets the uncompressed size of the chunks a push splits
+// files into
+func WithChunkSize(n int64) Option {
+	return func(o *options) {
+		o.chunkSize = n
+	}
+}
+
+// WithJobs sets how many chunks a pull fetches at once
+func WithJobs(n int) Option {
+	return func(o *options) {
+		o.jobs = n
+	}
+}
+
+// WithKeychain sets where registry credentials come from. The default is
+// the Docker config, as written by docker login.
+func WithKeychain(k authn.Keychain) Option {
+	return func(o *options) {
+		o.keychain = k
+	}
+}
+
+// WithProgress calls f after each chunk
+func WithProgress(f func(Progress)) Option {
+	return func(o *options) {
+		o.progress = f
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		chunkSize: DefaultChunkSize,
+		jobs:      DefaultJobs,
+		keychain:  authn.DefaultKeychain,
+		progress:  func(Progress) {},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *options) nameOptions(defaultTag string) []name.Option {
+	opts := []name.Option{name.WithDefaultTag(defaultTag)}
+	if o.insecure {
+		opts = append(opts, name.Insecure)
+	}
+	return opts
+}
+
+func (o *options) remoteOptions(ctx context.Context) []remote.Option {
+	return []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(o.keychain),
+	}
+}
+
+// chunk is a layer of the artifact
+type chunk struct {
+	index    int
+	desc     v1.Descriptor
+	file     string
+	fileSize int64
+	offset   int64
+	size     int64
+	digest   v1.Hash // Of the uncompressed chunk
+}
+
+func chunkAnnotations(file string, fileSize, offset, size int64, digest v1.Hash) map[string]string {
+	return map[string]string{
+		annotationFile:     file,
+		annotationFileSize: strconv.FormatInt(fileSize, 10),
+		annotationOffset:   strconv.FormatInt(offset, 10),
+		annotationSize:     strconv.FormatInt(size, 10),
+		annotationDigest:   digest.String(),
+	}
+}
+
+func parseChunk(index int, desc v1.Descriptor) (*chunk, error) {
+	if desc.MediaType != ChunkMediaType {
+		return nil, fmt.Errorf("layer %d has media type %q, want %q", index, desc.MediaType, ChunkMediaType)
+	}
+	c := &chunk{index: index, desc: desc, file: desc.Annotations[annotationFile]}
+	if c.file == "" {
+		return nil, fmt.Errorf("layer %d names no file", index)
+	}
+
+	var err error
+	for key, v := range map[string]*int64{
+		annotationFileSize: &c.fileSize,
+		annotationOffset:   &c.offset,
+		annotationSize:     &c.size,
+	} {
+		if *v, err = strconv.ParseInt(desc.Annotations[key], 10, 64); err != nil || *v < 0 {
+			return nil, fmt.Errorf("layer %d has an invalid %s annotation", index, key)
+		}
+	}
+	if c.offset+c.size > c.fileSize {
+		return nil, fmt.Errorf("layer %d ends past the end of %s", index, c.file)
+	}
+	if c.digest, err = v1.NewHash(desc.Annotations[annotationDigest]); err != nil {
+		return nil, fmt.Errorf("layer %d has an invalid %s annotation: %w", index, annotationDigest, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,330 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+)
+
+const testChunkSize = 64 << 10
+
+// testBlobs keeps blobs in memory, counting and optionally corrupting the
+// ones it serves
+type testBlobs struct {
+	mem registry.BlobHandler
+
+	mu      sync.Mutex
+	gets    map[v1.Hash]int
+	corrupt map[v1.Hash]bool
+}
+
+func newTestRegistry(t *testing.T) (string, *testBlobs) {
+	t.Helper()
+	blobs := &testBlobs{
+		mem:     registry.NewInMemoryBlobHandler(),
+		gets:    make(map[v1.Hash]int),
+		corrupt: make(map[v1.Hash]bool),
+	}
+	srv := httptest.NewServer(registry.New(registry.WithBlobHandler(blobs), registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://") + "/templates/macos-15", blobs
+}
+
+func (b *testBlobs) Get(ctx context.Context, repo string, h v1.Hash) (io.ReadCloser, error) {
+	b.mu.Lock()
+	b.gets[h]++
+	corrupt := b.corrupt[h]
+	b.mu.Unlock()
+
+	rc, err := b.mem.Get(ctx, repo, h)
+	if err != nil || !corrupt {
+		return rc, err
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	data[len(data)/2] ^= 0xff
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *testBlobs) Stat(ctx context.Context, repo string, h v1.Hash) (int64, error) {
+	return b.mem.(registry.BlobStatHandler).Stat(ctx, repo, h)
+}
+
+func (b *testBlobs) Put(ctx context.Context, repo string, h v1.Hash, rc io.ReadCloser) error {
+	return b.mem.(registry.BlobPutHandler).Put(ctx, repo, h, rc)
+}
+
+func (b *testBlobs) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gets = make(map[v1.Hash]int)
+	b.corrupt = make(map[v1.Hash]bool)
+}
+
+// newTestTemplate writes a template version with metadata. Disk.img has
+// runs of zeros and spans several chunks.
+func newTestTemplate(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "macos-15", "2025.02.01")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var disk []byte
+	for _, random := range []bool{true, false, true, false, true} {
+		part := make([]byte, testChunkSize)
+		if random {
+			_, _ = rand.Read(part)
+		}
+		disk = append(disk, part...)
+	}
+	disk = append(disk, []byte("tail")...)
+	aux := make([]byte, 1000)
+	_, _ = rand.Read(aux)
+	for file, data := range map[string][]byte{
+		"Disk.img":           disk,
+		"AuxiliaryStorage":   aux,
+		"HardwareModel.json": []byte(`{"hardwareModel":"test"}`),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := template.WriteMetadata(dir, &template.Metadata{
+		Name:       "macos-15",
+		Version:    "2025.02.01",
+		MacOSBuild: "24C101",
+		CreatedAt:  time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func assertSameFiles(t *testing.T, want, got string) {
+	t.Helper()
+	for _, f := range append(template.RequiredFiles, template.MetadataFile) {
+		w, err := os.ReadFile(filepath.Join(want, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := os.ReadFile(filepath.Join(got, f))
+		if err != nil {
+			t.Fatalf("pulled template has no %s: %v", f, err)
+		}
+		if !bytes.Equal(w, g) {
+			t.Errorf("pulled %s differs from the pushed one", f)
+		}
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	src := newTestTemplate(t)
+	ref, blobs := newTestRegistry(t)
+	ctx := context.Background()
+
+	digest, err := Push(ctx, src, ref, WithChunkSize(testChunkSize))
+	if err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		t.Errorf("Push() = %v, want a sha256 digest", digest)
+	}
+
+	var last Progress
+	templatesDir := t.TempDir()
+	got, err := Pull(ctx, ref+":2025.02.01", templatesDir, WithProgress(func(p Progress) { last = p }))
+	if err != nil {
+		t.Fatalf("Pull() error = %v", err)
+	}
+	want := filepath.Join(templatesDir, "macos-15", "2025.02.01")
+	if got.String() != "macos-15@2025.02.01" || got.Path != want {
+		t.Errorf("Pull() = %v at %s, want macos-15@2025.02.01 at %s", got, got.Path, want)
+	}
+	assertSameFiles(t, src, want)
+	if last.Chunks != last.Total || last.Bytes != last.TotalBytes || last.Total != 8 {
+		t.Errorf("last progress = %+v, want 8 of 8 chunks", last)
+	}
+
+	// The pulled version is served by the store
+	resolved, err := template.NewStore(templatesDir, "").Resolve("macos-15")
+	if err != nil {
+		t.Fatalf("Resolve() of the pulled template error = %v", err)
+	}
+	if resolved.Metadata == nil || resolved.Metadata.MacOSBuild != "24C101" {
+		t.Errorf("Resolve() metadata = %+v, want macOS build 24C101", resolved.Metadata)
+	}
+
+	// Pulling it again fetches no chunks
+	blobs.reset()
+	if _, err := Pull(ctx, ref+":2025.02.01", templatesDir); err != nil {
+		t.Fatalf("Pull() of a pulled template error = %v", err)
+	}
+	if n := len(blobs.gets); n != 1 {
+		t.Errorf("Pull() of a pulled template fetched %d blobs, want only the config", n)
+	}
+}
+
+func TestPull_Resume(t *testing.T) {
+	src := newTestTemplate(t)
+	ref, blobs := newTestRegistry(t)
+	ctx := context.Background()
+	if _, err := Push(ctx, src, ref, WithChunkSize(testChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks are AuxiliaryStorage, 6 of Disk.img, then HardwareModel.json;
+	// break the third of Disk.img
+	chunks := chunkDigests(t, src)
+	blobs.corrupt[chunks[3]] = true
+
+	templatesDir := t.TempDir()
+	if _, err := Pull(ctx, ref+":2025.02.01", templatesDir, WithJobs(1)); err == nil {
+		t.Fatal("Pull() of a corrupted chunk error = nil, want error")
+	}
+	if _, err := os.Stat(filepath.Join(templatesDir, "macos-15", "2025.02.01")); !os.IsNotExist(err) {
+		t.Fatalf("failed Pull() left the version in place: %v", err)
+	}
+	if _, err := template.NewStore(templatesDir, "").Resolve("macos-15"); err == nil {
+		t.Error("Resolve() of an unfinished pull error = nil, want error")
+	}
+
+	blobs.reset()
+	if _, err := Pull(ctx, ref+":2025.02.01", templatesDir, WithJobs(1)); err != nil {
+		t.Fatalf("resumed Pull() error = %v", err)
+	}
+	gets := 0
+	for h, n := range blobs.gets {
+		if slices.Contains(chunks, h) {
+			gets += n
+		}
+	}
+	if gets != 5 || blobs.gets[chunks[0]] != 0 || blobs.gets[chunks[1]] != 0 {
+		t.Errorf("resumed Pull() fetched chunks %v, want only the 5 from the broken one on", blobs.gets)
+	}
+	assertSameFiles(t, src, filepath.Join(templatesDir, "macos-15", "2025.02.01"))
+}
+
+func TestPull_DigestMismatch(t *testing.T) {
+	src := newTestTemplate(t)
+	ref, blobs := newTestRegistry(t)
+	ctx := context.Background()
+	if _, err := Push(ctx, src, ref, WithChunkSize(testChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	chunks := chunkDigests(t, src)
+	blobs.corrupt[chunks[len(chunks)-1]] = true
+
+	templatesDir := t.TempDir()
+	_, err := Pull(ctx, ref+":2025.02.01", templatesDir)
+	if err == nil {
+		t.Fatal("Pull() of a corrupted chunk error = nil, want error")
+	}
+	if _, err := os.Stat(filepath.Join(templatesDir, "macos-15", "2025.02.01")); !os.IsNotExist(err) {
+		t.Errorf("failed Pull() left the version in place: %v", err)
+	}
+}
+
+func TestPush_ChecksumMismatch(t *testing.T) {
+	src := newTestTemplate(t)
+	ref, _ := newTestRegistry(t)
+	if err := os.WriteFile(filepath.Join(src, "HardwareModel.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(context.Background(), src, ref, WithChunkSize(testChunkSize)); err == nil {
+		t.Error("Push() of a modified template error = nil, want error")
+	}
+}
+
+// chunkDigests returns the digests of the chunks Push makes of the
+// template in dir, in manifest order
+func chunkDigests(t *testing.T, dir string) []v1.Hash {
+	t.Helper()
+	var digests []v1.Hash
+	for _, f := range []string{"AuxiliaryStorage", "Disk.img", "HardwareModel.json"} {
+		data, err := os.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for off := 0; off < len(data); off += testChunkSize {
+			l, err := compressChunk(bytes.NewReader(data[off:min(off+testChunkSize, len(data))]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = os.Remove(l.path)
+			digests = append(digests, l.digest)
+		}
+	}
+	return digests
+}
+
+type recordingWriter struct {
+	writes [][2]int64 // offset, length
+}
+
+func (w *recordingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.writes = append(w.writes, [2]int64{off, int64(len(p))})
+	return len(p), nil
+}
+
+func TestWriteChunk(t *testing.T) {
+	data := make([]byte, 4*sparseBlock+10)
+	data[sparseBlock] = 1                 // Second block
+	data[2*sparseBlock+sparseBlock/2] = 1 // Third block, adjacent
+	data[len(data)-1] = 1                 // Partial last block
+
+	tests := []struct {
+		name   string
+		sparse bool
+		want   [][2]int64
+	}{
+		{
+			name:   "sparse",
+			sparse: true,
+			want:   [][2]int64{{100 + sparseBlock, 2 * sparseBlock}, {100 + 4*sparseBlock, 10}},
+		},
+		{
+			name: "dense",
+			want: [][2]int64{{100, int64(len(data))}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &recordingWriter{}
+			n, err := writeChunk(w, 100, bytes.NewReader(data), tt.sparse)
+			if err != nil {
+				t.Fatalf("writeChunk() error = %v", err)
+			}
+			if n != int64(len(data)) {
+				t.Errorf("writeChunk() = %d, want %d", n, len(data))
+			}
+			if len(w.writes) != len(tt.want) {
+				t.Fatalf("writeChunk() wrote %v, want %v", w.writes, tt.want)
+			}
+			for i := range tt.want {
+				if w.writes[i] != tt.want[i] {
+					t.Errorf("write %d = %v, want %v", i, w.writes[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
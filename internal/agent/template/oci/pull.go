@@ -0,0 +1,423 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// pullStateFile records which chunks an unfinished pull has written
+const pullStateFile = "PullState.json"
+
+// sparseBlock is the size of the zero blocks left as holes in pulled files
+const sparseBlock = 4096
+
+type pullState struct {
+	Manifest string `json:"manifest"`
+	Started  []int  `json:"started"`
+	Done     []int  `json:"done"`
+}
+
+// Pull downloads the template version at ref into templatesDir as
+// <name>/<version>, as named by its metadata, and returns it. The version
+// is not activated.
+//
+// Chunks are written to a hidden directory next to the version and checked
+// against the digests in the manifest, leaving runs of zeros as holes. Once
+// every file matches its checksum the directory is renamed into place. An
+// interrupted pull resumes after the chunks it wrote.
+func Pull(ctx context.Context, ref, templatesDir string, opts ...Option) (*template.Template, error) {
+	o := newOptions(opts)
+	if o.jobs <= 0 {
+		return nil, fmt.Errorf("jobs must be positive, got %d", o.jobs)
+	}
+	r, err := name.ParseReference(ref, o.nameOptions(name.DefaultTag)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	ropts := o.remoteOptions(ctx)
+
+	desc, err := remote.Get(r, ropts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest of %s: %w", r, err)
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s: %w", r, err)
+	}
+	if manifest.Config.MediaType != ConfigMediaType {
+		return nil, fmt.Errorf("%s is not a template: config has media type %q", r, manifest.Config.MediaType)
+	}
+
+	config, m, err := pullMetadata(r.Context(), manifest.Config, ropts)
+	if err != nil {
+		return nil, err
+	}
+	chunks, sizes, err := parseChunks(manifest, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", r, err)
+	}
+
+	t := &template.Template{
+		Name:     m.Name,
+		Version:  m.Version,
+		Path:     filepath.Join(templatesDir, m.Name, m.Version),
+		Metadata: m,
+	}
+	if existing, err := template.LoadMetadata(t.Path); err == nil {
+		if !maps.Equal(existing.Checksums, m.Checksums) {
+			return nil, fmt.Errorf("%s already exists with other files", t)
+		}
+		return t, nil
+	} else if _, statErr := os.Stat(t.Path); !os.IsNotExist(statErr) {
+		return nil, fmt.Errorf("%s already exists: %w", t, err)
+	}
+
+	partial := filepath.Join(templatesDir, m.Name, ".pull-"+m.Version)
+	state, err := loadPullState(partial, desc.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*os.File, len(sizes))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for file, size := range sizes {
+		f, err := os.OpenFile(filepath.Join(partial, file), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", file, err)
+		}
+		files[file] = f
+		// Growing the file leaves a hole for the chunks to fill
+		if err := f.Truncate(size); err != nil {
+			return nil, fmt.Errorf("failed to size %s: %w", file, err)
+		}
+	}
+
+	if err := pullChunks(ctx, r.Context(), chunks, files, partial, state, o, ropts); err != nil {
+		return nil, err
+	}
+
+	for file, f := range files {
+		if err := f.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync %s: %w", file, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(partial, template.MetadataFile), config, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", template.MetadataFile, err)
+	}
+	pulled := *t
+	pulled.Path = partial
+	if err := template.NewStore(templatesDir, "").Verify(&pulled); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(filepath.Join(partial, pullStateFile)); err != nil {
+		return nil, fmt.Errorf("failed to remove %s: %w", pullStateFile, err)
+	}
+	if err := os.Rename(partial, t.Path); err != nil {
+		return nil, fmt.Errorf("failed to move %s into place: %w", t, err)
+	}
+	return t, nil
+}
+
+// pullMetadata downloads and checks the TemplateMetadata.json config
+func pullMetadata(repo name.Repository, desc v1.Descriptor, ropts []remote.Option) ([]byte, *template.Metadata, error) {
+	l, err := remote.Layer(repo.Digest(desc.Digest.String()), ropts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get config: %w", err)
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get config: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+	config, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var m template.Metadata
+	if err := json.Unmarshal(config, &m); err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to parse %s: %v", model.ErrTemplateInvalid, template.MetadataFile, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, nil, err
+	}
+	for _, s := range []string{m.Name, m.Version} {
+		if s != filepath.Base(s) || strings.HasPrefix(s, ".") {
+			return nil, nil, fmt.Errorf("%w: %s: %q is not a valid directory name", model.ErrTemplateInvalid, template.MetadataFile, s)
+		}
+	}
+	return config, &m, nil
+}
+
+// parseChunks returns the chunks of the manifest and the size of each file
+// covered by the checksums in m
+func parseChunks(manifest *v1.Manifest, m *template.Metadata) ([]*chunk, map[string]int64, error) {
+	sizes := make(map[string]int64, len(m.Checksums))
+	for file := range m.Checksums {
+		sizes[file] = 0
+	}
+
+	chunks := make([]*chunk, 0, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		c, err := parseChunk(i, desc)
+		if err != nil {
+			return nil, nil, err
+		}
+		size, ok := sizes[c.file]
+		if !ok {
+			return nil, nil, fmt.Errorf("layer %d is of %s, which has no checksum", i, c.file)
+		}
+		if size != 0 && size != c.fileSize {
+			return nil, nil, fmt.Errorf("layers give %s different sizes", c.file)
+		}
+		sizes[c.file] = c.fileSize
+		chunks = append(chunks, c)
+	}
+	return chunks, sizes, nil
+}
+
+// pullChunks writes the chunks that state does not have yet to files
+func pullChunks(ctx context.Context, repo name.Repository, chunks []*chunk, files map[string]*os.File, partial string, state *pullState, o *options, ropts []remote.Option) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ropts = append(slices.Clone(ropts), remote.WithContext(ctx))
+
+	p := Progress{Total: len(chunks)}
+	var todo []*chunk
+	for _, c := range chunks {
+		p.TotalBytes += c.size
+		if slices.Contains(state.Done, c.index) {
+			p.Chunks++
+			p.Bytes += c.size
+			continue
+		}
+		todo = append(todo, c)
+	}
+	o.progress(p)
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	update := func(f func()) error {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+		return state.save(partial)
+	}
+
+	jobs := make(chan *chunk)
+	for i := 0; i < o.jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				// A chunk that was being written when a pull stopped may have
+				// left data where this one has zeros
+				sparse := true
+				if err := update(func() {
+					sparse = !slices.Contains(state.Started, c.index)
+					state.Started = append(state.Started, c.index)
+				}); err != nil {
+					fail(err)
+					continue
+				}
+				if err := pullChunk(repo, c, files[c.file], sparse, ropts); err != nil {
+					fail(err)
+					continue
+				}
+				if err := update(func() {
+					state.Done = append(state.Done, c.index)
+					p.Chunks++
+					p.Bytes += c.size
+					o.progress(p)
+				}); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, c := range todo {
+		select {
+		case jobs <- c:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// pullChunk downloads a chunk, decompresses it into f and checks both
+// digests
+func pullChunk(repo name.Repository, c *chunk, f *os.File, sparse bool, ropts []remote.Option) error {
+	l, err := remote.Layer(repo.Digest(c.desc.Digest.String()), ropts...)
+	if err != nil {
+		return fmt.Errorf("failed to get %s at %d: %w", c.file, c.offset, err)
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return fmt.Errorf("failed to get %s at %d: %w", c.file, c.offset, err)
+	}
+	defer func() { _ = rc.Close() }()
+	zr, err := zstd.NewReader(rc)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s at %d: %w", c.file, c.offset, err)
+	}
+	defer zr.Close()
+
+	h := sha256.New()
+	n, err := writeChunk(f, c.offset, io.TeeReader(io.LimitReader(zr, c.size+1), h), sparse)
+	if err != nil {
+		return fmt.Errorf("failed to write %s at %d: %w", c.file, c.offset, err)
+	}
+	// The digest of the compressed chunk is checked once it is read to
+	// the end
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return fmt.Errorf("failed to read %s at %d: %w", c.file, c.offset, err)
+	}
+	if n != c.size {
+		return fmt.Errorf("chunk of %s at %d has %d bytes, want %d", c.file, c.offset, n, c.size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != c.digest.Hex {
+		return fmt.Errorf("chunk of %s at %d does not match its digest %s", c.file, c.offset, c.digest)
+	}
+	return nil
+}
+
+// writeChunk writes r to w at off and returns the number of bytes read.
+// If sparse is set, blocks of zeros are skipped and left as holes.
+func writeChunk(w io.WriterAt, off int64, r io.Reader, sparse bool) (int64, error) {
+	buf := make([]byte, 1<<20)
+	var n int64
+	for {
+		m, err := io.ReadFull(r, buf)
+		if m > 0 {
+			if werr := writeNonZero(w, off+n, buf[:m], sparse); werr != nil {
+				return n, werr
+			}
+			n += int64(m)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+var zeroBlock = make([]byte, sparseBlock)
+
+// writeNonZero writes the runs of b that are not whole zero blocks
+func writeNonZero(w io.WriterAt, off int64, b []byte, sparse bool) error {
+	if !sparse {
+		_, err := w.WriteAt(b, off)
+		return err
+	}
+	isZero := func(start int) (bool, int) {
+		end := min(start+sparseBlock, len(b))
+		return bytes.Equal(b[start:end], zeroBlock[:end-start]), end
+	}
+
+	for start := 0; start < len(b); {
+		zero, end := isZero(start)
+		if zero {
+			start = end
+			continue
+		}
+		for end < len(b) {
+			zero, next := isZero(end)
+			if zero {
+				break
+			}
+			end = next
+		}
+		if _, err := w.WriteAt(b[start:end], off+int64(start)); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// loadPullState returns the state of the pull into partial, starting over
+// if it was of another manifest
+func loadPullState(partial, manifest string) (*pullState, error) {
+	var state pullState
+	data, err := os.ReadFile(filepath.Join(partial, pullStateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err == nil && state.Manifest == manifest {
+		return &state, nil
+	}
+
+	if err := os.RemoveAll(partial); err != nil {
+		return nil, fmt.Errorf("failed to remove unfinished pull: %w", err)
+	}
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", partial, err)
+	}
+	state = pullState{Manifest: manifest}
+	if err := state.save(partial); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// save replaces the state file atomically
+func (s *pullState) save(partial string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode pull state: %w", err)
+	}
+	tmp := filepath.Join(partial, "."+pullStateFile)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write pull state: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(partial, pullStateFile)); err != nil {
+		return fmt.Errorf("failed to write pull state: %w", err)
+	}
+	return nil
+}
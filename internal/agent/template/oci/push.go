@@ -0,0 +1,241 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+)
+
+// Push uploads the template version in dir to ref and returns the digest
+// of the manifest. The version must have a TemplateMetadata.json, and its
+// files must match the checksums in it. ref is tagged with the version
+// unless it has a tag. Chunks already in the repository are not uploaded
+// again, so an interrupted push can be run again.
+func Push(ctx context.Context, dir, ref string, opts ...Option) (string, error) {
+	o := newOptions(opts)
+	if o.chunkSize <= 0 {
+		return "", fmt.Errorf("chunk size must be positive, got %d", o.chunkSize)
+	}
+
+	m, err := template.LoadMetadata(dir)
+	if err != nil {
+		return "", err
+	}
+	config, err := os.ReadFile(filepath.Join(dir, template.MetadataFile))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", template.MetadataFile, err)
+	}
+	r, err := name.ParseReference(ref, o.nameOptions(m.Version)...)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	ropts := o.remoteOptions(ctx)
+
+	files := make([]string, 0, len(m.Checksums))
+	var total int64
+	for f := range m.Checksums {
+		info, err := os.Stat(filepath.Join(dir, f))
+		if err != nil {
+			return "", fmt.Errorf("failed to stat %s: %w", f, err)
+		}
+		files = append(files, f)
+		total += info.Size()
+	}
+	sort.Strings(files)
+
+	p := Progress{Total: chunkCount(dir, files, o.chunkSize), TotalBytes: total}
+	var layers []v1.Descriptor
+	for _, f := range files {
+		descs, err := pushFile(r.Context(), filepath.Join(dir, f), m.Checksums[f], o, ropts, &p)
+		if err != nil {
+			return "", err
+		}
+		layers = append(layers, descs...)
+	}
+
+	configLayer := static.NewLayer(config, ConfigMediaType)
+	if err := remote.WriteLayer(r.Context(), configLayer, ropts...); err != nil {
+		return "", fmt.Errorf("failed to upload config: %w", err)
+	}
+	configDigest, err := configLayer.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	manifest, err := json.Marshal(&v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: ConfigMediaType,
+			Size:      int64(len(config)),
+			Digest:    configDigest,
+		},
+		Layers: layers,
+		Annotations: map[string]string{
+			"org.opencontainers.image.title":   m.Name,
+			"org.opencontainers.image.version": m.Version,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := remote.Put(r, rawManifest(manifest), ropts...); err != nil {
+		return "", fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	sum := sha256.Sum256(manifest)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// pushFile uploads the chunks of the file at path and checks that it has
+// the checksum want
+func pushFile(repo name.Repository, path, want string, o *options, ropts []remote.Option, p *Progress) ([]v1.Descriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	file := filepath.Base(path)
+	h := sha256.New()
+	var descs []v1.Descriptor
+	for offset := int64(0); offset < info.Size(); offset += o.chunkSize {
+		size := min(o.chunkSize, info.Size()-offset)
+		l, err := compressChunk(io.TeeReader(io.NewSectionReader(f, offset, size), h))
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress %s at %d: %w", file, offset, err)
+		}
+		err = remote.WriteLayer(repo, l, ropts...)
+		_ = os.Remove(l.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload %s at %d: %w", file, offset, err)
+		}
+
+		descs = append(descs, v1.Descriptor{
+			MediaType:   ChunkMediaType,
+			Size:        l.size,
+			Digest:      l.digest,
+			Annotations: chunkAnnotations(file, info.Size(), offset, size, l.diffID),
+		})
+		p.Chunks++
+		p.Bytes += size
+		o.progress(*p)
+	}
+
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != want {
+		return nil, fmt.Errorf("%s does not match the checksum in %s", file, template.MetadataFile)
+	}
+	return descs, nil
+}
+
+func chunkCount(dir string, files []string, chunkSize int64) int {
+	n := 0
+	for _, f := range files {
+		if info, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			n += int((info.Size() + chunkSize - 1) / chunkSize)
+		}
+	}
+	return n
+}
+
+// chunkLayer is a compressed chunk kept in a temporary file until it is
+// uploaded
+type chunkLayer struct {
+	path   string
+	size   int64
+	digest v1.Hash
+	diffID v1.Hash
+}
+
+// compressChunk compresses r into a temporary file
+func compressChunk(r io.Reader) (*chunkLayer, error) {
+	tmp, err := os.CreateTemp("", "shoes-vz-chunk-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tmp.Close() }()
+
+	compressed := sha256.New()
+	uncompressed := sha256.New()
+	zw, err := zstd.NewWriter(io.MultiWriter(tmp, compressed))
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	if _, err := io.Copy(zw, io.TeeReader(r, uncompressed)); err != nil {
+		_ = zw.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return &chunkLayer{
+		path:   tmp.Name(),
+		size:   size,
+		digest: v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(compressed.Sum(nil))},
+		diffID: v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(uncompressed.Sum(nil))},
+	}, nil
+}
+
+func (l *chunkLayer) Digest() (v1.Hash, error)            { return l.digest, nil }
+func (l *chunkLayer) DiffID() (v1.Hash, error)            { return l.diffID, nil }
+func (l *chunkLayer) Size() (int64, error)                { return l.size, nil }
+func (l *chunkLayer) MediaType() (types.MediaType, error) { return ChunkMediaType, nil }
+func (l *chunkLayer) Compressed() (io.ReadCloser, error)  { return os.Open(l.path) }
+
+func (l *chunkLayer) Uncompressed() (io.ReadCloser, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &zstdReadCloser{Decoder: zr, f: f}, nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+	f io.Closer
+}
+
+func (r *zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.f.Close()
+}
+
+// rawManifest lets remote.Put upload an OCI manifest as is
+type rawManifest []byte
+
+func (m rawManifest) RawManifest() ([]byte, error) { return bytes.Clone(m), nil }
+
+func (m rawManifest) MediaType() (types.MediaType, error) { return types.OCIManifestSchema1, nil }
@@ -0,0 +1,222 @@
+package template
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// Files of a Tart VM directory
+const (
+	tartConfigFile = "config.json"
+	tartDiskFile   = "disk.img"
+	tartNVRAMFile  = "nvram.bin"
+	tartSocketFile = "control.sock"
+)
+
+// tartConfig is the part of a Tart config.json a template is built from
+type tartConfig struct {
+	Version       int    `json:"version"`
+	OS            string `json:"os"`
+	Arch          string `json:"arch"`
+	HardwareModel string `json:"hardwareModel"`
+	DiskFormat    string `json:"diskFormat"`
+}
+
+// hardwareModelFile is the content of HardwareModel.json
+type hardwareModelFile struct {
+	HardwareModel string `json:"hardwareModel"`
+}
+
+// ImportTart creates the template version dir from the stopped Tart VM in
+// src: disk.img becomes Disk.img, nvram.bin AuxiliaryStorage, and the
+// hardware model in config.json HardwareModel.json. m is written as its
+// TemplateMetadata.json. The minimum CPU and memory are not taken from the
+// VM: Tart records the host's limits there, which are more than runner VMs
+// get. Files are cloned where the file system allows it. dir must
+// not exist; it only appears once the template is complete.
+func ImportTart(src, dir string, m *Metadata) error {
+	config, err := loadTartConfig(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{tartDiskFile, tartNVRAMFile} {
+		info, err := os.Stat(filepath.Join(src, f))
+		if err != nil {
+			return fmt.Errorf("%w: Tart VM %s: %v", model.ErrTemplateInvalid, src, err)
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return fmt.Errorf("%w: Tart VM %s: %s is empty or not a file", model.ErrTemplateInvalid, src, f)
+		}
+	}
+	if tartRunning(src) {
+		return fmt.Errorf("the Tart VM in %s is running, stop it with tart stop first", src)
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to check %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(dir), err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".import-"+filepath.Base(dir)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+
+	if err := cloneFile(filepath.Join(src, tartDiskFile), filepath.Join(tmp, diskFile)); err != nil {
+		return err
+	}
+	if err := cloneFile(filepath.Join(src, tartNVRAMFile), filepath.Join(tmp, "AuxiliaryStorage")); err != nil {
+		return err
+	}
+	hw, err := json.MarshalIndent(hardwareModelFile{HardwareModel: config.HardwareModel}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode hardware model: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "HardwareModel.json"), append(hw, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write HardwareModel.json: %w", err)
+	}
+
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	if err := WriteMetadata(tmp, m); err != nil {
+		return err
+	}
+	if err := validateImport(tmp, m); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		return fmt.Errorf("failed to move template into place: %w", err)
+	}
+	return nil
+}
+
+// loadTartConfig reads and checks the config.json of the Tart VM in dir
+func loadTartConfig(dir string) (*tartConfig, error) {
+	data, err := os.ReadFile(filepath.Join(dir, tartConfigFile))
+	if err != nil {
+		return nil, fmt.Errorf("%w: Tart VM %s: %v", model.ErrTemplateInvalid, dir, err)
+	}
+	var c tartConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%w: Tart VM %s: failed to parse %s: %v", model.ErrTemplateInvalid, dir, tartConfigFile, err)
+	}
+
+	// Configs written before Tart supported Linux have no os and arch
+	switch {
+	case c.OS != "" && c.OS != "darwin":
+		return nil, fmt.Errorf("%w: Tart VM %s runs %s, only macOS VMs can be imported", model.ErrTemplateInvalid, dir, c.OS)
+	case c.Arch != "" && c.Arch != "arm64":
+		return nil, fmt.Errorf("%w: Tart VM %s is %s, only arm64 VMs can be imported", model.ErrTemplateInvalid, dir, c.Arch)
+	case c.DiskFormat != "" && c.DiskFormat != "raw":
+		return nil, fmt.Errorf("%w: Tart VM %s has a %s disk, only raw disks can be imported", model.ErrTemplateInvalid, dir, c.DiskFormat)
+	}
+	if err := checkHardwareModel(c.HardwareModel); err != nil {
+		return nil, fmt.Errorf("%w: Tart VM %s: %v", model.ErrTemplateInvalid, dir, err)
+	}
+	return &c, nil
+}
+
+// checkHardwareModel checks that s is a base64 encoded hardware model.
+// Virtualization.framework stores it as a binary property list.
+func checkHardwareModel(s string) error {
+	if s == "" {
+		return fmt.Errorf("no hardwareModel")
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("hardwareModel is not base64: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("bplist00")) {
+		return fmt.Errorf("hardwareModel is not a property list")
+	}
+	return nil
+}
+
+// tartRunning reports whether Tart is serving the control socket of the VM
+// in dir. A socket left behind by a VM that was killed refuses connections.
+func tartRunning(dir string) bool {
+	conn, err := net.DialTimeout("unix", filepath.Join(dir, tartSocketFile), time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// validateImport checks the imported template in dir as the agent would
+// before cloning it
+func validateImport(dir string, m *Metadata) error {
+	loaded, err := LoadMetadata(dir)
+	if err != nil {
+		return err
+	}
+	s := &Store{verified: make(map[string]string)}
+	if err := s.Verify(&Template{Name: m.Name, Version: m.Version, Path: dir, Metadata: loaded}); err != nil {
+		return err
+	}
+	return CheckHardwareModel(dir)
+}
+
+// CheckHardwareModel checks that the HardwareModel.json of the template in
+// dir holds a base64 encoded hardware model. It does not ask
+// Virtualization.framework whether the host supports it.
+func CheckHardwareModel(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "HardwareModel.json"))
+	if err != nil {
+		return fmt.Errorf("%w: failed to read HardwareModel.json: %v", model.ErrTemplateInvalid, err)
+	}
+	var hw hardwareModelFile
+	if err := json.Unmarshal(data, &hw); err != nil {
+		return fmt.Errorf("%w: failed to parse HardwareModel.json: %v", model.ErrTemplateInvalid, err)
+	}
+	if err := checkHardwareModel(hw.HardwareModel); err != nil {
+		return fmt.Errorf("%w: HardwareModel.json: %v", model.ErrTemplateInvalid, err)
+	}
+	return nil
+}
+
+// cloneFile clones src to dst with clonefile(2) through cp -c, and copies
+// it if the file system cannot clone
+func cloneFile(src, dst string) error {
+	if err := exec.Command("cp", "-c", src, dst).Run(); err == nil {
+		return os.Chmod(dst, 0644)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package template
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+func TestImportTart(t *testing.T) {
+	tests := []struct {
+		name    string
+		vm      string
+		wantErr bool
+	}{
+		{name: "macOS VM", vm: "macos"},
+		{name: "config without os and arch", vm: "legacy"},
+		{name: "Linux VM", vm: "linux", wantErr: true},
+		{name: "ASIF disk", vm: "asif", wantErr: true},
+		{name: "no hardware model", vm: "no-hardware-model", wantErr: true},
+		{name: "no NVRAM", vm: "no-nvram", wantErr: true},
+		{name: "no VM", vm: "missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templatesDir := t.TempDir()
+			dir := filepath.Join(templatesDir, "macos-15", "2025.02.01")
+			m := &Metadata{Name: "macos-15", Version: "2025.02.01", MacOSBuild: "24C101"}
+
+			err := ImportTart(filepath.Join("testdata", "tart", tt.vm), dir, m)
+			if tt.wantErr {
+				if !errors.Is(err, model.ErrTemplateInvalid) {
+					t.Errorf("ImportTart() error = %v, want %v", err, model.ErrTemplateInvalid)
+				}
+				if _, err := os.Stat(dir); !os.IsNotExist(err) {
+					t.Errorf("failed ImportTart() left %s behind: %v", dir, err)
+				}
+				entries, _ := os.ReadDir(filepath.Dir(dir))
+				if len(entries) != 0 {
+					t.Errorf("failed ImportTart() left %d temporary directories", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ImportTart() error = %v", err)
+			}
+
+			for src, dst := range map[string]string{"disk.img": "Disk.img", "nvram.bin": "AuxiliaryStorage"} {
+				want, err := os.ReadFile(filepath.Join("testdata", "tart", tt.vm, src))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := os.ReadFile(filepath.Join(dir, dst))
+				if err != nil {
+					t.Fatalf("imported template has no %s: %v", dst, err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("%s = %q, want the content of %s", dst, got, src)
+				}
+			}
+
+			var config tartConfig
+			data, _ := os.ReadFile(filepath.Join("testdata", "tart", tt.vm, tartConfigFile))
+			if err := json.Unmarshal(data, &config); err != nil {
+				t.Fatal(err)
+			}
+			var hw hardwareModelFile
+			data, err = os.ReadFile(filepath.Join(dir, "HardwareModel.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(data, &hw); err != nil || hw.HardwareModel != config.HardwareModel {
+				t.Errorf("HardwareModel.json = %s, want the hardware model of config.json", data)
+			}
+
+			// The store serves the imported version
+			got, err := NewStore(templatesDir, "", RequireMetadata()).Resolve("macos-15")
+			if err != nil {
+				t.Fatalf("Resolve() of the imported template error = %v", err)
+			}
+			// The minimums in config.json are the host's limits, not the guest's needs
+			if got.String() != "macos-15@2025.02.01" || got.Metadata.MinCPUCount != 0 || got.Metadata.MinMemoryBytes != 0 {
+				t.Errorf("Resolve() = %v with metadata %+v, want macos-15@2025.02.01 without minimums", got, got.Metadata)
+			}
+		})
+	}
+}
+
+func TestImportTart_Refuses(t *testing.T) {
+	src := filepath.Join("testdata", "tart", "macos")
+	m := func() *Metadata { return &Metadata{Name: "macos-15", Version: "1", MacOSBuild: "24C101"} }
+
+	t.Run("existing version", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "macos-15", "1")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ImportTart(src, dir, m()); err == nil {
+			t.Error("ImportTart() over an existing version error = nil, want error")
+		}
+	})
+
+	t.Run("incomplete metadata", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "macos-15", "1")
+		meta := m()
+		meta.MacOSBuild = ""
+		if err := ImportTart(src, dir, meta); !errors.Is(err, model.ErrTemplateInvalid) {
+			t.Errorf("ImportTart() error = %v, want %v", err, model.ErrTemplateInvalid)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("failed ImportTart() left %s behind", dir)
+		}
+	})
+
+	t.Run("running VM", func(t *testing.T) {
+		// Unix socket paths are short, so keep the VM out of t.TempDir()
+		vm, err := os.MkdirTemp("", "tart")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = os.RemoveAll(vm) })
+		for _, f := range []string{tartConfigFile, tartDiskFile, tartNVRAMFile} {
+			data, err := os.ReadFile(filepath.Join(src, f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(vm, f), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l, err := net.Listen("unix", filepath.Join(vm, tartSocketFile))
+		if err != nil {
+			t.Skipf("cannot listen on a unix socket: %v", err)
+		}
+
+		dir := filepath.Join(t.TempDir(), "macos-15", "1")
+		if err := ImportTart(vm, dir, m()); err == nil {
+			t.Error("ImportTart() of a running VM error = nil, want error")
+		}
+
+		// A socket nobody serves is left over from a killed VM
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		_ = l.Close()
+		if err := ImportTart(vm, dir, m()); err != nil {
+			t.Errorf("ImportTart() with a stale control socket error = %v", err)
+		}
+	})
+}
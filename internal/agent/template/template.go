@@ -0,0 +1,559 @@
+// Package template finds the VM templates runners are cloned from.
+//
+// Templates live in a directory, one subdirectory per name. A template is
+// either versioned, with one subdirectory per version:
+//
+//	templates/macos-15/2025.01/Disk.img
+//	templates/macos-15/2025.02/Disk.img
+//
+// or unversioned, with the files directly in it:
+//
+//	templates/macos-26/Disk.img
+//
+// Runners are cloned from the version named in the template's ActiveVersion
+// file, or from the newest version if there is none. A version with a
+// TemplateMetadata.json is only served once its files match the checksums
+// in it.
+package template
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// diskFile marks a directory as holding a template
+const diskFile = "Disk.img"
+
+// ActiveFile names the version runners of a template are cloned from
+const ActiveFile = "ActiveVersion"
+
+// Template is one version of a template
+type Template struct {
+	Name     string
+	Version  string // Empty for unversioned templates without metadata
+	Path     string
+	Metadata *Metadata // Nil if the template has no TemplateMetadata.json
+
+	// Err tells why List found the template unusable
+	Err error
+
+	// Active is set by Versions and All on the version runners are cloned
+	// from unless another one is asked for
+	Active bool
+}
+
+// String returns name@version, or the name of an unversioned template
+func (t *Template) String() string {
+	if t.Version == "" {
+		return t.Name
+	}
+	return t.Name + "@" + t.Version
+}
+
+// Proto returns t as reported to the server
+func (t *Template) Proto() *agentv1.Template {
+	p := &agentv1.Template{Name: t.Name, Version: t.Version, Active: t.Active}
+	if t.Metadata != nil {
+		p.MacosBuild = t.Metadata.MacOSBuild
+	}
+	return p
+}
+
+// CheckResources fails if t needs more CPUs or memory than a VM with cpus
+// and memoryBytes has
+func (t *Template) CheckResources(cpus uint, memoryBytes uint64) error {
+	if t.Metadata == nil {
+		return nil
+	}
+	if t.Metadata.MinCPUCount > cpus {
+		return fmt.Errorf("%w: %s needs %d CPUs, runner VMs have %d", model.ErrTemplateInvalid, t, t.Metadata.MinCPUCount, cpus)
+	}
+	if t.Metadata.MinMemoryBytes > memoryBytes {
+		return fmt.Errorf("%w: %s needs %d bytes of memory, runner VMs have %d", model.ErrTemplateInvalid, t, t.Metadata.MinMemoryBytes, memoryBytes)
+	}
+	return nil
+}
+
+// Store reads templates from a directory. The directory is read on every
+// call, so templates can be added while the agent runs.
+type Store struct {
+	dir             string
+	defaultTemplate string
+	requireMetadata bool
+
+	// Stamp of the files of each template path when they were verified
+	mu       sync.Mutex
+	verified map[string]string
+}
+
+// Option configures a Store
+type Option func(*Store)
+
+// RequireMetadata refuses templates without a TemplateMetadata.json
+func RequireMetadata() Option {
+	return func(s *Store) {
+		s.requireMetadata = true
+	}
+}
+
+// NewStore creates a Store for dir. defaultTemplate is used when a runner
+// does not ask for a template.
+func NewStore(dir, defaultTemplate string, opts ...Option) *Store {
+	s := &Store{
+		dir:             dir,
+		defaultTemplate: defaultTemplate,
+		verified:        make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Dir returns the templates directory
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// List returns the version runners are cloned from for every template,
+// sorted by name. Templates with invalid metadata are included with Err
+// set; checksums are not verified.
+func (s *Store) List() ([]*Template, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates directory: %w", err)
+	}
+
+	var templates []*Template
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		t, err := s.active(e.Name())
+		if err != nil {
+			continue
+		}
+		t.Err = s.loadMetadata(t)
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// All returns every version of every template, sorted by name and
+// version, with their metadata checked but not their checksums
+func (s *Store) All() ([]*Template, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates directory: %w", err)
+	}
+
+	var templates []*Template
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		versions, err := s.Versions(e.Name())
+		if err != nil {
+			continue
+		}
+		templates = append(templates, versions...)
+	}
+	return templates, nil
+}
+
+// Resolve returns the verified template runners named name are cloned
+// from. An empty name selects the default template.
+func (s *Store) Resolve(name string) (*Template, error) {
+	return s.ResolveVersion(name, "")
+}
+
+// ResolveVersion is Resolve for a given version of the template, or the
+// active version if version is empty
+func (s *Store) ResolveVersion(name, version string) (*Template, error) {
+	t, err := s.LookupVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Verify(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LookupVersion is ResolveVersion without verifying the checksums, which
+// reads the whole template
+func (s *Store) LookupVersion(name, version string) (*Template, error) {
+	t, err := s.find(name)
+	if err != nil {
+		return nil, err
+	}
+	if version != "" && version != t.Version {
+		versions, err := s.versions(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !containsVersion(versions, version) {
+			return nil, fmt.Errorf("%w: %s@%s", model.ErrTemplateNotFound, t.Name, version)
+		}
+		t = &Template{Name: t.Name, Version: version, Path: filepath.Join(s.dir, t.Name, version)}
+	}
+	if err := s.loadMetadata(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Active returns the version of the template name runners are cloned from,
+// without verifying it
+func (s *Store) Active(name string) (*Template, error) {
+	return s.find(name)
+}
+
+// find returns the active version of the template name
+func (s *Store) find(name string) (*Template, error) {
+	if name == "" {
+		name = s.defaultTemplate
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("%w: %q", model.ErrTemplateNotFound, name)
+	}
+
+	t, err := s.active(name)
+	if err == nil {
+		return t, nil
+	}
+
+	// Template labels are lower case, so names from the server may be too
+	entries, readErr := os.ReadDir(s.dir)
+	if readErr != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != name && strings.EqualFold(e.Name(), name) {
+			return s.active(e.Name())
+		}
+	}
+	return nil, err
+}
+
+// active returns the version of the template name runners are cloned
+// from: the one in its ActiveVersion file, or else the newest
+func (s *Store) active(name string) (*Template, error) {
+	path := filepath.Join(s.dir, name)
+	if isTemplateDir(path) {
+		return &Template{Name: name, Path: path}, nil
+	}
+
+	versions, err := s.versions(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %q has no versions in %s", model.ErrTemplateNotFound, name, s.dir)
+	}
+	v := versions[len(versions)-1]
+	if data, err := os.ReadFile(filepath.Join(path, ActiveFile)); err == nil {
+		active := strings.TrimSpace(string(data))
+		if !containsVersion(versions, active) {
+			return nil, fmt.Errorf("%w: %q activates version %q, which does not exist", model.ErrTemplateNotFound, name, active)
+		}
+		v = active
+	}
+	return &Template{Name: name, Version: v, Path: filepath.Join(path, v)}, nil
+}
+
+// Versions returns every version of the template name, oldest first, with
+// their metadata checked but not their checksums. Unversioned templates
+// have a single version.
+func (s *Store) Versions(name string) ([]*Template, error) {
+	path := filepath.Join(s.dir, name)
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("%w: %q", model.ErrTemplateNotFound, name)
+	}
+	if isTemplateDir(path) {
+		t := &Template{Name: name, Path: path, Active: true}
+		t.Err = s.loadMetadata(t)
+		return []*Template{t}, nil
+	}
+
+	versions, err := s.versions(name)
+	if err != nil {
+		return nil, err
+	}
+	active, err := s.active(name)
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]*Template, 0, len(versions))
+	for _, v := range versions {
+		t := &Template{Name: name, Version: v, Path: filepath.Join(path, v), Active: v == active.Version}
+		t.Err = s.loadMetadata(t)
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// Activate makes version the one new runners of the template name are
+// cloned from. The version must pass verification. The switch is atomic,
+// so runners are cloned from either the old or the new version.
+func (s *Store) Activate(name, version string) (*Template, error) {
+	path := filepath.Join(s.dir, name)
+	if isTemplateDir(path) {
+		return nil, fmt.Errorf("%w: %q has no versions to activate", model.ErrTemplateInvalid, name)
+	}
+	versions, err := s.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var t *Template
+	for _, v := range versions {
+		if v.Version == version {
+			t = v
+		}
+	}
+	if t == nil {
+		return nil, fmt.Errorf("%w: %s@%s", model.ErrTemplateNotFound, name, version)
+	}
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	if err := s.Verify(t); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(path, "."+ActiveFile+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", ActiveFile, err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.WriteString(version + "\n"); err != nil {
+		_ = tmp.Close()
+		return nil, fmt.Errorf("failed to write %s: %w", ActiveFile, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", ActiveFile, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", ActiveFile, err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(path, ActiveFile)); err != nil {
+		return nil, fmt.Errorf("failed to replace %s: %w", ActiveFile, err)
+	}
+	return t, nil
+}
+
+// GC removes the versions of each template that are older than its active
+// version and for which inUse returns false, and returns them. Newer
+// versions are kept, as they may be about to be activated.
+func (s *Store) GC(inUse func(*Template) bool) ([]*Template, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates directory: %w", err)
+	}
+
+	var removed []*Template
+	var errs []error
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		active, err := s.active(e.Name())
+		if err != nil || active.Version == "" {
+			continue
+		}
+		versions, err := s.versions(e.Name())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, v := range versions {
+			if compareVersions(v, active.Version) >= 0 {
+				break
+			}
+			t := &Template{Name: e.Name(), Version: v, Path: filepath.Join(s.dir, e.Name(), v)}
+			if inUse(t) {
+				continue
+			}
+			if err := os.RemoveAll(t.Path); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove %s: %w", t, err))
+				continue
+			}
+			s.mu.Lock()
+			delete(s.verified, t.Path)
+			s.mu.Unlock()
+			removed = append(removed, t)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+func containsVersion(versions []string, version string) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// versions returns the versions of the template name, oldest first
+func (s *Store) versions(name string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %q in %s", model.ErrTemplateNotFound, name, s.dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %s: %w", name, err)
+	}
+
+	var versions []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") && isTemplateDir(filepath.Join(s.dir, name, e.Name())) {
+			versions = append(versions, e.Name())
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) < 0 })
+	return versions, nil
+}
+
+// loadMetadata reads and checks the TemplateMetadata.json of t
+func (s *Store) loadMetadata(t *Template) error {
+	m, err := LoadMetadata(t.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if s.requireMetadata {
+			return fmt.Errorf("%w: %s has no %s", model.ErrTemplateInvalid, t, MetadataFile)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", t, err)
+	}
+
+	if !strings.EqualFold(m.Name, t.Name) {
+		return fmt.Errorf("%w: %s: metadata names template %q", model.ErrTemplateInvalid, t, m.Name)
+	}
+	if t.Version == "" {
+		t.Version = m.Version
+	} else if m.Version != t.Version {
+		return fmt.Errorf("%w: %s: metadata has version %q", model.ErrTemplateInvalid, t, m.Version)
+	}
+	t.Metadata = m
+	return nil
+}
+
+// Verify checks the files of t against the checksums in its metadata.
+// Files are only read again once their size or modification time changes.
+func (s *Store) Verify(t *Template) error {
+	if t.Metadata == nil {
+		return nil
+	}
+
+	stamp, err := filesStamp(t.Path, t.Metadata.Checksums)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", model.ErrTemplateInvalid, t, err)
+	}
+	s.mu.Lock()
+	verified := s.verified[t.Path] == stamp
+	s.mu.Unlock()
+	if verified {
+		return nil
+	}
+
+	// Templates are tens of GB, so they are read without holding the lock
+	for _, f := range sortedKeys(t.Metadata.Checksums) {
+		sum, err := fileChecksum(filepath.Join(t.Path, f))
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", model.ErrTemplateInvalid, t, err)
+		}
+		if sum != t.Metadata.Checksums[f] {
+			return fmt.Errorf("%w: %s: checksum mismatch for %s", model.ErrTemplateInvalid, t, f)
+		}
+	}
+
+	after, err := filesStamp(t.Path, t.Metadata.Checksums)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", model.ErrTemplateInvalid, t, err)
+	}
+	if after != stamp {
+		return fmt.Errorf("%w: %s: files changed while being verified", model.ErrTemplateInvalid, t)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verified[t.Path] = stamp
+	return nil
+}
+
+// filesStamp summarizes the expected checksum, size and modification time
+// of each file in dir
+func filesStamp(dir string, checksums map[string]string) (string, error) {
+	var b strings.Builder
+	for _, f := range sortedKeys(checksums) {
+		info, err := os.Stat(filepath.Join(dir, f))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%s:%d:%d;", f, checksums[f], info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isTemplateDir(path string) bool {
+	info, err := os.Stat(filepath.Join(path, diskFile))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// compareVersions orders versions like "2025.1.9" < "2025.1.10", comparing
+// the numeric parts as numbers and the rest as strings
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(strings.TrimPrefix(v, "v"), func(r rune) bool {
+			return r == '.' || r == '-' || r == '_'
+		})
+	}
+	pa, pb := split(a), split(b)
+
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.ParseUint(pa[i], 10, 64)
+		nb, errB := strconv.ParseUint(pb[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case pa[i] != pb[i]:
+			return strings.Compare(pa[i], pb[i])
+		}
+	}
+	if len(pa) != len(pb) {
+		if len(pa) < len(pb) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
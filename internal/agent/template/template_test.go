@@ -0,0 +1,347 @@
+package template
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// newTestTemplates creates templates with a Disk.img at each of paths
+func newTestTemplates(t *testing.T, paths ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, p := range paths {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, p, diskFile), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestStore_Resolve(t *testing.T) {
+	dir := newTestTemplates(t,
+		"macos-26",
+		"macos-15/2025.1.9",
+		"macos-15/2025.1.10",
+		"macos-15/2024.12.1",
+		"Xcode-16/1",
+	)
+	// A version directory without a disk is not a template
+	if err := os.MkdirAll(filepath.Join(dir, "macos-15", "2026.1.1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		template    string
+		defaultName string
+		want        string
+		wantErr     error
+	}{
+		{name: "unversioned", template: "macos-26", want: "macos-26"},
+		{name: "newest version", template: "macos-15", want: "macos-15@2025.1.10"},
+		{name: "default template", defaultName: "macos-26", want: "macos-26"},
+		{name: "case-insensitive name", template: "xcode-16", want: "Xcode-16@1"},
+		{name: "unknown template", template: "macos-14", wantErr: model.ErrTemplateNotFound},
+		{name: "no versions", template: "empty", wantErr: model.ErrTemplateNotFound},
+		{name: "no default", wantErr: model.ErrTemplateNotFound},
+		{name: "path traversal", template: "../macos-26", wantErr: model.ErrTemplateNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewStore(dir, tt.defaultName).Resolve(tt.template)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Resolve() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(got.Path, diskFile)); err != nil {
+				t.Errorf("Resolve() path %s has no disk: %v", got.Path, err)
+			}
+		})
+	}
+}
+
+func TestStore_List(t *testing.T) {
+	dir := newTestTemplates(t, "macos-26", "macos-15/1", "macos-15/2")
+
+	templates, err := NewStore(dir, "").List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tmpl := range templates {
+		got = append(got, tmpl.String())
+	}
+	if want := "[macos-15@2 macos-26]"; fmt.Sprint(got) != want {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "2025.1.9", b: "2025.1.10", want: -1},
+		{a: "v2", b: "v10", want: -1},
+		{a: "1.0", b: "1.0.1", want: -1},
+		{a: "2025-02", b: "2025-01", want: 1},
+		{a: "1.0-beta", b: "1.0-rc", want: -1},
+		{a: "3", b: "3", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			if got := compareVersions(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareVersions(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// writeTestTemplate creates a complete template version with metadata
+func writeTestTemplate(t *testing.T, dir, name, version string) string {
+	t.Helper()
+	path := filepath.Join(dir, name, version)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range RequiredFiles {
+		if err := os.WriteFile(filepath.Join(path, f), []byte(f+" content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteMetadata(path, &Metadata{
+		Name:       name,
+		Version:    version,
+		MacOSBuild: "24C101",
+		CreatedAt:  time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStore_ResolveVerifiesMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		modify  func(t *testing.T, path string)
+		wantErr error
+	}{
+		{name: "valid template"},
+		{
+			name: "modified disk",
+			modify: func(t *testing.T, path string) {
+				if err := os.WriteFile(filepath.Join(path, "Disk.img"), []byte("tampered"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: model.ErrTemplateInvalid,
+		},
+		{
+			name: "missing file",
+			modify: func(t *testing.T, path string) {
+				if err := os.Remove(filepath.Join(path, "AuxiliaryStorage")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: model.ErrTemplateInvalid,
+		},
+		{
+			name:    "version differs from directory",
+			modify:  func(t *testing.T, path string) { editMetadata(t, path, func(m *Metadata) { m.Version = "2024.12.1" }) },
+			wantErr: model.ErrTemplateInvalid,
+		},
+		{
+			name:    "unsupported schema",
+			modify:  func(t *testing.T, path string) { editMetadata(t, path, func(m *Metadata) { m.SchemaVersion = 99 }) },
+			wantErr: model.ErrTemplateInvalid,
+		},
+		{
+			name: "authorized key is not a public key",
+			modify: func(t *testing.T, path string) {
+				editMetadata(t, path, func(m *Metadata) { m.AuthorizedKey = "ssh-ed25519 garbage" })
+			},
+			wantErr: model.ErrTemplateInvalid,
+		},
+		{
+			name:    "no metadata",
+			modify:  func(t *testing.T, path string) { removeMetadata(t, path) },
+			wantErr: nil,
+		},
+		{
+			name:    "no metadata when required",
+			opts:    []Option{RequireMetadata()},
+			modify:  func(t *testing.T, path string) { removeMetadata(t, path) },
+			wantErr: model.ErrTemplateInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeTestTemplate(t, dir, "macos-15", "2025.01.15")
+			if tt.modify != nil {
+				tt.modify(t, path)
+			}
+
+			got, err := NewStore(dir, "", tt.opts...).Resolve("macos-15")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Resolve() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.Version != "2025.01.15" {
+				t.Errorf("Resolve() version = %v, want %v", got.Version, "2025.01.15")
+			}
+		})
+	}
+}
+
+func TestStore_VerifyNoticesChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestTemplate(t, dir, "macos-15", "1")
+	s := NewStore(dir, "")
+
+	if _, err := s.Resolve("macos-15"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A verified template is verified again once a file changes
+	if err := os.WriteFile(filepath.Join(path, "HardwareModel.json"), []byte("changed content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Resolve("macos-15"); !errors.Is(err, model.ErrTemplateInvalid) {
+		t.Errorf("Resolve() after change error = %v, want %v", err, model.ErrTemplateInvalid)
+	}
+}
+
+func editMetadata(t *testing.T, path string, edit func(*Metadata)) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(path, MetadataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	edit(&m)
+	data, err = json.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, MetadataFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func removeMetadata(t *testing.T, path string) {
+	t.Helper()
+	if err := os.Remove(filepath.Join(path, MetadataFile)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_Activate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTemplate(t, dir, "macos-15", "1")
+	writeTestTemplate(t, dir, "macos-15", "2")
+	broken := writeTestTemplate(t, dir, "macos-15", "3")
+	if err := os.WriteFile(filepath.Join(broken, "Disk.img"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(dir, "")
+
+	// Without an ActiveVersion the newest version is used, even if broken
+	if _, err := s.Resolve("macos-15"); !errors.Is(err, model.ErrTemplateInvalid) {
+		t.Fatalf("Resolve() error = %v, want %v", err, model.ErrTemplateInvalid)
+	}
+
+	tests := []struct {
+		name    string
+		version string
+		want    string
+		wantErr error
+	}{
+		{name: "older version", version: "1", want: "macos-15@1"},
+		{name: "switch again", version: "2", want: "macos-15@2"},
+		{name: "unknown version", version: "4", want: "macos-15@2", wantErr: model.ErrTemplateNotFound},
+		{name: "failing verification", version: "3", want: "macos-15@2", wantErr: model.ErrTemplateInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Activate("macos-15", tt.version); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Activate() error = %v, want %v", err, tt.wantErr)
+			}
+			got, err := s.Resolve("macos-15")
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "macos-15"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("template directory has %d entries, want 3 versions and %s", len(entries), ActiveFile)
+	}
+}
+
+func TestStore_GC(t *testing.T) {
+	dir := newTestTemplates(t, "macos-26")
+	for _, v := range []string{"1", "2", "3", "4", "5"} {
+		writeTestTemplate(t, dir, "macos-15", v)
+	}
+	writeTestTemplate(t, dir, "xcode-16", "1")
+	s := NewStore(dir, "")
+	if _, err := s.Activate("macos-15", "4"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.GC(func(t *Template) bool { return t.String() == "macos-15@2" })
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	var got []string
+	for _, tmpl := range removed {
+		got = append(got, tmpl.String())
+	}
+	if want := "[macos-15@1 macos-15@3]"; fmt.Sprint(got) != want {
+		t.Errorf("GC() = %v, want %v", got, want)
+	}
+
+	versions, err := s.Versions("macos-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, v := range versions {
+		got = append(got, v.Version)
+	}
+	if want := "[2 4 5]"; fmt.Sprint(got) != want {
+		t.Errorf("Versions() after GC = %v, want %v", got, want)
+	}
+}
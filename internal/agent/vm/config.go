@@ -7,8 +7,20 @@ import (
 	"path/filepath"
 )
 
-// MonitorTCPPort is the TCP port used by runner-agent for HTTP communication
-const MonitorTCPPort = 8080
+const (
+	// MonitorTCPPort is the TCP port used by runner-agent for HTTP communication
+	MonitorTCPPort = 8080
+
+	// MonitorVsockPort is the vsock port used by runner-agent for HTTP communication
+	MonitorVsockPort = 8080
+
+	// IPNotifyVsockPort is the vsock port the host accepts IP notifications on
+	IPNotifyVsockPort = 8081
+
+	// VMCPUCount and VMMemorySize are the resources of every runner VM
+	VMCPUCount   = 2
+	VMMemorySize = 4 * 1024 * 1024 * 1024
+)
 
 // BundleConfig represents the VM bundle configuration
 type BundleConfig struct {
@@ -17,15 +29,32 @@ type BundleConfig struct {
 	HardwareModelPath   string `json:"hardware_model_path"`
 	MachineIdentifier   string `json:"machine_identifier"`
 	RuntimeMetadataPath string `json:"runtime_metadata_path"`
+	SSHKeyPath          string `json:"ssh_key_path"` // Per-runner SSH private key
+	SetupScriptPath     string `json:"setup_script_path"`
+	SetupLogPath        string `json:"setup_log_path"`   // Output of the setup script
+	ConfigDiskPath      string `json:"config_disk_path"` // Read-only disk with the guest manifest
+	ConsoleLogPath      string `json:"console_log_path"` // Serial console output, rotated to console.log.1
+	AgentLogPath        string `json:"agent_log_path"`   // Agent log records for this runner, rotated to agent.log.1
 }
 
 // RuntimeMetadata contains runtime information about the VM
 type RuntimeMetadata struct {
 	RunnerID  string `json:"runner_id"`
-	IPAddress string `json:"ip_address"` // Guest IP address (set after VM starts)
-	CreatedAt string `json:"created_at"`
-	State     string `json:"state"`      // Current state: creating, running, stopped, error, etc.
-	UpdatedAt string `json:"updated_at"` // Last update timestamp
+	IPAddress string `json:"ip_address"`         // Guest IP address (set after VM starts)
+	HostKey   string `json:"host_key,omitempty"` // Pinned guest SSH host key (authorized_keys format)
+	// ConfigDisk is set once the guest reports it read the config disk
+	ConfigDisk bool `json:"config_disk,omitempty"`
+	// RunnerToken is set if the guest signs with its runner token rather
+	// than the agent's secret, as older guests without a config disk do
+	RunnerToken bool   `json:"runner_token,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	State       string `json:"state"`      // Current state: creating, running, stopped, error, etc.
+	UpdatedAt   string `json:"updated_at"` // Last update timestamp
+
+	// Template the disk was cloned from
+	Template        string `json:"template,omitempty"`
+	TemplateVersion string `json:"template_version,omitempty"`
+	MacOSBuild      string `json:"macos_build,omitempty"`
 }
 
 // LoadBundleConfig loads the bundle configuration from a directory
@@ -36,6 +65,12 @@ func LoadBundleConfig(bundlePath string) (*BundleConfig, error) {
 		HardwareModelPath:   filepath.Join(bundlePath, "HardwareModel.json"),
 		MachineIdentifier:   filepath.Join(bundlePath, "MachineIdentifier"),
 		RuntimeMetadataPath: filepath.Join(bundlePath, "RuntimeMetadata.json"),
+		SSHKeyPath:          filepath.Join(bundlePath, "id_ed25519"),
+		SetupScriptPath:     filepath.Join(bundlePath, "setup.sh"),
+		SetupLogPath:        filepath.Join(bundlePath, "setup.log"),
+		ConfigDiskPath:      filepath.Join(bundlePath, "ConfigDisk.img"),
+		ConsoleLogPath:      filepath.Join(bundlePath, "console.log"),
+		AgentLogPath:        filepath.Join(bundlePath, "agent.log"),
 	}, nil
 }
 
@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/configdisk"
+)
+
+// CreateOptions describes the runner a VM is created for
+type CreateOptions struct {
+	RunnerName  string
+	SetupScript string
+	Template    string // Template name; the agent's default if empty
+
+	// TemplateVersion of Template; the active version if empty
+	TemplateVersion string
+}
+
+// writeConfigDisk builds the config disk the runner-agent reads at boot
+func (m *vzManager) writeConfigDisk(bundleConfig *BundleConfig, runnerID string, opts CreateOptions) error {
+	key, err := authorizedKey(bundleConfig.SSHKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load runner SSH key: %w", err)
+	}
+
+	manifest := &configdisk.Manifest{
+		Version:       configdisk.ManifestVersion,
+		RunnerID:      runnerID,
+		RunnerName:    opts.RunnerName,
+		SetupScript:   opts.SetupScript,
+		CallbackAddr:  m.callbackAddr,
+		AuthToken:     auth.RunnerToken(m.authSecret, runnerID),
+		AuthorizedKey: key,
+	}
+	return configdisk.WriteImage(bundleConfig.ConfigDiskPath, manifest)
+}
+
+// UpdateConfigDisk records that the guest was configured from its config
+// disk, and whether it signs with the runner token written there
+func (m *vzManager) UpdateConfigDisk(runnerID string, loaded, runnerToken bool) error {
+	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return fmt.Errorf("failed to load bundle config: %w", err)
+	}
+
+	metadata, err := LoadRuntimeMetadata(bundleConfig.RuntimeMetadataPath)
+	if err != nil {
+		return fmt.Errorf("failed to load runtime metadata: %w", err)
+	}
+
+	metadata.ConfigDisk = loaded
+	metadata.RunnerToken = runnerToken
+	metadata.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	if err := SaveRuntimeMetadata(bundleConfig.RuntimeMetadataPath, metadata); err != nil {
+		return fmt.Errorf("failed to save runtime metadata: %w", err)
+	}
+
+	return nil
+}
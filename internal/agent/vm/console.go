@@ -0,0 +1,129 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Code-Hex/vz/v3"
+
+	"github.com/whywaita/shoes-vz/pkg/logging"
+)
+
+// DefaultConsoleLogSize is the size at which console.log is rotated
+const DefaultConsoleLogSize = 8 << 20
+
+// consoleCapture copies the output of a VM's serial console into its
+// console log. The log outlives the VM so that boot failures can be read.
+type consoleCapture struct {
+	input  *os.File // Guest input; the console is output only
+	reader *os.File
+	writer *os.File // Handed to the serial port
+	done   chan struct{}
+}
+
+// newConsoleCapture starts copying console output to path
+func newConsoleCapture(path string, maxSize int64) (*consoleCapture, error) {
+	log, err := logging.NewRotatingFile(path, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := os.Open(os.DevNull)
+	if err != nil {
+		_ = log.Close()
+		return nil, fmt.Errorf("failed to open console input: %w", err)
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		_ = input.Close()
+		_ = log.Close()
+		return nil, fmt.Errorf("failed to create console pipe: %w", err)
+	}
+
+	c := &consoleCapture{
+		input:  input,
+		reader: reader,
+		writer: writer,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(c.done)
+		_, _ = io.Copy(log, reader)
+		_ = log.Close()
+	}()
+	return c, nil
+}
+
+// serialPort returns the virtio console serial port writing to the log
+func (c *consoleCapture) serialPort() (*vz.VirtioConsoleDeviceSerialPortConfiguration, error) {
+	attachment, err := vz.NewFileHandleSerialPortAttachment(c.input, c.writer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create serial port attachment: %w", err)
+	}
+	port, err := vz.NewVirtioConsoleDeviceSerialPortConfiguration(attachment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create serial port config: %w", err)
+	}
+	return port, nil
+}
+
+// Close flushes what the guest wrote and closes the log
+func (c *consoleCapture) Close() {
+	_ = c.writer.Close()
+	_ = c.input.Close()
+
+	// The framework may still hold the write end; stop reading after a grace period
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+	}
+	_ = c.reader.Close()
+	<-c.done
+}
+
+// startConsole starts capturing the console of a VM about to be started,
+// replacing the capture of an earlier run
+func (m *vzManager) startConsole(runnerID string, bundleConfig *BundleConfig) (*consoleCapture, error) {
+	m.closeConsole(runnerID)
+
+	console, err := newConsoleCapture(bundleConfig.ConsoleLogPath, m.consoleLogSize)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.consoles[runnerID] = console
+	m.mu.Unlock()
+	return console, nil
+}
+
+// closeConsole stops capturing the console of a VM
+func (m *vzManager) closeConsole(runnerID string) {
+	m.mu.Lock()
+	console, ok := m.consoles[runnerID]
+	delete(m.consoles, runnerID)
+	m.mu.Unlock()
+
+	if ok {
+		console.Close()
+	}
+}
+
+// ReadConsoleLog returns up to the last limit bytes of a VM's console log.
+// It works whether or not the VM is running.
+func ReadConsoleLog(runnersPath, runnerID string, limit int64) ([]byte, error) {
+	bundleConfig, err := LoadBundleConfig(filepath.Join(runnersPath, fmt.Sprintf("%s.bundle", runnerID)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bundle config: %w", err)
+	}
+	return logging.ReadRotated(bundleConfig.ConsoleLogPath, limit)
+}
+
+// ReadConsoleLog returns up to the last limit bytes of a VM's console log
+func (m *vzManager) ReadConsoleLog(runnerID string, limit int64) ([]byte, error) {
+	return ReadConsoleLog(m.runnersPath, runnerID, limit)
+}
@@ -0,0 +1,38 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConsoleCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+
+	c, err := newConsoleCapture(path, 16)
+	if err != nil {
+		t.Fatalf("newConsoleCapture() error = %v", err)
+	}
+	// Stands in for the guest writing to the serial port
+	for _, s := range []string{"boot 1\n", "boot 2\n", "panic\n"} {
+		if _, err := c.writer.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rotated)+string(got) != "boot 1\nboot 2\npanic\n" {
+		t.Errorf("console log = %q + %q, want all output across both files", rotated, got)
+	}
+	if int64(len(got)) > 16 || int64(len(rotated)) > 16 {
+		t.Errorf("console log files are %d and %d bytes, want at most 16", len(rotated), len(got))
+	}
+}
@@ -0,0 +1,39 @@
+package vm
+
+import (
+	"context"
+
+	"github.com/whywaita/shoes-vz/pkg/filetransfer"
+)
+
+// CopyFromVM copies a file or directory from the VM via runner-agent
+func (m *vzManager) CopyFromVM(ctx context.Context, runnerID, remotePath, localPath string) (string, error) {
+	client, baseURL, err := m.fileTransferClient(runnerID)
+	if err != nil {
+		return "", err
+	}
+	return client.Download(ctx, baseURL, remotePath, localPath)
+}
+
+// CopyToVM copies a file or directory to the VM via runner-agent
+func (m *vzManager) CopyToVM(ctx context.Context, runnerID, localPath, remotePath string) (string, error) {
+	client, baseURL, err := m.fileTransferClient(runnerID)
+	if err != nil {
+		return "", err
+	}
+	return client.Upload(ctx, baseURL, localPath, remotePath)
+}
+
+func (m *vzManager) fileTransferClient(runnerID string) (*filetransfer.Client, string, error) {
+	endpoint, err := m.runnerAgentEndpoint(runnerID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &filetransfer.Client{
+		HTTPClient: endpoint.dialer.httpClient(0),
+		Signer:     endpoint.signer,
+		HostKey:    endpoint.hostKey,
+		MaxSize:    m.maxTransfer,
+	}, endpoint.baseURL, nil
+}
@@ -15,6 +15,7 @@ type VMListItem struct {
 	CreatedAt  string
 	State      string
 	UpdatedAt  string
+	Template   string // name@version the disk was cloned from
 }
 
 // ListVMs lists all VM bundles in the runners directory
@@ -66,8 +67,16 @@ func ListVMs(runnersPath string) ([]VMListItem, error) {
 			CreatedAt:  metadata.CreatedAt,
 			State:      metadata.State,
 			UpdatedAt:  metadata.UpdatedAt,
+			Template:   templateString(metadata),
 		})
 	}
 
 	return vms, nil
 }
+
+func templateString(m *RuntimeMetadata) string {
+	if m.TemplateVersion == "" {
+		return m.Template
+	}
+	return m.Template + "@" + m.TemplateVersion
+}
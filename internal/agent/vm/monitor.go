@@ -4,11 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"path/filepath"
 	"time"
 
 	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/pkg/auth"
 )
 
 // MonitorStatus represents the status returned by runner-monitor
@@ -33,33 +34,23 @@ type JobInfo struct {
 
 // GetMonitorStatus gets the runner status via HTTP
 func (m *vzManager) GetMonitorStatus(ctx context.Context, runnerID string) (*MonitorStatus, error) {
-	// Load runtime metadata to get IP address
-	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
-	bundleConfig, err := LoadBundleConfig(bundlePath)
+	endpoint, err := m.runnerAgentEndpoint(runnerID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load bundle config: %w", err)
-	}
-
-	metadata, err := LoadRuntimeMetadata(bundleConfig.RuntimeMetadataPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load runtime metadata: %w", err)
-	}
-
-	if metadata.IPAddress == "" {
-		return nil, fmt.Errorf("VM IP address not yet discovered")
+		return nil, err
 	}
+	hostKey := endpoint.hostKey
 
 	// Create HTTP client
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
+	client := endpoint.dialer.httpClient(10 * time.Second)
 
 	// Send HTTP GET request to /status
-	url := fmt.Sprintf("http://%s:%d/status", metadata.IPAddress, MonitorTCPPort)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.baseURL+"/status", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
+	nonce := auth.NewNonce()
+	req.Header.Set(auth.HeaderNonce, nonce)
+	endpoint.signer.Sign(req, nil)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -69,13 +60,24 @@ func (m *vzManager) GetMonitorStatus(ctx context.Context, runnerID string) (*Mon
 		_ = resp.Body.Close()
 	}()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if hostKey != nil {
+		if err := auth.VerifyHostSignature(hostKey, resp, "/status", nonce, body); err != nil {
+			return nil, fmt.Errorf("refusing status from %s: %w", runnerID, err)
+		}
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("HTTP request failed with status %d", resp.StatusCode)
 	}
 
 	// Parse JSON response
 	var status MonitorStatus
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+	if err := json.Unmarshal(body, &status); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"path/filepath"
 	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
 )
 
 // UpdateIPAddress updates the IP address in the runtime metadata
@@ -29,6 +33,50 @@ func (m *vzManager) UpdateIPAddress(runnerID, ipAddress string) error {
 	return nil
 }
 
+// UpdateHostKey pins the guest SSH host key in the runtime metadata
+func (m *vzManager) UpdateHostKey(runnerID, hostKey string) error {
+	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return fmt.Errorf("failed to load bundle config: %w", err)
+	}
+
+	metadata, err := LoadRuntimeMetadata(bundleConfig.RuntimeMetadataPath)
+	if err != nil {
+		return fmt.Errorf("failed to load runtime metadata: %w", err)
+	}
+
+	metadata.HostKey = hostKey
+	metadata.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	if err := SaveRuntimeMetadata(bundleConfig.RuntimeMetadataPath, metadata); err != nil {
+		return fmt.Errorf("failed to save runtime metadata: %w", err)
+	}
+
+	return nil
+}
+
+// pinnedHostKey returns the pinned guest SSH host key, or nil if the
+// runner-agent did not report one
+func (m *vzManager) pinnedHostKey(runnerID string) (ssh.PublicKey, error) {
+	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bundle config: %w", err)
+	}
+
+	metadata, err := LoadRuntimeMetadata(bundleConfig.RuntimeMetadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load runtime metadata: %w", err)
+	}
+
+	if metadata.HostKey == "" {
+		return nil, nil
+	}
+
+	return auth.ParseHostKey(metadata.HostKey)
+}
+
 // UpdateState updates the state in the runtime metadata
 func (m *vzManager) UpdateState(runnerID, state string) error {
 	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
@@ -0,0 +1,94 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/whywaita/shoes-vz/pkg/logging"
+)
+
+// DefaultAgentLogSize is the size at which a runner's agent.log is rotated
+const DefaultAgentLogSize = 4 << 20
+
+// Logger returns the logger from ctx with runner_id attached. Once the
+// runner's bundle exists, records are also written to its agent.log.
+func (m *vzManager) Logger(ctx context.Context, runnerID string) *slog.Logger {
+	logger := logging.LoggerFromContext(ctx, logging.WithComponent("vm"))
+
+	file := m.agentLog(runnerID)
+	if file == nil {
+		return logger.With("runner_id", runnerID)
+	}
+
+	// The file gets debug records too, so it holds the whole story of the runner
+	var fileHandler slog.Handler = slog.NewJSONHandler(agentLogWriter{file}, &slog.HandlerOptions{Level: slog.LevelDebug})
+	if requestID := logging.RequestIDFromContext(ctx); requestID != "" {
+		fileHandler = fileHandler.WithAttrs([]slog.Attr{slog.String("request_id", requestID)})
+	}
+	return slog.New(logging.NewTeeHandler(logger.Handler(), fileHandler)).With("runner_id", runnerID)
+}
+
+// agentLog returns the open agent.log of a runner, opening it if the bundle
+// exists. It returns nil if the log cannot be written.
+func (m *vzManager) agentLog(runnerID string) *logging.RotatingFile {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if file, ok := m.agentLogs[runnerID]; ok {
+		return file
+	}
+
+	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
+	if _, err := os.Stat(bundlePath); err != nil {
+		return nil
+	}
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return nil
+	}
+	file, err := logging.NewRotatingFile(bundleConfig.AgentLogPath, DefaultAgentLogSize)
+	if err != nil {
+		logging.WithComponent("vm").Warn("Failed to open agent log", "runner_id", runnerID, "error", err)
+		return nil
+	}
+	m.agentLogs[runnerID] = file
+	return file
+}
+
+// agentLogWriter drops records logged after the runner's agent.log was closed
+type agentLogWriter struct {
+	file *logging.RotatingFile
+}
+
+func (w agentLogWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	if errors.Is(err, os.ErrClosed) {
+		return len(p), nil
+	}
+	return n, err
+}
+
+// CloseLog closes the agent.log of a runner
+func (m *vzManager) CloseLog(runnerID string) {
+	m.mu.Lock()
+	file, ok := m.agentLogs[runnerID]
+	delete(m.agentLogs, runnerID)
+	m.mu.Unlock()
+
+	if ok {
+		_ = file.Close()
+	}
+}
+
+// ReadAgentLog returns up to the last limit bytes of a runner's agent.log
+func ReadAgentLog(runnersPath, runnerID string, limit int64) ([]byte, error) {
+	bundleConfig, err := LoadBundleConfig(filepath.Join(runnersPath, fmt.Sprintf("%s.bundle", runnerID)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bundle config: %w", err)
+	}
+	return logging.ReadRotated(bundleConfig.AgentLogPath, limit)
+}
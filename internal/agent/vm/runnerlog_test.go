@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/whywaita/shoes-vz/pkg/logging"
+)
+
+func TestManagerLogger(t *testing.T) {
+	runnersPath := t.TempDir()
+	m := &vzManager{runnersPath: runnersPath, agentLogs: make(map[string]*logging.RotatingFile)}
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+
+	// Nothing is written before the bundle exists
+	m.Logger(ctx, "runner-1").Info("before bundle")
+	if _, err := ReadAgentLog(runnersPath, "runner-1", 0); err == nil {
+		t.Fatal("ReadAgentLog() error = nil, want an error before the bundle exists")
+	}
+
+	if err := os.Mkdir(filepath.Join(runnersPath, "runner-1.bundle"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logger := m.Logger(ctx, "runner-1")
+	logger.Debug("VM state check", "attempt", 1)
+	m.Logger(ctx, "runner-1").Info("VM is now running")
+	m.CloseLog("runner-1")
+	if len(m.agentLogs) != 0 {
+		t.Errorf("agentLogs has %d open files after CloseLog, want 0", len(m.agentLogs))
+	}
+
+	// A logger handed out before CloseLog drops its records
+	logger.Info("after close")
+
+	got, err := ReadAgentLog(runnersPath, "runner-1", 0)
+	if err != nil {
+		t.Fatalf("ReadAgentLog() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(got)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("agent.log has %d lines, want 2: %q", len(lines), got)
+	}
+	for _, want := range []string{`"msg":"VM state check"`, `"msg":"VM is now running"`} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("agent.log = %q, want it to contain %s", got, want)
+		}
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"request_id":"req-1"`) || !strings.Contains(line, `"runner_id":"runner-1"`) {
+			t.Errorf("agent.log line %q lacks request_id or runner_id", line)
+		}
+	}
+}
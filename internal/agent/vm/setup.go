@@ -0,0 +1,200 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/whywaita/shoes-vz/pkg/configdisk"
+	"github.com/whywaita/shoes-vz/pkg/execstream"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
+)
+
+const (
+	// DefaultSetupTimeout is how long the setup script may run when no timeout is configured
+	DefaultSetupTimeout = 30 * time.Minute
+
+	// setupTailSize is the amount of trailing output kept for error messages
+	setupTailSize = 2048
+
+	// guestSetupCommand runs the script at $0 after removing it, so that the
+	// registration token it carries is gone from the guest even if the
+	// script is killed at the deadline
+	guestSetupCommand = `script=$(cat -- "$0") && rm -f -- "$0" && exec /bin/bash -c "$script"`
+)
+
+// SetupError is returned when the setup script ran but did not succeed.
+// Its message carries the tail of the output for Runner.ErrorMessage.
+type SetupError struct {
+	ExitCode int
+	TimedOut bool
+	Timeout  time.Duration
+	Tail     string // Last part of the combined output
+}
+
+func (e *SetupError) Error() string {
+	var msg string
+	if e.TimedOut {
+		msg = fmt.Sprintf("timed out after %s", e.Timeout)
+	} else {
+		msg = fmt.Sprintf("exit status %d", e.ExitCode)
+	}
+	if e.Tail == "" {
+		return msg
+	}
+	return msg + ": " + e.Tail
+}
+
+// RunSetupScript uploads the setup script to the VM and runs it via
+// runner-agent. Output is written to the setup log in the bundle.
+func (m *vzManager) RunSetupScript(ctx context.Context, runnerID, script string) (err error) {
+	ctx, span := tracer.Start(ctx, "vm.RunSetupScript", trace.WithAttributes(tracing.RunnerIDKey.String(runnerID)))
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.Logger(ctx, runnerID)
+
+	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return fmt.Errorf("failed to load bundle config: %w", err)
+	}
+
+	metadata, err := LoadRuntimeMetadata(bundleConfig.RuntimeMetadataPath)
+	if err != nil {
+		return fmt.Errorf("failed to load runtime metadata: %w", err)
+	}
+
+	// Guests that read the config disk already have the script in place
+	if !metadata.ConfigDisk {
+		// The script carries the runner registration token, so it is not
+		// kept on the host once uploaded, whether or not that worked
+		defer func() {
+			_ = os.Remove(bundleConfig.SetupScriptPath)
+		}()
+		if err := os.WriteFile(bundleConfig.SetupScriptPath, []byte(script), 0700); err != nil {
+			return fmt.Errorf("failed to write setup script: %w", err)
+		}
+		if _, err := m.CopyToVM(ctx, runnerID, bundleConfig.SetupScriptPath, configdisk.GuestSetupScriptPath); err != nil {
+			return fmt.Errorf("failed to upload setup script: %w", err)
+		}
+	}
+
+	logFile, err := os.OpenFile(bundleConfig.SetupLogPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create setup log: %w", err)
+	}
+	defer func() {
+		_ = logFile.Close()
+	}()
+
+	timeout := m.setupTimeout
+	if timeout <= 0 {
+		timeout = DefaultSetupTimeout
+	}
+
+	logger.Info("Running setup script",
+		"script_length", len(script),
+		"timeout", timeout,
+		"log", bundleConfig.SetupLogPath,
+	)
+
+	// runner-agent enforces the timeout; the local deadline only guards against a stalled connection
+	runCtx, cancel := context.WithTimeout(ctx, timeout+time.Minute)
+	defer cancel()
+
+	output := newSetupOutput(logger, logFile, setupTailSize)
+	req := execstream.Request{
+		Command:        "/bin/bash",
+		Args:           []string{"-c", guestSetupCommand, configdisk.GuestSetupScriptPath},
+		TimeoutSeconds: int(timeout / time.Second),
+	}
+	result, err := m.ExecStream(runCtx, runnerID, req, nil, output, output)
+	if err != nil {
+		return fmt.Errorf("failed to run setup script: %w", err)
+	}
+	if result.Error != "" {
+		return fmt.Errorf("failed to start setup script: %s", result.Error)
+	}
+
+	if result.TimedOut || result.ExitCode != 0 {
+		setupErr := &SetupError{
+			ExitCode: result.ExitCode,
+			TimedOut: result.TimedOut,
+			Timeout:  timeout,
+			Tail:     output.Tail(),
+		}
+		logger.Error("Setup script failed",
+			"exit_code", result.ExitCode,
+			"timed_out", result.TimedOut,
+			"log", bundleConfig.SetupLogPath,
+		)
+		return setupErr
+	}
+
+	logger.Info("Setup script completed", "output_length", output.Len())
+	return nil
+}
+
+// setupOutput writes combined output to a log file and keeps its tail
+type setupOutput struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	log    *os.File
+	tail   []byte
+	limit  int
+	total  int
+	err    error
+}
+
+func newSetupOutput(logger *slog.Logger, log *os.File, limit int) *setupOutput {
+	return &setupOutput{logger: logger, log: log, limit: limit}
+}
+
+func (o *setupOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// A failing log must not fail the script, so the first error is only remembered
+	if o.err == nil {
+		if _, err := o.log.Write(p); err != nil {
+			o.err = err
+			o.logger.Warn("Failed to write setup log", "error", err)
+		}
+	}
+
+	o.total += len(p)
+	o.tail = append(o.tail, p...)
+	if len(o.tail) > o.limit {
+		o.tail = append(o.tail[:0], o.tail[len(o.tail)-o.limit:]...)
+	}
+	return len(p), nil
+}
+
+// Tail returns the trailing output, starting at a line boundary when truncated
+func (o *setupOutput) Tail() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	tail := string(o.tail)
+	if o.total > len(o.tail) {
+		if i := strings.IndexByte(tail, '\n'); i >= 0 && i < len(tail)-1 {
+			tail = tail[i+1:]
+		}
+		tail = "..." + tail
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(tail, ""))
+}
+
+// Len returns the number of bytes written
+func (o *setupOutput) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.total
+}
@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []string
+		limit    int
+		wantTail string
+	}{
+		{
+			name:     "short output is kept whole",
+			writes:   []string{"line 1\n", "line 2\n"},
+			limit:    64,
+			wantTail: "line 1\nline 2",
+		},
+		{
+			name:     "truncated output starts at a line boundary",
+			writes:   []string{"first line\n", "second line\n", "third\n"},
+			limit:    16,
+			wantTail: "...third",
+		},
+		{
+			name:     "single long line is cut",
+			writes:   []string{strings.Repeat("a", 20)},
+			limit:    8,
+			wantTail: "..." + strings.Repeat("a", 8),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "setup.log")
+			logFile, err := os.Create(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = logFile.Close()
+			}()
+
+			output := newSetupOutput(slog.Default(), logFile, tt.limit)
+			for _, w := range tt.writes {
+				if _, err := output.Write([]byte(w)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+
+			if got := output.Tail(); got != tt.wantTail {
+				t.Errorf("Tail() = %q, want %q", got, tt.wantTail)
+			}
+
+			// The log keeps everything
+			data, err := os.ReadFile(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(tt.writes, ""); string(data) != want {
+				t.Errorf("log = %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestSetupError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *SetupError
+		want string
+	}{
+		{
+			name: "exit status",
+			err:  &SetupError{ExitCode: 3, Tail: "config.sh: not found"},
+			want: "exit status 3: config.sh: not found",
+		},
+		{
+			name: "timeout",
+			err:  &SetupError{ExitCode: -1, TimedOut: true, Timeout: 10 * time.Minute},
+			want: "timed out after 10m0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("Error() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuestSetupCommand(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "setup.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/bash\necho \"token=$TOKEN\"\nexit 3\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("/bin/bash", "-c", guestSetupCommand, script)
+	cmd.Env = append(os.Environ(), "TOKEN=abc")
+	out, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("exit error = %v, want exit status 3", err)
+	}
+	if string(out) != "token=abc\n" {
+		t.Errorf("output = %q, want %q", out, "token=abc\n")
+	}
+	if _, err := os.Stat(script); !os.IsNotExist(err) {
+		t.Errorf("setup script was left in place: %v", err)
+	}
+}
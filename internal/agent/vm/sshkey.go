@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+)
+
+// generateRunnerKey creates an ed25519 keypair dedicated to one runner.
+// The private key is written to path and never leaves the bundle.
+func generateRunnerKey(path string) error {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate SSH key: %w", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return fmt.Errorf("failed to marshal SSH key: %w", err)
+	}
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("failed to write SSH key: %w", err)
+	}
+
+	return nil
+}
+
+// authorizedKey returns the runner's public key in authorized_keys format for
+// delivery to the guest, or an empty string if it has no dedicated key
+func authorizedKey(path string) (string, error) {
+	signer, err := loadRunnerKey(path)
+	if err != nil || signer == nil {
+		return "", err
+	}
+	return auth.FormatPublicKey(signer.PublicKey()), nil
+}
+
+// loadRunnerKey loads the runner's private key, returning nil if it has none
+func loadRunnerKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+	}
+
+	return signer, nil
+}
+
+// runnerKey returns the private key dedicated to the runner, or nil if it has none
+func (m *vzManager) runnerKey(runnerID string) (ssh.Signer, error) {
+	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bundle config: %w", err)
+	}
+
+	return loadRunnerKey(bundleConfig.SSHKeyPath)
+}
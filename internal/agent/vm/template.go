@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"context"
+
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// Templates implements Manager
+func (m *vzManager) Templates() *template.Store {
+	return m.templates
+}
+
+func newTemplateStore(config *model.AgentConfig) *template.Store {
+	var opts []template.Option
+	if config.RequireTemplateMetadata {
+		opts = append(opts, template.RequireMetadata())
+	}
+	return template.NewStore(config.TemplatesDir, config.DefaultTemplate, opts...)
+}
+
+// checkTemplateResources fails if the template needs more than a runner
+// VM is given
+func checkTemplateResources(t *template.Template) error {
+	return t.CheckResources(VMCPUCount, VMMemorySize)
+}
+
+// acquireTemplate resolves the template name and counts it as being cloned
+// until releaseTemplate. The template is verified after it is counted, so
+// it cannot be collected meanwhile and templateMu is not held while it is
+// read.
+func (m *vzManager) acquireTemplate(name, version string) (*template.Template, error) {
+	m.templateMu.Lock()
+	t, err := m.templates.LookupVersion(name, version)
+	if err != nil {
+		m.templateMu.Unlock()
+		return nil, err
+	}
+	m.cloning[t.Path]++
+	m.templateMu.Unlock()
+
+	if err := m.templates.Verify(t); err != nil {
+		m.releaseTemplate(t)
+		return nil, err
+	}
+	return t, nil
+}
+
+func (m *vzManager) releaseTemplate(t *template.Template) {
+	m.templateMu.Lock()
+	defer m.templateMu.Unlock()
+
+	if m.cloning[t.Path]--; m.cloning[t.Path] <= 0 {
+		delete(m.cloning, t.Path)
+	}
+}
+
+// CollectTemplates implements Manager
+func (m *vzManager) CollectTemplates(ctx context.Context) ([]*template.Template, error) {
+	m.templateMu.Lock()
+	defer m.templateMu.Unlock()
+
+	vms, err := ListVMs(m.runnersPath)
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool, len(vms))
+	for _, v := range vms {
+		referenced[v.Template] = true
+	}
+
+	removed, err := m.templates.GC(func(t *template.Template) bool {
+		return m.cloning[t.Path] > 0 || referenced[t.String()]
+	})
+	logger := logging.LoggerFromContext(ctx, logging.WithComponent("vm"))
+	for _, t := range removed {
+		logger.Info("Removed unused template version", "template", t.String())
+	}
+	return removed, err
+}
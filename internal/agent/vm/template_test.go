@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+func TestVMManager_AcquireTemplate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "macos-15", "1")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range template.RequiredFiles {
+		if err := os.WriteFile(filepath.Join(path, f), []byte(f+" content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := template.WriteMetadata(path, &template.Metadata{
+		Name:       "macos-15",
+		Version:    "1",
+		MacOSBuild: "24C101",
+		CreatedAt:  time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	m := &vzManager{templates: template.NewStore(dir, "macos-15"), cloning: make(map[string]int)}
+
+	tmpl, err := m.acquireTemplate("macos-15", "")
+	if err != nil {
+		t.Fatalf("acquireTemplate() error = %v", err)
+	}
+	if n := m.cloning[tmpl.Path]; n != 1 {
+		t.Errorf("cloning count = %d, want 1", n)
+	}
+	m.releaseTemplate(tmpl)
+
+	// A template failing verification is not left counted as being cloned
+	if err := os.WriteFile(filepath.Join(path, "Disk.img"), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.acquireTemplate("macos-15", ""); !errors.Is(err, model.ErrTemplateInvalid) {
+		t.Errorf("acquireTemplate() error = %v, want %v", err, model.ErrTemplateInvalid)
+	}
+	if len(m.cloning) != 0 {
+		t.Errorf("cloning = %v after failed acquireTemplate, want empty", m.cloning)
+	}
+}
+
+func TestCheckTemplateResources_ImportedTart(t *testing.T) {
+	templatesDir := t.TempDir()
+	dir := filepath.Join(templatesDir, "macos-15", "2025.02.01")
+	m := &template.Metadata{Name: "macos-15", Version: "2025.02.01", MacOSBuild: "24C101"}
+	if err := template.ImportTart(filepath.Join("..", "template", "testdata", "tart", "macos"), dir, m); err != nil {
+		t.Fatalf("ImportTart() error = %v", err)
+	}
+	tmpl, err := template.NewStore(templatesDir, "", template.RequireMetadata()).Resolve("macos-15")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+
+	// Tart's 4 CPU and 8 GiB minimums are more than runner VMs get
+	if err := checkTemplateResources(tmpl); err != nil {
+		t.Errorf("checkTemplateResources() of an imported Tart VM error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/Code-Hex/vz/v3"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+)
+
+// errNoTransport is returned when a VM can be reached neither over vsock nor TCP
+var errNoTransport = errors.New("VM has no socket device and its IP address is not yet discovered")
+
+// transportDialer connects to a runner-agent over the VM's virtio socket
+// device, falling back to TCP when vsock is unavailable
+type transportDialer struct {
+	vsock   func() (net.Conn, error) // nil when the VM has no socket device
+	tcpAddr string                   // Empty when the guest IP is not known
+	tcp     net.Dialer
+}
+
+// DialContext ignores the address of the request and dials the VM
+func (d *transportDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	var errs []error
+	if d.vsock != nil {
+		conn, err := d.vsock()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("vsock: %w", err))
+	}
+	if d.tcpAddr != "" {
+		conn, err := d.tcp.DialContext(ctx, "tcp", d.tcpAddr)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("tcp: %w", err))
+	}
+	if len(errs) == 0 {
+		return nil, errNoTransport
+	}
+	return nil, errors.Join(errs...)
+}
+
+// httpClient returns an HTTP client that dials through d
+func (d *transportDialer) httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       d.DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// agentEndpoint is how to reach the runner-agent of a running VM
+type agentEndpoint struct {
+	baseURL string
+	hostKey ssh.PublicKey // Key the runner-agent signs its responses with
+	signer  *auth.Signer  // Signs requests with the secret the runner-agent holds
+	dialer  *transportDialer
+}
+
+// runnerAgentEndpoint returns how to reach the runner-agent of a running VM
+func (m *vzManager) runnerAgentEndpoint(runnerID string) (*agentEndpoint, error) {
+	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bundle config: %w", err)
+	}
+
+	metadata, err := LoadRuntimeMetadata(bundleConfig.RuntimeMetadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load runtime metadata: %w", err)
+	}
+
+	hostKey, err := m.verifiedHostKey(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &transportDialer{}
+	m.mu.RLock()
+	if vm, ok := m.vms[runnerID]; ok {
+		if devices := vm.SocketDevices(); len(devices) > 0 {
+			dialer.vsock = func() (net.Conn, error) {
+				return devices[0].Connect(MonitorVsockPort)
+			}
+		}
+	}
+	m.mu.RUnlock()
+	if metadata.IPAddress != "" {
+		dialer.tcpAddr = net.JoinHostPort(metadata.IPAddress, fmt.Sprint(MonitorTCPPort))
+	}
+	if dialer.vsock == nil && dialer.tcpAddr == "" {
+		return nil, errNoTransport
+	}
+
+	signer := m.signer
+	if metadata.RunnerToken {
+		signer = m.signer.ForRunner(runnerID)
+	}
+
+	// The host part only names the runner in logs; the dialer picks the route
+	return &agentEndpoint{
+		baseURL: "http://" + runnerID,
+		hostKey: hostKey,
+		signer:  signer,
+		dialer:  dialer,
+	}, nil
+}
+
+// listenVsock serves IP notifications from the guest on its socket device
+func (m *vzManager) listenVsock(logger *slog.Logger, runnerID string, vm *vz.VirtualMachine) {
+	devices := vm.SocketDevices()
+	if len(devices) == 0 {
+		return
+	}
+	listener, err := devices[0].Listen(IPNotifyVsockPort)
+	if err != nil {
+		logger.Warn("Failed to listen on vsock; IP notifications need the guest network", "error", err)
+		return
+	}
+
+	m.mu.Lock()
+	m.vsockListeners[runnerID] = listener
+	m.mu.Unlock()
+
+	go func() {
+		if err := m.ipNotifyServer.ServeRunner(listener, runnerID); err != nil {
+			logger.Debug("vsock IP notification listener stopped", "error", err)
+		}
+	}()
+}
+
+// closeVsock stops accepting IP notifications from the guest over vsock
+func (m *vzManager) closeVsock(runnerID string) {
+	m.mu.Lock()
+	listener, ok := m.vsockListeners[runnerID]
+	delete(m.vsockListeners, runnerID)
+	m.mu.Unlock()
+
+	if ok {
+		_ = listener.Close()
+	}
+}
@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportDialer(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		})
+	}
+
+	tcp := httptest.NewServer(handler("tcp"))
+	defer tcp.Close()
+	tcpAddr := strings.TrimPrefix(tcp.URL, "http://")
+
+	// Serves the handler on one end of a pipe per connection, like a socket device
+	vsock := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			_ = http.Serve(&singleConnListener{conn: server}, handler("vsock"))
+		}()
+		return client, nil
+	}
+	brokenVsock := func() (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	tests := []struct {
+		name    string
+		dialer  *transportDialer
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "vsock is preferred",
+			dialer: &transportDialer{vsock: vsock, tcpAddr: tcpAddr},
+			want:   "vsock",
+		},
+		{
+			name:   "falls back to TCP when vsock fails",
+			dialer: &transportDialer{vsock: brokenVsock, tcpAddr: tcpAddr},
+			want:   "tcp",
+		},
+		{
+			name:   "TCP only without a socket device",
+			dialer: &transportDialer{tcpAddr: tcpAddr},
+			want:   "tcp",
+		},
+		{
+			name:    "no transport",
+			dialer:  &transportDialer{},
+			wantErr: errNoTransport,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.dialer.httpClient(5 * time.Second).Get("http://runner-1/status")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Get() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("Get() = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+// singleConnListener accepts conn once; the server keeps serving it after
+// the next Accept fails
+type singleConnListener struct {
+	conn net.Conn
+	done bool
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if l.done {
+		return nil, io.EOF
+	}
+	l.done = true
+	return l.conn, nil
+}
+
+func (l *singleConnListener) Close() error   { return nil }
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
@@ -1,24 +1,36 @@
 package vm
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/Code-Hex/vz/v3"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/whywaita/shoes-vz/internal/agent/ipnotify"
+	"github.com/whywaita/shoes-vz/internal/agent/sshclient"
+	"github.com/whywaita/shoes-vz/internal/agent/template"
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/execstream"
 	"github.com/whywaita/shoes-vz/pkg/logging"
 	"github.com/whywaita/shoes-vz/pkg/model"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
 )
 
+var tracer = tracing.Tracer("vm")
+
 // Manager manages VM lifecycle using Apple Virtualization Framework
 type Manager interface {
 	// Create creates a new VM by cloning the template
-	Create(ctx context.Context, runnerID string) (*VMInfo, error)
+	Create(ctx context.Context, runnerID string, opts CreateOptions) (*VMInfo, error)
 
 	// Start starts the VM and returns the IP address
 	Start(ctx context.Context, runnerID string) (string, error)
@@ -32,11 +44,43 @@ type Manager interface {
 	// WaitForSSH waits until SSH is ready on the VM
 	WaitForSSH(ctx context.Context, runnerID string) error
 
-	// RunSetupScript runs the setup script via SSH
+	// RunSetupScript runs the setup script via runner-agent, failing if it
+	// exits non-zero or runs past the setup timeout
 	RunSetupScript(ctx context.Context, runnerID, script string) error
 
 	// Exec executes a command on the VM via HTTP (using runner-agent)
 	Exec(ctx context.Context, runnerID, command string, args []string) ([]byte, int, error)
+
+	// ExecStream executes a command on the VM via runner-agent, streaming
+	// stdin, stdout and stderr while it runs
+	ExecStream(ctx context.Context, runnerID string, req execstream.Request, stdin io.Reader, stdout, stderr io.Writer) (*execstream.Result, error)
+
+	// CopyFromVM copies a file or directory from the VM via runner-agent
+	// and returns the local path it was written to
+	CopyFromVM(ctx context.Context, runnerID, remotePath, localPath string) (string, error)
+
+	// CopyToVM copies a file or directory to the VM via runner-agent
+	// and returns the path it was written to in the guest
+	CopyToVM(ctx context.Context, runnerID, localPath, remotePath string) (string, error)
+
+	// ReadConsoleLog returns up to the last limit bytes of the VM's serial
+	// console output (0 for all of it), also after the VM has stopped
+	ReadConsoleLog(runnerID string, limit int64) ([]byte, error)
+
+	// Logger returns the logger from ctx with runner_id attached, also
+	// writing to the runner's agent.log once its bundle exists
+	Logger(ctx context.Context, runnerID string) *slog.Logger
+
+	// CloseLog closes the runner's agent.log. Loggers returned earlier drop
+	// their records from then on.
+	CloseLog(runnerID string)
+
+	// Templates returns the templates VMs are cloned from
+	Templates() *template.Store
+
+	// CollectTemplates removes template versions older than the active one
+	// that no runner is being or was cloned from, and returns them
+	CollectTemplates(ctx context.Context) ([]*template.Template, error)
 }
 
 // VMInfo contains information about a VM
@@ -44,56 +88,110 @@ type VMInfo struct {
 	RunnerID   string
 	BundlePath string
 	IPAddress  string // Guest IP address for SSH connection
+	Template   *template.Template
 }
 
 // vzManager implements Manager using Code-Hex/vz
 type vzManager struct {
-	templatePath   string
+	templates      *template.Store
 	runnersPath    string
-	sshKeyPath     string
+	sshPool        *sshclient.Pool
 	ipNotifyServer *ipnotify.Server
 	enableGraphics bool
-
-	mu  sync.RWMutex
-	vms map[string]*vz.VirtualMachine
+	signer         *auth.Signer
+	sshInsecure    bool
+	maxTransfer    int64
+	setupTimeout   time.Duration
+	authSecret     []byte
+	callbackAddr   string
+	consoleLogSize int64
+
+	mu             sync.RWMutex
+	vms            map[string]*vz.VirtualMachine
+	vsockListeners map[string]*vz.VirtioSocketListener // IP notification listeners by runner ID
+	consoles       map[string]*consoleCapture          // Serial console captures by runner ID
+	agentLogs      map[string]*logging.RotatingFile    // Open agent.log files by runner ID
+
+	// Number of clones in progress by template path, so that CollectTemplates
+	// does not remove a version before its bundles record it
+	templateMu sync.Mutex
+	cloning    map[string]int
 }
 
 // NewManager creates a new VM Manager
 func NewManager(config *model.AgentConfig, ipNotifyServer *ipnotify.Server) Manager {
-	return &vzManager{
-		templatePath:   config.TemplatePath,
+	m := &vzManager{
+		templates:      newTemplateStore(config),
 		runnersPath:    config.RunnersPath,
-		sshKeyPath:     config.SSHKeyPath,
 		ipNotifyServer: ipNotifyServer,
 		enableGraphics: config.EnableGraphics,
+		signer:         auth.NewSigner(config.AuthSecret),
+		sshInsecure:    config.SSHInsecure,
+		maxTransfer:    config.MaxTransferSize,
+		setupTimeout:   config.SetupTimeout,
+		authSecret:     config.AuthSecret,
+		callbackAddr:   config.CallbackAddr,
 		vms:            make(map[string]*vz.VirtualMachine),
-	}
+		vsockListeners: make(map[string]*vz.VirtioSocketListener),
+		consoles:       make(map[string]*consoleCapture),
+		agentLogs:      make(map[string]*logging.RotatingFile),
+		consoleLogSize: config.ConsoleLogSize,
+		cloning:        make(map[string]int),
+	}
+	if m.consoleLogSize <= 0 {
+		m.consoleLogSize = DefaultConsoleLogSize
+	}
+	m.sshPool = sshclient.NewPool(sshclient.Config{
+		User:                  config.SSHUser,
+		Port:                  config.SSHPort,
+		KeyPath:               config.SSHKeyPath,
+		HostKey:               m.pinnedHostKey,
+		ClientKey:             m.runnerKey,
+		InsecureIgnoreHostKey: config.SSHInsecure,
+	})
+	return m
 }
 
-// Create creates a new VM by cloning the template
-func (m *vzManager) Create(ctx context.Context, runnerID string) (*VMInfo, error) {
+// Create creates a new VM by cloning the template named in opts
+func (m *vzManager) Create(ctx context.Context, runnerID string, opts CreateOptions) (_ *VMInfo, err error) {
+	ctx, span := tracer.Start(ctx, "vm.Create", trace.WithAttributes(tracing.RunnerIDKey.String(runnerID)))
+	defer func() { tracing.End(span, err) }()
+
+	// Fail before creating anything if the template does not exist or
+	// does not match its metadata
+	tmpl, err := m.acquireTemplate(opts.Template, opts.TemplateVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer m.releaseTemplate(tmpl)
+	if err := checkTemplateResources(tmpl); err != nil {
+		return nil, err
+	}
+
 	// Create runner bundle directory
 	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
 	if err := os.MkdirAll(bundlePath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create bundle directory: %w", err)
 	}
+	logger := m.Logger(ctx, runnerID)
+	logger.Info("Cloning template", "template", tmpl.String(), "template_path", tmpl.Path, "bundle_path", bundlePath)
 
 	// Clone Disk.img
-	diskSrc := filepath.Join(m.templatePath, "Disk.img")
+	diskSrc := filepath.Join(tmpl.Path, "Disk.img")
 	diskDst := filepath.Join(bundlePath, "Disk.img")
 	if err := cloneFile(diskSrc, diskDst); err != nil {
 		return nil, fmt.Errorf("failed to clone disk: %w", err)
 	}
 
 	// Clone AuxiliaryStorage
-	auxSrc := filepath.Join(m.templatePath, "AuxiliaryStorage")
+	auxSrc := filepath.Join(tmpl.Path, "AuxiliaryStorage")
 	auxDst := filepath.Join(bundlePath, "AuxiliaryStorage")
 	if err := cloneFile(auxSrc, auxDst); err != nil {
 		return nil, fmt.Errorf("failed to clone auxiliary storage: %w", err)
 	}
 
 	// Copy HardwareModel.json (required for macOS VMs)
-	hwModelSrc := filepath.Join(m.templatePath, "HardwareModel.json")
+	hwModelSrc := filepath.Join(tmpl.Path, "HardwareModel.json")
 	hwModelDst := filepath.Join(bundlePath, "HardwareModel.json")
 	if _, err := os.Stat(hwModelSrc); os.IsNotExist(err) {
 		return nil, fmt.Errorf("hardware model not found in template: %s", hwModelSrc)
@@ -115,35 +213,56 @@ func (m *vzManager) Create(ctx context.Context, runnerID string) (*VMInfo, error
 		return nil, fmt.Errorf("failed to write machine identifier: %w", err)
 	}
 
+	// Generate an SSH keypair used only for this runner
+	if err := generateRunnerKey(filepath.Join(bundlePath, "id_ed25519")); err != nil {
+		return nil, fmt.Errorf("failed to generate runner SSH key: %w", err)
+	}
+
+	// Build the config disk carrying the guest's identity and setup script
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bundle config: %w", err)
+	}
+	if err := m.writeConfigDisk(bundleConfig, runnerID, opts); err != nil {
+		return nil, fmt.Errorf("failed to write config disk: %w", err)
+	}
+
 	// Save runtime metadata
 	now := time.Now().Format(time.RFC3339)
 	metadata := &RuntimeMetadata{
-		RunnerID:  runnerID,
-		IPAddress: "", // Will be set after VM starts and we get the IP
-		CreatedAt: now,
-		State:     "creating",
-		UpdatedAt: now,
+		RunnerID:        runnerID,
+		IPAddress:       "", // Will be set after VM starts and we get the IP
+		CreatedAt:       now,
+		State:           "creating",
+		UpdatedAt:       now,
+		Template:        tmpl.Name,
+		TemplateVersion: tmpl.Version,
+	}
+	if tmpl.Metadata != nil {
+		metadata.MacOSBuild = tmpl.Metadata.MacOSBuild
 	}
 	metadataPath := filepath.Join(bundlePath, "RuntimeMetadata.json")
 	if err := SaveRuntimeMetadata(metadataPath, metadata); err != nil {
 		return nil, fmt.Errorf("failed to save runtime metadata: %w", err)
 	}
+	logger.Info("VM bundle created")
 
 	return &VMInfo{
 		RunnerID:   runnerID,
 		BundlePath: bundlePath,
 		IPAddress:  "", // Will be discovered after VM starts
+		Template:   tmpl,
 	}, nil
 }
 
 // Start starts the VM and returns the IP address
-func (m *vzManager) Start(ctx context.Context, runnerID string) (string, error) {
-	logger := logging.WithComponent("vm")
+func (m *vzManager) Start(ctx context.Context, runnerID string) (_ string, err error) {
+	logger := m.Logger(ctx, runnerID)
 
 	// Update state to booting
 	if err := m.UpdateState(runnerID, "booting"); err != nil {
 		// Log but don't fail
-		logger.Warn("Failed to update state to booting", "runner_id", runnerID, "error", err)
+		logger.Warn("Failed to update state to booting", "error", err)
 	}
 
 	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
@@ -152,30 +271,69 @@ func (m *vzManager) Start(ctx context.Context, runnerID string) (string, error)
 	bundleConfig, err := LoadBundleConfig(bundlePath)
 	if err != nil {
 		if updateErr := m.UpdateState(runnerID, "error"); updateErr != nil {
-			logger.Warn("Failed to update state to error", "runner_id", runnerID, "error", updateErr)
+			logger.Warn("Failed to update state to error", "error", updateErr)
 		}
 		return "", fmt.Errorf("failed to load bundle config: %w", err)
 	}
 
+	// Stop capturing the console of a VM that failed to come up, since it
+	// may never be stopped
+	defer func() {
+		if err != nil {
+			m.closeConsole(runnerID)
+		}
+	}()
+
+	_, span := tracer.Start(ctx, "vm.Boot", trace.WithAttributes(tracing.RunnerIDKey.String(runnerID)))
+	err = m.boot(logger, runnerID, bundleConfig)
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+
+	ipCtx, span := tracer.Start(ctx, "vm.WaitForIP", trace.WithAttributes(tracing.RunnerIDKey.String(runnerID)))
+	ipAddress, err := m.waitForIP(ipCtx, logger, runnerID, bundleConfig)
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+
+	// Update state to running
+	if err := m.UpdateState(runnerID, "running"); err != nil {
+		logger.Warn("Failed to update state to running", "error", err)
+	}
+
+	return ipAddress, nil
+}
+
+// boot creates the VM with its console capture and waits until it is running.
+// The caller closes the console capture if it fails.
+func (m *vzManager) boot(logger *slog.Logger, runnerID string, bundleConfig *BundleConfig) error {
+	// Capture the serial console from the first boot message
+	console, err := m.startConsole(runnerID, bundleConfig)
+	if err != nil {
+		return fmt.Errorf("failed to start console capture: %w", err)
+	}
+
 	// Create VM configuration
-	vmConfig, err := m.createVMConfig(bundleConfig)
+	vmConfig, err := m.createVMConfig(bundleConfig, console)
 	if err != nil {
-		return "", fmt.Errorf("failed to create VM config: %w", err)
+		return fmt.Errorf("failed to create VM config: %w", err)
 	}
 
 	// Validate configuration
 	validated, err := vmConfig.Validate()
 	if err != nil {
-		return "", fmt.Errorf("VM config validation failed: %w", err)
+		return fmt.Errorf("VM config validation failed: %w", err)
 	}
 	if !validated {
-		return "", fmt.Errorf("VM config validation returned false")
+		return fmt.Errorf("VM config validation returned false")
 	}
 
 	// Create and start VM
 	vm, err := vz.NewVirtualMachine(vmConfig)
 	if err != nil {
-		return "", fmt.Errorf("failed to create VM: %w", err)
+		return fmt.Errorf("failed to create VM: %w", err)
 	}
 
 	// Store VM instance
@@ -184,58 +342,75 @@ func (m *vzManager) Start(ctx context.Context, runnerID string) (string, error)
 	m.mu.Unlock()
 
 	// Start VM
-	logger.Info("Starting VM", "runner_id", runnerID, "graphics_enabled", m.enableGraphics)
+	logger.Info("Starting VM", "graphics_enabled", m.enableGraphics)
 	if err := vm.Start(); err != nil {
-		return "", fmt.Errorf("failed to start VM: %w", err)
+		return fmt.Errorf("failed to start VM: %w", err)
 	}
 
 	// Wait for VM to reach running state
-	logger.Info("Waiting for VM to reach running state", "runner_id", runnerID)
+	logger.Info("Waiting for VM to reach running state")
 	for i := 0; i < 60; i++ {
 		state := vm.State()
-		logger.Debug("VM state check", "runner_id", runnerID, "attempt", i+1, "state", state)
+		logger.Debug("VM state check", "attempt", i+1, "state", state)
 		if state == vz.VirtualMachineStateRunning {
 			break
 		}
 		if state == vz.VirtualMachineStateError || state == vz.VirtualMachineStateStopped {
-			logger.Error("VM failed to start", "runner_id", runnerID, "state", state)
-			return "", fmt.Errorf("VM failed to start, state: %v", state)
+			logger.Error("VM failed to start", "state", state)
+			return fmt.Errorf("VM failed to start, state: %v", state)
 		}
 		time.Sleep(1 * time.Second)
 	}
 
 	if vm.State() != vz.VirtualMachineStateRunning {
-		logger.Error("VM did not reach running state", "runner_id", runnerID, "state", vm.State())
-		return "", fmt.Errorf("VM did not reach running state, current state: %v", vm.State())
+		logger.Error("VM did not reach running state", "state", vm.State())
+		return fmt.Errorf("VM did not reach running state, current state: %v", vm.State())
 	}
 
-	logger.Info("VM is now running, waiting for IP notification", "runner_id", runnerID)
+	// Accept IP notifications over vsock as well, for guests whose network is not up yet
+	m.listenVsock(logger, runnerID, vm)
+	return nil
+}
+
+// waitForIP waits for the guest to report its address and records it with the host key
+func (m *vzManager) waitForIP(ctx context.Context, logger *slog.Logger, runnerID string, bundleConfig *BundleConfig) (string, error) {
+	logger.Info("VM is now running, waiting for IP notification")
 
 	// Wait for IP notification from runner-agent (2 minutes timeout)
-	// The runner-agent will send its IOPlatformUUID (obtained from ioreg) as runner_id
-	// The IP notify server will match it to this runner ID using FIFO queue
-	ipAddress, err := m.ipNotifyServer.WaitForIP(ctx, runnerID, 2*time.Minute)
+	// A runner-agent that read the config disk sends this runner ID; older
+	// guests send their IOPlatformUUID, which is matched using a FIFO queue
+	ipInfo, err := m.ipNotifyServer.WaitForIP(ctx, runnerID, 2*time.Minute)
 	if err != nil {
 		return "", fmt.Errorf("failed to receive IP notification: %w", err)
 	}
+	ipAddress := ipInfo.IPAddress
+
+	logger.Info("Guest IP received via notification", "ip_address", ipAddress)
 
-	logger.Info("Guest IP received via notification", "runner_id", runnerID, "ip_address", ipAddress)
+	// Pin the host key reported by the guest for all later SSH and exec connections
+	if ipInfo.HostKey != "" {
+		if err := m.UpdateHostKey(runnerID, ipInfo.HostKey); err != nil {
+			return "", fmt.Errorf("failed to pin host key: %w", err)
+		}
+	} else if m.sshInsecure {
+		logger.Warn("Guest did not report an SSH host key; connecting without host key verification")
+	} else {
+		logger.Error("Guest did not report an SSH host key; SSH and exec will be refused")
+	}
 
 	// Update metadata with the discovered IP
 	if err := m.UpdateIPAddress(runnerID, ipAddress); err != nil {
 		return "", fmt.Errorf("failed to update IP address: %w", err)
 	}
-
-	// Update state to running
-	if err := m.UpdateState(runnerID, "running"); err != nil {
-		logger.Warn("Failed to update state to running", "runner_id", runnerID, "error", err)
+	if err := m.UpdateConfigDisk(runnerID, ipInfo.ConfigDisk, ipInfo.RunnerToken); err != nil {
+		return "", fmt.Errorf("failed to record config disk: %w", err)
 	}
 
 	return ipAddress, nil
 }
 
 // createVMConfig creates a VM configuration
-func (m *vzManager) createVMConfig(bundleConfig *BundleConfig) (*vz.VirtualMachineConfiguration, error) {
+func (m *vzManager) createVMConfig(bundleConfig *BundleConfig, console *consoleCapture) (*vz.VirtualMachineConfiguration, error) {
 	// Create boot loader
 	bootLoader, err := vz.NewMacOSBootLoader()
 	if err != nil {
@@ -246,8 +421,8 @@ func (m *vzManager) createVMConfig(bundleConfig *BundleConfig) (*vz.VirtualMachi
 	// Parameters: bootLoader, CPUCount, MemorySize
 	config, err := vz.NewVirtualMachineConfiguration(
 		bootLoader,
-		2,                // CPU count
-		4*1024*1024*1024, // 4GB memory
+		VMCPUCount,
+		VMMemorySize,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create VM config: %w", err)
@@ -303,7 +478,22 @@ func (m *vzManager) createVMConfig(bundleConfig *BundleConfig) (*vz.VirtualMachi
 		return nil, fmt.Errorf("failed to create storage config: %w", err)
 	}
 
-	config.SetStorageDevicesVirtualMachineConfiguration([]vz.StorageDeviceConfiguration{storageConfig})
+	storageDevices := []vz.StorageDeviceConfiguration{storageConfig}
+
+	// Attach the config disk read-only; bundles created before it existed have none
+	if _, err := os.Stat(bundleConfig.ConfigDiskPath); err == nil {
+		configDiskAttachment, err := vz.NewDiskImageStorageDeviceAttachment(bundleConfig.ConfigDiskPath, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create config disk attachment: %w", err)
+		}
+		configDiskConfig, err := vz.NewVirtioBlockDeviceConfiguration(configDiskAttachment)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create config disk storage config: %w", err)
+		}
+		storageDevices = append(storageDevices, configDiskConfig)
+	}
+
+	config.SetStorageDevicesVirtualMachineConfiguration(storageDevices)
 
 	// Create network device with NAT
 	natAttachment, err := vz.NewNATNetworkDeviceAttachment()
@@ -318,6 +508,20 @@ func (m *vzManager) createVMConfig(bundleConfig *BundleConfig) (*vz.VirtualMachi
 
 	config.SetNetworkDevicesVirtualMachineConfiguration([]*vz.VirtioNetworkDeviceConfiguration{networkConfig})
 
+	// Socket device for talking to runner-agent without the guest network
+	socketConfig, err := vz.NewVirtioSocketDeviceConfiguration()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket device config: %w", err)
+	}
+	config.SetSocketDevicesVirtualMachineConfiguration([]vz.SocketDeviceConfiguration{socketConfig})
+
+	// Serial console, written to console.log
+	serialPort, err := console.serialPort()
+	if err != nil {
+		return nil, err
+	}
+	config.SetSerialPortsVirtualMachineConfiguration([]*vz.VirtioConsoleDeviceSerialPortConfiguration{serialPort})
+
 	// Add graphics device if graphics is enabled
 	if m.enableGraphics {
 		// Create Mac graphics device
@@ -354,8 +558,17 @@ func (m *vzManager) createVMConfig(bundleConfig *BundleConfig) (*vz.VirtualMachi
 }
 
 // Stop stops the VM
-func (m *vzManager) Stop(ctx context.Context, runnerID string) error {
-	logger := logging.WithComponent("vm")
+func (m *vzManager) Stop(ctx context.Context, runnerID string) (err error) {
+	ctx, span := tracer.Start(ctx, "vm.Stop", trace.WithAttributes(tracing.RunnerIDKey.String(runnerID)))
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.Logger(ctx, runnerID)
+
+	// Drop the pooled SSH connection; it will not survive the VM
+	m.sshPool.Close(runnerID)
+
+	// Keep capturing the console until the VM is down, so shutdown messages are logged
+	defer m.closeConsole(runnerID)
 
 	m.mu.RLock()
 	vm, exists := m.vms[runnerID]
@@ -365,6 +578,8 @@ func (m *vzManager) Stop(ctx context.Context, runnerID string) error {
 		return fmt.Errorf("VM not found: %s", runnerID)
 	}
 
+	m.closeVsock(runnerID)
+
 	// Try graceful shutdown first
 	if vm.CanRequestStop() {
 		result, err := vm.RequestStop()
@@ -376,7 +591,7 @@ func (m *vzManager) Stop(ctx context.Context, runnerID string) error {
 					delete(m.vms, runnerID)
 					m.mu.Unlock()
 					if err := m.UpdateState(runnerID, "stopped"); err != nil {
-						logger.Warn("Failed to update state to stopped", "runner_id", runnerID, "error", err)
+						logger.Warn("Failed to update state to stopped", "error", err)
 					}
 					return nil
 				}
@@ -396,33 +611,57 @@ func (m *vzManager) Stop(ctx context.Context, runnerID string) error {
 
 	// Update state to stopped
 	if err := m.UpdateState(runnerID, "stopped"); err != nil {
-		logger.Warn("Failed to update state to stopped", "runner_id", runnerID, "error", err)
+		logger.Warn("Failed to update state to stopped", "error", err)
 	}
 
 	return nil
 }
 
 // Delete deletes the VM and its bundle
-func (m *vzManager) Delete(ctx context.Context, runnerID string) error {
-	logger := logging.WithComponent("vm")
+func (m *vzManager) Delete(ctx context.Context, runnerID string) (err error) {
+	ctx, span := tracer.Start(ctx, "vm.Delete", trace.WithAttributes(tracing.RunnerIDKey.String(runnerID)))
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.Logger(ctx, runnerID)
+	defer m.CloseLog(runnerID)
 
 	// Ensure VM is stopped
 	if err := m.Stop(ctx, runnerID); err != nil {
 		// Log error but continue with deletion
-		logger.Warn("Failed to stop VM before deletion", "runner_id", runnerID, "error", err)
+		logger.Warn("Failed to stop VM before deletion", "error", err)
 	}
 
-	// Delete bundle directory
+	// Destroy the runner's SSH key before anything else in the bundle,
+	// so it is gone even if removing the rest fails
 	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
+	bundleConfig, err := LoadBundleConfig(bundlePath)
+	if err != nil {
+		return fmt.Errorf("failed to load bundle config: %w", err)
+	}
+	if err := os.Remove(bundleConfig.SSHKeyPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete runner SSH key: %w", err)
+	}
+
+	// Delete bundle directory
+	logger.Info("Deleting VM bundle", "bundle_path", bundlePath)
+	m.CloseLog(runnerID)
 	if err := os.RemoveAll(bundlePath); err != nil {
 		return fmt.Errorf("failed to delete bundle: %w", err)
 	}
 
+	// The bundle may have been the last one cloned from an old version
+	if _, err := m.CollectTemplates(ctx); err != nil {
+		logger.Warn("Failed to collect unused template versions", "error", err)
+	}
+
 	return nil
 }
 
 // WaitForSSH waits until SSH is ready on the VM
-func (m *vzManager) WaitForSSH(ctx context.Context, runnerID string) error {
+func (m *vzManager) WaitForSSH(ctx context.Context, runnerID string) (err error) {
+	ctx, span := tracer.Start(ctx, "vm.WaitForSSH", trace.WithAttributes(tracing.RunnerIDKey.String(runnerID)))
+	defer func() { tracing.End(span, err) }()
+
 	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
 	bundleConfig, err := LoadBundleConfig(bundlePath)
 	if err != nil {
@@ -434,41 +673,67 @@ func (m *vzManager) WaitForSSH(ctx context.Context, runnerID string) error {
 		return fmt.Errorf("failed to load runtime metadata: %w", err)
 	}
 
-	return waitForSSH(ctx, runnerID, metadata.IPAddress, m.sshKeyPath, 5*time.Minute)
+	return waitForSSH(ctx, m.Logger(ctx, runnerID), m.sshPool, runnerID, metadata.IPAddress, 5*time.Minute)
 }
 
-// RunSetupScript runs the setup script via SSH
-func (m *vzManager) RunSetupScript(ctx context.Context, runnerID, script string) error {
-	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
-	bundleConfig, err := LoadBundleConfig(bundlePath)
+// Exec executes a command on the VM via HTTP using runner-agent and returns
+// its combined output. It runs until ctx is done.
+func (m *vzManager) Exec(ctx context.Context, runnerID, command string, args []string) ([]byte, int, error) {
+	var output lockedBuffer
+	result, err := m.ExecStream(ctx, runnerID, execstream.Request{Command: command, Args: args}, nil, &output, &output)
 	if err != nil {
-		return fmt.Errorf("failed to load bundle config: %w", err)
+		return output.Bytes(), -1, err
 	}
 
-	metadata, err := LoadRuntimeMetadata(bundleConfig.RuntimeMetadataPath)
-	if err != nil {
-		return fmt.Errorf("failed to load runtime metadata: %w", err)
+	if result.Error != "" {
+		return output.Bytes(), result.ExitCode, fmt.Errorf("command execution failed: %s", result.Error)
 	}
 
-	return runSSHScript(ctx, runnerID, metadata.IPAddress, m.sshKeyPath, script)
+	return output.Bytes(), result.ExitCode, nil
 }
 
-// Exec executes a command on the VM via HTTP using runner-agent
-func (m *vzManager) Exec(ctx context.Context, runnerID, command string, args []string) ([]byte, int, error) {
-	bundlePath := filepath.Join(m.runnersPath, fmt.Sprintf("%s.bundle", runnerID))
-	bundleConfig, err := LoadBundleConfig(bundlePath)
+// ExecStream executes a command on the VM via runner-agent, streaming its I/O
+func (m *vzManager) ExecStream(ctx context.Context, runnerID string, req execstream.Request, stdin io.Reader, stdout, stderr io.Writer) (*execstream.Result, error) {
+	endpoint, err := m.runnerAgentEndpoint(runnerID)
 	if err != nil {
-		return nil, -1, fmt.Errorf("failed to load bundle config: %w", err)
+		return nil, err
 	}
 
-	metadata, err := LoadRuntimeMetadata(bundleConfig.RuntimeMetadataPath)
-	if err != nil {
-		return nil, -1, fmt.Errorf("failed to load runtime metadata: %w", err)
+	client := &execstream.Client{
+		HTTPClient: endpoint.dialer.httpClient(0),
+		Signer:     endpoint.signer,
+		HostKey:    endpoint.hostKey,
 	}
+	return client.Run(ctx, endpoint.baseURL, req, stdin, stdout, stderr)
+}
 
-	if metadata.IPAddress == "" {
-		return nil, -1, fmt.Errorf("VM IP address not yet discovered")
+// verifiedHostKey returns the pinned host key that runner-agent responses
+// must be signed with. It returns nil only if unpinned guests are allowed.
+func (m *vzManager) verifiedHostKey(metadata *RuntimeMetadata) (ssh.PublicKey, error) {
+	if metadata.HostKey == "" {
+		if m.sshInsecure {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %s", sshclient.ErrNoHostKey, metadata.RunnerID)
 	}
 
-	return execViaHTTP(ctx, metadata.IPAddress, MonitorTCPPort, command, args)
+	return auth.ParseHostKey(metadata.HostKey)
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writers
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
 }
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/whywaita/shoes-vz/pkg/configdisk"
 	"github.com/whywaita/shoes-vz/pkg/model"
 )
 
@@ -107,16 +108,17 @@ func TestVMManager_Create(t *testing.T) {
 	tmpDir := t.TempDir()
 
 	config := &model.AgentConfig{
-		TemplatePath: templatePath,
-		RunnersPath:  tmpDir,
-		SSHKeyPath:   "",
+		TemplatesDir:    filepath.Dir(templatePath),
+		DefaultTemplate: filepath.Base(templatePath),
+		RunnersPath:     tmpDir,
+		SSHKeyPath:      "",
 	}
 
 	manager := NewManager(config, nil)
 
 	// Test VM creation
 	ctx := context.Background()
-	vmInfo, err := manager.Create(ctx, "test-runner-1")
+	vmInfo, err := manager.Create(ctx, "test-runner-1", CreateOptions{RunnerName: "test-runner", SetupScript: "echo setup"})
 	if err != nil {
 		t.Fatalf("Create() error = %v", err)
 	}
@@ -132,6 +134,27 @@ func TestVMManager_Create(t *testing.T) {
 		t.Errorf("Disk.img was not cloned: %s", diskPath)
 	}
 
+	// Verify a runner-specific SSH key was generated
+	keyPath := filepath.Join(vmInfo.BundlePath, "id_ed25519")
+	if info, err := os.Stat(keyPath); err != nil {
+		t.Errorf("runner SSH key was not generated: %v", err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("runner SSH key mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// Verify the config disk carries the runner's identity
+	configDisk, err := os.Open(filepath.Join(vmInfo.BundlePath, "ConfigDisk.img"))
+	if err != nil {
+		t.Fatalf("config disk was not created: %v", err)
+	}
+	manifest, err := configdisk.ReadManifest(configDisk)
+	_ = configDisk.Close()
+	if err != nil {
+		t.Errorf("ReadManifest() error = %v", err)
+	} else if manifest.RunnerID != "test-runner-1" || manifest.SetupScript != "echo setup" {
+		t.Errorf("manifest = %+v, want runner test-runner-1 with setup script", manifest)
+	}
+
 	// Verify metadata was saved
 	metadataPath := filepath.Join(vmInfo.BundlePath, "RuntimeMetadata.json")
 	if _, err := os.Stat(metadataPath); os.IsNotExist(err) {
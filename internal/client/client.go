@@ -3,15 +3,25 @@ package client
 import (
 	"context"
 	"fmt"
+	"log/slog"
 
 	myshoespb "github.com/whywaita/myshoes/api/proto.go"
 	shoesvzpb "github.com/whywaita/shoes-vz/gen/go/shoes/vz/shoes/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
+
+	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/tlsconfig"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
 )
 
+var tracer = tracing.Tracer("client")
+
 // Client implements the ShoesServer interface and acts as a bridge between
 // myshoes and shoes-vz-server
 type Client struct {
@@ -22,10 +32,25 @@ type Client struct {
 }
 
 // NewClient creates a new Client instance
-func NewClient(config *Config) (*Client, error) {
+func NewClient(config *Config, logger *slog.Logger) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if config.TLS {
+		tlsConfig, err := tlsconfig.NewClientConfig(tlsconfig.Files{
+			CertFile: config.TLSCertFile,
+			KeyFile:  config.TLSKeyFile,
+			CAFile:   config.TLSCAFile,
+		}, config.TLSServerName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up TLS: %w", err)
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
 	conn, err := grpc.NewClient(
 		config.ServerAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithStatsHandler(tracing.ClientHandler()),
+		grpc.WithUnaryInterceptor(logging.UnaryClientInterceptor(logger)),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gRPC client: %w", err)
@@ -51,7 +76,12 @@ func (c *Client) Close() error {
 // AddInstance implements the ShoesServer interface
 // It converts myshoes AddInstanceRequest to shoes-vz AddInstanceRequest,
 // calls shoes-vz-server, and converts the response back
-func (c *Client) AddInstance(ctx context.Context, req *myshoespb.AddInstanceRequest) (*myshoespb.AddInstanceResponse, error) {
+func (c *Client) AddInstance(ctx context.Context, req *myshoespb.AddInstanceRequest) (_ *myshoespb.AddInstanceResponse, err error) {
+	ctx, span := tracer.Start(ctx, "client.AddInstance", trace.WithAttributes(
+		attribute.String("shoes_vz.runner_name", req.RunnerName),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	// Convert resource type from enum to string
 	resourceType, err := ConvertResourceType(req.ResourceType)
 	if err != nil {
@@ -72,6 +102,8 @@ func (c *Client) AddInstance(ctx context.Context, req *myshoespb.AddInstanceRequ
 		return nil, err
 	}
 
+	span.SetAttributes(tracing.CloudIDKey.String(vzResp.CloudId))
+
 	// Convert response back to myshoes format
 	resp := &myshoespb.AddInstanceResponse{
 		CloudId:      vzResp.CloudId,
@@ -86,15 +118,19 @@ func (c *Client) AddInstance(ctx context.Context, req *myshoespb.AddInstanceRequ
 // DeleteInstance implements the ShoesServer interface
 // It converts myshoes DeleteInstanceRequest to shoes-vz DeleteInstanceRequest
 // and calls shoes-vz-server
-func (c *Client) DeleteInstance(ctx context.Context, req *myshoespb.DeleteInstanceRequest) (*myshoespb.DeleteInstanceResponse, error) {
+func (c *Client) DeleteInstance(ctx context.Context, req *myshoespb.DeleteInstanceRequest) (_ *myshoespb.DeleteInstanceResponse, err error) {
+	ctx, span := tracer.Start(ctx, "client.DeleteInstance", trace.WithAttributes(
+		tracing.CloudIDKey.String(req.CloudId),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	// Create shoes-vz request
 	vzReq := &shoesvzpb.DeleteInstanceRequest{
 		CloudId: req.CloudId,
 	}
 
 	// Call shoes-vz-server
-	_, err := c.vzClient.DeleteInstance(ctx, vzReq)
-	if err != nil {
+	if _, err := c.vzClient.DeleteInstance(ctx, vzReq); err != nil {
 		return nil, err
 	}
 
@@ -68,6 +68,85 @@ func TestLoadConfig(t *testing.T) {
 	}
 }
 
+func TestLoadConfig_OTLP(t *testing.T) {
+	tests := []struct {
+		name         string
+		endpoint     string
+		insecure     string
+		wantErr      bool
+		wantEndpoint string
+		wantInsecure bool
+	}{
+		{name: "tracing disabled", wantEndpoint: "", wantInsecure: false},
+		{name: "endpoint with TLS", endpoint: "otel.example.com:4317", wantEndpoint: "otel.example.com:4317"},
+		{name: "insecure endpoint", endpoint: "localhost:4317", insecure: "true", wantEndpoint: "localhost:4317", wantInsecure: true},
+		{name: "invalid insecure flag", endpoint: "localhost:4317", insecure: "maybe", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvShoesVzServerAddr, "localhost:50051")
+			t.Setenv(EnvOTLPEndpoint, tt.endpoint)
+			t.Setenv(EnvOTLPInsecure, tt.insecure)
+
+			config, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if config.OTLPEndpoint != tt.wantEndpoint {
+				t.Errorf("LoadConfig() OTLPEndpoint = %v, want %v", config.OTLPEndpoint, tt.wantEndpoint)
+			}
+			if config.OTLPInsecure != tt.wantInsecure {
+				t.Errorf("LoadConfig() OTLPInsecure = %v, want %v", config.OTLPInsecure, tt.wantInsecure)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_TLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+		wantTLS bool
+	}{
+		{name: "plaintext by default", wantTLS: false},
+		{name: "system roots", env: map[string]string{EnvTLS: "true"}, wantTLS: true},
+		{name: "TLS explicitly off", env: map[string]string{EnvTLS: "false"}, wantTLS: false},
+		{name: "CA implies TLS", env: map[string]string{EnvTLSCA: "/etc/shoes-vz/ca.pem"}, wantTLS: true},
+		{name: "mutual TLS", env: map[string]string{EnvTLSCA: "/etc/shoes-vz/ca.pem", EnvTLSCert: "/etc/shoes-vz/client.pem", EnvTLSKey: "/etc/shoes-vz/client-key.pem"}, wantTLS: true},
+		{name: "invalid TLS flag", env: map[string]string{EnvTLS: "maybe"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvShoesVzServerAddr, "localhost:50051")
+			for _, key := range []string{EnvTLS, EnvTLSCA, EnvTLSCert, EnvTLSKey, EnvTLSServerName} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			config, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if config.TLS != tt.wantTLS {
+				t.Errorf("LoadConfig() TLS = %v, want %v", config.TLS, tt.wantTLS)
+			}
+			if config.TLSCAFile != tt.env[EnvTLSCA] || config.TLSCertFile != tt.env[EnvTLSCert] || config.TLSKeyFile != tt.env[EnvTLSKey] {
+				t.Errorf("LoadConfig() TLS files = %q, %q, %q", config.TLSCAFile, config.TLSCertFile, config.TLSKeyFile)
+			}
+		})
+	}
+}
+
 func TestConvertResourceType(t *testing.T) {
 	tests := []struct {
 		name    string
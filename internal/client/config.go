@@ -3,16 +3,49 @@ package client
 import (
 	"fmt"
 	"os"
+	"strconv"
 )
 
 const (
 	// EnvShoesVzServerAddr is the environment variable name for shoes-vz-server address
 	EnvShoesVzServerAddr = "SHOESVZ_SERVER_ADDR"
+
+	// EnvOTLPEndpoint is the environment variable name for the OTLP/gRPC collector address
+	EnvOTLPEndpoint = "SHOESVZ_OTLP_ENDPOINT"
+
+	// EnvOTLPInsecure is the environment variable name for disabling TLS to the collector
+	EnvOTLPInsecure = "SHOESVZ_OTLP_INSECURE"
+
+	// EnvTLS is the environment variable name for connecting to shoes-vz-server over TLS
+	EnvTLS = "SHOESVZ_TLS"
+
+	// EnvTLSCA is the environment variable name for the CA bundle verifying shoes-vz-server
+	EnvTLSCA = "SHOESVZ_TLS_CA"
+
+	// EnvTLSCert is the environment variable name for the client certificate used for mutual TLS
+	EnvTLSCert = "SHOESVZ_TLS_CERT"
+
+	// EnvTLSKey is the environment variable name for the client private key used for mutual TLS
+	EnvTLSKey = "SHOESVZ_TLS_KEY"
+
+	// EnvTLSServerName is the environment variable name for the name verified against the server certificate
+	EnvTLSServerName = "SHOESVZ_TLS_SERVER_NAME"
 )
 
 // Config holds the configuration for the shoesvz-client
 type Config struct {
 	ServerAddr string
+
+	// OTLPEndpoint enables trace export when set
+	OTLPEndpoint string
+	OTLPInsecure bool
+
+	// TLS is set when any TLS variable is, with the system roots used unless TLSCAFile is given
+	TLS           bool
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
 }
 
 // LoadConfig loads configuration from environment variables
@@ -22,7 +55,33 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("%s environment variable is required", EnvShoesVzServerAddr)
 	}
 
-	return &Config{
-		ServerAddr: serverAddr,
-	}, nil
+	var otlpInsecure bool
+	if v := os.Getenv(EnvOTLPInsecure); v != "" {
+		var err error
+		otlpInsecure, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", EnvOTLPInsecure, err)
+		}
+	}
+
+	var useTLS bool
+	if v := os.Getenv(EnvTLS); v != "" {
+		var err error
+		useTLS, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", EnvTLS, err)
+		}
+	}
+
+	config := &Config{
+		ServerAddr:    serverAddr,
+		OTLPEndpoint:  os.Getenv(EnvOTLPEndpoint),
+		OTLPInsecure:  otlpInsecure,
+		TLSCAFile:     os.Getenv(EnvTLSCA),
+		TLSCertFile:   os.Getenv(EnvTLSCert),
+		TLSKeyFile:    os.Getenv(EnvTLSKey),
+		TLSServerName: os.Getenv(EnvTLSServerName),
+	}
+	config.TLS = useTLS || config.TLSCAFile != "" || config.TLSCertFile != "" || config.TLSKeyFile != "" || config.TLSServerName != ""
+	return config, nil
 }
@@ -0,0 +1,73 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstallAuthorizedKey(t *testing.T) {
+	runnerKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBKZf8ThTiSSH3mcDyMIvGqn6Ey94GeFbHbTmX9s6xgn"
+
+	tests := []struct {
+		name     string
+		existing string
+		key      string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "creates file and directory",
+			key:  runnerKey,
+			want: runnerKey + "\n",
+		},
+		{
+			name:     "replaces template key",
+			existing: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl template\n",
+			key:      runnerKey,
+			want:     runnerKey + "\n",
+		},
+		{
+			name:     "invalid key keeps existing file",
+			existing: "existing\n",
+			key:      "not-a-key",
+			want:     "existing\n",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".ssh", "authorized_keys")
+			if tt.existing != "" {
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatalf("Failed to create directory: %v", err)
+				}
+				if err := os.WriteFile(path, []byte(tt.existing), 0644); err != nil {
+					t.Fatalf("Failed to write authorized_keys: %v", err)
+				}
+			}
+
+			err := InstallAuthorizedKey(path, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InstallAuthorizedKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read authorized_keys: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("authorized_keys = %q, want %q", got, tt.want)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("Failed to stat authorized_keys: %v", err)
+			}
+			if !tt.wantErr && info.Mode().Perm() != 0600 {
+				t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+			}
+		})
+	}
+}
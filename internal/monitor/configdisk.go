@@ -0,0 +1,103 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/configdisk"
+)
+
+// DefaultConfigDiskDir is where macOS mounts the config disk
+const DefaultConfigDiskDir = "/Volumes/" + configdisk.VolumeLabel
+
+// ErrNoConfigDisk is returned when no config disk was found
+var ErrNoConfigDisk = errors.New("no config disk found")
+
+// configDiskDevices matches whole disks, not their partitions
+var configDiskDevices = regexp.MustCompile(`/disk[0-9]+$`)
+
+// LoadConfigDisk reads the manifest of the config disk. It is read from the
+// mounted volume at dir or, if that is not mounted yet, directly from the
+// disk devices. It keeps looking until timeout, since the volume is mounted
+// asynchronously at boot.
+func LoadConfigDisk(ctx context.Context, dir string, timeout time.Duration) (*configdisk.Manifest, error) {
+	return loadConfigDisk(ctx, dir, "/dev/disk*", timeout)
+}
+
+func loadConfigDisk(ctx context.Context, dir, devicePattern string, timeout time.Duration) (*configdisk.Manifest, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		manifest, err := readConfigDisk(dir, devicePattern)
+		if err == nil || !errors.Is(err, ErrNoConfigDisk) {
+			return manifest, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-ticker.C:
+		}
+	}
+}
+
+// readConfigDisk makes one attempt at finding the manifest
+func readConfigDisk(dir, devicePattern string) (*configdisk.Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, configdisk.ManifestName))
+	if err == nil {
+		return configdisk.ParseManifest(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	devices, err := filepath.Glob(devicePattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list disk devices: %w", err)
+	}
+	for _, device := range devices {
+		if !configDiskDevices.MatchString(device) {
+			continue
+		}
+		manifest, err := readConfigDiskDevice(device)
+		if errors.Is(err, configdisk.ErrNotConfigDisk) || os.IsPermission(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config disk %s: %w", device, err)
+		}
+		return manifest, nil
+	}
+
+	return nil, ErrNoConfigDisk
+}
+
+func readConfigDiskDevice(device string) (*configdisk.Manifest, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return configdisk.ReadManifest(f)
+}
+
+// InstallSetupScript writes the setup script from the manifest to the path
+// shoes-vz-agent runs it from
+func InstallSetupScript(manifest *configdisk.Manifest) error {
+	if err := os.WriteFile(configdisk.GuestSetupScriptPath, []byte(manifest.SetupScript), 0700); err != nil {
+		return fmt.Errorf("failed to write setup script: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/configdisk"
+)
+
+func TestLoadConfigDisk(t *testing.T) {
+	manifest := &configdisk.Manifest{
+		Version:      configdisk.ManifestVersion,
+		RunnerID:     "runner-1",
+		CallbackAddr: "192.168.64.1:8081",
+	}
+
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, mountDir, devDir string)
+		wantID    string
+		wantError error
+	}{
+		{
+			name: "mounted volume",
+			setup: func(t *testing.T, mountDir, devDir string) {
+				data := `{"version":1,"runner_id":"runner-mounted"}`
+				if err := os.WriteFile(filepath.Join(mountDir, configdisk.ManifestName), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantID: "runner-mounted",
+		},
+		{
+			name: "raw device when not mounted",
+			setup: func(t *testing.T, mountDir, devDir string) {
+				// Partitions and other disks are skipped
+				if err := os.WriteFile(filepath.Join(devDir, "disk0"), make([]byte, 4096), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := configdisk.WriteImage(filepath.Join(devDir, "disk1s1"), manifest); err != nil {
+					t.Fatal(err)
+				}
+				if err := configdisk.WriteImage(filepath.Join(devDir, "disk2"), manifest); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantID: "runner-1",
+		},
+		{
+			name:      "no config disk",
+			setup:     func(t *testing.T, mountDir, devDir string) {},
+			wantError: ErrNoConfigDisk,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountDir := t.TempDir()
+			devDir := t.TempDir()
+			tt.setup(t, mountDir, devDir)
+
+			got, err := loadConfigDisk(context.Background(), mountDir, filepath.Join(devDir, "disk*"), 100*time.Millisecond)
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Errorf("loadConfigDisk() error = %v, want %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfigDisk() error = %v", err)
+			}
+			if got.RunnerID != tt.wantID {
+				t.Errorf("loadConfigDisk() runner ID = %s, want %s", got.RunnerID, tt.wantID)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/execstream"
+)
+
+// execWaitDelay bounds how long output is drained after the process group is killed
+const execWaitDelay = 5 * time.Second
+
+// handleExecStream handles POST /exec/stream requests.
+// The request body is a FrameRequest followed by stdin frames; the response
+// streams stdout and stderr frames, then FrameExit and, if a host key is
+// set, FrameSignature.
+func (s *Server) handleExecStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t, spec, err := execstream.ReadFrame(r.Body)
+	if err != nil || t != execstream.FrameRequest {
+		http.Error(w, "Expected request frame", http.StatusBadRequest)
+		return
+	}
+
+	// The body is streamed, so the signature covers only the request frame
+	if err := s.signer.Verify(r, spec); err != nil {
+		s.rejectRequest(r, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req execstream.Request
+	if err := json.Unmarshal(spec, &req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Command == "" {
+		http.Error(w, "Command is required", http.StatusBadRequest)
+		return
+	}
+
+	// stdin keeps arriving while output is written
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		log.Printf("Failed to enable full duplex for exec stream: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if req.TimeoutSeconds > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, req.Command, req.Args...)
+	cmd.Dir = req.Dir
+	cmd.Env = append(os.Environ(), req.Env...)
+	// Run in its own process group so a deadline kills everything it spawned
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = execWaitDelay
+
+	w.Header().Set("Content-Type", execstream.ContentType)
+	w.WriteHeader(http.StatusOK)
+
+	out := execstream.NewWriter(w, func() {
+		_ = rc.Flush()
+	})
+	cmd.Stdout = out.Stream(execstream.FrameStdout)
+	cmd.Stderr = out.Stream(execstream.FrameStderr)
+
+	var stdin io.WriteCloser
+	if req.Stdin {
+		stdin, err = cmd.StdinPipe()
+		if err != nil {
+			s.finishExecStream(out, r, execstream.Result{ExitCode: -1, Error: err.Error()})
+			return
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		s.finishExecStream(out, r, execstream.Result{ExitCode: -1, Error: err.Error()})
+		return
+	}
+
+	if stdin != nil {
+		go func() {
+			if err := forwardStdin(r.Body, stdin, s.signer.StreamMAC(r)); err != nil {
+				// Kill the command rather than run it on forged input
+				log.Printf("Rejected stdin for exec stream from %s: %v", r.RemoteAddr, err)
+				rejectedRequests.WithLabelValues(r.URL.Path, auth.Reason(err)).Inc()
+				cancel()
+			}
+		}()
+	}
+
+	result := execstream.Result{}
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		} else {
+			result.ExitCode = -1
+			result.Error = err.Error()
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result.TimedOut = true
+	}
+
+	s.finishExecStream(out, r, result)
+}
+
+// finishExecStream writes the exit status and signs the response with the host key
+func (s *Server) finishExecStream(out *execstream.Writer, r *http.Request, result execstream.Result) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to marshal exec result: %v", err)
+		return
+	}
+	if err := out.WriteFrame(execstream.FrameExit, payload); err != nil {
+		log.Printf("Failed to write exec result: %v", err)
+		return
+	}
+
+	if s.hostKey == nil {
+		return
+	}
+
+	sig, err := auth.SignHostDigest(s.hostKey, r.URL.Path, r.Header.Get(auth.HeaderNonce), http.StatusOK, out.Digest())
+	if err != nil {
+		log.Printf("Failed to sign exec result: %v", err)
+		return
+	}
+	// The signature frame is not part of the digest it covers
+	if err := out.WriteUnsigned(execstream.FrameSignature, []byte(sig)); err != nil {
+		log.Printf("Failed to write exec signature: %v", err)
+	}
+}
+
+// forwardStdin copies stdin frames from the request body to the command,
+// checking the MAC of each frame before its data is written. It returns an
+// error only if a frame fails authentication.
+func forwardStdin(body io.Reader, stdin io.WriteCloser, mac *auth.StreamMAC) error {
+	defer func() {
+		_ = stdin.Close()
+	}()
+
+	for {
+		t, payload, err := execstream.ReadFrame(body)
+		if err != nil {
+			return nil
+		}
+		if t != execstream.FrameStdin {
+			continue
+		}
+		if mac.Enabled() {
+			if len(payload) < auth.StreamMACSize {
+				return auth.ErrInvalidStreamMAC
+			}
+			data, sum := payload[:len(payload)-auth.StreamMACSize], payload[len(payload)-auth.StreamMACSize:]
+			if err := mac.Verify(data, sum); err != nil {
+				return err
+			}
+			payload = data
+		}
+		if _, err := stdin.Write(payload); err != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/execstream"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+func TestServer_ExecStream(t *testing.T) {
+	secret := []byte("test-secret")
+	hostKey, err := EnsureHostKey(t.TempDir(), "machine-a")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+
+	server := NewServer(&model.MonitorConfig{
+		RunnerPath: t.TempDir(),
+		AuthSecret: secret,
+	})
+	server.SetHostKey(hostKey)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	client := &execstream.Client{
+		Signer:  auth.NewSigner(secret),
+		HostKey: hostKey.PublicKey(),
+	}
+
+	workDir := t.TempDir()
+
+	tests := []struct {
+		name         string
+		req          execstream.Request
+		stdin        string
+		wantStdout   string
+		wantStderr   string
+		wantExitCode int
+		wantTimedOut bool
+	}{
+		{
+			name:       "stdout and stderr are separate",
+			req:        execstream.Request{Command: "sh", Args: []string{"-c", "echo out; echo err >&2"}},
+			wantStdout: "out\n",
+			wantStderr: "err\n",
+		},
+		{
+			name:       "stdin is streamed",
+			req:        execstream.Request{Command: "cat"},
+			stdin:      "hello\nworld\n",
+			wantStdout: "hello\nworld\n",
+		},
+		{
+			name:       "env and working directory",
+			req:        execstream.Request{Command: "sh", Args: []string{"-c", "echo $GREETING; pwd"}, Env: []string{"GREETING=hi"}, Dir: workDir},
+			wantStdout: "hi\n" + workDir + "\n",
+		},
+		{
+			name:         "exit status",
+			req:          execstream.Request{Command: "sh", Args: []string{"-c", "exit 7"}},
+			wantExitCode: 7,
+		},
+		{
+			name:         "deadline kills the process group",
+			req:          execstream.Request{Command: "sh", Args: []string{"-c", "echo started; sleep 30 & wait"}, TimeoutSeconds: 1},
+			wantStdout:   "started\n",
+			wantExitCode: -1,
+			wantTimedOut: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdin io.Reader
+			if tt.stdin != "" {
+				stdin = strings.NewReader(tt.stdin)
+			}
+
+			var stdout, stderr bytes.Buffer
+			start := time.Now()
+			result, err := client.Run(context.Background(), ts.URL, tt.req, stdin, &stdout, &stderr)
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if stdout.String() != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.wantStdout)
+			}
+			if stderr.String() != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.wantStderr)
+			}
+			if result.ExitCode != tt.wantExitCode {
+				t.Errorf("ExitCode = %d, want %d", result.ExitCode, tt.wantExitCode)
+			}
+			if result.TimedOut != tt.wantTimedOut {
+				t.Errorf("TimedOut = %t, want %t", result.TimedOut, tt.wantTimedOut)
+			}
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("Run() took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestServer_ExecStreamAuthentication(t *testing.T) {
+	secret := []byte("test-secret")
+	hostKey, err := EnsureHostKey(t.TempDir(), "machine-a")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+	otherKey, err := EnsureHostKey(t.TempDir(), "machine-b")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+
+	server := NewServer(&model.MonitorConfig{
+		RunnerPath: t.TempDir(),
+		AuthSecret: secret,
+	})
+	server.SetHostKey(hostKey)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	req := execstream.Request{Command: "true"}
+
+	// Unsigned request is rejected before anything runs
+	unsigned := &execstream.Client{}
+	if _, err := unsigned.Run(context.Background(), ts.URL, req, nil, io.Discard, io.Discard); err == nil {
+		t.Error("Run() without signature error = nil, want error")
+	}
+
+	// A response signed by a different host key is refused
+	pinnedOther := &execstream.Client{
+		Signer:  auth.NewSigner(secret),
+		HostKey: otherKey.PublicKey(),
+	}
+	_, err = pinnedOther.Run(context.Background(), ts.URL, req, nil, io.Discard, io.Discard)
+	if !errors.Is(err, auth.ErrHostKeyMismatch) {
+		t.Errorf("Run() with other host key error = %v, want %v", err, auth.ErrHostKeyMismatch)
+	}
+}
+
+func TestServer_ExecStreamForgedStdin(t *testing.T) {
+	secret := []byte("test-secret")
+	server := NewServer(&model.MonitorConfig{
+		RunnerPath: t.TempDir(),
+		AuthSecret: secret,
+	})
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	spec, _ := json.Marshal(execstream.Request{Command: "cat", Stdin: true})
+	var body bytes.Buffer
+	if err := execstream.WriteFrame(&body, execstream.FrameRequest, spec); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	// A stdin frame whose MAC was not made with the secret
+	forged := append([]byte("forged\n"), make([]byte, auth.StreamMACSize)...)
+	if err := execstream.WriteFrame(&body, execstream.FrameStdin, forged); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+execstream.Path, &body)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	auth.NewSigner(secret).Sign(req, spec)
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var stdout bytes.Buffer
+	var result execstream.Result
+	for {
+		ft, payload, err := execstream.ReadFrame(resp.Body)
+		if err != nil {
+			break
+		}
+		switch ft {
+		case execstream.FrameStdout:
+			stdout.Write(payload)
+		case execstream.FrameExit:
+			if err := json.Unmarshal(payload, &result); err != nil {
+				t.Fatalf("failed to decode exit status: %v", err)
+			}
+		}
+	}
+
+	if stdout.Len() != 0 {
+		t.Errorf("stdout = %q, want forged stdin to be dropped", stdout.String())
+	}
+	if result.ExitCode == 0 {
+		t.Error("ExitCode = 0, want the command to be killed")
+	}
+}
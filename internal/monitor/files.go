@@ -0,0 +1,162 @@
+package monitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/filetransfer"
+)
+
+// handleFiles handles GET and PUT /files requests.
+// Bodies are streamed, so the signature covers the query string instead;
+// an uploaded body is checked against the MAC in its trailer.
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if err := s.signer.Verify(r, []byte(r.URL.RawQuery)); err != nil {
+		s.rejectRequest(r, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	target := r.URL.Query().Get("path")
+	if target == "" || !filepath.IsAbs(target) {
+		http.Error(w, "Absolute path is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleDownload(w, r, filepath.Clean(target))
+	case http.MethodPut:
+		auth.HostKeyMiddleware(s.hostKey, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.handleUpload(w, r, filepath.Clean(target))
+		})).ServeHTTP(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDownload streams target as a tar archive, signing it in a trailer
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, target string) {
+	if _, err := os.Lstat(target); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	size, err := filetransfer.Size(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if size > s.maxTransferSize {
+		http.Error(w, fmt.Sprintf("%s is %d bytes, limit is %d", target, size, s.maxTransferSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", filetransfer.ContentType)
+	if s.hostKey != nil {
+		w.Header().Set("Trailer", auth.HeaderHostSignature)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	digest := sha256.New()
+	if err := filetransfer.WriteTar(io.MultiWriter(w, digest), target); err != nil {
+		// The status is already sent; break the connection so the client sees a truncated archive
+		log.Printf("Failed to stream %s: %v", target, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	if s.hostKey != nil {
+		sig, err := auth.SignHostDigest(s.hostKey, r.URL.Path, r.Header.Get(auth.HeaderNonce), http.StatusOK, digest.Sum(nil))
+		if err != nil {
+			log.Printf("Failed to sign download of %s: %v", target, err)
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set(auth.HeaderHostSignature, sig)
+	}
+}
+
+// maxTarPadding bounds what is read after the end of an uploaded archive to reach its trailer
+const maxTarPadding = 1 << 20
+
+// handleUpload extracts a tar archive from the request body to target. The
+// archive is extracted to a temporary directory and only moved into place
+// once the body MAC has been checked.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, target string) {
+	dir, rename := filetransfer.Destination(target)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		http.Error(w, fmt.Sprintf("Directory not found: %s", dir), http.StatusNotFound)
+		return
+	}
+
+	tmp, err := os.MkdirTemp(dir, ".shoes-vz-upload-*")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create temporary directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmp)
+	}()
+
+	digest := sha256.New()
+	body := io.TeeReader(r.Body, digest)
+	rootName, err := filetransfer.ExtractTar(body, tmp, "", s.maxTransferSize)
+	if err != nil {
+		if errors.Is(err, filetransfer.ErrTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Drain the tar padding so that the trailer is read
+	if _, err := io.Copy(io.Discard, io.LimitReader(body, maxTarPadding)); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.verifyBodyMAC(r, digest.Sum(nil)); err != nil {
+		s.rejectRequest(r, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if rename == "" {
+		rename = rootName
+	}
+	dest := filepath.Join(dir, rename)
+	if err := os.Rename(filepath.Join(tmp, rootName), dest); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to move upload into place: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(filetransfer.UploadResponse{Path: dest}); err != nil {
+		log.Printf("Failed to encode upload response: %v", err)
+	}
+}
+
+// verifyBodyMAC checks the body MAC trailer of r against the digest of its body
+func (s *Server) verifyBodyMAC(r *http.Request, digest []byte) error {
+	mac := s.signer.StreamMAC(r)
+	if !mac.Enabled() {
+		return nil
+	}
+	sum, err := hex.DecodeString(r.Trailer.Get(auth.HeaderBodyMAC))
+	if err != nil || len(sum) == 0 {
+		return auth.ErrMissingSignature
+	}
+	return mac.Verify(digest, sum)
+}
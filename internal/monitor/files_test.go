@@ -0,0 +1,216 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/filetransfer"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+func TestServer_Files(t *testing.T) {
+	secret := []byte("test-secret")
+	hostKey, err := EnsureHostKey(t.TempDir(), "machine-a")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+
+	server := NewServer(&model.MonitorConfig{
+		RunnerPath:      t.TempDir(),
+		AuthSecret:      secret,
+		MaxTransferSize: 1024,
+	})
+	server.SetHostKey(hostKey)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	client := &filetransfer.Client{
+		Signer:  auth.NewSigner(secret),
+		HostKey: hostKey.PublicKey(),
+	}
+	ctx := context.Background()
+
+	// Upload a directory into an existing guest directory
+	local := filepath.Join(t.TempDir(), "work")
+	if err := os.MkdirAll(filepath.Join(local, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(local, "sub", "script.sh"), []byte("echo hi\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	guest := t.TempDir()
+	uploaded, err := client.Upload(ctx, ts.URL, local, guest)
+	if err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if want := filepath.Join(guest, "work"); uploaded != want {
+		t.Errorf("Upload() = %q, want %q", uploaded, want)
+	}
+	info, err := os.Stat(filepath.Join(guest, "work", "sub", "script.sh"))
+	if err != nil {
+		t.Fatalf("uploaded file: %v", err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("uploaded mode = %v, want %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+
+	// Download it back under a new name
+	back := filepath.Join(t.TempDir(), "back")
+	downloaded, err := client.Download(ctx, ts.URL, uploaded, back)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if downloaded != back {
+		t.Errorf("Download() = %q, want %q", downloaded, back)
+	}
+	data, err := os.ReadFile(filepath.Join(back, "sub", "script.sh"))
+	if err != nil || string(data) != "echo hi\n" {
+		t.Errorf("downloaded content = %q, %v, want %q", data, err, "echo hi\n")
+	}
+
+	// Over the server's limit
+	large := filepath.Join(guest, "large")
+	if err := os.WriteFile(large, []byte(strings.Repeat("x", 2048)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Download(ctx, ts.URL, large, t.TempDir()); err == nil || !strings.Contains(err.Error(), "413") {
+		t.Errorf("Download() of large file error = %v, want status 413", err)
+	}
+	if _, err := client.Upload(ctx, ts.URL, large, filepath.Join(guest, "large2")); err == nil || !strings.Contains(err.Error(), "413") {
+		t.Errorf("Upload() of large file error = %v, want status 413", err)
+	}
+
+	// Relative paths are refused
+	if _, err := client.Download(ctx, ts.URL, "work", t.TempDir()); err == nil {
+		t.Error("Download() of relative path error = nil, want error")
+	}
+}
+
+func TestServer_FilesAuthentication(t *testing.T) {
+	secret := []byte("test-secret")
+	hostKey, err := EnsureHostKey(t.TempDir(), "machine-a")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+	otherKey, err := EnsureHostKey(t.TempDir(), "machine-b")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+
+	server := NewServer(&model.MonitorConfig{
+		RunnerPath: t.TempDir(),
+		AuthSecret: secret,
+	})
+	server.SetHostKey(hostKey)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	guest := t.TempDir()
+	remote := filepath.Join(guest, "file")
+	if err := os.WriteFile(remote, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsigned requests are rejected
+	unsigned := &filetransfer.Client{}
+	if _, err := unsigned.Download(context.Background(), ts.URL, remote, t.TempDir()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Download() without signature error = %v, want status 401", err)
+	}
+	if _, err := unsigned.Upload(context.Background(), ts.URL, remote, filepath.Join(guest, "new")); err == nil {
+		t.Error("Upload() without signature error = nil, want error")
+	}
+	if _, err := os.Stat(filepath.Join(guest, "new")); !os.IsNotExist(err) {
+		t.Errorf("unsigned upload created a file: %v", err)
+	}
+
+	// A download signed by a different host key is not moved into place
+	pinnedOther := &filetransfer.Client{
+		Signer:  auth.NewSigner(secret),
+		HostKey: otherKey.PublicKey(),
+	}
+	local := filepath.Join(t.TempDir(), "file")
+	_, err = pinnedOther.Download(context.Background(), ts.URL, remote, local)
+	if !errors.Is(err, auth.ErrHostKeyMismatch) {
+		t.Errorf("Download() with other host key error = %v, want %v", err, auth.ErrHostKeyMismatch)
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("unverified download was kept: %v", err)
+	}
+}
+
+func TestServer_FilesUploadBodyMAC(t *testing.T) {
+	secret := []byte("test-secret")
+	server := NewServer(&model.MonitorConfig{
+		RunnerPath: t.TempDir(),
+		AuthSecret: secret,
+	})
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	local := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(local, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := filetransfer.WriteTar(&archive, local); err != nil {
+		t.Fatalf("WriteTar() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		trailer string
+	}{
+		{
+			name: "missing trailer",
+		},
+		{
+			name:    "MAC of another body",
+			trailer: strings.Repeat("00", auth.StreamMACSize),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guest := t.TempDir()
+			query := url.Values{"path": []string{filepath.Join(guest, "new")}}.Encode()
+			req, err := http.NewRequest(http.MethodPut, ts.URL+filetransfer.Path+"?"+query, bytes.NewReader(archive.Bytes()))
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			// Sent chunked so that the trailer goes out after the body
+			req.ContentLength = -1
+			req.Trailer = http.Header{}
+			if tt.trailer != "" {
+				req.Trailer.Set(auth.HeaderBodyMAC, tt.trailer)
+			}
+			auth.NewSigner(secret).Sign(req, []byte(req.URL.RawQuery))
+
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+			}
+			entries, err := os.ReadDir(guest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("upload left %d entries in the destination, want none", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package monitor
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultHostKeyDir is where the runner-agent keeps the host key. It is
+	// owned by the runner user, which cannot write /etc/ssh; templates
+	// point sshd at the key with a HostKey line in sshd_config.d.
+	DefaultHostKeyDir = "/var/db/shoes-vz"
+
+	// hostKeyName is the file name of the per-clone ed25519 host key
+	hostKeyName = "ssh_host_ed25519_key"
+
+	// hostKeyMarkerName records which machine the host key was generated for
+	hostKeyMarkerName = "shoes_vz_host_key_machine"
+)
+
+// EnsureHostKey makes sure the SSH host key in dir belongs to this machine.
+// Clones of a template share its host keys, so when machineID differs from
+// the one recorded at generation time all existing host keys are removed
+// and a fresh ed25519 key is generated. sshd on macOS is started on demand
+// by launchd, so new connections pick up the new key without a restart.
+func EnsureHostKey(dir, machineID string) (ssh.Signer, error) {
+	if machineID == "" {
+		return nil, fmt.Errorf("machine ID is empty")
+	}
+
+	keyPath := filepath.Join(dir, hostKeyName)
+	markerPath := filepath.Join(dir, hostKeyMarkerName)
+
+	if marker, err := os.ReadFile(markerPath); err == nil && strings.TrimSpace(string(marker)) == machineID {
+		keyData, err := os.ReadFile(keyPath)
+		if err == nil {
+			signer, err := ssh.ParsePrivateKey(keyData)
+			if err == nil {
+				return signer, nil
+			}
+		}
+		// Fall through and regenerate a missing or corrupt key
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create host key directory: %w", err)
+	}
+	if err := removeHostKeys(dir); err != nil {
+		return nil, err
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate host key: %w", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal host key: %w", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host key signer: %w", err)
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write host key: %w", err)
+	}
+	if err := os.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write host public key: %w", err)
+	}
+
+	// Write the marker last so that an interrupted run regenerates again
+	if err := os.WriteFile(markerPath, []byte(machineID+"\n"), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write host key marker: %w", err)
+	}
+
+	return signer, nil
+}
+
+// removeHostKeys deletes all ssh_host_*_key files inherited from the template
+func removeHostKeys(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "ssh_host_*_key*"))
+	if err != nil {
+		return fmt.Errorf("failed to list host keys: %w", err)
+	}
+
+	for _, path := range matches {
+		if !strings.HasSuffix(path, "_key") && !strings.HasSuffix(path, "_key.pub") {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove host key %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package monitor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureHostKey(t *testing.T) {
+	dir := t.TempDir()
+
+	// Host keys inherited from the template
+	for _, name := range []string{"ssh_host_ed25519_key", "ssh_host_ed25519_key.pub", "ssh_host_rsa_key", "ssh_host_rsa_key.pub"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("template key"), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	sshdConfig := filepath.Join(dir, "sshd_config")
+	if err := os.WriteFile(sshdConfig, []byte("PermitRootLogin no\n"), 0644); err != nil {
+		t.Fatalf("Failed to write sshd_config: %v", err)
+	}
+
+	first, err := EnsureHostKey(dir, "machine-a")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+
+	// Template keys are gone, unrelated files are kept
+	if _, err := os.Stat(filepath.Join(dir, "ssh_host_rsa_key")); !os.IsNotExist(err) {
+		t.Errorf("template RSA host key still exists (err = %v)", err)
+	}
+	if _, err := os.Stat(sshdConfig); err != nil {
+		t.Errorf("sshd_config was removed: %v", err)
+	}
+
+	pub, err := os.ReadFile(filepath.Join(dir, "ssh_host_ed25519_key.pub"))
+	if err != nil {
+		t.Fatalf("Failed to read public key: %v", err)
+	}
+	if !bytes.HasPrefix(pub, []byte("ssh-ed25519 ")) {
+		t.Errorf("public key = %q, want ssh-ed25519 key", pub)
+	}
+
+	tests := []struct {
+		name      string
+		machineID string
+		wantSame  bool
+	}{
+		{
+			name:      "same machine keeps its key",
+			machineID: "machine-a",
+			wantSame:  true,
+		},
+		{
+			name:      "new clone regenerates the key",
+			machineID: "machine-b",
+			wantSame:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := EnsureHostKey(dir, tt.machineID)
+			if err != nil {
+				t.Fatalf("EnsureHostKey() error = %v", err)
+			}
+
+			same := bytes.Equal(signer.PublicKey().Marshal(), first.PublicKey().Marshal())
+			if same != tt.wantSame {
+				t.Errorf("key unchanged = %t, want %t", same, tt.wantSame)
+			}
+		})
+	}
+
+	if _, err := EnsureHostKey(dir, ""); err == nil {
+		t.Error("EnsureHostKey() with empty machine ID error = nil, want error")
+	}
+
+	// The directory is created when its parent is writable
+	if _, err := EnsureHostKey(filepath.Join(t.TempDir(), "shoes-vz"), "machine-a"); err != nil {
+		t.Errorf("EnsureHostKey() in a new directory error = %v", err)
+	}
+}
@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
 )
 
 const (
@@ -19,17 +21,47 @@ const (
 	DefaultAgentPort = 8081
 )
 
-// NotifyIP notifies the shoes-vz-agent of this runner's IP address.
-// It retries every 2 seconds until successful or the context is canceled.
-func NotifyIP(ctx context.Context, runnerID, hostIP string, agentPort int) error {
-	ownIP, err := getOwnIP()
-	if err != nil {
-		return fmt.Errorf("failed to get own IP: %w", err)
+// Notification describes this guest to the shoes-vz-agent
+type Notification struct {
+	RunnerID  string
+	IPAddress string // Guest address the host can reach, from DiscoverNetwork
+	// HostKey, if not empty, is the guest's SSH host key in authorized_keys
+	// format and is pinned by the agent for later connections
+	HostKey string
+	// ConfigDisk reports that the guest was configured from its config disk,
+	// so the setup script is already in place
+	ConfigDisk bool
+}
+
+// NotifyIP notifies the shoes-vz-agent of this runner's IP address n.IPAddress.
+// It retries every 2 seconds until successful or the context is canceled,
+// trying the transports in order on each attempt.
+// Each attempt is signed with signer so that the agent can authenticate it.
+// Without an IP address, only vsock is tried, since the agent then reaches
+// the runner-agent over the socket device alone.
+func NotifyIP(ctx context.Context, transports []Transport, n Notification, signer *auth.Signer) error {
+	if n.IPAddress == "" {
+		var vsock []Transport
+		for _, t := range transports {
+			if _, ok := t.(*VsockTransport); ok {
+				vsock = append(vsock, t)
+			}
+		}
+		if len(vsock) == 0 {
+			return fmt.Errorf("no IP address to notify")
+		}
+		transports = vsock
 	}
 
-	notification := map[string]string{
-		"runner_id":  runnerID,
-		"ip_address": ownIP,
+	notification := map[string]any{
+		"runner_id":  n.RunnerID,
+		"ip_address": n.IPAddress,
+	}
+	if n.HostKey != "" {
+		notification["host_key"] = n.HostKey
+	}
+	if n.ConfigDisk {
+		notification["config_disk"] = true
 	}
 
 	body, err := json.Marshal(notification)
@@ -37,7 +69,6 @@ func NotifyIP(ctx context.Context, runnerID, hostIP string, agentPort int) error
 		return fmt.Errorf("failed to marshal notification: %w", err)
 	}
 
-	url := fmt.Sprintf("http://%s:%d/notify-ip", hostIP, agentPort)
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
@@ -46,62 +77,51 @@ func NotifyIP(ctx context.Context, runnerID, hostIP string, agentPort int) error
 		case <-ctx.Done():
 			return fmt.Errorf("context canceled: %w", ctx.Err())
 		case <-ticker.C:
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
-			if err != nil {
-				continue
-			}
-			req.Header.Set("Content-Type", "application/json")
-
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				continue
-			}
-
-			_ = resp.Body.Close()
-
-			if resp.StatusCode == http.StatusOK {
-				return nil
+			for _, t := range transports {
+				err := sendNotification(ctx, t, body, signer)
+				if err == nil {
+					return nil
+				}
+				if errors.Is(err, errBadNotificationResponse) {
+					return err
+				}
 			}
 		}
 	}
 }
 
-// getOwnIP returns the IP address of this machine in the 192.168.64.0/24 subnet.
-func getOwnIP() (string, error) {
-	interfaces, err := net.Interfaces()
+// errBadNotificationResponse marks a notification the agent accepted with an unreadable reply
+var errBadNotificationResponse = errors.New("failed to decode notification response")
+
+// sendNotification makes one notification attempt through t
+func sendNotification(ctx context.Context, t Transport, body []byte, signer *auth.Signer) error {
+	// The host part is not used for routing; the transport decides where the request goes
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://shoes-vz-agent/notify-ip", bytes.NewReader(body))
 	if err != nil {
-		return "", fmt.Errorf("failed to get interfaces: %w", err)
+		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	signer.Sign(req, body)
 
-	for _, iface := range interfaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
-		}
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
-
-		for _, addr := range addrs {
-			ipNet, ok := addr.(*net.IPNet)
-			if !ok {
-				continue
-			}
-
-			ip := ipNet.IP.To4()
-			if ip == nil {
-				continue
-			}
+	resp, err := hostHTTPClient(t).Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
 
-			// Check if IP is in 192.168.64.0/24 subnet
-			if ip[0] == 192 && ip[1] == 168 && ip[2] == 64 {
-				return ip.String(), nil
-			}
-		}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("notification failed with status %d", resp.StatusCode)
 	}
 
-	return "", fmt.Errorf("no IP address found in 192.168.64.0/24 subnet")
+	var notifyResp struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&notifyResp); err != nil {
+		return fmt.Errorf("%w: %v", errBadNotificationResponse, err)
+	}
+	return nil
 }
 
 // RunnerConfig represents the structure of .runner file
@@ -0,0 +1,218 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// NetworkConfig controls how the runner-agent finds the host and its own address
+type NetworkConfig struct {
+	HostIP    string       // Host address, optionally with a zone; inferred from the default route when empty
+	Subnet    netip.Prefix // When valid, the guest address must be in this network
+	Interface string       // When set, the guest address must be on this interface
+}
+
+// Network is the result of network discovery
+type Network struct {
+	HostIP    netip.Addr // Address of the host, with a zone for IPv6 link-local
+	GuestIP   netip.Addr // Address of this guest that the host can reach
+	Interface string     // Interface GuestIP is on
+}
+
+// Interface is a network interface and its addresses
+type Interface struct {
+	Name  string
+	Flags net.Flags
+	Addrs []netip.Prefix
+}
+
+// route is a default route
+type route struct {
+	Gateway   netip.Addr
+	Interface string
+}
+
+// DiscoverNetwork finds the host address and the guest address that routes to it
+func DiscoverNetwork(cfg NetworkConfig) (*Network, error) {
+	var host netip.Addr
+	var routeIface string
+	if cfg.HostIP != "" {
+		addr, err := netip.ParseAddr(cfg.HostIP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host IP %q: %w", cfg.HostIP, err)
+		}
+		host = addr
+	} else if r, err := defaultRoute(); err == nil {
+		host = r.Gateway
+		routeIface = r.Interface
+	} else {
+		host = netip.MustParseAddr(DefaultHostIP)
+	}
+
+	ifaces, err := systemInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	guest, iface, err := selectGuestAddr(ifaces, host, routeIface, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// A link-local host address is only usable on the interface it was found on
+	if host.Is6() && host.IsLinkLocalUnicast() && host.Zone() == "" {
+		host = host.WithZone(iface)
+	}
+
+	return &Network{HostIP: host, GuestIP: guest, Interface: iface}, nil
+}
+
+// selectGuestAddr picks the address of the interface that routes to host.
+// An address on the host's network wins over one on the default route
+// interface, and an address of the host's scope wins over one of another.
+func selectGuestAddr(ifaces []Interface, host netip.Addr, routeIface string, cfg NetworkConfig) (netip.Addr, string, error) {
+	var best netip.Addr
+	var bestIface string
+	bestRank := -1
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if cfg.Interface != "" && iface.Name != cfg.Interface {
+			continue
+		}
+
+		for _, prefix := range iface.Addrs {
+			addr := prefix.Addr()
+			if cfg.Subnet.IsValid() && !cfg.Subnet.Contains(addr) {
+				continue
+			}
+			if host.IsValid() && addr.Is4() != host.Is4() {
+				continue
+			}
+
+			rank := 0
+			if onLink(prefix, iface.Name, host) {
+				rank += 4
+			}
+			if iface.Name == routeIface {
+				rank += 2
+			}
+			if addr.IsLinkLocalUnicast() == host.IsLinkLocalUnicast() {
+				rank++
+			}
+			// Without a route to the host, only an explicit choice makes an address usable
+			if rank < 2 && !cfg.Subnet.IsValid() && cfg.Interface == "" {
+				continue
+			}
+
+			if rank > bestRank {
+				best, bestIface, bestRank = addr, iface.Name, rank
+			}
+		}
+	}
+
+	if bestRank < 0 {
+		return netip.Addr{}, "", fmt.Errorf("no address found that routes to host %s", host)
+	}
+	return best.WithZone(""), bestIface, nil
+}
+
+// onLink reports whether host is directly reachable from prefix on iface
+func onLink(prefix netip.Prefix, iface string, host netip.Addr) bool {
+	if !host.IsValid() {
+		return false
+	}
+	// Every interface has fe80::/64, so the zone tells which one the host is on
+	if host.IsLinkLocalUnicast() && host.Zone() != "" && host.Zone() != iface {
+		return false
+	}
+	return prefix.Masked().Contains(host.WithZone(""))
+}
+
+// systemInterfaces lists the interfaces of this machine
+func systemInterfaces() ([]Interface, error) {
+	netIfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interfaces: %w", err)
+	}
+
+	ifaces := make([]Interface, 0, len(netIfaces))
+	for _, ni := range netIfaces {
+		addrs, err := ni.Addrs()
+		if err != nil {
+			continue
+		}
+
+		iface := Interface{Name: ni.Name, Flags: ni.Flags}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+			ones, _ := ipNet.Mask.Size()
+			iface.Addrs = append(iface.Addrs, netip.PrefixFrom(addr.Unmap(), ones))
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+// defaultRoute returns the IPv4 default route, or the IPv6 one if there is none
+func defaultRoute() (*route, error) {
+	var lastErr error
+	for _, args := range [][]string{{"-n", "get", "default"}, {"-n", "get", "-inet6", "default"}} {
+		output, err := exec.Command("route", args...).Output()
+		if err != nil {
+			lastErr = fmt.Errorf("failed to run route: %w", err)
+			continue
+		}
+		r, err := parseRouteGet(string(output))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return r, nil
+	}
+	return nil, lastErr
+}
+
+// parseRouteGet parses the output of `route -n get`
+func parseRouteGet(output string) (*route, error) {
+	var r route
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "gateway":
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gateway %q: %w", value, err)
+			}
+			r.Gateway = addr
+		case "interface":
+			r.Interface = value
+		}
+	}
+
+	if !r.Gateway.IsValid() {
+		return nil, fmt.Errorf("no gateway in route output")
+	}
+	if r.Gateway.Is6() && r.Gateway.IsLinkLocalUnicast() && r.Gateway.Zone() == "" {
+		r.Gateway = r.Gateway.WithZone(r.Interface)
+	}
+	return &r, nil
+}
@@ -0,0 +1,208 @@
+package monitor
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestSelectGuestAddr(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	loopback := Interface{Name: "lo0", Flags: net.FlagUp | net.FlagLoopback, Addrs: []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/8"),
+		netip.MustParsePrefix("::1/128"),
+	}}
+	vmnet := Interface{Name: "en0", Flags: up, Addrs: []netip.Prefix{
+		netip.MustParsePrefix("fe80::1c2d:3eff:fe4f:5a6b/64"),
+		netip.MustParsePrefix("192.168.64.5/24"),
+	}}
+	bridged := Interface{Name: "en1", Flags: up, Addrs: []netip.Prefix{
+		netip.MustParsePrefix("fe80::aa:bbff:fecc:ddee/64"),
+		netip.MustParsePrefix("10.0.0.23/16"),
+		netip.MustParsePrefix("2001:db8::23/64"),
+	}}
+	down := Interface{Name: "en2", Flags: net.FlagBroadcast, Addrs: []netip.Prefix{
+		netip.MustParsePrefix("192.168.64.9/24"),
+	}}
+
+	tests := []struct {
+		name       string
+		ifaces     []Interface
+		host       string
+		routeIface string
+		cfg        NetworkConfig
+		wantIP     string
+		wantIface  string
+		wantErr    bool
+	}{
+		{
+			name:      "legacy vmnet subnet",
+			ifaces:    []Interface{loopback, vmnet},
+			host:      "192.168.64.1",
+			wantIP:    "192.168.64.5",
+			wantIface: "en0",
+		},
+		{
+			name:      "other vmnet subnet",
+			ifaces:    []Interface{loopback, {Name: "en0", Flags: up, Addrs: []netip.Prefix{netip.MustParsePrefix("192.168.105.3/24")}}},
+			host:      "192.168.105.1",
+			wantIP:    "192.168.105.3",
+			wantIface: "en0",
+		},
+		{
+			name:      "interface on the host's network wins",
+			ifaces:    []Interface{vmnet, bridged},
+			host:      "10.0.0.1",
+			wantIP:    "10.0.0.23",
+			wantIface: "en1",
+		},
+		{
+			name:       "default route interface when the gateway is off-link",
+			ifaces:     []Interface{vmnet, bridged},
+			host:       "172.16.0.1",
+			routeIface: "en1",
+			wantIP:     "10.0.0.23",
+			wantIface:  "en1",
+		},
+		{
+			name:    "no route to the host",
+			ifaces:  []Interface{loopback, vmnet},
+			host:    "172.16.0.1",
+			wantErr: true,
+		},
+		{
+			name:      "down interfaces are skipped",
+			ifaces:    []Interface{down, vmnet},
+			host:      "192.168.64.1",
+			wantIP:    "192.168.64.5",
+			wantIface: "en0",
+		},
+		{
+			name:      "configured subnet",
+			ifaces:    []Interface{vmnet, bridged},
+			host:      "172.16.0.1",
+			cfg:       NetworkConfig{Subnet: netip.MustParsePrefix("10.0.0.0/8")},
+			wantIP:    "10.0.0.23",
+			wantIface: "en1",
+		},
+		{
+			name:    "configured subnet without a match",
+			ifaces:  []Interface{vmnet},
+			host:    "192.168.64.1",
+			cfg:     NetworkConfig{Subnet: netip.MustParsePrefix("10.0.0.0/8")},
+			wantErr: true,
+		},
+		{
+			name:      "configured interface",
+			ifaces:    []Interface{vmnet, bridged},
+			host:      "192.168.64.1",
+			cfg:       NetworkConfig{Interface: "en1"},
+			wantIP:    "10.0.0.23",
+			wantIface: "en1",
+		},
+		{
+			name:      "IPv6 link-local host picks the zone's interface",
+			ifaces:    []Interface{vmnet, bridged},
+			host:      "fe80::1%en1",
+			wantIP:    "fe80::aa:bbff:fecc:ddee",
+			wantIface: "en1",
+		},
+		{
+			name:       "IPv6 link-local host without a zone uses the route interface",
+			ifaces:     []Interface{vmnet, bridged},
+			host:       "fe80::1",
+			routeIface: "en0",
+			wantIP:     "fe80::1c2d:3eff:fe4f:5a6b",
+			wantIface:  "en0",
+		},
+		{
+			name:      "IPv6 global host prefers a global address",
+			ifaces:    []Interface{vmnet, bridged},
+			host:      "2001:db8::1",
+			wantIP:    "2001:db8::23",
+			wantIface: "en1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, iface, err := selectGuestAddr(tt.ifaces, netip.MustParseAddr(tt.host), tt.routeIface, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectGuestAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ip.String() != tt.wantIP {
+				t.Errorf("selectGuestAddr() ip = %s, want %s", ip, tt.wantIP)
+			}
+			if iface != tt.wantIface {
+				t.Errorf("selectGuestAddr() interface = %s, want %s", iface, tt.wantIface)
+			}
+		})
+	}
+}
+
+func TestParseRouteGet(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      string
+		wantGateway string
+		wantIface   string
+		wantErr     bool
+	}{
+		{
+			name: "IPv4",
+			output: `   route to: default
+destination: default
+       mask: default
+    gateway: 192.168.64.1
+  interface: en0
+      flags: <UP,GATEWAY,DONE,STATIC,PRCLONING,GLOBAL>
+`,
+			wantGateway: "192.168.64.1",
+			wantIface:   "en0",
+		},
+		{
+			name: "IPv6 link-local gateway gets the interface as zone",
+			output: `   route to: ::
+destination: default
+    gateway: fe80::1
+  interface: en0
+`,
+			wantGateway: "fe80::1%en0",
+			wantIface:   "en0",
+		},
+		{
+			name: "IPv6 gateway with zone",
+			output: `    gateway: fe80::1%en1
+  interface: en1
+`,
+			wantGateway: "fe80::1%en1",
+			wantIface:   "en1",
+		},
+		{
+			name:    "no default route",
+			output:  "route: writing to routing socket: not in table\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRouteGet(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRouteGet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if r.Gateway.String() != tt.wantGateway {
+				t.Errorf("parseRouteGet() gateway = %s, want %s", r.Gateway, tt.wantGateway)
+			}
+			if r.Interface != tt.wantIface {
+				t.Errorf("parseRouteGet() interface = %s, want %s", r.Interface, tt.wantIface)
+			}
+		})
+	}
+}
@@ -2,36 +2,93 @@ package monitor
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"os/exec"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/execstream"
+	"github.com/whywaita/shoes-vz/pkg/filetransfer"
 	"github.com/whywaita/shoes-vz/pkg/model"
 )
 
+// rejectedRequests counts requests rejected by authentication
+var rejectedRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "shoesvz_runner_agent_rejected_requests_total",
+		Help: "Total number of requests rejected by authentication",
+	},
+	[]string{"path", "reason"},
+)
+
 // Server is the HTTP server for the runner monitor
 type Server struct {
 	monitor    *Monitor
 	listenAddr string
+	signer     *auth.Signer
+	hostKey    ssh.Signer
+
+	maxTransferSize int64
 }
 
 // NewServer creates a new Server instance
 func NewServer(config *model.MonitorConfig) *Server {
+	maxTransferSize := config.MaxTransferSize
+	if maxTransferSize <= 0 {
+		maxTransferSize = filetransfer.DefaultMaxSize
+	}
+
 	return &Server{
 		monitor:    NewMonitor(config.RunnerPath),
 		listenAddr: config.ListenAddr,
+		signer:     auth.NewSigner(config.AuthSecret),
+
+		maxTransferSize: maxTransferSize,
 	}
 }
 
+// SetHostKey sets the SSH host key used to sign responses
+func (s *Server) SetHostKey(hostKey ssh.Signer) {
+	s.hostKey = hostKey
+}
+
 // Start starts the HTTP server
 func (s *Server) Start() error {
-	http.HandleFunc("/status", s.handleStatus)
-	http.HandleFunc("/health", s.handleHealth)
-	http.HandleFunc("/exec", s.handleExec)
+	log.Printf("Starting HTTP server on %s (auth enabled: %t)", s.listenAddr, s.signer.Enabled())
+	return http.ListenAndServe(s.listenAddr, s.Handler())
+}
 
-	log.Printf("Starting HTTP server on %s", s.listenAddr)
-	return http.ListenAndServe(s.listenAddr, nil)
+// Serve serves the API on l, which may come from any Transport
+func (s *Server) Serve(l net.Listener) error {
+	log.Printf("Serving HTTP on %s %s (auth enabled: %t)", l.Addr().Network(), l.Addr(), s.signer.Enabled())
+	return http.Serve(l, s.Handler())
+}
+
+// Handler returns the HTTP handler serving the runner-agent API.
+// /status requires a valid signature when authentication is enabled, and its
+// responses are signed with the host key if one is set. Commands only run
+// through /exec/stream, which bounds them with a deadline and kills their
+// process group.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/status", s.signer.Middleware(auth.HostKeyMiddleware(s.hostKey, http.HandlerFunc(s.handleStatus)), s.rejectRequest))
+	mux.HandleFunc("/health", s.handleHealth)
+	// Authenticated and signed by the handlers themselves, since the bodies are streamed
+	mux.HandleFunc(execstream.Path, s.handleExecStream)
+	mux.HandleFunc(filetransfer.Path, s.handleFiles)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// rejectRequest records a request that failed authentication
+func (s *Server) rejectRequest(r *http.Request, err error) {
+	log.Printf("Rejected unauthenticated request to %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+	rejectedRequests.WithLabelValues(r.URL.Path, auth.Reason(err)).Inc()
 }
 
 // handleStatus handles GET /status requests
@@ -67,58 +124,3 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to encode health response: %v", err)
 	}
 }
-
-// ExecRequest represents a command execution request
-type ExecRequest struct {
-	Command string   `json:"command"`
-	Args    []string `json:"args,omitempty"`
-}
-
-// ExecResponse represents a command execution response
-type ExecResponse struct {
-	Output   string `json:"output"`
-	ExitCode int    `json:"exit_code"`
-	Error    string `json:"error,omitempty"`
-}
-
-// handleExec handles POST /exec requests to execute commands
-func (s *Server) handleExec(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req ExecRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
-		return
-	}
-
-	if req.Command == "" {
-		http.Error(w, "Command is required", http.StatusBadRequest)
-		return
-	}
-
-	// Execute command
-	cmd := exec.Command(req.Command, req.Args...)
-	output, err := cmd.CombinedOutput()
-
-	resp := ExecResponse{
-		Output: string(output),
-	}
-
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			resp.ExitCode = exitErr.ExitCode()
-		} else {
-			resp.ExitCode = -1
-			resp.Error = err.Error()
-		}
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
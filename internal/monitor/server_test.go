@@ -0,0 +1,101 @@
+package monitor
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+func TestServer_Authentication(t *testing.T) {
+	secret := []byte("test-secret")
+	server := NewServer(&model.MonitorConfig{
+		RunnerPath: t.TempDir(),
+		AuthSecret: secret,
+	})
+	handler := server.Handler()
+	signer := auth.NewSigner(secret)
+
+	execBody := []byte(`{"command":"true"}`)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       []byte
+		sign       bool
+		wantStatus int
+	}{
+		{
+			name:       "health does not require auth",
+			method:     http.MethodGet,
+			path:       "/health",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unsigned status is rejected",
+			method:     http.MethodGet,
+			path:       "/status",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "signed status is accepted",
+			method:     http.MethodGet,
+			path:       "/status",
+			sign:       true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "legacy exec is not served",
+			method:     http.MethodPost,
+			path:       "/exec",
+			body:       execBody,
+			sign:       true,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+			if tt.sign {
+				signer.Sign(req, tt.body)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestServer_HostKeySignature(t *testing.T) {
+	hostKey, err := EnsureHostKey(t.TempDir(), "machine-a")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+
+	server := NewServer(&model.MonitorConfig{RunnerPath: t.TempDir()})
+	server.SetHostKey(hostKey)
+	handler := server.Handler()
+
+	nonce := auth.NewNonce()
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set(auth.HeaderNonce, nonce)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	body, _ := io.ReadAll(resp.Body)
+	if err := auth.VerifyHostSignature(hostKey.PublicKey(), resp, "/status", nonce, body); err != nil {
+		t.Errorf("VerifyHostSignature() error = %v", err)
+	}
+}
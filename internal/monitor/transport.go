@@ -0,0 +1,113 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+const (
+	// DefaultVsockPort is the vsock port the runner-agent API listens on in the guest
+	DefaultVsockPort = 8080
+
+	// DefaultAgentVsockPort is the vsock port shoes-vz-agent accepts IP notifications on
+	DefaultAgentVsockPort = 8081
+
+	// vsockHostCID is the context ID that always addresses the host
+	vsockHostCID = 2
+
+	// vsockAnyCID binds a listener to every context ID of the guest
+	vsockAnyCID = 0xFFFFFFFF
+)
+
+// ErrVsockUnsupported is returned when the platform has no vsock support
+var ErrVsockUnsupported = errors.New("vsock is not supported on this platform")
+
+// Transport carries the runner-agent API and its notifications to shoes-vz-agent.
+// The HTTP protocol is the same whatever the transport.
+type Transport interface {
+	// Listen returns a listener for the runner-agent API
+	Listen() (net.Listener, error)
+
+	// DialHost connects to the shoes-vz-agent IP notification server
+	DialHost(ctx context.Context) (net.Conn, error)
+
+	// String describes the transport in logs
+	String() string
+}
+
+// TCPTransport uses the NAT network between host and guest
+type TCPTransport struct {
+	ListenAddr string // Address the API listens on; empty disables listening
+	HostAddr   string // host:port of the IP notification server
+}
+
+// Listen listens on ListenAddr
+func (t *TCPTransport) Listen() (net.Listener, error) {
+	if t.ListenAddr == "" {
+		return nil, fmt.Errorf("TCP listening is disabled")
+	}
+	return net.Listen("tcp", t.ListenAddr)
+}
+
+// DialHost dials HostAddr
+func (t *TCPTransport) DialHost(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", t.HostAddr)
+}
+
+func (t *TCPTransport) String() string {
+	return "tcp"
+}
+
+// VsockTransport uses the virtio socket device, which only connects the
+// guest to its own host
+type VsockTransport struct {
+	Port      uint32 // Port the API listens on
+	AgentPort uint32 // Port of the IP notification server on the host
+}
+
+// Listen listens on Port for connections from the host
+func (t *VsockTransport) Listen() (net.Listener, error) {
+	return listenVsock(t.Port)
+}
+
+// DialHost connects to AgentPort on the host
+func (t *VsockTransport) DialHost(ctx context.Context) (net.Conn, error) {
+	return dialVsock(ctx, vsockHostCID, t.AgentPort)
+}
+
+func (t *VsockTransport) String() string {
+	return "vsock"
+}
+
+// VsockAddr is the address of a vsock endpoint
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+// Network returns "vsock"
+func (a *VsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a *VsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+// hostHTTPClient returns an HTTP client whose connections go through t,
+// whatever address a request is for
+func hostHTTPClient(t Transport) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return t.DialHost(ctx)
+			},
+			// Each attempt goes through a fresh connection so that a fallback transport is retried
+			DisableKeepAlives: true,
+		},
+	}
+}
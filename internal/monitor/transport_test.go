@@ -0,0 +1,203 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/execstream"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// pipeListener is a net.Listener whose connections are in-memory pipes
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &VsockAddr{CID: 3, Port: DefaultVsockPort}
+}
+
+// Dial hands one end of a new pipe to Accept
+func (l *pipeListener) Dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pipeTransport connects to a host served on pipeListener
+type pipeTransport struct {
+	host *pipeListener
+	err  error // Returned from DialHost when set
+}
+
+func (t *pipeTransport) Listen() (net.Listener, error) {
+	return newPipeListener(), nil
+}
+
+func (t *pipeTransport) DialHost(ctx context.Context) (net.Conn, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.host.Dial(ctx)
+}
+
+func (t *pipeTransport) String() string {
+	return "pipe"
+}
+
+func TestServer_ServeOverPipe(t *testing.T) {
+	secret := []byte("test-secret")
+	hostKey, err := EnsureHostKey(t.TempDir(), "machine-a")
+	if err != nil {
+		t.Fatalf("EnsureHostKey() error = %v", err)
+	}
+
+	server := NewServer(&model.MonitorConfig{
+		RunnerPath: t.TempDir(),
+		AuthSecret: secret,
+	})
+	server.SetHostKey(hostKey)
+
+	l := newPipeListener()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+
+	client := &execstream.Client{
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return l.Dial(ctx)
+				},
+			},
+		},
+		Signer:  auth.NewSigner(secret),
+		HostKey: hostKey.PublicKey(),
+	}
+
+	var stdout, stderr bytes.Buffer
+	req := execstream.Request{Command: "sh", Args: []string{"-c", "cat; echo err >&2; exit 3"}}
+	result, err := client.Run(context.Background(), "http://runner", req, strings.NewReader("hello\n"), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if result.ExitCode != 3 {
+		t.Errorf("Run() exit code = %d, want 3", result.ExitCode)
+	}
+	if stdout.String() != "hello\n" {
+		t.Errorf("Run() stdout = %q, want %q", stdout.String(), "hello\n")
+	}
+	if stderr.String() != "err\n" {
+		t.Errorf("Run() stderr = %q, want %q", stderr.String(), "err\n")
+	}
+
+	_ = l.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve() error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestSendNotification(t *testing.T) {
+	secret := []byte("test-secret")
+	signer := auth.NewSigner(secret)
+
+	host := newPipeListener()
+	defer func() {
+		_ = host.Close()
+	}()
+	received := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/notify-ip", signer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n struct {
+			RunnerID string `json:"runner_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- n.RunnerID
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}), nil))
+	go func() {
+		_ = http.Serve(host, mux)
+	}()
+
+	body := []byte(`{"runner_id":"runner-1","ip_address":"192.168.64.2"}`)
+
+	tests := []struct {
+		name      string
+		transport Transport
+		signer    *auth.Signer
+		wantErr   bool
+	}{
+		{
+			name:      "delivered over pipe",
+			transport: &pipeTransport{host: host},
+			signer:    signer,
+		},
+		{
+			name:      "transport cannot connect",
+			transport: &pipeTransport{host: host, err: ErrVsockUnsupported},
+			signer:    signer,
+			wantErr:   true,
+		},
+		{
+			name:      "rejected by the agent",
+			transport: &pipeTransport{host: host},
+			signer:    auth.NewSigner([]byte("wrong-secret")),
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sendNotification(context.Background(), tt.transport, body, tt.signer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendNotification() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if got := <-received; got != "runner-1" {
+					t.Errorf("received runner_id = %q, want %q", got, "runner-1")
+				}
+			}
+		})
+	}
+}
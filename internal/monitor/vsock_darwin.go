@@ -0,0 +1,154 @@
+//go:build darwin
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// afVsock is AF_VSOCK from <sys/socket.h>, which package syscall does not define
+const afVsock = 40
+
+// sockaddrVM is struct sockaddr_vm from <sys/vsock.h>
+type sockaddrVM struct {
+	Len       uint8
+	Family    uint8
+	Reserved1 uint16
+	Port      uint32
+	CID       uint32
+}
+
+func newSockaddrVM(cid, port uint32) *sockaddrVM {
+	return &sockaddrVM{
+		Len:    uint8(unsafe.Sizeof(sockaddrVM{})),
+		Family: afVsock,
+		Port:   port,
+		CID:    cid,
+	}
+}
+
+// listenVsock listens on a vsock port of the guest
+func listenVsock(port uint32) (net.Listener, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vsock socket: %w", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	sa := newSockaddrVM(vsockAnyCID, port)
+	if _, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa)); errno != 0 {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind vsock port %d: %w", port, errno)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("failed to listen on vsock port %d: %w", port, err)
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set vsock socket non-blocking: %w", err)
+	}
+
+	return &vsockListener{
+		file: os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d", port)),
+		addr: &VsockAddr{CID: vsockAnyCID, Port: port},
+	}, nil
+}
+
+// dialVsock connects to a vsock port
+func dialVsock(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vsock socket: %w", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	// Connecting to the host does not leave the machine, so it is not made cancelable
+	sa := newSockaddrVM(cid, port)
+	if _, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa)); errno != 0 {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("failed to connect to vsock %d:%d: %w", cid, port, errno)
+	}
+	if err := ctx.Err(); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+
+	return newVsockConn(fd, &VsockAddr{CID: vsockAnyCID}, &VsockAddr{CID: cid, Port: port})
+}
+
+// vsockListener accepts vsock connections through the runtime poller
+type vsockListener struct {
+	file *os.File
+	addr *VsockAddr
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rc, err := l.file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var nfd int
+	var acceptErr error
+	err = rc.Read(func(fd uintptr) bool {
+		// syscall.Accept rejects the unknown address family, so the peer address is not asked for
+		r, _, errno := syscall.Syscall(syscall.SYS_ACCEPT, fd, 0, 0)
+		if errno == syscall.EAGAIN {
+			return false
+		}
+		nfd, acceptErr = int(r), nil
+		if errno != 0 {
+			acceptErr = errno
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, fmt.Errorf("failed to accept vsock connection: %w", acceptErr)
+	}
+	syscall.CloseOnExec(nfd)
+
+	return newVsockConn(nfd, l.addr, &VsockAddr{CID: vsockHostCID})
+}
+
+func (l *vsockListener) Close() error {
+	return l.file.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockConn is a connected vsock socket
+type vsockConn struct {
+	*os.File
+	local, remote net.Addr
+}
+
+func newVsockConn(fd int, local, remote net.Addr) (net.Conn, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set vsock socket non-blocking: %w", err)
+	}
+	return &vsockConn{
+		File:   os.NewFile(uintptr(fd), "vsock:"+remote.String()),
+		local:  local,
+		remote: remote,
+	}, nil
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
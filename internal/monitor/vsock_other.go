@@ -0,0 +1,16 @@
+//go:build !darwin
+
+package monitor
+
+import (
+	"context"
+	"net"
+)
+
+func listenVsock(port uint32) (net.Listener, error) {
+	return nil, ErrVsockUnsupported
+}
+
+func dialVsock(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	return nil, ErrVsockUnsupported
+}
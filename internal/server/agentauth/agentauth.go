@@ -0,0 +1,312 @@
+// Package agentauth keeps the bootstrap tokens and per-agent credentials
+// used to authenticate shoes-vz-agent to shoes-vz-server
+package agentauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// DefaultTokenTTL is how long a bootstrap token is valid unless told otherwise
+const DefaultTokenTTL = 24 * time.Hour
+
+var (
+	// ErrInvalidBootstrapToken is returned for unknown, expired or used up bootstrap tokens
+	ErrInvalidBootstrapToken = errors.New("invalid bootstrap token")
+
+	// ErrInvalidCredential is returned for credentials that were never issued
+	ErrInvalidCredential = errors.New("invalid agent credential")
+
+	// ErrAgentRevoked is returned for agents whose credential has been revoked
+	ErrAgentRevoked = errors.New("agent credential revoked")
+)
+
+// BootstrapToken is a token agents exchange for a credential
+type BootstrapToken struct {
+	ID          string    `json:"id"`
+	Hash        string    `json:"hash"`
+	Description string    `json:"description,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	MaxUses     int       `json:"max_uses,omitempty"` // 0 for no limit
+	Uses        int       `json:"uses"`
+}
+
+// Agent is an enrolled agent
+type Agent struct {
+	ID             string     `json:"id"`
+	Hostname       string     `json:"hostname"`
+	TokenID        string     `json:"token_id"`
+	CredentialHash string     `json:"credential_hash"`
+	EnrolledAt     time.Time  `json:"enrolled_at"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+}
+
+type state struct {
+	BootstrapTokens []*BootstrapToken `json:"bootstrap_tokens"`
+	Agents          []*Agent          `json:"agents"`
+}
+
+// Store keeps tokens and credentials in a JSON file. Only hashes of the
+// secrets are written.
+type Store struct {
+	path string
+	now  func() time.Time
+
+	mu    sync.RWMutex
+	state state
+}
+
+// Open loads the store at path, creating it if it does not exist
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, now: time.Now}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to read agent auth file: %w", err)
+	default:
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("failed to parse agent auth file: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// CreateBootstrapToken creates a token valid for ttl (DefaultTokenTTL if
+// 0) that maxUses agents can enroll with (any number if 0). The token is
+// returned in plain text only here.
+func (s *Store) CreateBootstrapToken(ttl time.Duration, maxUses int, description string) (string, *BootstrapToken, error) {
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	if maxUses < 0 {
+		return "", nil, fmt.Errorf("invalid max uses: %d", maxUses)
+	}
+
+	id, err := randomString(6)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	token := id + "." + secret
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	t := &BootstrapToken{
+		ID:          id,
+		Hash:        hash(token),
+		Description: description,
+		ExpiresAt:   now.Add(ttl),
+		MaxUses:     maxUses,
+	}
+
+	// Drop tokens that can no longer be used
+	tokens := []*BootstrapToken{t}
+	for _, old := range s.state.BootstrapTokens {
+		if old.usable(now) {
+			tokens = append(tokens, old)
+		}
+	}
+	s.state.BootstrapTokens = tokens
+
+	if err := s.save(); err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+// Enroll exchanges a bootstrap token for a new agent ID and credential
+func (s *Store) Enroll(token, hostname string) (string, string, error) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", ErrInvalidBootstrapToken
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var t *BootstrapToken
+	for _, candidate := range s.state.BootstrapTokens {
+		if candidate.ID == id {
+			t = candidate
+			break
+		}
+	}
+	if t == nil || !t.usable(now) || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash(token))) != 1 {
+		return "", "", ErrInvalidBootstrapToken
+	}
+
+	agent := &Agent{
+		ID:         uuid.New().String(),
+		Hostname:   hostname,
+		TokenID:    t.ID,
+		EnrolledAt: now,
+	}
+	credential := agent.ID + "." + secret
+	agent.CredentialHash = hash(credential)
+
+	t.Uses++
+	s.state.Agents = append(s.state.Agents, agent)
+	if err := s.save(); err != nil {
+		t.Uses--
+		s.state.Agents = s.state.Agents[:len(s.state.Agents)-1]
+		return "", "", err
+	}
+	return agent.ID, credential, nil
+}
+
+// Authenticate returns the ID of the agent a credential was issued to
+func (s *Store) Authenticate(credential string) (string, error) {
+	id, _, ok := strings.Cut(credential, ".")
+	if !ok {
+		return "", ErrInvalidCredential
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agent := s.findAgent(id)
+	if agent == nil || subtle.ConstantTimeCompare([]byte(agent.CredentialHash), []byte(hash(credential))) != 1 {
+		return "", ErrInvalidCredential
+	}
+	if agent.RevokedAt != nil {
+		return "", ErrAgentRevoked
+	}
+	return agent.ID, nil
+}
+
+// Check returns ErrAgentRevoked once the agent has been revoked
+func (s *Store) Check(agentID string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agent := s.findAgent(agentID)
+	if agent == nil {
+		return model.ErrAgentNotFound
+	}
+	if agent.RevokedAt != nil {
+		return ErrAgentRevoked
+	}
+	return nil
+}
+
+// Revoke revokes an agent's credential
+func (s *Store) Revoke(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent := s.findAgent(agentID)
+	if agent == nil {
+		return model.ErrAgentNotFound
+	}
+	if agent.RevokedAt != nil {
+		return nil
+	}
+
+	now := s.now()
+	agent.RevokedAt = &now
+	if err := s.save(); err != nil {
+		agent.RevokedAt = nil
+		return err
+	}
+	return nil
+}
+
+// ListAgents returns all enrolled agents, oldest first
+func (s *Store) ListAgents() []Agent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agents := make([]Agent, 0, len(s.state.Agents))
+	for _, a := range s.state.Agents {
+		agents = append(agents, *a)
+	}
+	sort.SliceStable(agents, func(i, j int) bool {
+		return agents[i].EnrolledAt.Before(agents[j].EnrolledAt)
+	})
+	return agents
+}
+
+func (s *Store) findAgent(agentID string) *Agent {
+	for _, a := range s.state.Agents {
+		if a.ID == agentID {
+			return a
+		}
+	}
+	return nil
+}
+
+// save writes the state through a temporary file so that a crash never
+// leaves a truncated file behind
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode agent auth file: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write agent auth file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write agent auth file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write agent auth file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write agent auth file: %w", err)
+	}
+	return nil
+}
+
+func (t *BootstrapToken) usable(now time.Time) bool {
+	return now.Before(t.ExpiresAt) && (t.MaxUses == 0 || t.Uses < t.MaxUses)
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,127 @@
+package agentauth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+func TestStore_Enroll(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		maxUses int
+		enrolls int
+		advance time.Duration
+		mangle  func(string) string
+		wantErr error
+	}{
+		{name: "valid token", maxUses: 1, enrolls: 1},
+		{name: "token used up", maxUses: 1, enrolls: 2, wantErr: ErrInvalidBootstrapToken},
+		{name: "unlimited token", maxUses: 0, enrolls: 3},
+		{name: "expired token", maxUses: 1, enrolls: 1, advance: 2 * time.Hour, wantErr: ErrInvalidBootstrapToken},
+		{name: "wrong secret", maxUses: 1, enrolls: 1, mangle: func(token string) string { return token + "x" }, wantErr: ErrInvalidBootstrapToken},
+		{name: "malformed token", maxUses: 1, enrolls: 1, mangle: func(string) string { return "garbage" }, wantErr: ErrInvalidBootstrapToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Open(filepath.Join(t.TempDir(), "agents.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.now = func() time.Time { return now }
+
+			token, _, err := s.CreateBootstrapToken(time.Hour, tt.maxUses, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.mangle != nil {
+				token = tt.mangle(token)
+			}
+			s.now = func() time.Time { return now.Add(tt.advance) }
+
+			for i := 0; i < tt.enrolls; i++ {
+				agentID, credential, err := s.Enroll(token, "mac-1")
+				if i < tt.enrolls-1 {
+					if err != nil {
+						t.Fatalf("Enroll() #%d error = %v", i, err)
+					}
+					continue
+				}
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Enroll() error = %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+
+				got, err := s.Authenticate(credential)
+				if err != nil || got != agentID {
+					t.Errorf("Authenticate() = %v, %v, want %v", got, err, agentID)
+				}
+			}
+		})
+	}
+}
+
+func TestStore_Revoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := s.CreateBootstrapToken(0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentID, credential, err := s.Enroll(token, "mac-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, otherCredential, err := s.Enroll(token, "mac-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Revoke(agentID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke("unknown"); !errors.Is(err, model.ErrAgentNotFound) {
+		t.Errorf("Revoke(unknown) error = %v, want %v", err, model.ErrAgentNotFound)
+	}
+
+	// Credentials and revocations survive a restart
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(credential); !errors.Is(err, ErrAgentRevoked) {
+		t.Errorf("Authenticate(revoked) error = %v, want %v", err, ErrAgentRevoked)
+	}
+	if err := s.Check(agentID); !errors.Is(err, ErrAgentRevoked) {
+		t.Errorf("Check(revoked) error = %v, want %v", err, ErrAgentRevoked)
+	}
+	if got, err := s.Authenticate(otherCredential); err != nil || got != otherID {
+		t.Errorf("Authenticate(other) = %v, %v, want %v", got, err, otherID)
+	}
+	if _, err := s.Authenticate(otherID + ".forged"); !errors.Is(err, ErrInvalidCredential) {
+		t.Errorf("Authenticate(forged) error = %v, want %v", err, ErrInvalidCredential)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{token, credential, otherCredential} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("auth file contains the secret %q", secret)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	adminv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/admin/v1"
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/internal/server/rollout"
+	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// CreateBootstrapToken implements AdminService.CreateBootstrapToken
+func (s *Server) CreateBootstrapToken(ctx context.Context, req *adminv1.CreateBootstrapTokenRequest) (*adminv1.CreateBootstrapTokenResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.agentAuth == nil {
+		return nil, status.Error(codes.FailedPrecondition, "agent enrollment is not enabled on this server")
+	}
+	if req.TtlSeconds < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid ttl_seconds: %d", req.TtlSeconds)
+	}
+
+	token, t, err := s.agentAuth.CreateBootstrapToken(time.Duration(req.TtlSeconds)*time.Second, int(req.MaxUses), req.Description)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create bootstrap token: %v", err)
+	}
+
+	logging.FromContext(ctx, s.logger).Info("Bootstrap token created",
+		"token_id", t.ID,
+		"expires_at", t.ExpiresAt,
+		"max_uses", t.MaxUses,
+	)
+	return &adminv1.CreateBootstrapTokenResponse{
+		Token:     token,
+		TokenId:   t.ID,
+		ExpiresAt: timestamppb.New(t.ExpiresAt),
+	}, nil
+}
+
+// ListEnrolledAgents implements AdminService.ListEnrolledAgents
+func (s *Server) ListEnrolledAgents(ctx context.Context, _ *adminv1.ListEnrolledAgentsRequest) (*adminv1.ListEnrolledAgentsResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.agentAuth == nil {
+		return nil, status.Error(codes.FailedPrecondition, "agent enrollment is not enabled on this server")
+	}
+
+	resp := &adminv1.ListEnrolledAgentsResponse{}
+	for _, a := range s.agentAuth.ListAgents() {
+		agent := &adminv1.EnrolledAgent{
+			AgentId:    a.ID,
+			Hostname:   a.Hostname,
+			TokenId:    a.TokenID,
+			EnrolledAt: timestamppb.New(a.EnrolledAt),
+			Connected:  s.hasAgentStream(a.ID),
+		}
+		if a.RevokedAt != nil {
+			agent.RevokedAt = timestamppb.New(*a.RevokedAt)
+		}
+		resp.Agents = append(resp.Agents, agent)
+	}
+	return resp, nil
+}
+
+// RevokeAgent implements AdminService.RevokeAgent
+func (s *Server) RevokeAgent(ctx context.Context, req *adminv1.RevokeAgentRequest) (*adminv1.RevokeAgentResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.agentAuth == nil {
+		return nil, status.Error(codes.FailedPrecondition, "agent enrollment is not enabled on this server")
+	}
+
+	if err := s.agentAuth.Revoke(req.AgentId); err != nil {
+		if errors.Is(err, model.ErrAgentNotFound) {
+			return nil, status.Errorf(codes.NotFound, "agent %s is not enrolled", req.AgentId)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to revoke agent: %v", err)
+	}
+
+	// Keep the scheduler away from it until its stream is closed
+	if err := s.store.UpdateAgentStatus(req.AgentId, agentv1.AgentStatus_AGENT_STATUS_OFFLINE); err != nil && !errors.Is(err, model.ErrAgentNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to update agent status: %v", err)
+	}
+
+	logging.FromContext(ctx, s.logger).Info("Agent revoked", "agent_id", req.AgentId)
+	return &adminv1.RevokeAgentResponse{}, nil
+}
+
+// SetTemplateCanary implements AdminService.SetTemplateCanary
+func (s *Server) SetTemplateCanary(ctx context.Context, req *adminv1.SetTemplateCanaryRequest) (*adminv1.SetTemplateCanaryResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	r, err := s.rollouts.Set(req.Template, req.Version, int(req.WeightPercent), req.MaxFailureRateDelta, int(req.MinRunners))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid canary: %v", err)
+	}
+	s.metricsCollector.SetCanaryWeight(r.Template, r.Version, r.WeightPercent)
+
+	logging.FromContext(ctx, s.logger).Info("Template canary set",
+		"template", r.Template,
+		"template_version", r.Version,
+		"weight_percent", r.WeightPercent,
+		"max_failure_rate_delta", r.MaxFailureRateDelta,
+		"min_runners", r.MinRunners,
+	)
+	return &adminv1.SetTemplateCanaryResponse{Rollout: rolloutToProto(r)}, nil
+}
+
+// ListTemplateRollouts implements AdminService.ListTemplateRollouts
+func (s *Server) ListTemplateRollouts(ctx context.Context, _ *adminv1.ListTemplateRolloutsRequest) (*adminv1.ListTemplateRolloutsResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	resp := &adminv1.ListTemplateRolloutsResponse{}
+	for _, r := range s.rollouts.List() {
+		resp.Rollouts = append(resp.Rollouts, rolloutToProto(r))
+	}
+	return resp, nil
+}
+
+// DeleteTemplateCanary implements AdminService.DeleteTemplateCanary
+func (s *Server) DeleteTemplateCanary(ctx context.Context, req *adminv1.DeleteTemplateCanaryRequest) (*adminv1.DeleteTemplateCanaryResponse, error) {
+	if err := s.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	r, err := s.rollouts.Delete(req.Template)
+	if err != nil {
+		if errors.Is(err, rollout.ErrRolloutNotFound) {
+			return nil, status.Errorf(codes.NotFound, "template %s has no canary", req.Template)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to delete canary: %v", err)
+	}
+	s.metricsCollector.DeleteCanaryWeight(r.Template, r.Version)
+
+	logging.FromContext(ctx, s.logger).Info("Template canary deleted", "template", r.Template, "template_version", r.Version)
+	return &adminv1.DeleteTemplateCanaryResponse{Rollout: rolloutToProto(r)}, nil
+}
+
+func rolloutToProto(r rollout.Rollout) *adminv1.TemplateRollout {
+	p := &adminv1.TemplateRollout{
+		Template:            r.Template,
+		CanaryVersion:       r.Version,
+		WeightPercent:       uint32(r.WeightPercent),
+		State:               adminv1.TemplateRolloutState_TEMPLATE_ROLLOUT_STATE_CANARY,
+		Canary:              statsToProto(r.Canary),
+		Stable:              statsToProto(r.Stable),
+		MaxFailureRateDelta: r.MaxFailureRateDelta,
+		MinRunners:          uint32(r.MinRunners),
+		CreatedAt:           timestamppb.New(r.CreatedAt),
+		Reason:              r.Reason,
+	}
+	if r.State == rollout.StateRolledBack {
+		p.State = adminv1.TemplateRolloutState_TEMPLATE_ROLLOUT_STATE_ROLLED_BACK
+		p.RolledBackAt = timestamppb.New(r.RolledBackAt)
+	}
+	return p
+}
+
+func statsToProto(s rollout.Stats) *adminv1.TemplateVersionStats {
+	return &adminv1.TemplateVersionStats{
+		Runners:            uint32(s.Runners),
+		Failures:           uint32(s.Failures),
+		FailureRate:        s.FailureRate(),
+		MeanStartupSeconds: s.MeanStartup().Seconds(),
+	}
+}
@@ -0,0 +1,91 @@
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/internal/server/agentauth"
+	"github.com/whywaita/shoes-vz/pkg/auth"
+	"github.com/whywaita/shoes-vz/pkg/logging"
+)
+
+// Enroll implements AgentService.Enroll
+func (s *Server) Enroll(ctx context.Context, req *agentv1.EnrollRequest) (*agentv1.EnrollResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	if s.agentAuth == nil {
+		return nil, status.Error(codes.FailedPrecondition, "agent enrollment is not enabled on this server")
+	}
+
+	agentID, credential, err := s.agentAuth.Enroll(req.BootstrapToken, req.Hostname)
+	if err != nil {
+		if errors.Is(err, agentauth.ErrInvalidBootstrapToken) {
+			logger.Warn("Rejected enrollment", "hostname", req.Hostname, "error", err)
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		logger.Error("Failed to enroll agent", "hostname", req.Hostname, "error", err)
+		return nil, status.Errorf(codes.Internal, "failed to enroll agent: %v", err)
+	}
+
+	logger.Info("Agent enrolled", "agent_id", agentID, "hostname", req.Hostname)
+	return &agentv1.EnrollResponse{
+		AgentId:    agentID,
+		Credential: credential,
+	}, nil
+}
+
+// authenticateAgent returns the ID of the agent whose credential the call carries
+func (s *Server) authenticateAgent(ctx context.Context) (string, error) {
+	credential, ok := auth.BearerFromContext(ctx)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "missing agent credential")
+	}
+
+	agentID, err := s.agentAuth.Authenticate(credential)
+	switch {
+	case errors.Is(err, agentauth.ErrAgentRevoked):
+		return "", status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return "", status.Error(codes.Unauthenticated, err.Error())
+	}
+	return agentID, nil
+}
+
+// checkSyncAgent checks the agent ID a Sync stream claims. Authenticated
+// streams may only claim their own ID; otherwise the agent must at least
+// have registered.
+func (s *Server) checkSyncAgent(authenticatedID, claimedID string) error {
+	if claimedID == "" {
+		return status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	if s.agentAuth != nil {
+		if claimedID != authenticatedID {
+			return status.Errorf(codes.PermissionDenied, "credential does not belong to agent %s", claimedID)
+		}
+		return nil
+	}
+	if _, err := s.store.GetAgent(claimedID); err != nil {
+		return status.Errorf(codes.NotFound, "agent %s is not registered", claimedID)
+	}
+	return nil
+}
+
+// authorizeAdmin checks the admin token of an AdminService call
+func (s *Server) authorizeAdmin(ctx context.Context) error {
+	if len(s.adminToken) == 0 {
+		return status.Error(codes.PermissionDenied, "admin API is not enabled on this server")
+	}
+	token, ok := auth.BearerFromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing admin token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), s.adminToken) != 1 {
+		return status.Error(codes.PermissionDenied, "invalid admin token")
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package grpc
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	adminv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/admin/v1"
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/internal/server/agentauth"
+	"github.com/whywaita/shoes-vz/internal/server/store"
+)
+
+// fakeSyncStream plays an agent on the other end of Sync
+type fakeSyncStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *agentv1.SyncRequest
+	sent chan *agentv1.SyncResponse
+}
+
+func newFakeSyncStream(credential string) *fakeSyncStream {
+	ctx := context.Background()
+	if credential != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+credential))
+	}
+	return &fakeSyncStream{
+		ctx:  ctx,
+		recv: make(chan *agentv1.SyncRequest, 1),
+		sent: make(chan *agentv1.SyncResponse, 10),
+	}
+}
+
+func (f *fakeSyncStream) Context() context.Context { return f.ctx }
+
+func (f *fakeSyncStream) Recv() (*agentv1.SyncRequest, error) {
+	req, ok := <-f.recv
+	if !ok {
+		return nil, io.EOF
+	}
+	return req, nil
+}
+
+func (f *fakeSyncStream) Send(resp *agentv1.SyncResponse) error {
+	f.sent <- resp
+	return nil
+}
+
+// startSync runs Sync on the stream and returns its result channel
+func startSync(s *Server, f *fakeSyncStream) chan error {
+	done := make(chan error, 1)
+	go func() { done <- s.Sync(f) }()
+	return done
+}
+
+func waitSync(t *testing.T, done chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not return")
+		return nil
+	}
+}
+
+func newAuthTestServer(t *testing.T) (*Server, *agentauth.Store, string) {
+	t.Helper()
+	a, err := agentauth.Open(filepath.Join(t.TempDir(), "agents.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := a.CreateBootstrapToken(time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(store.NewStore(), nil, slog.Default(), WithAgentAuth(a), WithAdminToken([]byte("admin-secret")))
+	return s, a, token
+}
+
+func enrollAndRegister(t *testing.T, s *Server, token string) (string, string) {
+	t.Helper()
+	resp, err := s.Enroll(context.Background(), &agentv1.EnrollRequest{BootstrapToken: token, Hostname: "mac-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+resp.Credential))
+	reg, err := s.RegisterAgent(ctx, &agentv1.RegisterAgentRequest{Hostname: "mac-1", Capacity: &agentv1.AgentCapacity{MaxRunners: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.AgentId != resp.AgentId {
+		t.Fatalf("RegisterAgent() agent ID = %v, want enrolled ID %v", reg.AgentId, resp.AgentId)
+	}
+	return resp.AgentId, resp.Credential
+}
+
+func TestServer_SyncAuthentication(t *testing.T) {
+	s, _, token := newAuthTestServer(t)
+	agentID, credential := enrollAndRegister(t, s, token)
+	otherID, _ := enrollAndRegister(t, s, token)
+
+	tests := []struct {
+		name       string
+		credential string
+		agentID    string
+		wantCode   codes.Code
+	}{
+		{name: "no credential", agentID: agentID, wantCode: codes.Unauthenticated},
+		{name: "forged credential", credential: agentID + ".forged", agentID: agentID, wantCode: codes.Unauthenticated},
+		{name: "claims another agent", credential: credential, agentID: otherID, wantCode: codes.PermissionDenied},
+		{name: "own agent", credential: credential, agentID: agentID, wantCode: codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSyncStream(tt.credential)
+			done := startSync(s, f)
+			f.recv <- &agentv1.SyncRequest{AgentId: tt.agentID}
+			if tt.wantCode == codes.OK {
+				<-f.sent
+				close(f.recv)
+			}
+
+			err := waitSync(t, done)
+			if tt.wantCode == codes.OK {
+				if err != io.EOF {
+					t.Errorf("Sync() error = %v, want io.EOF", err)
+				}
+				return
+			}
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("Sync() code = %v, want %v (error = %v)", code, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestServer_SyncDuplicateAndRevoke(t *testing.T) {
+	s, _, token := newAuthTestServer(t)
+	agentID, credential := enrollAndRegister(t, s, token)
+
+	first := newFakeSyncStream(credential)
+	firstDone := startSync(s, first)
+	first.recv <- &agentv1.SyncRequest{AgentId: agentID}
+	<-first.sent
+
+	// A second stream for the same agent is refused while the first is open
+	second := newFakeSyncStream(credential)
+	secondDone := startSync(s, second)
+	second.recv <- &agentv1.SyncRequest{AgentId: agentID}
+	if code := status.Code(waitSync(t, secondDone)); code != codes.AlreadyExists {
+		t.Errorf("duplicate Sync() code = %v, want %v", code, codes.AlreadyExists)
+	}
+
+	// Revocation needs the admin token
+	if _, err := s.RevokeAgent(context.Background(), &adminv1.RevokeAgentRequest{AgentId: agentID}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("RevokeAgent() without token code = %v, want %v", status.Code(err), codes.Unauthenticated)
+	}
+	adminCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-secret"))
+	if _, err := s.RevokeAgent(adminCtx, &adminv1.RevokeAgentRequest{AgentId: agentID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The open stream is closed on its next message, without a command
+	first.recv <- &agentv1.SyncRequest{AgentId: agentID}
+	if code := status.Code(waitSync(t, firstDone)); code != codes.PermissionDenied {
+		t.Errorf("Sync() after revocation code = %v, want %v", code, codes.PermissionDenied)
+	}
+	if len(first.sent) != 0 {
+		t.Errorf("revoked agent received %d more responses", len(first.sent))
+	}
+	agent, err := s.store.GetAgent(agentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Status != agentv1.AgentStatus_AGENT_STATUS_OFFLINE {
+		t.Errorf("revoked agent status = %v, want %v", agent.Status, agentv1.AgentStatus_AGENT_STATUS_OFFLINE)
+	}
+
+	// And it cannot come back
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+credential))
+	if _, err := s.RegisterAgent(ctx, &agentv1.RegisterAgentRequest{Capacity: &agentv1.AgentCapacity{}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("RegisterAgent() after revocation code = %v, want %v", status.Code(err), codes.PermissionDenied)
+	}
+}
+
+func TestServer_SyncWithoutAuthentication(t *testing.T) {
+	s := NewServer(store.NewStore(), nil, slog.Default())
+
+	f := newFakeSyncStream("")
+	done := startSync(s, f)
+	f.recv <- &agentv1.SyncRequest{AgentId: "never-registered"}
+	if code := status.Code(waitSync(t, done)); code != codes.NotFound {
+		t.Errorf("Sync() code = %v, want %v", code, codes.NotFound)
+	}
+
+	if _, err := s.Enroll(context.Background(), &agentv1.EnrollRequest{BootstrapToken: "x.y"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Enroll() code = %v, want %v", status.Code(err), codes.FailedPrecondition)
+	}
+}
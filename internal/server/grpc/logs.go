@@ -0,0 +1,126 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	shoesv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/shoes/v1"
+	"github.com/whywaita/shoes-vz/pkg/logging"
+)
+
+const (
+	// defaultConsoleLogBytes is how much of the console log is returned when the request sets no limit
+	defaultConsoleLogBytes = 256 << 10
+
+	// maxConsoleLogBytes keeps a log reply well under the gRPC message size limit
+	maxConsoleLogBytes = 1 << 20
+
+	// runnerLogTimeout bounds the wait for the agent, which picks up commands on its next sync
+	runnerLogTimeout = 30 * time.Second
+)
+
+// GetConsoleLog implements ShoesService.GetConsoleLog
+func (s *Server) GetConsoleLog(ctx context.Context, req *shoesv1.GetConsoleLogRequest) (*shoesv1.GetConsoleLogResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	runner, err := s.store.GetRunnerByCloudID(req.CloudId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "runner not found: %v", err)
+	}
+	agentID, err := s.store.GetAgentForRunner(runner.RunnerId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get agent: %v", err)
+	}
+
+	limit := req.LimitBytes
+	if limit <= 0 {
+		limit = defaultConsoleLogBytes
+	}
+	limit = min(limit, maxConsoleLogBytes)
+
+	logID := uuid.New().String()
+	ch := s.addLogWaiter(logID, agentID)
+	defer s.removeLogWaiter(logID)
+
+	cmd := &agentv1.SyncResponse{
+		Command: &agentv1.SyncResponse_GetRunnerLog{
+			GetRunnerLog: &agentv1.GetRunnerLogCommand{
+				RunnerId:   runner.RunnerId,
+				RequestId:  logID,
+				Kind:       agentv1.RunnerLogKind_RUNNER_LOG_KIND_CONSOLE,
+				LimitBytes: limit,
+			},
+		},
+	}
+	if err := s.sendCommandToAgent(agentID, cmd); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to send command to agent: %v", err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, runnerLogTimeout)
+	defer cancel()
+
+	select {
+	case <-timeoutCtx.Done():
+		logger.Warn("Agent did not send console log", "runner_id", runner.RunnerId, "agent_id", agentID)
+		return nil, status.Errorf(codes.DeadlineExceeded, "agent did not send the console log: %v", timeoutCtx.Err())
+	case log := <-ch:
+		if log.ErrorMessage != "" {
+			return nil, status.Errorf(codes.NotFound, "console log unavailable: %s", log.ErrorMessage)
+		}
+		return &shoesv1.GetConsoleLogResponse{Content: log.Content}, nil
+	}
+}
+
+// logWaiter is a request waiting for the RunnerLog of the agent it asked
+type logWaiter struct {
+	agentID string
+	ch      chan *agentv1.RunnerLog
+}
+
+// addLogWaiter registers a channel for the RunnerLog answering logID, which
+// only agentID may send
+func (s *Server) addLogWaiter(logID, agentID string) chan *agentv1.RunnerLog {
+	ch := make(chan *agentv1.RunnerLog, 1)
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.logWaiters[logID] = logWaiter{agentID: agentID, ch: ch}
+	return ch
+}
+
+// removeLogWaiter unregisters the channel for logID
+func (s *Server) removeLogWaiter(logID string) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	delete(s.logWaiters, logID)
+}
+
+// deliverRunnerLogs hands logs sent by an agent to the requests waiting for
+// them. Logs answering a request sent to another agent are dropped.
+func (s *Server) deliverRunnerLogs(agentID string, logs []*agentv1.RunnerLog) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	for _, log := range logs {
+		waiter, ok := s.logWaiters[log.RequestId]
+		if !ok {
+			continue // The request gave up waiting
+		}
+		if waiter.agentID != agentID {
+			s.logger.Warn("Dropping runner log from another agent",
+				"agent_id", agentID,
+				"runner_id", log.RunnerId,
+			)
+			continue
+		}
+		select {
+		case waiter.ch <- log:
+		default:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package grpc
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	shoesv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/shoes/v1"
+	"github.com/whywaita/shoes-vz/internal/server/store"
+)
+
+func TestServer_GetConsoleLog(t *testing.T) {
+	st := store.NewStore()
+	st.RegisterAgent("agent-1", &agentv1.Agent{AgentId: "agent-1"})
+	if err := st.UpdateAgentRunners("agent-1", []*agentv1.Runner{{RunnerId: "runner-1"}, {RunnerId: "runner-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	st.RegisterCloudID("shoes-vz-runner-1", "runner-1")
+	st.RegisterCloudID("shoes-vz-runner-2", "runner-2")
+
+	s := NewServer(st, nil, slog.Default())
+
+	// Play the agent: answer log commands the way the sync client does
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			cmd, ok := s.getNextCommand("agent-1").Command.(*agentv1.SyncResponse_GetRunnerLog)
+			if !ok {
+				continue
+			}
+			log := &agentv1.RunnerLog{
+				RequestId: cmd.GetRunnerLog.RequestId,
+				RunnerId:  cmd.GetRunnerLog.RunnerId,
+			}
+			if cmd.GetRunnerLog.RunnerId == "runner-1" {
+				log.Content = []byte("panic: boot failed\n")
+			} else {
+				log.ErrorMessage = "no such file or directory"
+			}
+			s.deliverRunnerLogs("agent-1", []*agentv1.RunnerLog{log})
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		cloudID  string
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "log is returned", cloudID: "shoes-vz-runner-1", want: "panic: boot failed\n", wantCode: codes.OK},
+		{name: "agent cannot read the log", cloudID: "shoes-vz-runner-2", wantCode: codes.NotFound},
+		{name: "unknown runner", cloudID: "shoes-vz-unknown", wantCode: codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.GetConsoleLog(context.Background(), &shoesv1.GetConsoleLogRequest{CloudId: tt.cloudID})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("GetConsoleLog() code = %v, want %v (error = %v)", code, tt.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if string(resp.Content) != tt.want {
+				t.Errorf("GetConsoleLog() = %q, want %q", resp.Content, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_DeliverRunnerLogs_OtherAgent(t *testing.T) {
+	s := NewServer(store.NewStore(), nil, slog.Default())
+	ch := s.addLogWaiter("log-1", "agent-a")
+	defer s.removeLogWaiter("log-1")
+
+	// agent-b answers a request sent to agent-a
+	s.deliverRunnerLogs("agent-b", []*agentv1.RunnerLog{{RequestId: "log-1", RunnerId: "runner-a", Content: []byte("forged")}})
+	select {
+	case log := <-ch:
+		t.Fatalf("log from another agent was delivered: %q", log.Content)
+	default:
+	}
+
+	s.deliverRunnerLogs("agent-a", []*agentv1.RunnerLog{{RequestId: "log-1", RunnerId: "runner-a", Content: []byte("real")}})
+	select {
+	case log := <-ch:
+		if string(log.Content) != "real" {
+			t.Errorf("delivered log = %q, want %q", log.Content, "real")
+		}
+	default:
+		t.Fatal("log from the agent that was asked was not delivered")
+	}
+}
@@ -0,0 +1,69 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/whywaita/shoes-vz/internal/server/scheduler"
+	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// selectAgent selects an agent for req. If the rollout of its template
+// sends the runner to the canary version, it sets req.TemplateVersion,
+// unless no agent has that version. Otherwise the runner is cloned from
+// the agent's active version, so agents whose active version is the
+// canary, even a rolled back one, are skipped. Rollouts only cover runners
+// that name their template, since the server does not know which template
+// an agent defaults to.
+func (s *Server) selectAgent(ctx context.Context, req *scheduler.Request) (string, error) {
+	req.TemplateVersion = s.rollouts.Choose(req.Template)
+	if req.TemplateVersion != "" {
+		agentID, err := s.scheduler.SelectAgent(ctx, req)
+		if !errors.Is(err, model.ErrNoAvailableAgent) {
+			return agentID, err
+		}
+		logging.FromContext(ctx, s.logger).Warn("No agent available with the canary version, using the stable version",
+			"template", req.Template,
+			"template_version", req.TemplateVersion,
+		)
+		req.TemplateVersion = ""
+	}
+	req.ExcludeVersion = s.rollouts.CanaryVersion(req.Template)
+	return s.scheduler.SelectAgent(ctx, req)
+}
+
+// recordTemplateStartup counts a runner that started or failed to towards
+// the metrics and the rollout of the template version it was cloned from
+func (s *Server) recordTemplateStartup(ctx context.Context, req *scheduler.Request, runnerID string, failed bool, duration time.Duration) {
+	// The agent reports the version once the VM is created
+	name, version := req.Template, req.TemplateVersion
+	if runner, err := s.store.GetRunner(runnerID); err == nil && runner.GetTemplate() != nil {
+		name, version = runner.GetTemplate().GetName(), runner.GetTemplate().GetVersion()
+	}
+	if name == "" {
+		return
+	}
+
+	s.metricsCollector.RecordTemplateStartup(name, version, failed, duration)
+	// Runners on the agent's default template are never sent to a canary,
+	// so they are left out of rollouts
+	if req.Template == "" {
+		return
+	}
+	r, rolledBack := s.rollouts.Record(name, version, failed, duration)
+	if !rolledBack {
+		return
+	}
+	s.metricsCollector.RecordTemplateRollback(r.Template, r.Version)
+	logging.FromContext(ctx, s.logger).Warn("Canary template version rolled back",
+		"template", r.Template,
+		"template_version", r.Version,
+		"reason", r.Reason,
+		"canary_runners", r.Canary.Runners,
+		"canary_failures", r.Canary.Failures,
+		"stable_runners", r.Stable.Runners,
+		"stable_failures", r.Stable.Failures,
+	)
+}
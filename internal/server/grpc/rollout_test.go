@@ -0,0 +1,209 @@
+package grpc
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	adminv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/admin/v1"
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	shoesv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/shoes/v1"
+	"github.com/whywaita/shoes-vz/internal/server/scheduler"
+	"github.com/whywaita/shoes-vz/internal/server/store"
+)
+
+func TestServer_CanaryRollback(t *testing.T) {
+	st := store.NewStore()
+	for id, versions := range map[string][]string{"agent-1": {"1"}, "agent-2": {"1", "2"}} {
+		var templates []*agentv1.Template
+		for _, v := range versions {
+			templates = append(templates, &agentv1.Template{Name: "macos-15", Version: v, Active: v == "1"})
+		}
+		st.RegisterAgent(id, &agentv1.Agent{
+			AgentId:      id,
+			Capacity:     &agentv1.AgentCapacity{MaxRunners: 10},
+			Status:       agentv1.AgentStatus_AGENT_STATUS_ONLINE,
+			Capabilities: &agentv1.AgentCapabilities{Templates: templates},
+		})
+	}
+	s := NewServer(st, newTestCollector(st), slog.Default(), WithAdminToken([]byte("admin-secret")))
+	adminCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-secret"))
+
+	if _, err := s.SetTemplateCanary(adminCtx, &adminv1.SetTemplateCanaryRequest{Template: "macos-15", Version: "2", WeightPercent: 100, MinRunners: 2}); err != nil {
+		t.Fatalf("SetTemplateCanary() error = %v", err)
+	}
+
+	// Play the agents: canary runners fail, stable runners start
+	commands := make(chan *agentv1.CreateRunnerCommand, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			for _, agentID := range []string{"agent-1", "agent-2"} {
+				cmd, ok := s.getNextCommand(agentID).Command.(*agentv1.SyncResponse_CreateRunner)
+				if !ok {
+					continue
+				}
+				commands <- cmd.CreateRunner
+				version, state := "1", agentv1.RunnerState_RUNNER_STATE_SSH_READY
+				if cmd.CreateRunner.TemplateVersion != "" {
+					version, state = cmd.CreateRunner.TemplateVersion, agentv1.RunnerState_RUNNER_STATE_ERROR
+				}
+				_ = st.UpdateAgentRunners(agentID, []*agentv1.Runner{{
+					RunnerId: cmd.CreateRunner.RunnerId,
+					State:    state,
+					Template: &agentv1.Template{Name: "macos-15", Version: version},
+				}})
+			}
+		}
+	}()
+
+	req := &shoesv1.AddInstanceRequest{RunnerName: "runner", Labels: []string{"template-macos-15"}}
+	for i := 0; i < 2; i++ {
+		if _, err := s.AddInstance(context.Background(), req); err == nil {
+			t.Fatalf("AddInstance() of canary runner %d error = nil, want error", i)
+		}
+		if cmd := <-commands; cmd.TemplateVersion != "2" {
+			t.Errorf("CreateRunnerCommand.TemplateVersion = %q, want canary 2", cmd.TemplateVersion)
+		}
+	}
+
+	// Rolled back: new runners use the stable version
+	if _, err := s.AddInstance(context.Background(), req); err != nil {
+		t.Fatalf("AddInstance() after rollback error = %v", err)
+	}
+	if cmd := <-commands; cmd.TemplateVersion != "" {
+		t.Errorf("CreateRunnerCommand.TemplateVersion after rollback = %q, want empty", cmd.TemplateVersion)
+	}
+
+	resp, err := s.ListTemplateRollouts(adminCtx, &adminv1.ListTemplateRolloutsRequest{})
+	if err != nil {
+		t.Fatalf("ListTemplateRollouts() error = %v", err)
+	}
+	if len(resp.Rollouts) != 1 {
+		t.Fatalf("ListTemplateRollouts() returned %d rollouts, want 1", len(resp.Rollouts))
+	}
+	r := resp.Rollouts[0]
+	if r.State != adminv1.TemplateRolloutState_TEMPLATE_ROLLOUT_STATE_ROLLED_BACK || r.Reason == "" {
+		t.Errorf("rollout state = %v with reason %q, want rolled back with a reason", r.State, r.Reason)
+	}
+	// Counting stops at the rollback
+	if r.Canary.Failures != 2 || r.Stable.Runners != 0 {
+		t.Errorf("rollout counted %d canary failures and %d stable runners, want 2 and 0", r.Canary.Failures, r.Stable.Runners)
+	}
+}
+
+func TestServer_CanaryFallsBackToStable(t *testing.T) {
+	st := store.NewStore()
+	st.RegisterAgent("agent-1", &agentv1.Agent{
+		AgentId:      "agent-1",
+		Capacity:     &agentv1.AgentCapacity{MaxRunners: 2},
+		Status:       agentv1.AgentStatus_AGENT_STATUS_ONLINE,
+		Capabilities: &agentv1.AgentCapabilities{Templates: []*agentv1.Template{{Name: "macos-15", Version: "1", Active: true}}},
+	})
+	s := NewServer(st, newTestCollector(st), slog.Default(), WithAdminToken([]byte("admin-secret")))
+	adminCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-secret"))
+	if _, err := s.SetTemplateCanary(adminCtx, &adminv1.SetTemplateCanaryRequest{Template: "macos-15", Version: "2", WeightPercent: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &scheduler.Request{Template: "macos-15"}
+	agentID, err := s.selectAgent(context.Background(), req)
+	if err != nil {
+		t.Fatalf("selectAgent() error = %v", err)
+	}
+	if agentID != "agent-1" || req.TemplateVersion != "" {
+		t.Errorf("selectAgent() = %v with version %q, want agent-1 with the stable version", agentID, req.TemplateVersion)
+	}
+}
+
+func TestServer_StableSkipsRolledBackCanary(t *testing.T) {
+	st := store.NewStore()
+	for id, active := range map[string]string{"agent-1": "1", "agent-2": "2"} {
+		st.RegisterAgent(id, &agentv1.Agent{
+			AgentId:  id,
+			Capacity: &agentv1.AgentCapacity{MaxRunners: 2},
+			Status:   agentv1.AgentStatus_AGENT_STATUS_ONLINE,
+			Capabilities: &agentv1.AgentCapabilities{Templates: []*agentv1.Template{
+				{Name: "macos-15", Version: "1", Active: active == "1"},
+				{Name: "macos-15", Version: "2", Active: active == "2"},
+			}},
+		})
+	}
+	s := NewServer(st, newTestCollector(st), slog.Default(), WithAdminToken([]byte("admin-secret")))
+	adminCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-secret"))
+	if _, err := s.SetTemplateCanary(adminCtx, &adminv1.SetTemplateCanaryRequest{Template: "macos-15", Version: "2", WeightPercent: 100, MinRunners: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, rolledBack := s.rollouts.Record("macos-15", "2", true, 0); !rolledBack {
+		t.Fatal("Record() did not roll back the canary")
+	}
+
+	// agent-2 would clone an unpinned runner from the rolled back canary
+	req := &scheduler.Request{Template: "macos-15"}
+	agentID, err := s.selectAgent(context.Background(), req)
+	if err != nil {
+		t.Fatalf("selectAgent() error = %v", err)
+	}
+	if agentID != "agent-1" || req.TemplateVersion != "" {
+		t.Errorf("selectAgent() = %v with version %q, want agent-1 with the stable version", agentID, req.TemplateVersion)
+	}
+}
+
+func TestServer_CanaryIgnoresDefaultTemplate(t *testing.T) {
+	st := store.NewStore()
+	st.RegisterAgent("agent-1", &agentv1.Agent{
+		AgentId:  "agent-1",
+		Capacity: &agentv1.AgentCapacity{MaxRunners: 2},
+		Status:   agentv1.AgentStatus_AGENT_STATUS_ONLINE,
+		Capabilities: &agentv1.AgentCapabilities{Templates: []*agentv1.Template{
+			{Name: "macos-15", Version: "1", Active: true},
+			{Name: "macos-15", Version: "2"},
+		}},
+	})
+	s := NewServer(st, newTestCollector(st), slog.Default(), WithAdminToken([]byte("admin-secret")))
+	adminCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-secret"))
+	if _, err := s.SetTemplateCanary(adminCtx, &adminv1.SetTemplateCanaryRequest{Template: "macos-15", Version: "2", WeightPercent: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The runner asks for no template, so it gets the agent's default at
+	// its active version even though that is the template under canary
+	req := &scheduler.Request{}
+	agentID, err := s.selectAgent(context.Background(), req)
+	if err != nil {
+		t.Fatalf("selectAgent() error = %v", err)
+	}
+	if agentID != "agent-1" || req.TemplateVersion != "" || req.ExcludeVersion != "" {
+		t.Errorf("selectAgent() = %v with version %q excluding %q, want agent-1 with the active version", agentID, req.TemplateVersion, req.ExcludeVersion)
+	}
+
+	// Nor is it counted towards the rollout
+	if err := st.UpdateAgentRunners("agent-1", []*agentv1.Runner{{
+		RunnerId: "runner-1",
+		State:    agentv1.RunnerState_RUNNER_STATE_SSH_READY,
+		Template: &agentv1.Template{Name: "macos-15", Version: "1"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	s.recordTemplateStartup(context.Background(), req, "runner-1", false, time.Second)
+
+	resp, err := s.ListTemplateRollouts(adminCtx, &adminv1.ListTemplateRolloutsRequest{})
+	if err != nil {
+		t.Fatalf("ListTemplateRollouts() error = %v", err)
+	}
+	if len(resp.Rollouts) != 1 {
+		t.Fatalf("ListTemplateRollouts() returned %d rollouts, want 1", len(resp.Rollouts))
+	}
+	if r := resp.Rollouts[0]; r.Canary.Runners != 0 || r.Stable.Runners != 0 {
+		t.Errorf("rollout counted %d canary and %d stable runners, want none", r.Canary.Runners, r.Stable.Runners)
+	}
+}
@@ -8,27 +8,45 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	adminv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/admin/v1"
 	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
 	shoesv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/shoes/v1"
+	"github.com/whywaita/shoes-vz/internal/server/agentauth"
 	"github.com/whywaita/shoes-vz/internal/server/metrics"
+	"github.com/whywaita/shoes-vz/internal/server/rollout"
 	"github.com/whywaita/shoes-vz/internal/server/scheduler"
 	"github.com/whywaita/shoes-vz/internal/server/store"
 	"github.com/whywaita/shoes-vz/pkg/logging"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
 )
 
+var tracer = tracing.Tracer("server")
+
 // Server implements both ShoesService and AgentService
 type Server struct {
 	shoesv1.UnimplementedShoesServiceServer
 	agentv1.UnimplementedAgentServiceServer
+	adminv1.UnimplementedAdminServiceServer
 
 	store            *store.Store
 	scheduler        scheduler.Scheduler
 	metricsCollector *metrics.Collector
 	logger           *slog.Logger
 
+	// Template for each resource type; agents use their default otherwise
+	resourceTemplates map[string]string
+	// Canary versions of templates
+	rollouts *rollout.Manager
+
+	// Agent credentials; agents are not authenticated when nil
+	agentAuth *agentauth.Store
+	// Token required by AdminService; it is disabled when empty
+	adminToken []byte
+
 	// Map of agent ID to sync stream
 	mu      sync.RWMutex
 	streams map[string]agentv1.AgentService_SyncServer
@@ -39,17 +57,66 @@ type Server struct {
 
 	// Track runner creation times for metrics
 	runnerCreationTimes sync.Map // map[runnerID]time.Time
+
+	// Requests waiting for a RunnerLog, by its request ID
+	logMu      sync.Mutex
+	logWaiters map[string]logWaiter
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithAgentAuth requires agents to enroll and to authenticate with the
+// credential they were issued
+func WithAgentAuth(a *agentauth.Store) Option {
+	return func(s *Server) {
+		s.agentAuth = a
+	}
+}
+
+// WithAdminToken enables AdminService for callers presenting token
+func WithAdminToken(token []byte) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// WithScheduler replaces the default spread scheduler
+func WithScheduler(sch scheduler.Scheduler) Option {
+	return func(s *Server) {
+		s.scheduler = sch
+	}
+}
+
+// WithResourceTemplates sets the template runners of each resource type
+// are cloned from, unless a template- label names one
+func WithResourceTemplates(m map[string]string) Option {
+	return func(s *Server) {
+		s.resourceTemplates = m
+	}
+}
+
+// WithRollouts replaces the default rollout manager
+func WithRollouts(m *rollout.Manager) Option {
+	return func(s *Server) {
+		s.rollouts = m
+	}
 }
 
 // NewServer creates a new gRPC server
-func NewServer(st *store.Store, metricsCollector *metrics.Collector, logger *slog.Logger) *Server {
+func NewServer(st *store.Store, metricsCollector *metrics.Collector, logger *slog.Logger, opts ...Option) *Server {
 	s := &Server{
 		store:            st,
-		scheduler:        scheduler.NewRoundRobinScheduler(st),
+		scheduler:        scheduler.NewSpreadScheduler(st),
+		rollouts:         rollout.NewManager(rollout.DefaultMaxFailureRateDelta, rollout.DefaultMinRunners),
 		metricsCollector: metricsCollector,
 		logger:           logger,
 		streams:          make(map[string]agentv1.AgentService_SyncServer),
 		pendingCommands:  make(map[string][]*agentv1.SyncResponse),
+		logWaiters:       make(map[string]logWaiter),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	// Start background cleanup goroutine
@@ -70,10 +137,18 @@ func (s *Server) AddInstance(ctx context.Context, req *shoesv1.AddInstanceReques
 	)
 
 	// Select an agent
-	agentID, err := s.scheduler.SelectAgent()
+	schedReq := &scheduler.Request{
+		RunnerName:   req.RunnerName,
+		ResourceType: req.ResourceType,
+		Labels:       req.Labels,
+		Template:     scheduler.SelectTemplate(req.ResourceType, req.Labels, s.resourceTemplates),
+	}
+	selectCtx, selectSpan := tracer.Start(ctx, "scheduler.SelectAgent")
+	agentID, err := s.selectAgent(selectCtx, schedReq)
+	tracing.End(selectSpan, err)
 	if err != nil {
 		s.metricsCollector.RecordAddInstanceRequest("failed_no_agent", time.Since(startTime))
-		logger.Error("No available agent", "error", err)
+		logger.Error("No available agent", "labels", req.Labels, "template", schedReq.Template, "error", err)
 		return nil, status.Errorf(codes.Unavailable, "no available agent: %v", err)
 	}
 
@@ -85,37 +160,55 @@ func (s *Server) AddInstance(ctx context.Context, req *shoesv1.AddInstanceReques
 		"runner_id", runnerID,
 		"cloud_id", cloudID,
 		"agent_id", agentID,
+		"template", schedReq.Template,
+		"template_version", schedReq.TemplateVersion,
+	)
+	trace.SpanFromContext(ctx).SetAttributes(
+		tracing.RunnerIDKey.String(runnerID),
+		tracing.CloudIDKey.String(cloudID),
+		tracing.AgentIDKey.String(agentID),
 	)
 
 	// Track creation time for startup duration metrics
 	s.runnerCreationTimes.Store(runnerID, startTime)
 
-	// Register cloud ID mapping
+	// Register cloud ID mapping, and let only the chosen agent report the runner
 	s.store.RegisterCloudID(cloudID, runnerID)
+	s.store.AssignRunner(runnerID, agentID)
 
 	// Create runner command
 	cmd := &agentv1.SyncResponse{
 		Command: &agentv1.SyncResponse_CreateRunner{
 			CreateRunner: &agentv1.CreateRunnerCommand{
-				RunnerId:    runnerID,
-				RunnerName:  req.RunnerName,
-				SetupScript: req.SetupScript,
-				RequestId:   requestID,
+				RunnerId:     runnerID,
+				RunnerName:   req.RunnerName,
+				SetupScript:  req.SetupScript,
+				RequestId:    requestID,
+				TraceContext: tracing.Inject(ctx),
+				Template:     schedReq.Template,
+
+				TemplateVersion: schedReq.TemplateVersion,
 			},
 		},
 	}
 
 	// Send command to agent
 	if err := s.sendCommandToAgent(agentID, cmd); err != nil {
+		s.store.UnassignRunner(runnerID)
 		s.metricsCollector.RecordAddInstanceRequest("failed_send_command", time.Since(startTime))
 		s.metricsCollector.RecordRunnerFailure("send_command_failed")
 		return nil, status.Errorf(codes.Internal, "failed to send command to agent: %v", err)
 	}
 
 	// Wait for runner to reach SSH_READY state
-	if err := s.waitForRunnerState(ctx, runnerID, agentv1.RunnerState_RUNNER_STATE_SSH_READY, 5*time.Minute); err != nil {
+	waitCtx, waitSpan := tracer.Start(ctx, "server.WaitForRunner")
+	err = s.waitForRunnerState(waitCtx, runnerID, agentv1.RunnerState_RUNNER_STATE_SSH_READY, 5*time.Minute)
+	tracing.End(waitSpan, err)
+	if err != nil {
+		s.store.UnassignRunner(runnerID)
 		s.metricsCollector.RecordAddInstanceRequest("failed_timeout", time.Since(startTime))
 		s.metricsCollector.RecordRunnerFailure("startup_timeout")
+		s.recordTemplateStartup(ctx, schedReq, runnerID, true, time.Since(startTime))
 		return nil, status.Errorf(codes.Internal, "runner failed to start: %v", err)
 	}
 
@@ -134,6 +227,13 @@ func (s *Server) AddInstance(ctx context.Context, req *shoesv1.AddInstanceReques
 	}
 
 	s.metricsCollector.RecordAddInstanceRequest("success", time.Since(startTime))
+	s.recordTemplateStartup(ctx, schedReq, runnerID, false, time.Since(startTime))
+	logger.Info("Runner ready",
+		"runner_id", runnerID,
+		"template", runner.GetTemplate().GetName(),
+		"template_version", runner.GetTemplate().GetVersion(),
+		"macos_build", runner.GetTemplate().GetMacosBuild(),
+	)
 
 	return &shoesv1.AddInstanceResponse{
 		CloudId:   cloudID,
@@ -169,13 +269,19 @@ func (s *Server) DeleteInstance(ctx context.Context, req *shoesv1.DeleteInstance
 		"runner_id", runner.RunnerId,
 		"agent_id", agentID,
 	)
+	trace.SpanFromContext(ctx).SetAttributes(
+		tracing.RunnerIDKey.String(runner.RunnerId),
+		tracing.CloudIDKey.String(req.CloudId),
+		tracing.AgentIDKey.String(agentID),
+	)
 
 	// Create delete command
 	cmd := &agentv1.SyncResponse{
 		Command: &agentv1.SyncResponse_DeleteRunner{
 			DeleteRunner: &agentv1.DeleteRunnerCommand{
-				RunnerId:  runner.RunnerId,
-				RequestId: requestID,
+				RunnerId:     runner.RunnerId,
+				RequestId:    requestID,
+				TraceContext: tracing.Inject(ctx),
 			},
 		},
 	}
@@ -201,12 +307,25 @@ func (s *Server) DeleteInstance(ctx context.Context, req *shoesv1.DeleteInstance
 // RegisterAgent implements AgentService.RegisterAgent
 func (s *Server) RegisterAgent(ctx context.Context, req *agentv1.RegisterAgentRequest) (*agentv1.RegisterAgentResponse, error) {
 	agentID := uuid.New().String()
+	if s.agentAuth != nil {
+		// Enrolled agents keep their ID across restarts
+		id, err := s.authenticateAgent(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if s.hasAgentStream(id) {
+			return nil, status.Errorf(codes.AlreadyExists, "agent %s is already connected", id)
+		}
+		agentID = id
+	}
 
 	agent := &agentv1.Agent{
-		AgentId:  agentID,
-		Hostname: req.Hostname,
-		Capacity: req.Capacity,
-		Status:   agentv1.AgentStatus_AGENT_STATUS_ONLINE,
+		AgentId:      agentID,
+		Hostname:     req.Hostname,
+		Capacity:     req.Capacity,
+		Status:       agentv1.AgentStatus_AGENT_STATUS_ONLINE,
+		Labels:       req.Labels,
+		Capabilities: req.Capabilities,
 	}
 
 	s.store.RegisterAgent(agentID, agent)
@@ -215,6 +334,7 @@ func (s *Server) RegisterAgent(ctx context.Context, req *agentv1.RegisterAgentRe
 		"agent_id", agentID,
 		"hostname", req.Hostname,
 		"max_runners", req.Capacity.MaxRunners,
+		"labels", scheduler.AgentLabels(agent),
 	)
 
 	return &agentv1.RegisterAgentResponse{
@@ -225,45 +345,93 @@ func (s *Server) RegisterAgent(ctx context.Context, req *agentv1.RegisterAgentRe
 
 // Sync implements AgentService.Sync
 func (s *Server) Sync(stream agentv1.AgentService_SyncServer) error {
+	logger := logging.FromContext(stream.Context(), s.logger)
+
+	// With agent authentication the stream belongs to the authenticated agent
+	var authenticatedID string
+	if s.agentAuth != nil {
+		id, err := s.authenticateAgent(stream.Context())
+		if err != nil {
+			return err
+		}
+		authenticatedID = id
+	}
+
 	var agentID string
+	defer func() {
+		if agentID == "" {
+			return
+		}
+		s.removeAgentStream(agentID, stream)
+		if err := s.store.UpdateAgentStatus(agentID, agentv1.AgentStatus_AGENT_STATUS_OFFLINE); err != nil {
+			logger.Error("Failed to update agent status", "agent_id", agentID, "error", err)
+		}
+	}()
 
 	for {
 		req, err := stream.Recv()
 		if err != nil {
 			if agentID != "" {
-				s.logger.Info("Agent stream closed", "agent_id", agentID, "error", err)
-				s.removeAgentStream(agentID)
-				if updateErr := s.store.UpdateAgentStatus(agentID, agentv1.AgentStatus_AGENT_STATUS_OFFLINE); updateErr != nil {
-					s.logger.Error("Failed to update agent status", "agent_id", agentID, "error", updateErr)
-				}
+				logger.Info("Agent stream closed", "agent_id", agentID, "error", err)
 			}
 			return err
 		}
 
 		// First message should contain agent ID
 		if agentID == "" {
+			if err := s.checkSyncAgent(authenticatedID, req.AgentId); err != nil {
+				logger.Warn("Rejected agent stream", "agent_id", req.AgentId, "error", err)
+				return err
+			}
+			if !s.claimAgentStream(req.AgentId, stream) {
+				logger.Warn("Rejected duplicate agent stream", "agent_id", req.AgentId)
+				return status.Errorf(codes.AlreadyExists, "agent %s already has a Sync stream", req.AgentId)
+			}
 			agentID = req.AgentId
-			s.setAgentStream(agentID, stream)
-			s.logger.Info("Agent connected", "agent_id", agentID)
+			logger.Info("Agent connected", "agent_id", agentID)
+		} else if req.AgentId != "" && req.AgentId != agentID {
+			return status.Errorf(codes.PermissionDenied, "stream belongs to agent %s", agentID)
+		}
+
+		// Stop talking to an agent as soon as it is revoked
+		if s.agentAuth != nil {
+			if err := s.agentAuth.Check(agentID); err != nil {
+				logger.Warn("Closing stream of revoked agent", "agent_id", agentID)
+				return status.Error(codes.PermissionDenied, err.Error())
+			}
 		}
 
 		// Update agent status
 		if err := s.store.UpdateAgentStatus(agentID, agentv1.AgentStatus_AGENT_STATUS_ONLINE); err != nil {
-			s.logger.Error("Failed to update agent status", "agent_id", agentID, "error", err)
+			logger.Error("Failed to update agent status", "agent_id", agentID, "error", err)
 		}
 
 		// Update runners
 		if err := s.store.UpdateAgentRunners(agentID, req.Runners); err != nil {
-			s.logger.Error("Failed to update agent runners",
+			logger.Error("Failed to update agent runners",
 				"agent_id", agentID,
 				"error", err,
 			)
 		}
 
+		// Agents older than template reporting on Sync send none
+		if len(req.Templates) > 0 {
+			if err := s.store.UpdateAgentTemplates(agentID, req.Templates); err != nil {
+				logger.Error("Failed to update agent templates", "agent_id", agentID, "error", err)
+			}
+		}
+
+		s.deliverRunnerLogs(agentID, req.RunnerLogs)
+
 		// Send pending commands or noop
 		resp := s.getNextCommand(agentID)
-		if err := stream.Send(resp); err != nil {
-			s.logger.Error("Failed to send response to agent",
+		span := startDispatchSpan(stream.Context(), agentID, resp)
+		err = stream.Send(resp)
+		if span != nil {
+			tracing.End(span, err)
+		}
+		if err != nil {
+			logger.Error("Failed to send response to agent",
 				"agent_id", agentID,
 				"error", err,
 			)
@@ -272,6 +440,28 @@ func (s *Server) Sync(stream agentv1.AgentService_SyncServer) error {
 	}
 }
 
+// startDispatchSpan starts a span in the trace of the request that queued
+// cmd, marking when it left for the agent. It returns nil for untraced commands.
+func startDispatchSpan(ctx context.Context, agentID string, cmd *agentv1.SyncResponse) trace.Span {
+	var carrier map[string]string
+	var runnerID string
+	switch c := cmd.Command.(type) {
+	case *agentv1.SyncResponse_CreateRunner:
+		carrier, runnerID = c.CreateRunner.TraceContext, c.CreateRunner.RunnerId
+	case *agentv1.SyncResponse_DeleteRunner:
+		carrier, runnerID = c.DeleteRunner.TraceContext, c.DeleteRunner.RunnerId
+	}
+	if len(carrier) == 0 {
+		return nil
+	}
+
+	_, span := tracer.Start(tracing.Extract(ctx, carrier), "server.DispatchCommand", trace.WithAttributes(
+		tracing.RunnerIDKey.String(runnerID),
+		tracing.AgentIDKey.String(agentID),
+	))
+	return span
+}
+
 // sendCommandToAgent sends a command to an agent
 func (s *Server) sendCommandToAgent(agentID string, cmd *agentv1.SyncResponse) error {
 	s.commandMu.Lock()
@@ -302,18 +492,32 @@ func (s *Server) getNextCommand(agentID string) *agentv1.SyncResponse {
 	return cmd
 }
 
-// setAgentStream registers a stream for an agent
-func (s *Server) setAgentStream(agentID string, stream agentv1.AgentService_SyncServer) {
+// claimAgentStream registers a stream for an agent, unless it already has one
+func (s *Server) claimAgentStream(agentID string, stream agentv1.AgentService_SyncServer) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if _, exists := s.streams[agentID]; exists {
+		return false
+	}
 	s.streams[agentID] = stream
+	return true
 }
 
-// removeAgentStream removes a stream for an agent
-func (s *Server) removeAgentStream(agentID string) {
+// removeAgentStream removes the stream of an agent if it is still stream
+func (s *Server) removeAgentStream(agentID string, stream agentv1.AgentService_SyncServer) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.streams, agentID)
+	if s.streams[agentID] == stream {
+		delete(s.streams, agentID)
+	}
+}
+
+// hasAgentStream reports whether an agent has an open stream
+func (s *Server) hasAgentStream(agentID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.streams[agentID]
+	return exists
 }
 
 // waitForRunnerState waits for a runner to reach a specific state
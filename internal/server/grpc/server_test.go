@@ -0,0 +1,95 @@
+package grpc
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	shoesv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/shoes/v1"
+	"github.com/whywaita/shoes-vz/internal/server/metrics"
+	"github.com/whywaita/shoes-vz/internal/server/store"
+	"github.com/whywaita/shoes-vz/pkg/tracing"
+)
+
+var (
+	testMetricsOnce sync.Once
+	testMetrics     *metrics.Metrics
+)
+
+// newTestCollector returns a collector for st; the Prometheus metrics can
+// only be registered once per process
+func newTestCollector(st *store.Store) *metrics.Collector {
+	testMetricsOnce.Do(func() { testMetrics = metrics.NewMetrics() })
+	return metrics.NewCollector(testMetrics, st)
+}
+
+func TestServer_AddInstanceTraceContext(t *testing.T) {
+	if _, err := tracing.Setup(context.Background(), tracing.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(prev)
+
+	st := store.NewStore()
+	st.RegisterAgent("agent-1", &agentv1.Agent{
+		AgentId:  "agent-1",
+		Capacity: &agentv1.AgentCapacity{MaxRunners: 2},
+		Status:   agentv1.AgentStatus_AGENT_STATUS_ONLINE,
+	})
+	s := NewServer(st, newTestCollector(st), slog.Default())
+
+	// Play the agent: bring the runner to SSH_READY and keep the command
+	commands := make(chan *agentv1.CreateRunnerCommand, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			cmd, ok := s.getNextCommand("agent-1").Command.(*agentv1.SyncResponse_CreateRunner)
+			if !ok {
+				continue
+			}
+			commands <- cmd.CreateRunner
+			_ = st.UpdateAgentRunners("agent-1", []*agentv1.Runner{{
+				RunnerId: cmd.CreateRunner.RunnerId,
+				State:    agentv1.RunnerState_RUNNER_STATE_SSH_READY,
+			}})
+		}
+	}()
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "AddInstance")
+	if _, err := s.AddInstance(ctx, &shoesv1.AddInstanceRequest{RunnerName: "runner"}); err != nil {
+		t.Fatalf("AddInstance() error = %v", err)
+	}
+	span.End()
+
+	cmd := <-commands
+	agentCtx := trace.SpanContextFromContext(tracing.Extract(context.Background(), cmd.TraceContext))
+	if agentCtx.TraceID() != span.SpanContext().TraceID() {
+		t.Errorf("CreateRunnerCommand trace ID = %v, want %v", agentCtx.TraceID(), span.SpanContext().TraceID())
+	}
+
+	got := map[string]bool{}
+	for _, s := range exporter.GetSpans() {
+		got[s.Name] = s.Parent.SpanID() == span.SpanContext().SpanID()
+	}
+	for _, name := range []string{"scheduler.SelectAgent", "server.WaitForRunner"} {
+		if !got[name] {
+			t.Errorf("span %q is missing or not a child of the request span", name)
+		}
+	}
+}
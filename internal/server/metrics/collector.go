@@ -57,9 +57,13 @@ func (c *Collector) collectRunnerMetrics() {
 	idleCount := 0
 	busyCount := 0
 	errorCount := 0
+	templateCounts := make(map[[2]string]int)
 
 	for _, runner := range runners {
 		stateCounts[runner.State]++
+		if t := runner.GetTemplate(); t != nil {
+			templateCounts[[2]string{t.Name, t.Version}]++
+		}
 
 		// Count idle/busy runners
 		switch runner.GuestRunnerState {
@@ -96,6 +100,12 @@ func (c *Collector) collectRunnerMetrics() {
 		}
 	}
 
+	// Versions go away as runners are replaced, so start from scratch
+	c.metrics.RunnersByTemplate.Reset()
+	for t, count := range templateCounts {
+		c.metrics.RunnersByTemplate.WithLabelValues(t[0], t[1]).Set(float64(count))
+	}
+
 	c.metrics.RunnersIdle.Set(float64(idleCount))
 	c.metrics.RunnersBusy.Set(float64(busyCount))
 	c.metrics.RunnerErrors.Set(float64(errorCount))
@@ -200,3 +210,32 @@ func (c *Collector) RecordAddInstanceRequest(status string, duration time.Durati
 func (c *Collector) RecordDeleteInstanceRequest(status string) {
 	c.metrics.DeleteInstanceRequestsTotal.WithLabelValues(status).Inc()
 }
+
+// RecordTemplateStartup records a runner cloned from a template version
+// that started or failed to
+func (c *Collector) RecordTemplateStartup(template, version string, failed bool, duration time.Duration) {
+	result := "success"
+	if failed {
+		result = "failure"
+	}
+	c.metrics.TemplateStartupsTotal.WithLabelValues(template, version, result).Inc()
+	if !failed {
+		c.metrics.TemplateStartupDuration.WithLabelValues(template, version).Observe(duration.Seconds())
+	}
+}
+
+// SetCanaryWeight records the weight of a canary template version
+func (c *Collector) SetCanaryWeight(template, version string, weightPercent int) {
+	c.metrics.TemplateCanaryWeight.WithLabelValues(template, version).Set(float64(weightPercent))
+}
+
+// DeleteCanaryWeight stops reporting a canary template version
+func (c *Collector) DeleteCanaryWeight(template, version string) {
+	c.metrics.TemplateCanaryWeight.DeleteLabelValues(template, version)
+}
+
+// RecordTemplateRollback records a canary template version rolled back
+func (c *Collector) RecordTemplateRollback(template, version string) {
+	c.metrics.TemplateRollbacksTotal.WithLabelValues(template, version).Inc()
+	c.metrics.TemplateCanaryWeight.WithLabelValues(template, version).Set(0)
+}
@@ -13,6 +13,7 @@ type Metrics struct {
 	RunnersBusy           prometheus.Gauge
 	RunnerStartupDuration prometheus.Histogram
 	RunnerJobDuration     prometheus.Histogram
+	RunnersByTemplate     *prometheus.GaugeVec
 
 	// Agent metrics
 	AgentsTotal           *prometheus.GaugeVec
@@ -33,6 +34,12 @@ type Metrics struct {
 	AddInstanceRequestsTotal    *prometheus.CounterVec
 	DeleteInstanceRequestsTotal *prometheus.CounterVec
 	AddInstanceDuration         prometheus.Histogram
+
+	// Template rollout metrics
+	TemplateStartupsTotal   *prometheus.CounterVec
+	TemplateStartupDuration *prometheus.HistogramVec
+	TemplateCanaryWeight    *prometheus.GaugeVec
+	TemplateRollbacksTotal  *prometheus.CounterVec
 }
 
 // NewMetrics creates and registers all metrics
@@ -72,6 +79,13 @@ func NewMetrics() *Metrics {
 				Buckets: []float64{60, 300, 600, 1800, 3600, 7200},
 			},
 		),
+		RunnersByTemplate: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "shoesvz_runners_by_template",
+				Help: "Number of runners by the template version they were cloned from",
+			},
+			[]string{"template", "version"},
+		),
 
 		// Agent metrics
 		AgentsTotal: promauto.NewGaugeVec(
@@ -159,6 +173,37 @@ func NewMetrics() *Metrics {
 				Buckets: []float64{10, 30, 60, 120, 300, 600},
 			},
 		),
+
+		// Template rollout metrics
+		TemplateStartupsTotal: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shoesvz_template_startups_total",
+				Help: "Total number of runners that started or failed to, by template version and result",
+			},
+			[]string{"template", "version", "result"},
+		),
+		TemplateStartupDuration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "shoesvz_template_startup_duration_seconds",
+				Help:    "Runner startup duration by template version",
+				Buckets: []float64{10, 30, 60, 120, 300, 600},
+			},
+			[]string{"template", "version"},
+		),
+		TemplateCanaryWeight: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "shoesvz_template_canary_weight_percent",
+				Help: "Share of new runners sent to a canary template version; 0 once rolled back",
+			},
+			[]string{"template", "version"},
+		),
+		TemplateRollbacksTotal: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shoesvz_template_rollbacks_total",
+				Help: "Total number of canary template versions rolled back automatically",
+			},
+			[]string{"template", "version"},
+		),
 	}
 
 	return m
@@ -0,0 +1,241 @@
+// Package rollout sends a share of new runners to a canary version of a
+// template and rolls the canary back when its runners fail to start more
+// often than those of the stable version.
+package rollout
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxFailureRateDelta is how much higher than the stable
+	// version's the failure rate of a canary may be
+	DefaultMaxFailureRateDelta = 0.1
+
+	// DefaultMinRunners is how many canary runners must have started or
+	// failed before the canary is judged
+	DefaultMinRunners = 10
+)
+
+// ErrRolloutNotFound is returned for templates without a canary
+var ErrRolloutNotFound = errors.New("rollout not found")
+
+// State of a rollout
+type State string
+
+const (
+	// StateCanary sends a share of new runners to the canary version
+	StateCanary State = "canary"
+
+	// StateRolledBack sends no more runners to the canary version
+	StateRolledBack State = "rolled-back"
+)
+
+// Stats counts the runners started from one side of a rollout
+type Stats struct {
+	Runners  int // Runners that started or failed to
+	Failures int
+
+	// Sum of the startup durations of runners that started
+	StartupTotal time.Duration
+}
+
+// FailureRate returns the share of runners that failed to start
+func (s Stats) FailureRate() float64 {
+	if s.Runners == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Runners)
+}
+
+// MeanStartup returns the mean startup duration of runners that started
+func (s Stats) MeanStartup() time.Duration {
+	started := s.Runners - s.Failures
+	if started <= 0 {
+		return 0
+	}
+	return s.StartupTotal / time.Duration(started)
+}
+
+func (s *Stats) record(failed bool, startup time.Duration) {
+	s.Runners++
+	if failed {
+		s.Failures++
+	} else {
+		s.StartupTotal += startup
+	}
+}
+
+// Rollout is a canary of a template version
+type Rollout struct {
+	Template string
+	Version  string // Canary version; runners of other versions are stable
+
+	WeightPercent       int // Share of new runners sent to the canary
+	MaxFailureRateDelta float64
+	MinRunners          int
+
+	State        State
+	Canary       Stats
+	Stable       Stats
+	CreatedAt    time.Time
+	RolledBackAt time.Time
+	Reason       string // Why the canary was rolled back
+}
+
+// Manager keeps the rollouts of the server. Rollouts are kept in memory
+// only.
+type Manager struct {
+	maxFailureRateDelta float64
+	minRunners          int
+	intN                func(n int) int
+	now                 func() time.Time
+
+	mu       sync.Mutex
+	rollouts map[string]*Rollout // By lower case template name
+}
+
+// NewManager creates a Manager. maxFailureRateDelta and minRunners apply
+// to rollouts that do not set their own.
+func NewManager(maxFailureRateDelta float64, minRunners int) *Manager {
+	return &Manager{
+		maxFailureRateDelta: maxFailureRateDelta,
+		minRunners:          minRunners,
+		intN:                rand.IntN,
+		now:                 time.Now,
+		rollouts:            make(map[string]*Rollout),
+	}
+}
+
+// Set starts a canary of version of template, or changes its weight.
+// Statistics are reset when the version changes or the canary was rolled
+// back. A zero maxFailureRateDelta or minRunners selects the default.
+func (m *Manager) Set(template, version string, weightPercent int, maxFailureRateDelta float64, minRunners int) (Rollout, error) {
+	if template == "" || version == "" {
+		return Rollout{}, fmt.Errorf("template and version are required")
+	}
+	if weightPercent < 0 || weightPercent > 100 {
+		return Rollout{}, fmt.Errorf("weight must be between 0 and 100, got %d", weightPercent)
+	}
+	if maxFailureRateDelta < 0 || maxFailureRateDelta > 1 {
+		return Rollout{}, fmt.Errorf("max failure rate delta must be between 0 and 1, got %v", maxFailureRateDelta)
+	}
+	if minRunners < 0 {
+		return Rollout{}, fmt.Errorf("min runners must not be negative, got %d", minRunners)
+	}
+	if maxFailureRateDelta == 0 {
+		maxFailureRateDelta = m.maxFailureRateDelta
+	}
+	if minRunners == 0 {
+		minRunners = m.minRunners
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := strings.ToLower(template)
+	r, ok := m.rollouts[key]
+	if !ok || r.Version != version || r.State != StateCanary {
+		r = &Rollout{Template: template, Version: version, State: StateCanary, CreatedAt: m.now()}
+		m.rollouts[key] = r
+	}
+	r.WeightPercent = weightPercent
+	r.MaxFailureRateDelta = maxFailureRateDelta
+	r.MinRunners = minRunners
+	return *r, nil
+}
+
+// Delete ends the rollout of template
+func (m *Manager) Delete(template string) (Rollout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := strings.ToLower(template)
+	r, ok := m.rollouts[key]
+	if !ok {
+		return Rollout{}, fmt.Errorf("%w: %s", ErrRolloutNotFound, template)
+	}
+	delete(m.rollouts, key)
+	return *r, nil
+}
+
+// List returns the rollouts sorted by template
+func (m *Manager) List() []Rollout {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rollouts := make([]Rollout, 0, len(m.rollouts))
+	for _, r := range m.rollouts {
+		rollouts = append(rollouts, *r)
+	}
+	sort.Slice(rollouts, func(i, j int) bool { return rollouts[i].Template < rollouts[j].Template })
+	return rollouts
+}
+
+// Choose returns the canary version if a new runner of template should be
+// cloned from it, or "" for the stable version
+func (m *Manager) Choose(template string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rollouts[strings.ToLower(template)]
+	if !ok || r.State != StateCanary || r.WeightPercent == 0 {
+		return ""
+	}
+	if m.intN(100) < r.WeightPercent {
+		return r.Version
+	}
+	return ""
+}
+
+// CanaryVersion returns the version of the rollout of template, whether it
+// is still a canary or was rolled back, or "" if there is none. Runners
+// that are not sent to the canary must not be cloned from it.
+func (m *Manager) CanaryVersion(template string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rollouts[strings.ToLower(template)]
+	if !ok {
+		return ""
+	}
+	return r.Version
+}
+
+// Record counts a runner of template that was cloned from version and
+// started or failed to. It returns the rollout if this rolled it back.
+// Counting stops once the canary is rolled back.
+func (m *Manager) Record(template, version string, failed bool, startup time.Duration) (Rollout, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rollouts[strings.ToLower(template)]
+	if !ok || r.State != StateCanary {
+		return Rollout{}, false
+	}
+	if version == r.Version {
+		r.Canary.record(failed, startup)
+	} else {
+		r.Stable.record(failed, startup)
+	}
+
+	if r.Canary.Runners < r.MinRunners {
+		return Rollout{}, false
+	}
+	canaryRate, stableRate := r.Canary.FailureRate(), r.Stable.FailureRate()
+	if canaryRate-stableRate <= r.MaxFailureRateDelta {
+		return Rollout{}, false
+	}
+
+	r.State = StateRolledBack
+	r.RolledBackAt = m.now()
+	r.Reason = fmt.Sprintf("canary failure rate %.1f%% exceeds stable failure rate %.1f%% by more than %.1f points",
+		canaryRate*100, stableRate*100, r.MaxFailureRateDelta*100)
+	return *r, true
+}
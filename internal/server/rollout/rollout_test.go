@@ -0,0 +1,176 @@
+package rollout
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestManager_Choose(t *testing.T) {
+	tests := []struct {
+		name   string
+		weight int
+		want   int // Canary runners out of 100
+	}{
+		{name: "no canary", weight: 0, want: 0},
+		{name: "a fifth", weight: 20, want: 20},
+		{name: "all", weight: 100, want: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(DefaultMaxFailureRateDelta, DefaultMinRunners)
+			next := 0
+			m.intN = func(n int) int { next++; return (next - 1) % n }
+			if _, err := m.Set("macos-15", "2", tt.weight, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			got := 0
+			for i := 0; i < 100; i++ {
+				switch v := m.Choose("MacOS-15"); v {
+				case "2":
+					got++
+				case "":
+				default:
+					t.Fatalf("Choose() = %v, want 2 or empty", v)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("Choose() picked the canary %d times, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if v := NewManager(DefaultMaxFailureRateDelta, DefaultMinRunners).Choose("macos-15"); v != "" {
+		t.Errorf("Choose() without rollout = %v, want empty", v)
+	}
+}
+
+func TestManager_Record(t *testing.T) {
+	tests := []struct {
+		name           string
+		canaryFailures int
+		stableFailures int
+		wantRolledBack bool
+	}{
+		{name: "canary as good as stable", canaryFailures: 1, stableFailures: 1},
+		{name: "canary within the threshold", canaryFailures: 2, stableFailures: 1},
+		{name: "canary fails more", canaryFailures: 3, stableFailures: 1, wantRolledBack: true},
+		{name: "both fail", canaryFailures: 5, stableFailures: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(0.1, 10)
+			if _, err := m.Set("macos-15", "2", 50, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			rolledBack := false
+			for i := 0; i < 10; i++ {
+				m.Record("macos-15", "1", i < tt.stableFailures, time.Minute)
+				_, rb := m.Record("macos-15", "2", i < tt.canaryFailures, 2*time.Minute)
+				rolledBack = rolledBack || rb
+			}
+			if rolledBack != tt.wantRolledBack {
+				t.Errorf("Record() rolled back = %v, want %v", rolledBack, tt.wantRolledBack)
+			}
+
+			r := m.List()[0]
+			wantState := StateCanary
+			if tt.wantRolledBack {
+				wantState = StateRolledBack
+			}
+			if r.State != wantState {
+				t.Errorf("State = %v, want %v", r.State, wantState)
+			}
+			if tt.wantRolledBack {
+				if v := m.Choose("macos-15"); v != "" {
+					t.Errorf("Choose() after rollback = %v, want empty", v)
+				}
+				return
+			}
+			if r.Canary.Runners != 10 || r.Stable.Runners != 10 {
+				t.Errorf("Runners = %d canary, %d stable, want 10 each", r.Canary.Runners, r.Stable.Runners)
+			}
+			if r.Canary.MeanStartup() != 2*time.Minute || r.Stable.MeanStartup() != time.Minute {
+				t.Errorf("MeanStartup() = %v canary, %v stable, want 2m0s and 1m0s", r.Canary.MeanStartup(), r.Stable.MeanStartup())
+			}
+		})
+	}
+}
+
+func TestManager_RecordWaitsForMinRunners(t *testing.T) {
+	m := NewManager(0.1, 10)
+	if _, err := m.Set("macos-15", "2", 50, 0, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, rb := m.Record("macos-15", "2", true, 0); rb {
+			t.Fatalf("Record() rolled back after %d runners, want not before 3", i+1)
+		}
+	}
+	r, rb := m.Record("macos-15", "2", true, 0)
+	if !rb {
+		t.Fatal("Record() did not roll back after 3 failed runners")
+	}
+	if r.Reason == "" || r.RolledBackAt.IsZero() {
+		t.Errorf("rolled back rollout has Reason %q and RolledBackAt %v", r.Reason, r.RolledBackAt)
+	}
+
+	// Setting the canary again starts over
+	r, err := m.Set("macos-15", "2", 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != StateCanary || r.Canary.Runners != 0 || r.MinRunners != 10 {
+		t.Errorf("Set() after rollback = %+v, want a new canary with default min runners", r)
+	}
+}
+
+func TestManager_SetAndDelete(t *testing.T) {
+	m := NewManager(DefaultMaxFailureRateDelta, DefaultMinRunners)
+
+	invalid := []struct {
+		name     string
+		template string
+		version  string
+		weight   int
+		delta    float64
+	}{
+		{name: "no template", version: "2", weight: 10},
+		{name: "no version", template: "macos-15", weight: 10},
+		{name: "weight over 100", template: "macos-15", version: "2", weight: 101},
+		{name: "negative weight", template: "macos-15", version: "2", weight: -1},
+		{name: "delta over 1", template: "macos-15", version: "2", weight: 10, delta: 1.5},
+	}
+	for _, tt := range invalid {
+		if _, err := m.Set(tt.template, tt.version, tt.weight, tt.delta, 0); err == nil {
+			t.Errorf("Set() with %s error = nil, want error", tt.name)
+		}
+	}
+
+	if _, err := m.Set("macos-15", "2", 10, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	m.Record("macos-15", "2", false, time.Minute)
+	r, err := m.Set("macos-15", "2", 30, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.WeightPercent != 30 || r.Canary.Runners != 1 {
+		t.Errorf("Set() of the same version = %+v, want weight 30 keeping 1 runner", r)
+	}
+
+	if _, err := m.Delete("macos-15"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := m.Delete("macos-15"); !errors.Is(err, ErrRolloutNotFound) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrRolloutNotFound)
+	}
+	if n := len(m.List()); n != 0 {
+		t.Errorf("List() has %d rollouts after Delete, want 0", n)
+	}
+}
@@ -0,0 +1,104 @@
+package scheduler
+
+import (
+	"regexp"
+	"strings"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+)
+
+// defaultLabels are held by every agent. GitHub gives the first three to all
+// self-hosted macOS runners on Apple silicon, and myshoes registers every
+// runner with its own label.
+var defaultLabels = []string{"self-hosted", "macos", "arm64", "myshoes"}
+
+// TemplateLabelPrefix marks a label naming the template to create the
+// runner from, e.g. template-macos-15
+const TemplateLabelPrefix = "template-"
+
+// chipGeneration finds the generation in a chip name like "Apple M2 Pro"
+var chipGeneration = regexp.MustCompile(`\bM(\d+)\b`)
+
+// AgentLabels returns the labels an agent satisfies: the default labels,
+// the ones it registered, and the ones derived from its capabilities.
+// Labels are lower case.
+func AgentLabels(agent *agentv1.Agent) []string {
+	labels := append([]string{}, defaultLabels...)
+	for _, l := range agent.GetLabels() {
+		labels = append(labels, strings.ToLower(l))
+	}
+
+	c := agent.GetCapabilities()
+	labels = append(labels, versionLabels("macos", c.GetMacosVersion())...)
+	for _, v := range c.GetXcodeVersions() {
+		labels = append(labels, versionLabels("xcode", v)...)
+	}
+	if chip := strings.TrimSpace(c.GetChip()); chip != "" {
+		labels = append(labels, strings.ToLower(strings.Join(strings.Fields(chip), "-")))
+		if m := chipGeneration.FindStringSubmatch(chip); m != nil {
+			labels = append(labels, "m"+m[1])
+		}
+	}
+	for _, t := range c.GetTemplates() {
+		labels = append(labels, TemplateLabelPrefix+strings.ToLower(t.GetName()))
+	}
+
+	return labels
+}
+
+// versionLabels turns "15.2.1" into prefix-15, prefix-15.2 and prefix-15.2.1
+func versionLabels(prefix, version string) []string {
+	version = strings.TrimSpace(version)
+	if version == "" {
+		return nil
+	}
+
+	var labels []string
+	parts := strings.Split(version, ".")
+	for i := range parts {
+		labels = append(labels, prefix+"-"+strings.Join(parts[:i+1], "."))
+	}
+	return labels
+}
+
+// matchLabels reports whether the agent satisfies every requested label.
+// Labels are compared case-insensitively, as GitHub does.
+func matchLabels(agent *agentv1.Agent, requested []string) bool {
+	if len(requested) == 0 {
+		return true
+	}
+
+	have := make(map[string]bool)
+	for _, l := range AgentLabels(agent) {
+		have[l] = true
+	}
+	for _, l := range requested {
+		if !have[strings.ToLower(l)] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTemplate reports whether the agent has the template name, and the
+// given version of it unless version is empty. Without a version, the
+// agent's active version must not be exclude.
+func hasTemplate(agent *agentv1.Agent, name, version, exclude string) bool {
+	found := false
+	for _, t := range agent.GetCapabilities().GetTemplates() {
+		if !strings.EqualFold(t.GetName(), name) {
+			continue
+		}
+		if version != "" {
+			if t.GetVersion() == version {
+				return true
+			}
+			continue
+		}
+		if exclude != "" && t.GetActive() && t.GetVersion() == exclude {
+			return false
+		}
+		found = true
+	}
+	return found
+}
@@ -1,59 +1,227 @@
 package scheduler
 
 import (
-	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
 	"github.com/whywaita/shoes-vz/internal/server/store"
 	"github.com/whywaita/shoes-vz/pkg/model"
 )
 
-// Scheduler selects the best agent for a new runner
+// Strategy names accepted by New
+const (
+	StrategySpread            = "spread"
+	StrategyBinPack           = "bin-pack"
+	StrategyRoundRobin        = "round-robin"
+	StrategyLeastRecentlyUsed = "least-recently-used"
+)
+
+// DefaultStrategy is used when no strategy is configured
+const DefaultStrategy = StrategySpread
+
+// Strategies lists the strategy names accepted by New
+var Strategies = []string{StrategySpread, StrategyBinPack, StrategyRoundRobin, StrategyLeastRecentlyUsed}
+
+// Request describes the runner an agent is selected for
+type Request struct {
+	RunnerName   string
+	ResourceType string
+	Labels       []string
+	Template     string // Template the runner is cloned from; any agent's default if empty
+
+	// TemplateVersion of Template the agent must have; any if empty
+	TemplateVersion string
+
+	// ExcludeVersion skips agents whose active version of Template it is,
+	// when no TemplateVersion is requested
+	ExcludeVersion string
+}
+
+// Scheduler selects the best agent for a new runner. Only online agents
+// with a free slot, all of the requested labels and the requested template
+// are considered.
 type Scheduler interface {
-	SelectAgent() (string, error)
+	SelectAgent(ctx context.Context, req *Request) (string, error)
 }
 
-// roundRobinScheduler implements a simple round-robin scheduler
-type roundRobinScheduler struct {
-	store *store.Store
+// New creates the scheduler for a strategy name
+func New(strategy string, s *store.Store) (Scheduler, error) {
+	switch strategy {
+	case StrategySpread, "":
+		return NewSpreadScheduler(s), nil
+	case StrategyBinPack:
+		return NewBinPackScheduler(s), nil
+	case StrategyRoundRobin:
+		return NewRoundRobinScheduler(s), nil
+	case StrategyLeastRecentlyUsed, "lru":
+		return NewLeastRecentlyUsedScheduler(s), nil
+	default:
+		return nil, fmt.Errorf("unknown scheduling strategy %q (available: %v)", strategy, Strategies)
+	}
 }
 
-// NewRoundRobinScheduler creates a new round-robin scheduler
-func NewRoundRobinScheduler(s *store.Store) Scheduler {
-	return &roundRobinScheduler{
-		store: s,
+// candidate is an online agent with room for another runner
+type candidate struct {
+	agentID string
+	free    uint32
+}
+
+// candidates returns the agents that can take the runner, sorted by agent
+// ID so that every strategy breaks ties the same way
+func candidates(s *store.Store, req *Request) []candidate {
+	var cs []candidate
+	for _, agent := range s.GetOnlineAgents() {
+		if !matchLabels(agent, req.Labels) {
+			continue
+		}
+		if req.Template != "" && !hasTemplate(agent, req.Template, req.TemplateVersion, req.ExcludeVersion) {
+			continue
+		}
+
+		hasCapacity, err := s.HasCapacity(agent.AgentId)
+		if err != nil || !hasCapacity {
+			continue
+		}
+
+		running := uint32(s.GetRunnerCount(agent.AgentId))
+		if running >= agent.Capacity.GetMaxRunners() {
+			continue
+		}
+		cs = append(cs, candidate{agentID: agent.AgentId, free: agent.Capacity.GetMaxRunners() - running})
 	}
+
+	sort.Slice(cs, func(i, j int) bool { return cs[i].agentID < cs[j].agentID })
+	return cs
 }
 
-// SelectAgent selects an agent with available capacity
-// Uses a simple strategy: select the agent with the most available capacity
-func (s *roundRobinScheduler) SelectAgent() (string, error) {
-	agents := s.store.GetOnlineAgents()
-	if len(agents) == 0 {
+// spreadScheduler places runners on the agent with the most free slots
+type spreadScheduler struct {
+	store *store.Store
+}
+
+// NewSpreadScheduler creates a scheduler that spreads runners across agents
+func NewSpreadScheduler(s *store.Store) Scheduler {
+	return &spreadScheduler{store: s}
+}
+
+// SelectAgent selects the agent with the most free slots
+func (s *spreadScheduler) SelectAgent(_ context.Context, req *Request) (string, error) {
+	cs := candidates(s.store, req)
+	if len(cs) == 0 {
 		return "", model.ErrNoAvailableAgent
 	}
 
-	var (
-		selectedAgent        *agentv1.Agent
-		maxAvailableCapacity uint32
-	)
+	selected := cs[0]
+	for _, c := range cs[1:] {
+		if c.free > selected.free {
+			selected = c
+		}
+	}
+	return selected.agentID, nil
+}
 
-	for _, agent := range agents {
-		hasCapacity, err := s.store.HasCapacity(agent.AgentId)
-		if err != nil || !hasCapacity {
-			continue
+// binPackScheduler fills up agents one at a time
+type binPackScheduler struct {
+	store *store.Store
+}
+
+// NewBinPackScheduler creates a scheduler that packs runners onto as few
+// agents as possible
+func NewBinPackScheduler(s *store.Store) Scheduler {
+	return &binPackScheduler{store: s}
+}
+
+// SelectAgent selects the agent with the fewest free slots
+func (s *binPackScheduler) SelectAgent(_ context.Context, req *Request) (string, error) {
+	cs := candidates(s.store, req)
+	if len(cs) == 0 {
+		return "", model.ErrNoAvailableAgent
+	}
+
+	selected := cs[0]
+	for _, c := range cs[1:] {
+		if c.free < selected.free {
+			selected = c
 		}
+	}
+	return selected.agentID, nil
+}
+
+// roundRobinScheduler takes agents in turn, ordered by agent ID
+type roundRobinScheduler struct {
+	store *store.Store
+
+	mu   sync.Mutex
+	last string
+}
 
-		currentRunners := s.store.GetRunnerCount(agent.AgentId)
-		available := agent.Capacity.MaxRunners - uint32(currentRunners)
+// NewRoundRobinScheduler creates a round-robin scheduler
+func NewRoundRobinScheduler(s *store.Store) Scheduler {
+	return &roundRobinScheduler{store: s}
+}
+
+// SelectAgent selects the first agent after the previously selected one,
+// skipping agents without free slots
+func (s *roundRobinScheduler) SelectAgent(_ context.Context, req *Request) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if selectedAgent == nil || available > maxAvailableCapacity {
-			selectedAgent = agent
-			maxAvailableCapacity = available
+	cs := candidates(s.store, req)
+	if len(cs) == 0 {
+		return "", model.ErrNoAvailableAgent
+	}
+
+	selected := cs[0]
+	for _, c := range cs {
+		if c.agentID > s.last {
+			selected = c
+			break
 		}
 	}
+	s.last = selected.agentID
+	return selected.agentID, nil
+}
+
+// leastRecentlyUsedScheduler selects the agent that has waited longest
+// since it was last given a runner
+type leastRecentlyUsedScheduler struct {
+	store *store.Store
 
-	if selectedAgent == nil {
+	mu sync.Mutex
+	// lastUsed holds a sequence number per agent rather than a time, so
+	// that two selections in the same clock tick are still ordered
+	lastUsed map[string]uint64
+	seq      uint64
+}
+
+// NewLeastRecentlyUsedScheduler creates a least-recently-used scheduler
+func NewLeastRecentlyUsedScheduler(s *store.Store) Scheduler {
+	return &leastRecentlyUsedScheduler{
+		store:    s,
+		lastUsed: make(map[string]uint64),
+	}
+}
+
+// SelectAgent selects the agent selected least recently. Agents never
+// selected come first.
+func (s *leastRecentlyUsedScheduler) SelectAgent(_ context.Context, req *Request) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs := candidates(s.store, req)
+	if len(cs) == 0 {
 		return "", model.ErrNoAvailableAgent
 	}
 
-	return selectedAgent.AgentId, nil
+	selected := cs[0]
+	for _, c := range cs[1:] {
+		if s.lastUsed[c.agentID] < s.lastUsed[selected.agentID] {
+			selected = c
+		}
+	}
+	s.seq++
+	s.lastUsed[selected.agentID] = s.seq
+	return selected.agentID, nil
 }
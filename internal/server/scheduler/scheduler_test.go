@@ -0,0 +1,336 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/internal/server/store"
+	"github.com/whywaita/shoes-vz/pkg/model"
+)
+
+// testAgent is an agent with maxRunners slots and running runners on it
+type testAgent struct {
+	id         string
+	maxRunners uint32
+	running    int
+	offline    bool
+	labels     []string
+	macos      string
+	templates  []string // name or name@version, with a trailing * if active
+}
+
+func newTestStore(t *testing.T, agents []testAgent) *store.Store {
+	t.Helper()
+	st := store.NewStore()
+	for _, a := range agents {
+		var templates []*agentv1.Template
+		for _, nameVersion := range a.templates {
+			nameVersion, active := strings.CutSuffix(nameVersion, "*")
+			name, version, _ := strings.Cut(nameVersion, "@")
+			templates = append(templates, &agentv1.Template{Name: name, Version: version, Active: active})
+		}
+		agentStatus := agentv1.AgentStatus_AGENT_STATUS_ONLINE
+		if a.offline {
+			agentStatus = agentv1.AgentStatus_AGENT_STATUS_OFFLINE
+		}
+		st.RegisterAgent(a.id, &agentv1.Agent{
+			AgentId:  a.id,
+			Status:   agentStatus,
+			Capacity: &agentv1.AgentCapacity{MaxRunners: a.maxRunners},
+			Labels:   a.labels,
+			Capabilities: &agentv1.AgentCapabilities{
+				MacosVersion: a.macos,
+				Templates:    templates,
+			},
+		})
+
+		var runners []*agentv1.Runner
+		for i := 0; i < a.running; i++ {
+			runners = append(runners, &agentv1.Runner{
+				RunnerId: fmt.Sprintf("%s-runner-%d", a.id, i),
+				State:    agentv1.RunnerState_RUNNER_STATE_RUNNING,
+			})
+		}
+		if err := st.UpdateAgentRunners(a.id, runners); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return st
+}
+
+// selectN runs SelectAgent n times and returns the agents picked
+func selectN(t *testing.T, s Scheduler, n int, req *Request) ([]string, error) {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		agentID, err := s.SelectAgent(context.Background(), req)
+		if err != nil {
+			return got, err
+		}
+		got = append(got, agentID)
+	}
+	return got, nil
+}
+
+func TestSchedulers(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		agents   []testAgent
+		labels   []string
+		template string
+		selects  int
+		want     []string
+		wantErr  error
+
+		templateVersion string
+		excludeVersion  string
+	}{
+		{
+			name:     "spread picks most free slots",
+			strategy: StrategySpread,
+			agents:   []testAgent{{id: "a", maxRunners: 2}, {id: "b", maxRunners: 4, running: 1}},
+			selects:  1,
+			want:     []string{"b"},
+		},
+		{
+			name:     "spread breaks ties by agent ID",
+			strategy: StrategySpread,
+			agents:   []testAgent{{id: "c", maxRunners: 2}, {id: "a", maxRunners: 2}, {id: "b", maxRunners: 2}},
+			selects:  1,
+			want:     []string{"a"},
+		},
+		{
+			name:     "bin-pack picks fewest free slots",
+			strategy: StrategyBinPack,
+			agents:   []testAgent{{id: "a", maxRunners: 4}, {id: "b", maxRunners: 4, running: 3}, {id: "c", maxRunners: 2, running: 2}},
+			selects:  1,
+			want:     []string{"b"},
+		},
+		{
+			name:     "bin-pack breaks ties by agent ID",
+			strategy: StrategyBinPack,
+			agents:   []testAgent{{id: "b", maxRunners: 2, running: 1}, {id: "a", maxRunners: 3, running: 2}},
+			selects:  1,
+			want:     []string{"a"},
+		},
+		{
+			name:     "round-robin cycles in agent ID order",
+			strategy: StrategyRoundRobin,
+			agents:   []testAgent{{id: "c", maxRunners: 2}, {id: "a", maxRunners: 2}, {id: "b", maxRunners: 8}},
+			selects:  4,
+			want:     []string{"a", "b", "c", "a"},
+		},
+		{
+			name:     "round-robin skips full agents",
+			strategy: StrategyRoundRobin,
+			agents:   []testAgent{{id: "a", maxRunners: 2}, {id: "b", maxRunners: 1, running: 1}, {id: "c", maxRunners: 2}},
+			selects:  3,
+			want:     []string{"a", "c", "a"},
+		},
+		{
+			name:     "least-recently-used prefers agents never used",
+			strategy: StrategyLeastRecentlyUsed,
+			agents:   []testAgent{{id: "b", maxRunners: 2}, {id: "a", maxRunners: 2}},
+			selects:  3,
+			want:     []string{"a", "b", "a"},
+		},
+		{
+			name:     "offline agents are ignored",
+			strategy: StrategySpread,
+			agents:   []testAgent{{id: "a", maxRunners: 8, offline: true}, {id: "b", maxRunners: 1}},
+			selects:  1,
+			want:     []string{"b"},
+		},
+		{
+			name:     "labels narrow the candidates",
+			strategy: StrategySpread,
+			agents:   []testAgent{{id: "a", maxRunners: 4, macos: "14.6"}, {id: "b", maxRunners: 2, macos: "15.2", labels: []string{"Xcode-16"}}},
+			labels:   []string{"self-hosted", "macOS", "macos-15", "xcode-16"},
+			selects:  1,
+			want:     []string{"b"},
+		},
+		{
+			name:     "myshoes label is held by every agent",
+			strategy: StrategySpread,
+			agents:   []testAgent{{id: "a", maxRunners: 2}},
+			labels:   []string{"self-hosted", "myshoes"},
+			selects:  1,
+			want:     []string{"a"},
+		},
+		{
+			name:     "no agent has the labels",
+			strategy: StrategyRoundRobin,
+			agents:   []testAgent{{id: "a", maxRunners: 4, macos: "15.2"}},
+			labels:   []string{"macos-15", "xcode-16"},
+			selects:  1,
+			wantErr:  model.ErrNoAvailableAgent,
+		},
+		{
+			name:     "template narrows the candidates",
+			strategy: StrategySpread,
+			agents:   []testAgent{{id: "a", maxRunners: 4, templates: []string{"macos-26"}}, {id: "b", maxRunners: 2, templates: []string{"macos-26", "macOS-15"}}},
+			template: "macos-15",
+			selects:  1,
+			want:     []string{"b"},
+		},
+		{
+			name:            "template version narrows the candidates",
+			strategy:        StrategySpread,
+			agents:          []testAgent{{id: "a", maxRunners: 4, templates: []string{"macos-15@1"}}, {id: "b", maxRunners: 2, templates: []string{"macos-15@1", "macos-15@2"}}},
+			template:        "macos-15",
+			templateVersion: "2",
+			selects:         2,
+			want:            []string{"b", "b"},
+		},
+		{
+			name:           "excluded version skips agents where it is active",
+			strategy:       StrategySpread,
+			agents:         []testAgent{{id: "a", maxRunners: 2, templates: []string{"macos-15@1*", "macos-15@2"}}, {id: "b", maxRunners: 4, templates: []string{"macos-15@1", "macos-15@2*"}}},
+			template:       "macos-15",
+			excludeVersion: "2",
+			selects:        2,
+			want:           []string{"a", "a"},
+		},
+		{
+			name:            "excluded version does not apply to a requested version",
+			strategy:        StrategySpread,
+			agents:          []testAgent{{id: "a", maxRunners: 2, templates: []string{"macos-15@1*", "macos-15@2"}}, {id: "b", maxRunners: 4, templates: []string{"macos-15@1", "macos-15@2*"}}},
+			template:        "macos-15",
+			templateVersion: "2",
+			excludeVersion:  "2",
+			selects:         1,
+			want:            []string{"b"},
+		},
+		{
+			name:     "no free slots",
+			strategy: StrategyBinPack,
+			agents:   []testAgent{{id: "a", maxRunners: 1, running: 1}},
+			selects:  1,
+			wantErr:  model.ErrNoAvailableAgent,
+		},
+		{
+			name:     "no agents",
+			strategy: StrategyLeastRecentlyUsed,
+			selects:  1,
+			wantErr:  model.ErrNoAvailableAgent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.strategy, newTestStore(t, tt.agents))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := selectN(t, s, tt.selects, &Request{ResourceType: "small", Labels: tt.labels, Template: tt.template, TemplateVersion: tt.templateVersion, ExcludeVersion: tt.excludeVersion})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SelectAgent() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("SelectAgent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		strategy string
+		wantErr  bool
+	}{
+		{strategy: ""},
+		{strategy: StrategySpread},
+		{strategy: StrategyBinPack},
+		{strategy: StrategyRoundRobin},
+		{strategy: StrategyLeastRecentlyUsed},
+		{strategy: "lru"},
+		{strategy: "random", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			_, err := New(tt.strategy, store.NewStore())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New(%q) error = %v, wantErr %v", tt.strategy, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgentLabels(t *testing.T) {
+	tests := []struct {
+		name  string
+		agent *agentv1.Agent
+		want  []string
+	}{
+		{
+			name:  "defaults only",
+			agent: &agentv1.Agent{},
+			want:  []string{"self-hosted", "macos", "arm64", "myshoes"},
+		},
+		{
+			name: "registered labels and capabilities",
+			agent: &agentv1.Agent{
+				Labels: []string{"Team-iOS"},
+				Capabilities: &agentv1.AgentCapabilities{
+					MacosVersion:  "15.2",
+					XcodeVersions: []string{"16.1"},
+					Chip:          "Apple M2 Pro",
+					Templates:     []*agentv1.Template{{Name: "macos-15", Version: "2025.01"}},
+				},
+			},
+			want: []string{
+				"self-hosted", "macos", "arm64", "myshoes", "team-ios",
+				"macos-15", "macos-15.2", "xcode-16", "xcode-16.1",
+				"apple-m2-pro", "m2", "template-macos-15",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AgentLabels(tt.agent); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("AgentLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectTemplate(t *testing.T) {
+	byResourceType, err := ParseResourceTemplates("small=macos-15, large=macos-15-xcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		resourceType string
+		labels       []string
+		want         string
+	}{
+		{name: "mapped resource type", resourceType: "large", want: "macos-15-xcode"},
+		{name: "label wins over resource type", resourceType: "large", labels: []string{"self-hosted", "Template-macOS-26"}, want: "macos-26"},
+		{name: "agent default", resourceType: "medium", labels: []string{"self-hosted"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SelectTemplate(tt.resourceType, tt.labels, byResourceType); got != tt.want {
+				t.Errorf("SelectTemplate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseResourceTemplates("small"); err == nil {
+		t.Errorf("ParseResourceTemplates(%q) error = nil, want error", "small")
+	}
+}
@@ -0,0 +1,37 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseResourceTemplates parses a resource type to template mapping written
+// as "small=macos-15,large=macos-15-xcode"
+func ParseResourceTemplates(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		resourceType, name, ok := strings.Cut(pair, "=")
+		resourceType, name = strings.TrimSpace(resourceType), strings.TrimSpace(name)
+		if !ok || resourceType == "" || name == "" {
+			return nil, fmt.Errorf("invalid resource template %q, want resource-type=template", pair)
+		}
+		m[resourceType] = name
+	}
+	return m, nil
+}
+
+// SelectTemplate returns the template a runner is cloned from: the one
+// named by a template- label, else the one mapped to its resource type.
+// It is empty when the agent's default template should be used.
+func SelectTemplate(resourceType string, labels []string, byResourceType map[string]string) string {
+	for _, l := range labels {
+		if len(l) > len(TemplateLabelPrefix) && strings.EqualFold(l[:len(TemplateLabelPrefix)], TemplateLabelPrefix) {
+			return strings.ToLower(l[len(TemplateLabelPrefix):])
+		}
+	}
+	return byResourceType[resourceType]
+}
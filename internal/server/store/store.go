@@ -5,6 +5,8 @@ import (
 	"sync"
 	"time"
 
+	"google.golang.org/protobuf/proto"
+
 	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
 	"github.com/whywaita/shoes-vz/pkg/model"
 )
@@ -16,6 +18,8 @@ type Store struct {
 	runners map[string]*agentv1.Runner
 	// Map runner ID to agent ID
 	runnerToAgent map[string]string
+	// Map runner ID to the agent its CreateRunner command was sent to
+	assignedRunners map[string]string
 	// Map cloud ID (from myshoes) to runner ID
 	cloudIDToRunner map[string]string
 }
@@ -26,6 +30,7 @@ func NewStore() *Store {
 		agents:          make(map[string]*agentv1.Agent),
 		runners:         make(map[string]*agentv1.Runner),
 		runnerToAgent:   make(map[string]string),
+		assignedRunners: make(map[string]string),
 		cloudIDToRunner: make(map[string]string),
 	}
 }
@@ -78,7 +83,48 @@ func (s *Store) UpdateAgentStatus(agentID string, status agentv1.AgentStatus) er
 	return nil
 }
 
-// UpdateAgentRunners updates the runners for an agent
+// UpdateAgentTemplates replaces the templates an agent reported when it
+// registered
+func (s *Store) UpdateAgentTemplates(agentID string, templates []*agentv1.Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, exists := s.agents[agentID]
+	if !exists {
+		return model.ErrAgentNotFound
+	}
+
+	// Schedulers may be reading the old agent, so replace it
+	updated := proto.Clone(agent).(*agentv1.Agent)
+	if updated.Capabilities == nil {
+		updated.Capabilities = &agentv1.AgentCapabilities{}
+	}
+	updated.Capabilities.Templates = templates
+	s.agents[agentID] = updated
+	return nil
+}
+
+// AssignRunner records that a runner is being created on an agent, so that
+// no other agent may report it
+func (s *Store) AssignRunner(runnerID, agentID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assignedRunners[runnerID] = agentID
+}
+
+// UnassignRunner forgets the assignment of a runner whose creation failed
+func (s *Store) UnassignRunner(runnerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.assignedRunners, runnerID)
+}
+
+// UpdateAgentRunners updates the runners for an agent. Runners that another
+// agent reported or was assigned are ignored, and reported with
+// ErrRunnerNotAssigned once the others are updated. Runners the server does
+// not know, such as those created before it restarted, are adopted.
 func (s *Store) UpdateAgentRunners(agentID string, runners []*agentv1.Runner) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -88,6 +134,21 @@ func (s *Store) UpdateAgentRunners(agentID string, runners []*agentv1.Runner) er
 		return model.ErrAgentNotFound
 	}
 
+	var owned []*agentv1.Runner
+	var ignored []string
+	for _, r := range runners {
+		owner, ok := s.runnerToAgent[r.RunnerId]
+		if !ok {
+			owner, ok = s.assignedRunners[r.RunnerId]
+		}
+		if ok && owner != agentID {
+			ignored = append(ignored, r.RunnerId)
+			continue
+		}
+		owned = append(owned, r)
+	}
+	runners = owned
+
 	// Build a set of runner IDs from the received list
 	receivedRunnerIDs := make(map[string]bool)
 	for _, r := range runners {
@@ -113,14 +174,19 @@ func (s *Store) UpdateAgentRunners(agentID string, runners []*agentv1.Runner) er
 		}
 		delete(s.runners, runnerID)
 		delete(s.runnerToAgent, runnerID)
+		delete(s.assignedRunners, runnerID)
 	}
 
 	// Update runner information
 	for _, r := range runners {
 		s.runners[r.RunnerId] = r
 		s.runnerToAgent[r.RunnerId] = agentID
+		delete(s.assignedRunners, r.RunnerId)
 	}
 
+	if len(ignored) > 0 {
+		return fmt.Errorf("%w: %v", model.ErrRunnerNotAssigned, ignored)
+	}
 	return nil
 }
 
@@ -211,6 +277,7 @@ func (s *Store) DeleteRunner(runnerID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	delete(s.assignedRunners, runnerID)
 	if _, exists := s.runners[runnerID]; !exists {
 		return model.ErrRunnerNotFound
 	}
@@ -1,9 +1,11 @@
 package store
 
 import (
+	"errors"
 	"testing"
 
 	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+	"github.com/whywaita/shoes-vz/pkg/model"
 )
 
 func TestStore_RegisterAndGetAgent(t *testing.T) {
@@ -296,3 +298,122 @@ func TestStore_UpdateAgentRunners_RemovesStaleRunners(t *testing.T) {
 		t.Errorf("GetRunnerCount() = %v, want 2", count)
 	}
 }
+
+func TestStore_UpdateAgentTemplates(t *testing.T) {
+	s := NewStore()
+	s.RegisterAgent("agent-1", &agentv1.Agent{
+		AgentId:      "agent-1",
+		Capabilities: &agentv1.AgentCapabilities{MacosVersion: "15.2", Templates: []*agentv1.Template{{Name: "macos-15", Version: "1"}}},
+	})
+	before, err := s.GetAgent("agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.UpdateAgentTemplates("agent-1", []*agentv1.Template{{Name: "macos-15", Version: "1"}, {Name: "macos-15", Version: "2"}}); err != nil {
+		t.Fatalf("UpdateAgentTemplates() error = %v", err)
+	}
+
+	got, err := s.GetAgent("agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got.Capabilities.Templates); n != 2 {
+		t.Errorf("GetAgent() has %d templates, want 2", n)
+	}
+	if got.Capabilities.MacosVersion != "15.2" {
+		t.Errorf("GetAgent() MacosVersion = %v, want 15.2", got.Capabilities.MacosVersion)
+	}
+	if n := len(before.Capabilities.Templates); n != 1 {
+		t.Errorf("agent returned before the update has %d templates, want 1", n)
+	}
+
+	if err := s.UpdateAgentTemplates("agent-2", nil); err == nil {
+		t.Error("UpdateAgentTemplates() for unknown agent error = nil, want error")
+	}
+}
+
+func TestStore_UpdateAgentRunners_OtherAgentsRunner(t *testing.T) {
+	s := NewStore()
+	s.RegisterAgent("agent-a", &agentv1.Agent{AgentId: "agent-a"})
+	s.RegisterAgent("agent-b", &agentv1.Agent{AgentId: "agent-b"})
+
+	s.AssignRunner("runner-a", "agent-a")
+	if err := s.UpdateAgentRunners("agent-a", []*agentv1.Runner{{RunnerId: "runner-a", State: agentv1.RunnerState_RUNNER_STATE_RUNNING}}); err != nil {
+		t.Fatalf("UpdateAgentRunners(agent-a) error = %v", err)
+	}
+
+	// agent-b reports agent-a's runner, one assigned to agent-a and not
+	// reported yet, and one the server does not know next to its own
+	s.AssignRunner("runner-b", "agent-b")
+	s.AssignRunner("runner-c", "agent-a")
+	err := s.UpdateAgentRunners("agent-b", []*agentv1.Runner{
+		{RunnerId: "runner-a", State: agentv1.RunnerState_RUNNER_STATE_ERROR},
+		{RunnerId: "runner-b", State: agentv1.RunnerState_RUNNER_STATE_RUNNING},
+		{RunnerId: "runner-c", State: agentv1.RunnerState_RUNNER_STATE_RUNNING},
+		{RunnerId: "runner-x", State: agentv1.RunnerState_RUNNER_STATE_RUNNING},
+	})
+	if !errors.Is(err, model.ErrRunnerNotAssigned) {
+		t.Errorf("UpdateAgentRunners(agent-b) error = %v, want %v", err, model.ErrRunnerNotAssigned)
+	}
+
+	tests := []struct {
+		runnerID  string
+		wantAgent string
+		wantState agentv1.RunnerState
+	}{
+		{runnerID: "runner-a", wantAgent: "agent-a", wantState: agentv1.RunnerState_RUNNER_STATE_RUNNING},
+		{runnerID: "runner-b", wantAgent: "agent-b", wantState: agentv1.RunnerState_RUNNER_STATE_RUNNING},
+		{runnerID: "runner-x", wantAgent: "agent-b", wantState: agentv1.RunnerState_RUNNER_STATE_RUNNING},
+	}
+	for _, tt := range tests {
+		t.Run(tt.runnerID, func(t *testing.T) {
+			agentID, err := s.GetAgentForRunner(tt.runnerID)
+			if err != nil {
+				t.Fatalf("GetAgentForRunner() error = %v", err)
+			}
+			if agentID != tt.wantAgent {
+				t.Errorf("GetAgentForRunner() = %v, want %v", agentID, tt.wantAgent)
+			}
+			runner, err := s.GetRunner(tt.runnerID)
+			if err != nil {
+				t.Fatalf("GetRunner() error = %v", err)
+			}
+			if runner.State != tt.wantState {
+				t.Errorf("GetRunner().State = %v, want %v", runner.State, tt.wantState)
+			}
+		})
+	}
+
+	if _, err := s.GetRunner("runner-c"); !errors.Is(err, model.ErrRunnerNotFound) {
+		t.Errorf("GetRunner(runner-c) error = %v, want %v", err, model.ErrRunnerNotFound)
+	}
+
+	// agent-b's report did not make runner-a stale for agent-a
+	if n := len(s.ListRunnersByAgent("agent-a")); n != 1 {
+		t.Errorf("ListRunnersByAgent(agent-a) has %d runners, want 1", n)
+	}
+}
+
+func TestStore_UnassignRunner(t *testing.T) {
+	s := NewStore()
+	s.RegisterAgent("agent-a", &agentv1.Agent{AgentId: "agent-a"})
+	s.RegisterAgent("agent-b", &agentv1.Agent{AgentId: "agent-b"})
+
+	// The runner never came up on agent-a, so agent-b may report it
+	s.AssignRunner("runner-a", "agent-a")
+	s.UnassignRunner("runner-a")
+	if err := s.UpdateAgentRunners("agent-b", []*agentv1.Runner{{RunnerId: "runner-a"}}); err != nil {
+		t.Fatalf("UpdateAgentRunners() error = %v", err)
+	}
+	agentID, err := s.GetAgentForRunner("runner-a")
+	if err != nil {
+		t.Fatalf("GetAgentForRunner() error = %v", err)
+	}
+	if agentID != "agent-b" {
+		t.Errorf("GetAgentForRunner() = %v, want %v", agentID, "agent-b")
+	}
+	if n := len(s.assignedRunners); n != 0 {
+		t.Errorf("assignedRunners has %d entries, want 0", n)
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataKeyAuthorization is the gRPC metadata key carrying bearer tokens
+const MetadataKeyAuthorization = "authorization"
+
+const bearerPrefix = "Bearer "
+
+// BearerFromContext returns the bearer token of an incoming gRPC call
+func BearerFromContext(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, v := range md.Get(MetadataKeyAuthorization) {
+		if len(v) > len(bearerPrefix) && strings.EqualFold(v[:len(bearerPrefix)], bearerPrefix) {
+			return v[len(bearerPrefix):], true
+		}
+	}
+	return "", false
+}
+
+// Bearer sends a bearer token with every gRPC call. The token can be set
+// after the connection is made; nothing is sent while it is empty.
+type Bearer struct {
+	mu    sync.RWMutex
+	token string
+}
+
+// NewBearer creates a Bearer sending token
+func NewBearer(token string) *Bearer {
+	return &Bearer{token: token}
+}
+
+// Set replaces the token
+func (b *Bearer) Set(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.token = token
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials
+func (b *Bearer) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.token == "" {
+		return nil, nil
+	}
+	return map[string]string{MetadataKeyAuthorization: bearerPrefix + b.token}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials. TLS
+// is optional in shoes-vz, so tokens are also sent over plaintext.
+func (b *Bearer) RequireTransportSecurity() bool {
+	return false
+}
+
+var _ credentials.PerRPCCredentials = (*Bearer)(nil)
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderTimestamp carries the Unix time (seconds) at which a request was signed
+	HeaderTimestamp = "X-Shoes-Vz-Timestamp"
+
+	// HeaderSignature carries the hex-encoded HMAC-SHA256 signature of a request
+	HeaderSignature = "X-Shoes-Vz-Signature"
+
+	// DefaultMaxSkew is the maximum allowed difference between the signing time and now
+	DefaultMaxSkew = 5 * time.Minute
+
+	// maxSignedBodySize limits how much of a request body is buffered for verification
+	maxSignedBodySize = 10 << 20
+
+	// DefaultReplayCacheSize bounds the nonces remembered to reject replays
+	DefaultReplayCacheSize = 1 << 16
+)
+
+var (
+	// ErrMissingSignature is returned when a request carries no signature headers
+	ErrMissingSignature = errors.New("missing signature")
+
+	// ErrInvalidTimestamp is returned when the timestamp header cannot be parsed
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+
+	// ErrExpiredTimestamp is returned when the timestamp is outside the allowed skew
+	ErrExpiredTimestamp = errors.New("timestamp outside allowed window")
+
+	// ErrInvalidSignature is returned when the signature does not match
+	ErrInvalidSignature = errors.New("invalid signature")
+
+	// ErrReplayedRequest is returned when the nonce of a request was already seen
+	ErrReplayedRequest = errors.New("replayed request")
+
+	// ErrReplayCacheFull is returned when too many requests arrive within
+	// the allowed skew to remember all of their nonces
+	ErrReplayCacheFull = errors.New("replay cache full")
+)
+
+// Signer signs and verifies HTTP requests exchanged between shoes-vz-agent
+// and shoes-vz-runner-agent using a shared secret. Each request carries a
+// nonce, and a nonce is only accepted once.
+// A nil Signer or a Signer without a secret disables authentication;
+// binaries only allow that when asked to run without authentication.
+type Signer struct {
+	secret  []byte
+	maxSkew time.Duration
+	now     func() time.Time
+	seen    *replayCache
+}
+
+// NewSigner creates a new Signer for the given shared secret
+func NewSigner(secret []byte) *Signer {
+	return &Signer{
+		secret:  secret,
+		maxSkew: DefaultMaxSkew,
+		now:     time.Now,
+		seen:    newReplayCache(DefaultReplayCacheSize),
+	}
+}
+
+// RunnerToken derives the secret the runner-agent of runnerID shares with
+// shoes-vz-agent from the agent's secret, so that a guest only ever holds
+// its own. It returns nil if secret is empty.
+func RunnerToken(secret []byte, runnerID string) []byte {
+	if len(secret) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("shoes-vz runner token\n"))
+	mac.Write([]byte(runnerID))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// ForRunner returns a Signer using the token of runnerID. It shares the
+// replay cache of s, so a nonce is only accepted once across all runners.
+func (s *Signer) ForRunner(runnerID string) *Signer {
+	if !s.Enabled() {
+		return s
+	}
+	return &Signer{
+		secret:  RunnerToken(s.secret, runnerID),
+		maxSkew: s.maxSkew,
+		now:     s.now,
+		seen:    s.seen,
+	}
+}
+
+// LoadSecret reads a shared secret from a file, trimming surrounding whitespace
+func LoadSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret file: %w", err)
+	}
+
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret file is empty: %s", path)
+	}
+
+	return secret, nil
+}
+
+// Enabled returns true if requests are signed and verified
+func (s *Signer) Enabled() bool {
+	return s != nil && len(s.secret) > 0
+}
+
+// Sign adds timestamp, nonce and signature headers to the request. A nonce
+// already set with HeaderNonce is kept, so that it can also be checked in
+// the response signature.
+// body must be the exact payload that will be sent.
+func (s *Signer) Sign(req *http.Request, body []byte) {
+	if !s.Enabled() {
+		return
+	}
+
+	nonce := req.Header.Get(HeaderNonce)
+	if nonce == "" {
+		nonce = NewNonce()
+		req.Header.Set(HeaderNonce, nonce)
+	}
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, s.signature(req.Method, req.URL.Path, timestamp, nonce, body))
+}
+
+// Verify checks the timestamp, nonce and signature headers of the request
+// against body. A request is only accepted once.
+func (s *Signer) Verify(req *http.Request, body []byte) error {
+	if !s.Enabled() {
+		return nil
+	}
+
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	signature := req.Header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return ErrMissingSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	skew := s.now().Sub(time.Unix(unix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > s.maxSkew {
+		return ErrExpiredTimestamp
+	}
+
+	expected := s.signature(req.Method, req.URL.Path, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return ErrInvalidSignature
+	}
+
+	// Only signed nonces are remembered, so the cache cannot be filled
+	// without the secret
+	return s.seen.add(nonce, time.Unix(unix, 0).Add(s.maxSkew), s.now())
+}
+
+// Middleware returns an http.Handler that rejects requests failing Verify
+// with 401 Unauthorized. onReject, if not nil, is called for each rejection.
+func (s *Signer) Middleware(next http.Handler, onReject func(r *http.Request, err error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		_ = r.Body.Close()
+
+		if err := s.Verify(r, body); err != nil {
+			if onReject != nil {
+				onReject(r, err)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reason returns a short label describing a verification error, suitable for metrics
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, ErrMissingSignature):
+		return "missing_signature"
+	case errors.Is(err, ErrInvalidTimestamp):
+		return "invalid_timestamp"
+	case errors.Is(err, ErrExpiredTimestamp):
+		return "expired_timestamp"
+	case errors.Is(err, ErrInvalidSignature):
+		return "invalid_signature"
+	case errors.Is(err, ErrReplayedRequest):
+		return "replayed"
+	case errors.Is(err, ErrReplayCacheFull):
+		return "replay_cache_full"
+	case errors.Is(err, ErrInvalidStreamMAC):
+		return "invalid_stream_mac"
+	default:
+		return "unknown"
+	}
+}
+
+// signature computes HMAC-SHA256 over the method, path, timestamp, nonce and body digest
+func (s *Signer) signature(method, path, timestamp, nonce string, body []byte) string {
+	bodyDigest := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(method))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(path))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(hex.EncodeToString(bodyDigest[:])))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// replayCache remembers the nonces of verified requests until their
+// timestamps are too old to be accepted anyway
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // Nonce to when it expires
+	max  int
+}
+
+func newReplayCache(max int) *replayCache {
+	return &replayCache{seen: make(map[string]time.Time), max: max}
+}
+
+// add records nonce until expires, failing if it was already recorded
+func (c *replayCache) add(nonce string, expires, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.seen[nonce]; ok {
+		return ErrReplayedRequest
+	}
+	if len(c.seen) >= c.max {
+		for n, exp := range c.seen {
+			if !exp.After(now) {
+				delete(c.seen, n)
+			}
+		}
+		if len(c.seen) >= c.max {
+			return ErrReplayCacheFull
+		}
+	}
+	c.seen[nonce] = expires
+	return nil
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSigner(secret string, now time.Time) *Signer {
+	s := NewSigner([]byte(secret))
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestSigner_SignAndVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"runner_id":"test","ip_address":"192.168.64.5"}`)
+
+	tests := []struct {
+		name    string
+		mutate  func(req *http.Request, verifier *Signer) []byte
+		wantErr error
+	}{
+		{
+			name: "valid signature",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				return body
+			},
+			wantErr: nil,
+		},
+		{
+			name: "tampered body",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				return []byte(`{"runner_id":"test","ip_address":"192.168.64.6"}`)
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "different path",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				req.URL.Path = "/exec"
+				return body
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "missing headers",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				req.Header.Del(HeaderSignature)
+				return body
+			},
+			wantErr: ErrMissingSignature,
+		},
+		{
+			name: "missing nonce",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				req.Header.Del(HeaderNonce)
+				return body
+			},
+			wantErr: ErrMissingSignature,
+		},
+		{
+			name: "different nonce",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				req.Header.Set(HeaderNonce, "other-nonce")
+				return body
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "invalid timestamp",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				req.Header.Set(HeaderTimestamp, "not-a-number")
+				return body
+			},
+			wantErr: ErrInvalidTimestamp,
+		},
+		{
+			name: "expired timestamp",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				verifier.now = func() time.Time { return now.Add(DefaultMaxSkew + time.Second) }
+				return body
+			},
+			wantErr: ErrExpiredTimestamp,
+		},
+		{
+			name: "wrong secret",
+			mutate: func(req *http.Request, verifier *Signer) []byte {
+				verifier.secret = []byte("other-secret")
+				return body
+			},
+			wantErr: ErrInvalidSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := newTestSigner("test-secret", now)
+			verifier := newTestSigner("test-secret", now)
+
+			req := httptest.NewRequest(http.MethodPost, "/notify-ip", bytes.NewReader(body))
+			signer.Sign(req, body)
+
+			verifyBody := tt.mutate(req, verifier)
+			err := verifier.Verify(req, verifyBody)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSigner_Replay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := newTestSigner("test-secret", now)
+	verifier := newTestSigner("test-secret", now)
+	body := []byte(`{"command":"true"}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/exec", bytes.NewReader(body))
+	req.Header.Set(HeaderNonce, "client-nonce")
+	signer.Sign(req, body)
+	if got := req.Header.Get(HeaderNonce); got != "client-nonce" {
+		t.Errorf("Sign() replaced nonce with %q", got)
+	}
+
+	if err := verifier.Verify(req, body); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if err := verifier.Verify(req, body); !errors.Is(err, ErrReplayedRequest) {
+		t.Errorf("Verify() of a replayed request error = %v, want %v", err, ErrReplayedRequest)
+	}
+
+	// A new request is signed with a new nonce
+	req = httptest.NewRequest(http.MethodPost, "/exec", bytes.NewReader(body))
+	signer.Sign(req, body)
+	if err := verifier.Verify(req, body); err != nil {
+		t.Errorf("Verify() of a new request error = %v", err)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newReplayCache(2)
+
+	if err := c.add("a", now.Add(time.Minute), now); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if err := c.add("b", now.Add(time.Hour), now); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if err := c.add("c", now.Add(time.Hour), now); !errors.Is(err, ErrReplayCacheFull) {
+		t.Errorf("add() to a full cache error = %v, want %v", err, ErrReplayCacheFull)
+	}
+
+	// Expired nonces make room
+	later := now.Add(2 * time.Minute)
+	if err := c.add("c", later.Add(time.Hour), later); err != nil {
+		t.Errorf("add() once a nonce expired error = %v", err)
+	}
+	if err := c.add("b", later.Add(time.Hour), later); !errors.Is(err, ErrReplayedRequest) {
+		t.Errorf("add() of a remembered nonce error = %v, want %v", err, ErrReplayedRequest)
+	}
+}
+
+func TestSigner_Disabled(t *testing.T) {
+	var nilSigner *Signer
+	emptySigner := NewSigner(nil)
+
+	for _, s := range []*Signer{nilSigner, emptySigner} {
+		if s.Enabled() {
+			t.Error("Enabled() = true, want false")
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		s.Sign(req, nil)
+		if req.Header.Get(HeaderSignature) != "" {
+			t.Error("Sign() set signature header on disabled signer")
+		}
+
+		if err := s.Verify(req, nil); err != nil {
+			t.Errorf("Verify() error = %v, want nil", err)
+		}
+	}
+}
+
+func TestSigner_Middleware(t *testing.T) {
+	now := time.Now()
+	signer := newTestSigner("test-secret", now)
+
+	var gotBody []byte
+	handler := signer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}), nil)
+
+	body := []byte(`{"command":"true"}`)
+
+	// Signed request is passed through with its body intact
+	req := httptest.NewRequest(http.MethodPost, "/exec", bytes.NewReader(body))
+	signer.Sign(req, body)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("signed request status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !bytes.Equal(gotBody, body) {
+		t.Errorf("handler body = %s, want %s", gotBody, body)
+	}
+
+	// Unsigned request is rejected and reported
+	var rejected error
+	handler = signer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called for unsigned request")
+	}), func(r *http.Request, err error) {
+		rejected = err
+	})
+
+	req = httptest.NewRequest(http.MethodPost, "/exec", bytes.NewReader(body))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderNonce, "nonce")
+	req.Header.Set(HeaderSignature, "deadbeef")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if Reason(rejected) != "invalid_signature" {
+		t.Errorf("Reason() = %s, want invalid_signature", Reason(rejected))
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	secretPath := filepath.Join(tmpDir, "secret")
+	if err := os.WriteFile(secretPath, []byte("  my-secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+
+	secret, err := LoadSecret(secretPath)
+	if err != nil {
+		t.Fatalf("LoadSecret() error = %v", err)
+	}
+	if string(secret) != "my-secret" {
+		t.Errorf("LoadSecret() = %q, want %q", secret, "my-secret")
+	}
+
+	emptyPath := filepath.Join(tmpDir, "empty")
+	if err := os.WriteFile(emptyPath, []byte("\n"), 0600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+	if _, err := LoadSecret(emptyPath); err == nil {
+		t.Error("LoadSecret() error = nil for empty file, want error")
+	}
+}
+
+func TestSigner_ForRunner(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	agent := newTestSigner("secret", now)
+	body := []byte("body")
+
+	// The runner-agent only knows its own token
+	guest := NewSigner(RunnerToken([]byte("secret"), "runner-1"))
+	guest.now = func() time.Time { return now }
+
+	req := httptest.NewRequest(http.MethodPost, "/notify-ip", nil)
+	guest.Sign(req, body)
+
+	if err := agent.ForRunner("runner-2").Verify(req, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() for another runner error = %v, want %v", err, ErrInvalidSignature)
+	}
+	if err := agent.Verify(req, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() with the agent secret error = %v, want %v", err, ErrInvalidSignature)
+	}
+	if err := agent.ForRunner("runner-1").Verify(req, body); err != nil {
+		t.Errorf("Verify() for the runner error = %v", err)
+	}
+	// The replay cache is shared with the agent's signer
+	if err := agent.ForRunner("runner-1").Verify(req, body); !errors.Is(err, ErrReplayedRequest) {
+		t.Errorf("Verify() replayed error = %v, want %v", err, ErrReplayedRequest)
+	}
+
+	if NewSigner(nil).ForRunner("runner-1").Enabled() {
+		t.Error("ForRunner() of a disabled signer is enabled")
+	}
+}
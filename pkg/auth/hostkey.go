@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// HeaderNonce carries a random value chosen by the client that the
+	// runner-agent must include in its response signature
+	HeaderNonce = "X-Shoes-Vz-Nonce"
+
+	// HeaderHostSignature carries the base64-encoded SSH signature of a
+	// response, made with the guest's SSH host key
+	HeaderHostSignature = "X-Shoes-Vz-Host-Signature"
+)
+
+var (
+	// ErrMissingHostSignature is returned when a response carries no host key signature
+	ErrMissingHostSignature = errors.New("missing host key signature")
+
+	// ErrHostKeyMismatch is returned when a response was not signed by the pinned host key
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+)
+
+// ParseHostKey parses a public key in authorized_keys format
+func ParseHostKey(s string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key: %w", err)
+	}
+	return key, nil
+}
+
+// FormatPublicKey formats a public key in authorized_keys format without a trailing newline
+func FormatPublicKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// NewNonce returns a random nonce for HeaderNonce. crypto/rand never fails to read.
+func NewNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// HostKeyMiddleware returns an http.Handler that signs every response with
+// the guest's SSH host key, so that the agent can check it is talking to
+// the VM whose key it pinned. A nil signer disables response signing.
+func HostKeyMiddleware(signer ssh.Signer, next http.Handler) http.Handler {
+	if signer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(buf, r)
+
+		bodyDigest := sha256.Sum256(buf.body.Bytes())
+		sig, err := SignHostDigest(signer, r.URL.Path, r.Header.Get(HeaderNonce), buf.status, bodyDigest[:])
+		if err != nil {
+			http.Error(w, "Failed to sign response", http.StatusInternalServerError)
+			return
+		}
+
+		for k, v := range buf.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set(HeaderHostSignature, sig)
+		w.WriteHeader(buf.status)
+		_, _ = w.Write(buf.body.Bytes())
+	})
+}
+
+// VerifyHostSignature checks that resp was signed by key for the given
+// request path and nonce. body must be the complete response body.
+func VerifyHostSignature(key ssh.PublicKey, resp *http.Response, path, nonce string, body []byte) error {
+	bodyDigest := sha256.Sum256(body)
+	return VerifyHostDigest(key, resp.Header.Get(HeaderHostSignature), path, nonce, resp.StatusCode, bodyDigest[:])
+}
+
+// SignHostDigest signs a SHA-256 digest of response data with the host key
+// and returns the signature in the encoding used by HeaderHostSignature.
+// Streaming responses use it to sign everything sent once they are done.
+func SignHostDigest(signer ssh.Signer, path, nonce string, status int, digest []byte) (string, error) {
+	sig, err := signer.Sign(rand.Reader, hostSignedData(path, nonce, status, digest))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign response: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(ssh.Marshal(sig)), nil
+}
+
+// VerifyHostDigest checks a signature made by SignHostDigest against key
+func VerifyHostDigest(key ssh.PublicKey, signature, path, nonce string, status int, digest []byte) error {
+	if signature == "" {
+		return ErrMissingHostSignature
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrHostKeyMismatch)
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(raw, &sig); err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrHostKeyMismatch)
+	}
+
+	if err := key.Verify(hostSignedData(path, nonce, status, digest), &sig); err != nil {
+		return ErrHostKeyMismatch
+	}
+
+	return nil
+}
+
+// hostSignedData returns the bytes covered by a response signature
+func hostSignedData(path, nonce string, status int, digest []byte) []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%d\n%s", path, nonce, status, hex.EncodeToString(digest)))
+}
+
+// bufferedResponse collects a response so that it can be signed before sending
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.wrote {
+		return
+	}
+	b.status = status
+	b.wrote = true
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wrote = true
+	return b.body.Write(p)
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return signer
+}
+
+func TestHostKeyMiddleware(t *testing.T) {
+	hostKey := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+
+	handler := HostKeyMiddleware(hostKey, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"state":"idle"}`))
+	}))
+
+	tests := []struct {
+		name       string
+		key        ssh.PublicKey
+		verifyPath string
+		tamper     bool
+		wantErr    error
+	}{
+		{
+			name:       "pinned key verifies",
+			key:        hostKey.PublicKey(),
+			verifyPath: "/status",
+			wantErr:    nil,
+		},
+		{
+			name:       "other key is rejected",
+			key:        otherKey.PublicKey(),
+			verifyPath: "/status",
+			wantErr:    ErrHostKeyMismatch,
+		},
+		{
+			name:       "response for another path is rejected",
+			key:        hostKey.PublicKey(),
+			verifyPath: "/exec",
+			wantErr:    ErrHostKeyMismatch,
+		},
+		{
+			name:       "tampered body is rejected",
+			key:        hostKey.PublicKey(),
+			verifyPath: "/status",
+			tamper:     true,
+			wantErr:    ErrHostKeyMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce := NewNonce()
+
+			req := httptest.NewRequest(http.MethodGet, "/status", nil)
+			req.Header.Set(HeaderNonce, nonce)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			resp := rec.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", resp.Header.Get("Content-Type"))
+			}
+			if tt.tamper {
+				body = []byte(`{"state":"busy"}`)
+			}
+
+			err := VerifyHostSignature(tt.key, resp, tt.verifyPath, nonce, body)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyHostSignature() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyHostSignature_Missing(t *testing.T) {
+	hostKey := newTestHostKey(t)
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	err := VerifyHostSignature(hostKey.PublicKey(), resp, "/status", "nonce", nil)
+	if !errors.Is(err, ErrMissingHostSignature) {
+		t.Errorf("VerifyHostSignature() error = %v, want %v", err, ErrMissingHostSignature)
+	}
+}
+
+func TestParseHostKey(t *testing.T) {
+	hostKey := newTestHostKey(t)
+
+	formatted := FormatPublicKey(hostKey.PublicKey())
+	parsed, err := ParseHostKey(formatted)
+	if err != nil {
+		t.Fatalf("ParseHostKey() error = %v", err)
+	}
+	if FormatPublicKey(parsed) != formatted {
+		t.Errorf("ParseHostKey() = %s, want %s", FormatPublicKey(parsed), formatted)
+	}
+
+	if _, err := ParseHostKey("not a key"); err == nil {
+		t.Error("ParseHostKey() error = nil for invalid key, want error")
+	}
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+)
+
+// StreamMACSize is the size of each MAC produced by a StreamMAC
+const StreamMACSize = sha256.Size
+
+// HeaderBodyMAC is the request trailer carrying the hex-encoded StreamMAC of
+// the digest of a streamed body
+const HeaderBodyMAC = "X-Shoes-Vz-Body-Mac"
+
+// ErrInvalidStreamMAC is returned when a part of a streamed body does not match its MAC
+var ErrInvalidStreamMAC = errors.New("invalid stream MAC")
+
+// StreamMAC authenticates the parts of a request body that are streamed
+// after the signed part. Each MAC covers the previous one, starting from the
+// request signature, so parts cannot be dropped, reordered or moved to
+// another request.
+type StreamMAC struct {
+	signer *Signer
+	prev   []byte
+}
+
+// StreamMAC starts the chain of MACs for the streamed parts of req, which
+// must already be signed (by Sign on the client, or checked by Verify on
+// the server)
+func (s *Signer) StreamMAC(req *http.Request) *StreamMAC {
+	return &StreamMAC{signer: s, prev: []byte(req.Header.Get(HeaderSignature))}
+}
+
+// Enabled returns true if parts carry a MAC
+func (m *StreamMAC) Enabled() bool {
+	return m.signer.Enabled()
+}
+
+// Sum returns the MAC of the next part, or nil if authentication is disabled
+func (m *StreamMAC) Sum(part []byte) []byte {
+	if !m.Enabled() {
+		return nil
+	}
+	h := hmac.New(sha256.New, m.signer.secret)
+	h.Write(m.prev)
+	h.Write(part)
+	m.prev = h.Sum(nil)
+	return m.prev
+}
+
+// Verify checks the MAC of the next part
+func (m *StreamMAC) Verify(part, mac []byte) error {
+	if !m.Enabled() {
+		return nil
+	}
+	if !hmac.Equal(m.Sum(part), mac) {
+		return ErrInvalidStreamMAC
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamMAC(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	parts := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+
+	tests := []struct {
+		name    string
+		mutate  func(parts [][]byte) [][]byte
+		secret  string
+		wantErr error
+	}{
+		{
+			name:    "in order",
+			mutate:  func(parts [][]byte) [][]byte { return parts },
+			secret:  "secret",
+			wantErr: nil,
+		},
+		{
+			name:    "reordered",
+			mutate:  func(parts [][]byte) [][]byte { return [][]byte{parts[1], parts[0], parts[2]} },
+			secret:  "secret",
+			wantErr: ErrInvalidStreamMAC,
+		},
+		{
+			name:    "dropped",
+			mutate:  func(parts [][]byte) [][]byte { return [][]byte{parts[0], parts[2], parts[2]} },
+			secret:  "secret",
+			wantErr: ErrInvalidStreamMAC,
+		},
+		{
+			name:    "different secret",
+			mutate:  func(parts [][]byte) [][]byte { return parts },
+			secret:  "other",
+			wantErr: ErrInvalidStreamMAC,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/exec/stream", nil)
+			newTestSigner("secret", now).Sign(req, []byte("head"))
+
+			client := newTestSigner("secret", now).StreamMAC(req)
+			var macs [][]byte
+			for _, p := range parts {
+				macs = append(macs, client.Sum(p))
+			}
+
+			server := newTestSigner(tt.secret, now).StreamMAC(req)
+			var err error
+			for i, p := range tt.mutate(parts) {
+				if err = server.Verify(p, macs[i]); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStreamMAC_OtherRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := newTestSigner("secret", now)
+
+	req := httptest.NewRequest("POST", "/exec/stream", nil)
+	signer.Sign(req, []byte("head"))
+	other := httptest.NewRequest("POST", "/exec/stream", nil)
+	signer.Sign(other, []byte("head"))
+
+	mac := signer.StreamMAC(req).Sum([]byte("data"))
+	if err := signer.StreamMAC(other).Verify([]byte("data"), mac); !errors.Is(err, ErrInvalidStreamMAC) {
+		t.Errorf("Verify() error = %v, want %v", err, ErrInvalidStreamMAC)
+	}
+}
@@ -0,0 +1,290 @@
+package configdisk
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// The config disk is a FAT12 volume with the manifest as the only file in
+// its root directory. FAT12 is mounted by macOS without any driver and is
+// simple enough to write without formatting tools.
+const (
+	sectorSize        = 512
+	sectorsPerCluster = 8
+	clusterSize       = sectorSize * sectorsPerCluster
+	reservedSectors   = 1
+	numFATs           = 2
+	rootEntries       = sectorSize / dirEntrySize
+	dirEntrySize      = 32
+	minClusters       = 256  // Keeps the volume at 1MiB or more
+	maxClusters       = 4084 // Largest cluster count that is still FAT12
+	mediaDescriptor   = 0xF8
+
+	attrVolumeID = 0x08
+	attrArchive  = 0x20
+	attrLongName = 0x0F
+
+	// manifestShortName is the 8.3 alias of ManifestName
+	manifestShortName = "MANIFE~1JSO"
+
+	// dosEpoch is 1980-01-01, the earliest FAT date, so images are reproducible
+	dosEpoch = 1<<5 | 1
+)
+
+// WriteImage writes a config disk image containing m to path
+func WriteImage(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	image, err := buildImage(m.RunnerID, data)
+	if err != nil {
+		return err
+	}
+
+	// The manifest holds the auth token
+	if err := os.WriteFile(path, image, 0600); err != nil {
+		return fmt.Errorf("failed to write config disk: %w", err)
+	}
+	return nil
+}
+
+// buildImage lays out a FAT12 volume with data as the manifest file
+func buildImage(volumeSeed string, data []byte) ([]byte, error) {
+	fileClusters := (len(data) + clusterSize - 1) / clusterSize
+	clusters := max(minClusters, fileClusters)
+	if clusters > maxClusters {
+		return nil, fmt.Errorf("manifest is too large for a config disk: %d bytes", len(data))
+	}
+
+	fatBytes := ((clusters+2)*3 + 1) / 2
+	fatSectors := (fatBytes + sectorSize - 1) / sectorSize
+	rootSectors := rootEntries * dirEntrySize / sectorSize
+	totalSectors := reservedSectors + numFATs*fatSectors + rootSectors + clusters*sectorsPerCluster
+
+	image := make([]byte, totalSectors*sectorSize)
+
+	// Boot sector with the BIOS parameter block
+	boot := image[:sectorSize]
+	copy(boot[0:], []byte{0xEB, 0x3C, 0x90})
+	copy(boot[3:11], "SHOESVZ ")
+	binary.LittleEndian.PutUint16(boot[11:], sectorSize)
+	boot[13] = sectorsPerCluster
+	binary.LittleEndian.PutUint16(boot[14:], reservedSectors)
+	boot[16] = numFATs
+	binary.LittleEndian.PutUint16(boot[17:], rootEntries)
+	binary.LittleEndian.PutUint16(boot[19:], uint16(totalSectors))
+	boot[21] = mediaDescriptor
+	binary.LittleEndian.PutUint16(boot[22:], uint16(fatSectors))
+	binary.LittleEndian.PutUint16(boot[24:], 32) // Sectors per track
+	binary.LittleEndian.PutUint16(boot[26:], 64) // Heads
+	boot[36] = 0x80                              // Drive number
+	boot[38] = 0x29                              // Extended boot signature
+	binary.LittleEndian.PutUint32(boot[39:], crc32.ChecksumIEEE([]byte(volumeSeed)))
+	copy(boot[43:54], shortName(VolumeLabel))
+	copy(boot[54:62], "FAT12   ")
+	boot[510], boot[511] = 0x55, 0xAA
+
+	// File allocation tables, identical copies
+	fat := make([]byte, fatSectors*sectorSize)
+	setFAT12(fat, 0, 0xF00|mediaDescriptor)
+	setFAT12(fat, 1, 0xFFF)
+	for i := 0; i < fileClusters; i++ {
+		next := uint16(2 + i + 1)
+		if i == fileClusters-1 {
+			next = 0xFFF
+		}
+		setFAT12(fat, 2+i, next)
+	}
+	for i := 0; i < numFATs; i++ {
+		copy(image[(reservedSectors+i*fatSectors)*sectorSize:], fat)
+	}
+
+	// Root directory: volume label, long name and the short entry it belongs to
+	root := image[(reservedSectors+numFATs*fatSectors)*sectorSize:]
+	copy(root[0:11], shortName(VolumeLabel))
+	root[11] = attrVolumeID
+
+	short := []byte(manifestShortName)
+	putLongName(root[dirEntrySize:], ManifestName, lfnChecksum(short))
+
+	entry := root[2*dirEntrySize:]
+	copy(entry[0:11], short)
+	entry[11] = attrArchive
+	binary.LittleEndian.PutUint16(entry[16:], dosEpoch) // Creation date
+	binary.LittleEndian.PutUint16(entry[18:], dosEpoch) // Access date
+	binary.LittleEndian.PutUint16(entry[24:], dosEpoch) // Modification date
+	if len(data) > 0 {
+		binary.LittleEndian.PutUint16(entry[26:], 2)
+	}
+	binary.LittleEndian.PutUint32(entry[28:], uint32(len(data)))
+
+	// File data, starting at cluster 2
+	dataStart := (reservedSectors + numFATs*fatSectors + rootSectors) * sectorSize
+	copy(image[dataStart:], data)
+
+	return image, nil
+}
+
+// ReadManifest reads the manifest from a config disk image or device
+func ReadManifest(r io.ReaderAt) (*Manifest, error) {
+	boot := make([]byte, sectorSize)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotConfigDisk, err)
+	}
+	if boot[510] != 0x55 || boot[511] != 0xAA || boot[38] != 0x29 || string(boot[43:54]) != string(shortName(VolumeLabel)) {
+		return nil, ErrNotConfigDisk
+	}
+
+	bytesPerSector := int(binary.LittleEndian.Uint16(boot[11:]))
+	perCluster := int(boot[13])
+	reserved := int(binary.LittleEndian.Uint16(boot[14:]))
+	fats := int(boot[16])
+	entries := int(binary.LittleEndian.Uint16(boot[17:]))
+	fatSectors := int(binary.LittleEndian.Uint16(boot[22:]))
+	if bytesPerSector == 0 || perCluster == 0 || entries == 0 || fatSectors == 0 {
+		return nil, fmt.Errorf("%w: invalid BIOS parameter block", ErrNotConfigDisk)
+	}
+
+	fat := make([]byte, fatSectors*bytesPerSector)
+	if _, err := r.ReadAt(fat, int64(reserved*bytesPerSector)); err != nil {
+		return nil, fmt.Errorf("failed to read FAT: %w", err)
+	}
+
+	rootOffset := int64((reserved + fats*fatSectors) * bytesPerSector)
+	root := make([]byte, entries*dirEntrySize)
+	if _, err := r.ReadAt(root, rootOffset); err != nil {
+		return nil, fmt.Errorf("failed to read root directory: %w", err)
+	}
+	dataOffset := rootOffset + int64(len(root)+bytesPerSector-1)/int64(bytesPerSector)*int64(bytesPerSector)
+
+	cluster, size, err := findManifest(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// Follow the cluster chain
+	bytesPerCluster := perCluster * bytesPerSector
+	data := make([]byte, 0, size)
+	buf := make([]byte, bytesPerCluster)
+	for len(data) < size {
+		if cluster < 2 || cluster >= 0xFF8 {
+			return nil, fmt.Errorf("manifest cluster chain ends early")
+		}
+		if _, err := r.ReadAt(buf, dataOffset+int64(cluster-2)*int64(bytesPerCluster)); err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %w", err)
+		}
+		data = append(data, buf[:min(bytesPerCluster, size-len(data))]...)
+		cluster = getFAT12(fat, cluster)
+	}
+
+	return ParseManifest(data)
+}
+
+// findManifest returns the first cluster and size of the manifest file
+func findManifest(root []byte) (int, int, error) {
+	var longName string
+	for off := 0; off+dirEntrySize <= len(root); off += dirEntrySize {
+		entry := root[off : off+dirEntrySize]
+		switch {
+		case entry[0] == 0x00:
+			return 0, 0, fmt.Errorf("config disk has no %s", ManifestName)
+		case entry[0] == 0xE5:
+			longName = ""
+		case entry[11] == attrLongName:
+			// Entries are stored last part first
+			longName = readLongName(entry) + longName
+		case entry[11]&attrVolumeID != 0:
+			longName = ""
+		default:
+			if strings.EqualFold(longName, ManifestName) || string(entry[0:11]) == manifestShortName {
+				return int(binary.LittleEndian.Uint16(entry[26:])), int(binary.LittleEndian.Uint32(entry[28:])), nil
+			}
+			longName = ""
+		}
+	}
+	return 0, 0, fmt.Errorf("config disk has no %s", ManifestName)
+}
+
+// setFAT12 stores a 12-bit FAT entry
+func setFAT12(fat []byte, cluster int, value uint16) {
+	off := cluster + cluster/2
+	if cluster%2 == 0 {
+		fat[off] = byte(value)
+		fat[off+1] = fat[off+1]&0xF0 | byte(value>>8)&0x0F
+	} else {
+		fat[off] = fat[off]&0x0F | byte(value<<4)
+		fat[off+1] = byte(value >> 4)
+	}
+}
+
+// getFAT12 loads a 12-bit FAT entry
+func getFAT12(fat []byte, cluster int) int {
+	off := cluster + cluster/2
+	if off+1 >= len(fat) {
+		return 0xFFF
+	}
+	v := int(binary.LittleEndian.Uint16(fat[off:]))
+	if cluster%2 == 0 {
+		return v & 0xFFF
+	}
+	return v >> 4
+}
+
+// shortName pads a name to the 11 bytes of a FAT directory entry
+func shortName(name string) []byte {
+	b := []byte(strings.ToUpper(name) + strings.Repeat(" ", 11))
+	return b[:11]
+}
+
+// lfnChecksum is the checksum of a short name stored in its long name entries
+func lfnChecksum(short []byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// lfnOffsets are the positions of the 13 UTF-16 characters in a long name entry
+var lfnOffsets = [13]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+// putLongName writes name, which must fit in one entry, as a long name entry
+func putLongName(entry []byte, name string, checksum byte) {
+	chars := utf16.Encode([]rune(name))
+	entry[0] = 0x41 // Sequence 1, last entry
+	entry[11] = attrLongName
+	entry[13] = checksum
+	for i, off := range lfnOffsets {
+		var c uint16
+		switch {
+		case i < len(chars):
+			c = chars[i]
+		case i == len(chars):
+			c = 0x0000
+		default:
+			c = 0xFFFF
+		}
+		binary.LittleEndian.PutUint16(entry[off:], c)
+	}
+}
+
+// readLongName returns the part of a long name stored in one entry
+func readLongName(entry []byte) string {
+	var chars []uint16
+	for _, off := range lfnOffsets {
+		c := binary.LittleEndian.Uint16(entry[off:])
+		if c == 0x0000 || c == 0xFFFF {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars))
+}
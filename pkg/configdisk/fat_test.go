@@ -0,0 +1,151 @@
+package configdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteImageReadManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest Manifest
+	}{
+		{
+			name: "full manifest",
+			manifest: Manifest{
+				Version:       ManifestVersion,
+				RunnerID:      "runner-1",
+				RunnerName:    "myshoes-runner-1",
+				SetupScript:   "#!/bin/bash\necho setup\n",
+				CallbackAddr:  "192.168.64.1:8081",
+				AuthToken:     []byte("secret"),
+				AuthorizedKey: "ssh-ed25519 AAAA runner-1",
+			},
+		},
+		{
+			name: "script spanning many clusters",
+			manifest: Manifest{
+				Version:     ManifestVersion,
+				RunnerID:    "runner-2",
+				SetupScript: strings.Repeat("echo line\n", 5000),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ConfigDisk.img")
+			if err := WriteImage(path, &tt.manifest); err != nil {
+				t.Fatalf("WriteImage() error = %v", err)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("image mode = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+			}
+			if info.Size()%sectorSize != 0 {
+				t.Errorf("image size %d is not a multiple of %d", info.Size(), sectorSize)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+
+			got, err := ReadManifest(f)
+			if err != nil {
+				t.Fatalf("ReadManifest() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.manifest) {
+				t.Errorf("ReadManifest() = %+v, want %+v", *got, tt.manifest)
+			}
+		})
+	}
+}
+
+func TestBuildImage_FAT12Layout(t *testing.T) {
+	image, err := buildImage("runner-1", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("buildImage() error = %v", err)
+	}
+
+	boot := image[:sectorSize]
+	totalSectors := int(binary.LittleEndian.Uint16(boot[19:]))
+	fatSectors := int(binary.LittleEndian.Uint16(boot[22:]))
+	rootSectors := int(binary.LittleEndian.Uint16(boot[17:])) * dirEntrySize / sectorSize
+	dataSectors := totalSectors - reservedSectors - numFATs*fatSectors - rootSectors
+
+	// The FAT type is decided by the cluster count alone
+	if clusters := dataSectors / int(boot[13]); clusters > maxClusters {
+		t.Errorf("cluster count = %d, want at most %d for FAT12", clusters, maxClusters)
+	}
+	if totalSectors*sectorSize != len(image) {
+		t.Errorf("total sectors = %d, image has %d", totalSectors, len(image)/sectorSize)
+	}
+	if !bytes.Equal(boot[510:], []byte{0x55, 0xAA}) {
+		t.Errorf("boot signature = %x, want 55aa", boot[510:])
+	}
+	if got := string(boot[54:62]); got != "FAT12   " {
+		t.Errorf("file system type = %q, want %q", got, "FAT12   ")
+	}
+}
+
+func TestBuildImage_TooLarge(t *testing.T) {
+	if _, err := buildImage("runner-1", make([]byte, (maxClusters+1)*clusterSize)); err == nil {
+		t.Error("buildImage() error = nil, want error")
+	}
+}
+
+func TestReadManifest_NotConfigDisk(t *testing.T) {
+	tests := []struct {
+		name  string
+		image []byte
+	}{
+		{name: "empty", image: nil},
+		{name: "zeroed", image: make([]byte, 4*sectorSize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadManifest(bytes.NewReader(tt.image))
+			if !errors.Is(err, ErrNotConfigDisk) {
+				t.Errorf("ReadManifest() error = %v, want %v", err, ErrNotConfigDisk)
+			}
+		})
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "valid", data: `{"version":1,"runner_id":"r1","callback_addr":"192.168.64.1:8081"}`},
+		{name: "missing runner ID", data: `{"version":1}`, wantErr: true},
+		{name: "unknown version", data: `{"version":2,"runner_id":"r1"}`, wantErr: true},
+		{name: "callback without port", data: `{"version":1,"runner_id":"r1","callback_addr":"192.168.64.1"}`, wantErr: true},
+		{name: "not JSON", data: `runner`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseManifest([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
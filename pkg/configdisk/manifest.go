@@ -0,0 +1,68 @@
+// Package configdisk builds and reads the per-runner config disk, a small
+// FAT volume attached to the guest that carries its identity and bootstrap
+// settings in a JSON manifest.
+package configdisk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	// ManifestName is the name of the manifest file on the config disk
+	ManifestName = "manifest.json"
+
+	// VolumeLabel is the FAT volume label of config disks
+	VolumeLabel = "SHOESVZCFG"
+
+	// ManifestVersion is the manifest format written by this version
+	ManifestVersion = 1
+
+	// GuestSetupScriptPath is where the runner-agent writes the setup script
+	// from the manifest, and where shoes-vz-agent runs it from
+	GuestSetupScriptPath = "/tmp/shoes-vz-setup.sh"
+)
+
+// ErrNotConfigDisk is returned when an image is not a config disk
+var ErrNotConfigDisk = errors.New("not a config disk")
+
+// Manifest is the content of the config disk
+type Manifest struct {
+	Version       int    `json:"version"`
+	RunnerID      string `json:"runner_id"`
+	RunnerName    string `json:"runner_name,omitempty"`
+	SetupScript   string `json:"setup_script,omitempty"`
+	CallbackAddr  string `json:"callback_addr,omitempty"`  // host:port of the shoes-vz-agent IP notification server
+	AuthToken     []byte `json:"auth_token,omitempty"`     // Runner's own secret for signing requests to and from shoes-vz-agent
+	AuthorizedKey string `json:"authorized_key,omitempty"` // SSH public key of the runner
+}
+
+// Validate checks that the manifest can be used by this version
+func (m *Manifest) Validate() error {
+	if m.Version != ManifestVersion {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if m.RunnerID == "" {
+		return fmt.Errorf("manifest has no runner_id")
+	}
+	if m.CallbackAddr != "" {
+		if _, _, err := net.SplitHostPort(m.CallbackAddr); err != nil {
+			return fmt.Errorf("invalid callback_addr: %w", err)
+		}
+	}
+	return nil
+}
+
+// ParseManifest decodes and validates a manifest
+func ParseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
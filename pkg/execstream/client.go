@@ -0,0 +1,158 @@
+package execstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+)
+
+// Client runs commands through the runner-agent streaming exec endpoint
+type Client struct {
+	HTTPClient *http.Client
+	Signer     *auth.Signer  // Signs the request; nil disables
+	HostKey    ssh.PublicKey // Pinned guest host key the response must be signed with; nil skips the check
+}
+
+// Run runs req on the runner-agent at baseURL (e.g. http://192.168.64.2:8080).
+// Output is copied to stdout and stderr as it arrives. If stdin is not nil,
+// it is streamed to the command until EOF. Cancelling ctx aborts the request,
+// which makes the runner-agent kill the command.
+//
+// When a host key is set, the output has already been written by the time
+// the signature is checked; a mismatch is reported as an error from Run.
+func (c *Client) Run(ctx context.Context, baseURL string, req Request, stdin io.Reader, stdout, stderr io.Writer) (*Result, error) {
+	req.Stdin = stdin != nil
+
+	spec, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var head bytes.Buffer
+	if err := WriteFrame(&head, FrameRequest, spec); err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	var body io.Reader = &head
+	var pw *io.PipeWriter
+	if stdin != nil {
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		body = pr
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+Path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", ContentType)
+	nonce := auth.NewNonce()
+	httpReq.Header.Set(auth.HeaderNonce, nonce)
+	// The signature covers the request frame; stdin frames follow it with a
+	// MAC chained to the signature
+	c.Signer.Sign(httpReq, spec)
+	if pw != nil {
+		mac := c.Signer.StreamMAC(httpReq)
+		go func() {
+			if _, err := pw.Write(head.Bytes()); err != nil {
+				return
+			}
+			_ = pw.CloseWithError(copyStdin(pw, stdin, mac))
+		}()
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, fmt.Errorf("HTTP request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	reader := newDigestReader(resp.Body)
+	var result *Result
+	for {
+		t, payload, err := reader.next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return result, fmt.Errorf("failed to read response: %w", err)
+		}
+
+		switch t {
+		case FrameStdout:
+			if _, err := stdout.Write(payload); err != nil {
+				return nil, fmt.Errorf("failed to write stdout: %w", err)
+			}
+		case FrameStderr:
+			if _, err := stderr.Write(payload); err != nil {
+				return nil, fmt.Errorf("failed to write stderr: %w", err)
+			}
+		case FrameExit:
+			result = &Result{}
+			if err := json.Unmarshal(payload, result); err != nil {
+				return nil, fmt.Errorf("failed to decode exit status: %w", err)
+			}
+			if c.HostKey == nil {
+				return result, nil
+			}
+		case FrameSignature:
+			if c.HostKey == nil {
+				return result, nil
+			}
+			if result == nil {
+				return nil, fmt.Errorf("signature received before exit status")
+			}
+			if err := auth.VerifyHostDigest(c.HostKey, string(payload), Path, nonce, resp.StatusCode, reader.digest.Sum(nil)); err != nil {
+				return result, fmt.Errorf("refusing exec result: %w", err)
+			}
+			return result, nil
+		default:
+			return nil, fmt.Errorf("unexpected frame type %d", t)
+		}
+	}
+
+	if result == nil {
+		return nil, fmt.Errorf("stream ended without exit status")
+	}
+	return result, fmt.Errorf("refusing exec result: %w", auth.ErrMissingHostSignature)
+}
+
+// copyStdin sends everything read from stdin as stdin frames, each ending
+// with its MAC when authentication is enabled
+func copyStdin(w io.Writer, stdin io.Reader, mac *auth.StreamMAC) error {
+	buf := make([]byte, 32<<10, 32<<10+auth.StreamMACSize)
+	for {
+		n, err := stdin.Read(buf[:32<<10])
+		if n > 0 {
+			if werr := WriteFrame(w, FrameStdin, append(buf[:n], mac.Sum(buf[:n])...)); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
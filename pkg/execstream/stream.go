@@ -0,0 +1,210 @@
+package execstream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// Path is the runner-agent endpoint serving streaming exec
+const Path = "/exec/stream"
+
+// ContentType is the media type of request and response bodies
+const ContentType = "application/vnd.shoes-vz.exec-stream"
+
+// MaxFrameSize is the largest payload carried by a single frame
+const MaxFrameSize = 1 << 20
+
+// frameHeaderSize is the size of the type byte plus the payload length
+const frameHeaderSize = 5
+
+// FrameType identifies the payload of a frame
+type FrameType byte
+
+const (
+	// FrameRequest carries the JSON-encoded Request; it is the first frame of a request body
+	FrameRequest FrameType = 1
+
+	// FrameStdin carries data for the command's standard input, followed by
+	// its auth.StreamMAC when authentication is enabled
+	FrameStdin FrameType = 2
+
+	// FrameStdout carries data the command wrote to standard output
+	FrameStdout FrameType = 3
+
+	// FrameStderr carries data the command wrote to standard error
+	FrameStderr FrameType = 4
+
+	// FrameExit carries the JSON-encoded Result once the command has finished
+	FrameExit FrameType = 5
+
+	// FrameSignature carries the host key signature over all preceding response frames
+	FrameSignature FrameType = 6
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Request describes a command to run in the guest
+type Request struct {
+	Command        string   `json:"command"`
+	Args           []string `json:"args,omitempty"`
+	Env            []string `json:"env,omitempty"` // KEY=VALUE pairs added to the runner-agent environment
+	Dir            string   `json:"dir,omitempty"`
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"` // Process group is killed after this; 0 means no deadline
+	Stdin          bool     `json:"stdin,omitempty"`           // Stdin frames follow; otherwise stdin is empty
+}
+
+// Result is the outcome of a command
+type Result struct {
+	ExitCode int    `json:"exit_code"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Error    string `json:"error,omitempty"` // Set if the command could not be run at all
+}
+
+// WriteFrame writes a single frame to w
+func WriteFrame(w io.Writer, t FrameType, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	var header [frameHeaderSize]byte
+	header[0] = byte(t)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadFrame reads a single frame from r. It returns io.EOF only if r ends
+// cleanly before a new frame starts.
+func ReadFrame(r io.Reader) (FrameType, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, fmt.Errorf("truncated frame header: %w", err)
+		}
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxFrameSize {
+		return 0, nil, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("truncated frame payload: %w", err)
+	}
+
+	return FrameType(header[0]), payload, nil
+}
+
+// Writer writes frames from concurrent producers, flushing after each one
+// and keeping a digest of everything written for signing
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	flush  func()
+	digest hash.Hash
+}
+
+// NewWriter creates a Writer on w. flush, if not nil, is called after each frame.
+func NewWriter(w io.Writer, flush func()) *Writer {
+	return &Writer{
+		w:      w,
+		flush:  flush,
+		digest: sha256.New(),
+	}
+}
+
+// WriteFrame writes a frame and adds it to the digest
+func (w *Writer) WriteFrame(t FrameType, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := WriteFrame(io.MultiWriter(w.w, w.digest), t, payload); err != nil {
+		return err
+	}
+	if w.flush != nil {
+		w.flush()
+	}
+	return nil
+}
+
+// WriteUnsigned writes a frame without adding it to the digest
+func (w *Writer) WriteUnsigned(t FrameType, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := WriteFrame(w.w, t, payload); err != nil {
+		return err
+	}
+	if w.flush != nil {
+		w.flush()
+	}
+	return nil
+}
+
+// Digest returns the SHA-256 digest of all frames written so far
+func (w *Writer) Digest() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.digest.Sum(nil)
+}
+
+// Stream returns an io.Writer that sends everything written to it as frames of type t
+func (w *Writer) Stream(t FrameType) io.Writer {
+	return &streamWriter{w: w, t: t}
+}
+
+// streamWriter splits writes into frames of a single type
+type streamWriter struct {
+	w *Writer
+	t FrameType
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), MaxFrameSize)
+		if err := s.w.WriteFrame(s.t, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// digestReader reads frames while keeping a digest of them, mirroring Writer
+type digestReader struct {
+	r      io.Reader
+	digest hash.Hash
+}
+
+func newDigestReader(r io.Reader) *digestReader {
+	return &digestReader{r: r, digest: sha256.New()}
+}
+
+// next reads a frame, adding it to the digest unless it is a signature
+func (d *digestReader) next() (FrameType, []byte, error) {
+	t, payload, err := ReadFrame(d.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if t != FrameSignature {
+		// Same encoding as WriteFrame, which cannot fail on a hash
+		_ = WriteFrame(d.digest, t, payload)
+	}
+	return t, payload, nil
+}
@@ -0,0 +1,100 @@
+package execstream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, nil)
+
+	large := strings.Repeat("x", MaxFrameSize+10)
+	if _, err := io.WriteString(w.Stream(FrameStdout), large); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.WriteFrame(FrameExit, []byte(`{"exit_code":0}`)); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	digest := w.Digest()
+	if err := w.WriteUnsigned(FrameSignature, []byte("sig")); err != nil {
+		t.Fatalf("WriteUnsigned() error = %v", err)
+	}
+
+	reader := newDigestReader(&buf)
+	var stdout strings.Builder
+	var types []FrameType
+	for {
+		typ, payload, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next() error = %v", err)
+		}
+		types = append(types, typ)
+		if typ == FrameStdout {
+			stdout.Write(payload)
+		}
+	}
+
+	// Large writes are split at MaxFrameSize
+	wantTypes := []FrameType{FrameStdout, FrameStdout, FrameExit, FrameSignature}
+	if len(types) != len(wantTypes) {
+		t.Fatalf("frame types = %v, want %v", types, wantTypes)
+	}
+	for i := range wantTypes {
+		if types[i] != wantTypes[i] {
+			t.Errorf("frame %d type = %d, want %d", i, types[i], wantTypes[i])
+		}
+	}
+	if stdout.String() != large {
+		t.Errorf("stdout length = %d, want %d", stdout.Len(), len(large))
+	}
+
+	// Reader and writer agree on the digest, which excludes the signature
+	if !bytes.Equal(reader.digest.Sum(nil), digest) {
+		t.Error("reader digest does not match writer digest")
+	}
+}
+
+func TestReadFrame_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{
+			name:    "clean end",
+			data:    nil,
+			wantErr: io.EOF,
+		},
+		{
+			name:    "truncated header",
+			data:    []byte{byte(FrameStdout), 0},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "truncated payload",
+			data:    []byte{byte(FrameStdout), 0, 0, 0, 4, 'a'},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "oversized frame",
+			data:    []byte{byte(FrameStdout), 0xff, 0xff, 0xff, 0xff},
+			wantErr: ErrFrameTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ReadFrame(bytes.NewReader(tt.data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReadFrame() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
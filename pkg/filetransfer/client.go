@@ -0,0 +1,223 @@
+package filetransfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/whywaita/shoes-vz/pkg/auth"
+)
+
+// Path is the runner-agent endpoint for file transfers.
+// GET downloads the file or directory named by the "path" query parameter as
+// a tar stream; PUT extracts a tar stream to it.
+const Path = "/files"
+
+// ContentType is the media type of transfer bodies
+const ContentType = "application/x-tar"
+
+// UploadResponse is returned by the runner-agent after an upload
+type UploadResponse struct {
+	Path string `json:"path"` // Where the uploaded root ended up
+}
+
+// Client copies files to and from a runner-agent
+type Client struct {
+	HTTPClient *http.Client
+	Signer     *auth.Signer  // Signs requests; nil disables
+	HostKey    ssh.PublicKey // Pinned guest host key responses must be signed with; nil skips the check
+	MaxSize    int64         // Limit on the total size of files; DefaultMaxSize if zero
+}
+
+// Download copies remotePath from the runner-agent at baseURL to localPath,
+// following cp semantics for an existing local directory. The archive is
+// extracted to a temporary directory and only moved into place once the
+// host key signature has been checked.
+func (c *Client) Download(ctx context.Context, baseURL, remotePath, localPath string) (string, error) {
+	req, nonce, err := c.newRequest(ctx, http.MethodGet, baseURL, remotePath, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+
+	dir, rename := Destination(localPath)
+	tmp, err := os.MkdirTemp(dir, ".shoes-vz-cp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmp)
+	}()
+
+	digest := sha256.New()
+	body := io.TeeReader(resp.Body, digest)
+	rootName, err := ExtractTar(body, tmp, "", c.maxSize())
+	if err != nil {
+		return "", err
+	}
+	// Drain the tar padding so that the trailer is read
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if c.HostKey != nil {
+		signature := resp.Trailer.Get(auth.HeaderHostSignature)
+		if err := auth.VerifyHostDigest(c.HostKey, signature, Path, nonce, resp.StatusCode, digest.Sum(nil)); err != nil {
+			return "", fmt.Errorf("refusing download: %w", err)
+		}
+	}
+
+	if rename == "" {
+		rename = rootName
+	}
+	dest := filepath.Join(dir, rename)
+	if err := os.Rename(filepath.Join(tmp, rootName), dest); err != nil {
+		return "", fmt.Errorf("failed to move download into place: %w", err)
+	}
+
+	return dest, nil
+}
+
+// Upload copies localPath to remotePath on the runner-agent at baseURL,
+// following cp semantics for an existing remote directory. It returns
+// where the copy ended up in the guest.
+func (c *Client) Upload(ctx context.Context, baseURL, localPath, remotePath string) (string, error) {
+	size, err := Size(localPath)
+	if err != nil {
+		return "", err
+	}
+	if size > c.maxSize() {
+		return "", fmt.Errorf("%w: %d bytes", ErrTooLarge, size)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(WriteTar(pw, localPath))
+	}()
+	defer func() {
+		_ = pr.Close()
+	}()
+
+	body := &macReader{r: pr, digest: sha256.New()}
+	req, nonce, err := c.newRequest(ctx, http.MethodPut, baseURL, remotePath, body)
+	if err != nil {
+		return "", err
+	}
+	// The archive is checked against the trailer before the runner-agent
+	// moves it into place
+	if c.Signer.Enabled() {
+		body.req = req
+		body.mac = c.Signer.StreamMAC(req)
+		req.Trailer = http.Header{auth.HeaderBodyMAC: nil}
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if c.HostKey != nil {
+		if err := auth.VerifyHostSignature(c.HostKey, resp, Path, nonce, respBody); err != nil {
+			return "", fmt.Errorf("refusing upload response: %w", err)
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+
+	var uploadResp UploadResponse
+	if err := json.Unmarshal(respBody, &uploadResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return uploadResp.Path, nil
+}
+
+// newRequest creates a signed request for remotePath. The query string is
+// signed in place of the body, which is streamed.
+func (c *Client) newRequest(ctx context.Context, method, baseURL, remotePath string, body io.Reader) (*http.Request, string, error) {
+	query := url.Values{"path": []string{remotePath}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+Path+"?"+query, body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", ContentType)
+	}
+	nonce := auth.NewNonce()
+	req.Header.Set(auth.HeaderNonce, nonce)
+	c.Signer.Sign(req, []byte(req.URL.RawQuery))
+
+	return req, nonce, nil
+}
+
+// macReader hashes an upload body as it is sent, and sets the body MAC
+// trailer of req once the body ends
+type macReader struct {
+	r      io.Reader
+	digest hash.Hash
+	req    *http.Request
+	mac    *auth.StreamMAC
+}
+
+func (m *macReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.digest.Write(p[:n])
+	if errors.Is(err, io.EOF) && m.req != nil {
+		// The transport sends the trailer after this EOF
+		m.req.Trailer.Set(auth.HeaderBodyMAC, hex.EncodeToString(m.mac.Sum(m.digest.Sum(nil))))
+	}
+	return n, err
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) maxSize() int64 {
+	if c.MaxSize > 0 {
+		return c.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+// responseError builds an error from a non-OK response
+func responseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return fmt.Errorf("HTTP request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
@@ -0,0 +1,260 @@
+package filetransfer
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMaxSize is the default limit on the total size of files in one transfer
+const DefaultMaxSize int64 = 4 << 30
+
+// ErrTooLarge is returned when a transfer exceeds its size limit
+var ErrTooLarge = errors.New("transfer exceeds size limit")
+
+// Size returns the total size of regular files under src, which may be a file or directory
+func Size(src string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %w", src, err)
+	}
+	return total, nil
+}
+
+// WriteTar writes src, a file or directory, to w as a tar stream. Entries
+// are named relative to the parent of src, so the archive has a single
+// root named after src. Permissions, modification times and symlinks are kept.
+func WriteTar(w io.Writer, src string) error {
+	tw := tar.NewWriter(w)
+	base := filepath.Dir(filepath.Clean(src))
+
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			// Sockets, devices and pipes cannot be meaningfully copied
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+
+		// The header fixed the size; a file that shrank meanwhile is an error
+		if _, err := io.CopyN(tw, f, header.Size); err != nil {
+			return fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+
+	return tw.Close()
+}
+
+// Destination resolves where an archive rooted at a single entry is extracted
+// for the requested destination, following cp semantics: into dest if it is an
+// existing directory, otherwise as dest itself. It returns the directory to
+// extract into and, in the latter case, the name replacing the archive's root.
+func Destination(dest string) (dir, rename string) {
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		return dest, ""
+	}
+	return filepath.Dir(dest), filepath.Base(dest)
+}
+
+// ExtractTar extracts a tar stream into dir, which must exist. If rename is
+// not empty, the archive's root entry is extracted under that name. Entries
+// cannot escape dir, and extraction stops with ErrTooLarge once the regular
+// files exceed maxSize bytes. It returns the name of the extracted root.
+func ExtractTar(r io.Reader, dir, rename string, maxSize int64) (string, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to open destination: %w", err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	tr := tar.NewReader(r)
+	var total int64
+	var rootName string
+
+	type dirTimes struct {
+		name   string
+		header *tar.Header
+	}
+	var dirs []dirTimes
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		name, err := entryName(header.Name, rename)
+		if err != nil {
+			return "", err
+		}
+		top, _, _ := strings.Cut(name, "/")
+		if rootName == "" {
+			rootName = top
+		} else if top != rootName {
+			return "", fmt.Errorf("archive has more than one root: %s and %s", rootName, top)
+		}
+
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(name, 0700); err != nil {
+				return "", fmt.Errorf("failed to create %s: %w", name, err)
+			}
+			// Applied once the contents are written, since the mode may deny writes
+			dirs = append(dirs, dirTimes{name: name, header: header})
+		case tar.TypeReg:
+			total += header.Size
+			if total > maxSize {
+				return "", ErrTooLarge
+			}
+			if err := extractFile(root, name, tr, header.Size, mode); err != nil {
+				return "", err
+			}
+			if err := root.Chtimes(name, header.ModTime, header.ModTime); err != nil {
+				return "", fmt.Errorf("failed to set times on %s: %w", name, err)
+			}
+		case tar.TypeSymlink:
+			if err := root.MkdirAll(path.Dir(name), 0700); err != nil {
+				return "", fmt.Errorf("failed to create %s: %w", path.Dir(name), err)
+			}
+			_ = root.Remove(name)
+			// The link target is not resolved here; the root keeps later writes inside dir
+			if err := root.Symlink(header.Linkname, name); err != nil {
+				return "", fmt.Errorf("failed to create symlink %s: %w", name, err)
+			}
+		default:
+			// Hard links, devices and the like are skipped
+		}
+	}
+
+	// Deepest directories first so that restricting a parent does not block its children
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := root.Chmod(d.name, d.header.FileInfo().Mode().Perm()); err != nil {
+			return "", fmt.Errorf("failed to set mode on %s: %w", d.name, err)
+		}
+		if err := root.Chtimes(d.name, d.header.ModTime, d.header.ModTime); err != nil {
+			return "", fmt.Errorf("failed to set times on %s: %w", d.name, err)
+		}
+	}
+
+	if rootName == "" {
+		return "", fmt.Errorf("archive is empty")
+	}
+	return rootName, nil
+}
+
+// extractFile writes one regular file from the archive
+func extractFile(root *os.Root, name string, r io.Reader, size int64, mode fs.FileMode) error {
+	if err := root.MkdirAll(path.Dir(name), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path.Dir(name), err)
+	}
+
+	// Replace rather than write through an existing file or symlink
+	_ = root.Remove(name)
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+
+	if _, err := io.CopyN(f, r, size); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	if err := root.Chmod(name, mode); err != nil {
+		return fmt.Errorf("failed to set mode on %s: %w", name, err)
+	}
+	return nil
+}
+
+// entryName validates an archive entry name and applies rename to its root
+func entryName(name, rename string) (string, error) {
+	clean := path.Clean(strings.TrimSuffix(name, "/"))
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid archive entry %q", name)
+	}
+
+	if rename != "" {
+		if _, rest, found := strings.Cut(clean, "/"); found {
+			clean = rename + "/" + rest
+		} else {
+			clean = rename
+		}
+	}
+
+	return clean, nil
+}
@@ -0,0 +1,188 @@
+package filetransfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteTarExtractTar(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "data")
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "secret"), []byte("s3cr3t"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/run.sh", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "secret"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	// Read-only directory must still be extractable
+	if err := os.Chmod(filepath.Join(src, "bin"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chmod(filepath.Join(src, "bin"), 0755)
+	})
+
+	var buf bytes.Buffer
+	if err := WriteTar(&buf, src); err != nil {
+		t.Fatalf("WriteTar() error = %v", err)
+	}
+
+	dest := t.TempDir()
+	rootName, err := ExtractTar(&buf, dest, "copy", DefaultMaxSize)
+	if err != nil {
+		t.Fatalf("ExtractTar() error = %v", err)
+	}
+	if rootName != "copy" {
+		t.Errorf("ExtractTar() = %q, want %q", rootName, "copy")
+	}
+	t.Cleanup(func() {
+		_ = os.Chmod(filepath.Join(dest, "copy", "bin"), 0755)
+	})
+
+	tests := []struct {
+		path string
+		mode os.FileMode
+	}{
+		{path: "copy/bin", mode: os.ModeDir | 0555},
+		{path: "copy/bin/run.sh", mode: 0755},
+		{path: "copy/secret", mode: 0600},
+		{path: "copy/link", mode: os.ModeSymlink | 0777},
+	}
+	for _, tt := range tests {
+		info, err := os.Lstat(filepath.Join(dest, tt.path))
+		if err != nil {
+			t.Errorf("Lstat(%s) error = %v", tt.path, err)
+			continue
+		}
+		if info.Mode() != tt.mode {
+			t.Errorf("mode of %s = %v, want %v", tt.path, info.Mode(), tt.mode)
+		}
+	}
+
+	if target, err := os.Readlink(filepath.Join(dest, "copy", "link")); err != nil || target != "bin/run.sh" {
+		t.Errorf("Readlink() = %q, %v, want %q", target, err, "bin/run.sh")
+	}
+	info, err := os.Stat(filepath.Join(dest, "copy", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func TestExtractTar_Rejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tar.Header
+		maxSize int64
+		wantErr error
+	}{
+		{
+			name:    "parent traversal",
+			entries: []tar.Header{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}},
+			maxSize: DefaultMaxSize,
+		},
+		{
+			name:    "absolute path",
+			entries: []tar.Header{{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}},
+			maxSize: DefaultMaxSize,
+		},
+		{
+			name: "write through symlink",
+			entries: []tar.Header{
+				{Name: "root/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "root/out", Typeflag: tar.TypeSymlink, Linkname: "/tmp"},
+				{Name: "root/out/file", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			maxSize: DefaultMaxSize,
+		},
+		{
+			name: "multiple roots",
+			entries: []tar.Header{
+				{Name: "a", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "b", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			maxSize: DefaultMaxSize,
+		},
+		{
+			name: "too large",
+			entries: []tar.Header{
+				{Name: "root/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "root/a", Typeflag: tar.TypeReg, Mode: 0644, Size: 6},
+				{Name: "root/b", Typeflag: tar.TypeReg, Mode: 0644, Size: 6},
+			},
+			maxSize: 10,
+			wantErr: ErrTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, h := range tt.entries {
+				if err := tw.WriteHeader(&h); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tw.Write(bytes.Repeat([]byte("x"), int(h.Size))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := ExtractTar(&buf, t.TempDir(), "", tt.maxSize)
+			if err == nil {
+				t.Fatal("ExtractTar() error = nil, want error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("ExtractTar() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDestination(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		dest       string
+		wantDir    string
+		wantRename string
+	}{
+		{name: "existing directory", dest: dir, wantDir: dir, wantRename: ""},
+		{name: "existing file", dest: file, wantDir: dir, wantRename: "file"},
+		{name: "new name", dest: filepath.Join(dir, "new"), wantDir: dir, wantRename: "new"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotDir, gotRename := Destination(tt.dest)
+			if gotDir != tt.wantDir || gotRename != tt.wantRename {
+				t.Errorf("Destination() = (%q, %q), want (%q, %q)", gotDir, gotRename, tt.wantDir, tt.wantRename)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// Package grpcmetrics provides gRPC interceptors recording Prometheus metrics
+package grpcmetrics
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics holds the metrics for one side of gRPC connections
+type Metrics struct {
+	handled  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	active   *prometheus.GaugeVec
+	received *prometheus.CounterVec
+	sent     *prometheus.CounterVec
+}
+
+// NewServerMetrics creates and registers the shoesvz_grpc_server_* metrics
+func NewServerMetrics(reg prometheus.Registerer) *Metrics {
+	return newMetrics(reg, "server")
+}
+
+// NewClientMetrics creates and registers the shoesvz_grpc_client_* metrics
+func NewClientMetrics(reg prometheus.Registerer) *Metrics {
+	return newMetrics(reg, "client")
+}
+
+func newMetrics(reg prometheus.Registerer, side string) *Metrics {
+	factory := promauto.With(reg)
+	prefix := "shoesvz_grpc_" + side + "_"
+
+	return &Metrics{
+		handled: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: prefix + "handled_total",
+				Help: "Total number of completed RPCs and streams by status code",
+			},
+			[]string{"method", "code"},
+		),
+		duration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: prefix + "handling_seconds",
+				Help: "Duration of RPCs, or lifetime of streams",
+				// Sync streams live as long as the agent is connected
+				Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 30, 60, 300, 1800, 3600, 21600, 86400},
+			},
+			[]string{"method"},
+		),
+		active: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: prefix + "streams_active",
+				Help: "Number of open streams",
+			},
+			[]string{"method"},
+		),
+		received: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: prefix + "msg_received_total",
+				Help: "Total number of stream messages received",
+			},
+			[]string{"method"},
+		),
+		sent: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: prefix + "msg_sent_total",
+				Help: "Total number of stream messages sent",
+			},
+			[]string{"method"},
+		),
+	}
+}
+
+func (m *Metrics) observe(method string, start time.Time, err error) {
+	m.handled.WithLabelValues(method, status.Code(err).String()).Inc()
+	m.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// UnaryServerInterceptor returns a gRPC server interceptor recording metrics
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.observe(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns a gRPC stream server interceptor recording
+// message counts and stream lifetime
+func (m *Metrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		method := info.FullMethod
+		start := time.Now()
+		m.active.WithLabelValues(method).Inc()
+		defer m.active.WithLabelValues(method).Dec()
+
+		err := handler(srv, &serverStream{ServerStream: ss, metrics: m, method: method})
+		m.observe(method, start, err)
+		return err
+	}
+}
+
+// UnaryClientInterceptor returns a gRPC client interceptor recording metrics
+func (m *Metrics) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		m.observe(method, start, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor returns a gRPC stream client interceptor recording
+// message counts and stream lifetime. A stream ends when receiving fails.
+func (m *Metrics) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			m.observe(method, start, err)
+			return nil, err
+		}
+
+		m.active.WithLabelValues(method).Inc()
+		return &clientStream{ClientStream: cs, metrics: m, method: method, start: start}, nil
+	}
+}
+
+// serverStream counts the messages of a server stream
+type serverStream struct {
+	grpc.ServerStream
+	metrics *Metrics
+	method  string
+}
+
+func (s *serverStream) RecvMsg(msg any) error {
+	err := s.ServerStream.RecvMsg(msg)
+	if err == nil {
+		s.metrics.received.WithLabelValues(s.method).Inc()
+	}
+	return err
+}
+
+func (s *serverStream) SendMsg(msg any) error {
+	err := s.ServerStream.SendMsg(msg)
+	if err == nil {
+		s.metrics.sent.WithLabelValues(s.method).Inc()
+	}
+	return err
+}
+
+// clientStream counts the messages of a client stream
+type clientStream struct {
+	grpc.ClientStream
+	metrics *Metrics
+	method  string
+	start   time.Time
+	once    sync.Once
+}
+
+func (s *clientStream) RecvMsg(msg any) error {
+	err := s.ClientStream.RecvMsg(msg)
+	if err == nil {
+		s.metrics.received.WithLabelValues(s.method).Inc()
+		return nil
+	}
+
+	s.once.Do(func() {
+		s.metrics.active.WithLabelValues(s.method).Dec()
+		if err == io.EOF {
+			s.metrics.observe(s.method, s.start, nil)
+		} else {
+			s.metrics.observe(s.method, s.start, err)
+		}
+	})
+	return err
+}
+
+func (s *clientStream) SendMsg(msg any) error {
+	err := s.ClientStream.SendMsg(msg)
+	if err == nil {
+		s.metrics.sent.WithLabelValues(s.method).Inc()
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package grpcmetrics
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const syncMethod = "/shoes.vz.agent.v1.AgentService/Sync"
+
+// fakeServerStream stands in for an agent sending recv messages
+type fakeServerStream struct {
+	grpc.ServerStream
+	recv int
+}
+
+func (s *fakeServerStream) Context() context.Context { return context.Background() }
+
+func (s *fakeServerStream) RecvMsg(any) error {
+	if s.recv == 0 {
+		return io.EOF
+	}
+	s.recv--
+	return nil
+}
+
+func (s *fakeServerStream) SendMsg(any) error { return nil }
+
+func TestStreamServerInterceptor(t *testing.T) {
+	tests := []struct {
+		name       string
+		recv       int
+		handlerErr error
+		wantCode   string
+	}{
+		{name: "agent disconnects", recv: 3, handlerErr: io.EOF, wantCode: codes.Unknown.String()},
+		{name: "stream canceled", recv: 1, handlerErr: status.Error(codes.Canceled, "context canceled"), wantCode: codes.Canceled.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewServerMetrics(prometheus.NewRegistry())
+			info := &grpc.StreamServerInfo{FullMethod: syncMethod, IsClientStream: true, IsServerStream: true}
+
+			err := m.StreamServerInterceptor()(nil, &fakeServerStream{recv: tt.recv}, info, func(_ any, ss grpc.ServerStream) error {
+				if got := testutil.ToFloat64(m.active.WithLabelValues(syncMethod)); got != 1 {
+					t.Errorf("streams_active during stream = %v, want 1", got)
+				}
+				// Answer every message, like Sync does
+				for ss.RecvMsg(nil) == nil {
+					if err := ss.SendMsg(nil); err != nil {
+						return err
+					}
+				}
+				return tt.handlerErr
+			})
+			if err != tt.handlerErr {
+				t.Fatalf("interceptor error = %v, want %v", err, tt.handlerErr)
+			}
+
+			if got := testutil.ToFloat64(m.received.WithLabelValues(syncMethod)); got != float64(tt.recv) {
+				t.Errorf("msg_received_total = %v, want %v", got, tt.recv)
+			}
+			if got := testutil.ToFloat64(m.sent.WithLabelValues(syncMethod)); got != float64(tt.recv) {
+				t.Errorf("msg_sent_total = %v, want %v", got, tt.recv)
+			}
+			if got := testutil.ToFloat64(m.active.WithLabelValues(syncMethod)); got != 0 {
+				t.Errorf("streams_active after stream = %v, want 0", got)
+			}
+			if got := testutil.ToFloat64(m.handled.WithLabelValues(syncMethod, tt.wantCode)); got != 1 {
+				t.Errorf("handled_total{code=%q} = %v, want 1", tt.wantCode, got)
+			}
+		})
+	}
+}
+
+// fakeClientStream stands in for a server sending recv messages before closing
+type fakeClientStream struct {
+	grpc.ClientStream
+	recv int
+	err  error
+}
+
+func (s *fakeClientStream) RecvMsg(any) error {
+	if s.recv == 0 {
+		return s.err
+	}
+	s.recv--
+	return nil
+}
+
+func (s *fakeClientStream) SendMsg(any) error { return nil }
+
+func TestStreamClientInterceptor(t *testing.T) {
+	tests := []struct {
+		name     string
+		closeErr error
+		wantCode string
+	}{
+		{name: "server closes the stream", closeErr: io.EOF, wantCode: codes.OK.String()},
+		{name: "server is unavailable", closeErr: status.Error(codes.Unavailable, "connection reset"), wantCode: codes.Unavailable.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewClientMetrics(prometheus.NewRegistry())
+			streamer := func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, ...grpc.CallOption) (grpc.ClientStream, error) {
+				return &fakeClientStream{recv: 2, err: tt.closeErr}, nil
+			}
+
+			cs, err := m.StreamClientInterceptor()(context.Background(), &grpc.StreamDesc{}, nil, syncMethod, streamer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cs.SendMsg(nil); err != nil {
+				t.Fatal(err)
+			}
+			for cs.RecvMsg(nil) == nil {
+			}
+			// Receiving again after the end must not count the stream twice
+			_ = cs.RecvMsg(nil)
+
+			if got := testutil.ToFloat64(m.received.WithLabelValues(syncMethod)); got != 2 {
+				t.Errorf("msg_received_total = %v, want 2", got)
+			}
+			if got := testutil.ToFloat64(m.sent.WithLabelValues(syncMethod)); got != 1 {
+				t.Errorf("msg_sent_total = %v, want 1", got)
+			}
+			if got := testutil.ToFloat64(m.active.WithLabelValues(syncMethod)); got != 0 {
+				t.Errorf("streams_active = %v, want 0", got)
+			}
+			if got := testutil.ToFloat64(m.handled.WithLabelValues(syncMethod, tt.wantCode)); got != 1 {
+				t.Errorf("handled_total{code=%q} = %v, want 1", tt.wantCode, got)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type contextKey string
@@ -29,10 +30,30 @@ func NewRequestID() string {
 	return uuid.New().String()
 }
 
-// FromContext returns a logger with request_id from context
+// FromContext returns a logger with request_id and trace_id from context
 func FromContext(ctx context.Context, base *slog.Logger) *slog.Logger {
+	logger := base
 	if requestID := RequestIDFromContext(ctx); requestID != "" {
-		return base.With("request_id", requestID)
+		logger = logger.With("request_id", requestID)
 	}
-	return base
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger
+}
+
+const loggerKey contextKey = "logger"
+
+// WithLogger adds a request-scoped logger to context
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// LoggerFromContext returns the logger added by WithLogger, or base with
+// request_id from context if there is none
+func LoggerFromContext(ctx context.Context, base *slog.Logger) *slog.Logger {
+	if v, ok := ctx.Value(loggerKey).(*slog.Logger); ok && v != nil {
+		return v
+	}
+	return FromContext(ctx, base)
 }
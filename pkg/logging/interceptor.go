@@ -2,7 +2,9 @@ package logging
 
 import (
 	"context"
+	"io"
 	"log/slog"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
@@ -69,6 +71,90 @@ func UnaryClientInterceptor(logger *slog.Logger) grpc.UnaryClientInterceptor {
 	}
 }
 
+// StreamServerInterceptor returns a gRPC stream server interceptor for logging.
+// The stream's context carries the request ID for the handler.
+func StreamServerInterceptor(logger *slog.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := WithRequestID(ss.Context(), extractOrGenerateRequestID(ss.Context()))
+		logger := FromContext(ctx, logger)
+
+		logger.Info("gRPC stream started", "method", info.FullMethod)
+		start := time.Now()
+
+		err := handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+
+		logAttrs := []any{
+			"method", info.FullMethod,
+			"duration_ms", time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			logAttrs = append(logAttrs, "error", err.Error())
+		}
+		logger.Info("gRPC stream finished", logAttrs...)
+
+		return err
+	}
+}
+
+// StreamClientInterceptor returns a gRPC stream client interceptor for logging
+func StreamClientInterceptor(logger *slog.Logger) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		// Ensure request ID in metadata
+		requestID := RequestIDFromContext(ctx)
+		if requestID == "" {
+			requestID = NewRequestID()
+			ctx = WithRequestID(ctx, requestID)
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, MetadataKeyRequestID, requestID)
+		logger := FromContext(ctx, logger)
+
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			logger.Info("gRPC client stream failed", "method", method, "error", err.Error())
+			return nil, err
+		}
+
+		logger.Info("gRPC client stream opened", "method", method)
+		return &loggedClientStream{ClientStream: cs, logger: logger, method: method, start: time.Now()}, nil
+	}
+}
+
+// contextServerStream replaces the context of a server stream
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// loggedClientStream logs when a client stream ends
+type loggedClientStream struct {
+	grpc.ClientStream
+	logger *slog.Logger
+	method string
+	start  time.Time
+	once   sync.Once
+}
+
+func (s *loggedClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			logAttrs := []any{
+				"method", s.method,
+				"duration_ms", time.Since(s.start).Milliseconds(),
+			}
+			if err != io.EOF {
+				logAttrs = append(logAttrs, "error", err.Error())
+			}
+			s.logger.Info("gRPC client stream closed", logAttrs...)
+		})
+	}
+	return err
+}
+
 func extractOrGenerateRequestID(ctx context.Context) string {
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
 		if vals := md.Get(MetadataKeyRequestID); len(vals) > 0 {
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context { return s.ctx }
+
+func TestStreamServerInterceptor(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	md := metadata.New(map[string]string{MetadataKeyRequestID: "req-from-agent"})
+	ss := &fakeServerStream{ctx: metadata.NewIncomingContext(context.Background(), md)}
+	info := &grpc.StreamServerInfo{FullMethod: "/shoes.vz.agent.v1.AgentService/Sync"}
+
+	var got string
+	err := StreamServerInterceptor(logger)(nil, ss, info, func(_ any, ss grpc.ServerStream) error {
+		got = RequestIDFromContext(ss.Context())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "req-from-agent" {
+		t.Errorf("request ID in handler = %q, want %q", got, "req-from-agent")
+	}
+	for _, msg := range []string{`msg="gRPC stream started"`, `msg="gRPC stream finished"`} {
+		if !strings.Contains(buf.String(), msg) {
+			t.Errorf("log = %q, want %s", buf.String(), msg)
+		}
+	}
+}
+
+func TestRecoveryInterceptors(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{
+			name: "unary",
+			call: func() error {
+				_, err := RecoveryUnaryServerInterceptor(logger)(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test/Unary"},
+					func(context.Context, any) (any, error) { panic("boom") })
+				return err
+			},
+		},
+		{
+			name: "stream",
+			call: func() error {
+				return RecoveryStreamServerInterceptor(logger)(nil, &fakeServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: "/test/Stream"},
+					func(any, grpc.ServerStream) error { panic("boom") })
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			err := tt.call()
+			if code := status.Code(err); code != codes.Internal {
+				t.Errorf("code = %v, want %v", code, codes.Internal)
+			}
+			if !strings.Contains(buf.String(), "panic=boom") {
+				t.Errorf("log = %q, want the panic value", buf.String())
+			}
+		})
+	}
+}
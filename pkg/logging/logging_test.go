@@ -1,9 +1,13 @@
 package logging
 
 import (
+	"bytes"
 	"context"
+	"log/slog"
+	"strings"
 	"testing"
 
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -65,6 +69,54 @@ func TestFromContext_NoRequestID(t *testing.T) {
 	}
 }
 
+func TestFromContext_TraceID(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(slog.NewTextHandler(&buf, nil))
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	FromContext(ctx, base).Info("runner created")
+
+	if want := "trace_id=4bf92f3577b34da6a3ce929d0e0e4736"; !strings.Contains(buf.String(), want) {
+		t.Errorf("log = %q, want it to contain %s", buf.String(), want)
+	}
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	base := NewLogger()
+	stored := NewLogger()
+
+	if got := LoggerFromContext(WithLogger(context.Background(), stored), base); got != stored {
+		t.Error("LoggerFromContext() should return the logger added by WithLogger")
+	}
+	if got := LoggerFromContext(context.Background(), base); got != base {
+		t.Error("LoggerFromContext() should return base when context has no logger")
+	}
+}
+
+func TestTeeHandler(t *testing.T) {
+	var info, debug bytes.Buffer
+	logger := slog.New(NewTeeHandler(
+		slog.NewTextHandler(&info, &slog.HandlerOptions{Level: slog.LevelInfo}),
+		slog.NewTextHandler(&debug, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	)).With("runner_id", "runner-1")
+
+	logger.Debug("checking")
+	logger.Info("started")
+
+	if got := info.String(); strings.Contains(got, "checking") || !strings.Contains(got, "msg=started runner_id=runner-1") {
+		t.Errorf("info handler got %q", got)
+	}
+	if got := debug.String(); !strings.Contains(got, "msg=checking runner_id=runner-1") || !strings.Contains(got, "msg=started runner_id=runner-1") {
+		t.Errorf("debug handler got %q", got)
+	}
+}
+
 func TestExtractOrGenerateRequestID(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -0,0 +1,125 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file that is moved to path.1 once it reaches
+// maxSize, so that at most twice maxSize bytes are kept on disk
+type RotatingFile struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens path for appending
+func NewRotatingFile(path string, maxSize int64) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid log size limit: %d", maxSize)
+	}
+
+	r := &RotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write appends p, rotating whenever the file reaches its limit
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		if r.f == nil {
+			return written, os.ErrClosed
+		}
+		if r.size >= r.maxSize {
+			if err := r.rotate(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p[:min(int64(len(p)), r.maxSize-r.size)]
+		n, err := r.f.Write(chunk)
+		r.size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	r.f = nil
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	return r.open()
+}
+
+// Close closes the file
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// ReadRotated returns up to the last limit bytes of a log written by
+// RotatingFile, including its rotated part. A limit of 0 returns everything.
+func ReadRotated(path string, limit int64) ([]byte, error) {
+	var data []byte
+	for _, p := range []string{path + ".1", path} {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read log file: %w", err)
+		}
+		data = append(data, b...)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("failed to read log file: %w", os.ErrNotExist)
+	}
+
+	if limit > 0 && int64(len(data)) > limit {
+		data = data[int64(len(data))-limit:]
+	}
+	return data, nil
+}
+
+var _ io.WriteCloser = (*RotatingFile)(nil)
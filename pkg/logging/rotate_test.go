@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+
+	r, err := NewRotatingFile(path, 10)
+	if err != nil {
+		t.Fatalf("NewRotatingFile() error = %v", err)
+	}
+	for _, s := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dd\n"} {
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "current file", path: path, want: "cccc\ndd\n"},
+		{name: "rotated file", path: path + ".1", want: "aaaa\nbbbb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := os.ReadFile(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Reopening appends to the current file
+	r, err = NewRotatingFile(path, 10)
+	if err != nil {
+		t.Fatalf("NewRotatingFile() error = %v", err)
+	}
+	if _, err := r.Write([]byte("e\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	_ = r.Close()
+	if _, err := r.Write([]byte("f\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() after Close() error = %v, want %v", err, os.ErrClosed)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "cccc\ndd\ne\n" {
+		t.Errorf("content after reopen = %q, want %q", got, "cccc\ndd\ne\n")
+	}
+}
+
+func TestReadRotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "console.log")
+	if err := os.WriteFile(path+".1", []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		limit   int64
+		want    string
+		wantErr bool
+	}{
+		{name: "everything", path: path, want: "old\nnew\n"},
+		{name: "tail", path: path, limit: 6, want: "d\nnew\n"},
+		{name: "limit larger than log", path: path, limit: 100, want: "old\nnew\n"},
+		{name: "missing log", path: filepath.Join(dir, "missing.log"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadRotated(tt.path, tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadRotated() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ReadRotated() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
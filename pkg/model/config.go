@@ -15,11 +15,23 @@ type AgentConfig struct {
 	ServerAddr     string
 	Hostname       string
 	MaxRunners     uint32
-	TemplatePath   string
 	RunnersPath    string
 	SSHKeyPath     string
+	SSHUser        string
+	SSHPort        int
+	SSHInsecure    bool // Accept any guest host key when the runner-agent did not report one
 	SyncInterval   time.Duration
+	SetupTimeout   time.Duration // Limit on the setup script run time (0 for the default)
+	CallbackAddr   string        // host:port guests use to reach the IP notification server
 	EnableGraphics bool
+	AuthSecret     []byte // Shared secret for signing requests to and from runner-agent
+
+	TemplatesDir            string // Directory of templates, see internal/agent/template
+	DefaultTemplate         string // Template used when a runner does not name one
+	RequireTemplateMetadata bool   // Refuse templates without a TemplateMetadata.json
+
+	MaxTransferSize int64 // Limit on bytes per file copy to or from a VM (0 for the default)
+	ConsoleLogSize  int64 // Size at which a VM's console log is rotated (0 for the default)
 }
 
 // MonitorConfig contains configuration for shoes-vz-runner-agent
@@ -27,4 +39,7 @@ type MonitorConfig struct {
 	ListenAddr   string // TCP listen address
 	RunnerPath   string
 	PollInterval time.Duration
+	AuthSecret   []byte // Shared secret for signing requests to and from shoes-vz-agent
+
+	MaxTransferSize int64 // Limit on bytes per /files transfer (0 for the default)
 }
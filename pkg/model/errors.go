@@ -9,6 +9,10 @@ var (
 	// ErrAgentNotFound is returned when an agent is not found
 	ErrAgentNotFound = errors.New("agent not found")
 
+	// ErrRunnerNotAssigned is returned when an agent reports a runner that
+	// was neither sent to it nor already belongs to it
+	ErrRunnerNotAssigned = errors.New("runner not assigned to agent")
+
 	// ErrNoAvailableAgent is returned when no agent has capacity
 	ErrNoAvailableAgent = errors.New("no available agent")
 
@@ -30,6 +34,10 @@ var (
 	// ErrTemplateNotFound is returned when template is not found
 	ErrTemplateNotFound = errors.New("template not found")
 
+	// ErrTemplateInvalid is returned when a template's metadata or files
+	// fail verification
+	ErrTemplateInvalid = errors.New("template invalid")
+
 	// ErrCloneFailed is returned when APFS clone fails
 	ErrCloneFailed = errors.New("APFS clone failed")
 )
@@ -19,6 +19,9 @@ type RunnerInfo struct {
 	SetupScript  string
 	BundlePath   string
 	MachineID    string
+
+	// Template is the template version the VM was cloned from
+	Template *agentv1.Template
 }
 
 // IsTerminalState returns true if the runner is in a terminal state
@@ -0,0 +1,209 @@
+// Package tlsconfig builds TLS configurations for the gRPC connections
+// between myshoes plugin, shoes-vz-server and shoes-vz-agent
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Files names the PEM files used by one end of a connection
+type Files struct {
+	// CertFile and KeyFile are this end's certificate and private key
+	CertFile string
+	KeyFile  string
+
+	// CAFile verifies the other end. On a server it also turns on mutual
+	// TLS; on a client the system roots are used when it is empty.
+	CAFile string
+}
+
+func (f Files) validate() error {
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return errors.New("certificate and key must be given together")
+	}
+	return nil
+}
+
+// NewServerConfig returns the TLS configuration of a server. Clients must
+// present a certificate signed by f.CAFile when it is set. The certificate,
+// key and CA files are read again when they change on disk, so rotated
+// certificates are used for new connections without a restart.
+func NewServerConfig(f Files) (*tls.Config, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	if f.CertFile == "" {
+		return nil, errors.New("server certificate is required")
+	}
+
+	cert, err := newKeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.get()
+		},
+	}
+	if f.CAFile == "" {
+		return config, nil
+	}
+
+	ca, err := newCertPool(f.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = ca.pool
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.ClientCAs = ca.get()
+		c.GetConfigForClient = nil
+		return c, nil
+	}
+	return config, nil
+}
+
+// NewClientConfig returns the TLS configuration of a client. serverName
+// overrides the name checked against the server certificate. The client
+// certificate is read again when it changes on disk; the CA file is only
+// read once.
+func NewClientConfig(f Files, serverName string) (*tls.Config, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if f.CAFile != "" {
+		ca, err := newCertPool(f.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = ca.pool
+	}
+	if f.CertFile != "" {
+		cert, err := newKeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get()
+		}
+	}
+	return config, nil
+}
+
+// fileVersion identifies the contents of a file without reading it
+type fileVersion struct {
+	modTime int64
+	size    int64
+}
+
+func statFile(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: info.ModTime().UnixNano(), size: info.Size()}, nil
+}
+
+// keyPair is a certificate that is reloaded when its files change
+type keyPair struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	version [2]fileVersion
+}
+
+func newKeyPair(certFile, keyFile string) (*keyPair, error) {
+	k := &keyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := k.get(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// get returns the current certificate. If the files changed but cannot be
+// loaded, for example while only one of them has been replaced, the
+// previous certificate is kept.
+func (k *keyPair) get() (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	certVersion, certErr := statFile(k.certFile)
+	keyVersion, keyErr := statFile(k.keyFile)
+	version := [2]fileVersion{certVersion, keyVersion}
+	if k.cert != nil && (certErr != nil || keyErr != nil || version == k.version) {
+		return k.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	k.cert = &cert
+	k.version = version
+	return k.cert, nil
+}
+
+// certPool is a CA bundle that is reloaded when its file changes
+type certPool struct {
+	path string
+
+	mu      sync.Mutex
+	pool    *x509.CertPool
+	version fileVersion
+}
+
+func newCertPool(path string) (*certPool, error) {
+	version, err := statFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool, err := loadCertPool(path)
+	if err != nil {
+		return nil, err
+	}
+	return &certPool{path: path, pool: pool, version: version}, nil
+}
+
+func (c *certPool) get() *x509.CertPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	version, err := statFile(c.path)
+	if err != nil || version == c.version {
+		return c.pool
+	}
+	if pool, err := loadCertPool(c.path); err == nil {
+		c.pool = pool
+		c.version = version
+	}
+	return c.pool
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,236 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string) (*testCA, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "shoes-vz test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ca.pem")
+	writePEM(t, path, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key}, path
+}
+
+// issue writes a certificate for name, signed by the CA, to certFile and keyFile
+func (ca *testCA) issue(t *testing.T, certFile, keyFile, name string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	// Make sure the change is visible even on coarse file timestamps
+	mtime := time.Now().Add(time.Duration(serial) * time.Second)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects client to server over loopback and returns the
+// serial number of the certificate the server presented
+func handshake(t *testing.T, server, client *tls.Config) (int64, error) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = lis.Close() }()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		serverErr <- tls.Server(conn, server).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", lis.Addr().String(), client)
+	if err != nil {
+		<-serverErr
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+	// TLS 1.3 clients finish before the server has checked their certificate
+	if err := <-serverErr; err != nil {
+		return 0, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caFile := newTestCA(t, dir)
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	agentCert, agentKey := filepath.Join(dir, "agent.pem"), filepath.Join(dir, "agent-key.pem")
+	ca.issue(t, serverCert, serverKey, "shoes-vz-server", 10)
+	ca.issue(t, agentCert, agentKey, "agent-1", 20)
+
+	otherCA, otherCAFile := newTestCA(t, t.TempDir())
+	otherCert, otherKey := filepath.Join(dir, "other.pem"), filepath.Join(dir, "other-key.pem")
+	otherCA.issue(t, otherCert, otherKey, "agent-2", 30)
+
+	server, err := NewServerConfig(Files{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		files   Files
+		wantErr bool
+	}{
+		{name: "agent with certificate", files: Files{CertFile: agentCert, KeyFile: agentKey, CAFile: caFile}},
+		{name: "agent without certificate", files: Files{CAFile: caFile}, wantErr: true},
+		{name: "certificate from another CA", files: Files{CertFile: otherCert, KeyFile: otherKey, CAFile: caFile}, wantErr: true},
+		{name: "server not trusted", files: Files{CertFile: agentCert, KeyFile: agentKey, CAFile: otherCAFile}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClientConfig(tt.files, "shoes-vz-server")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = handshake(t, server, client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerConfig_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca, caFile := newTestCA(t, dir)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	ca.issue(t, certFile, keyFile, "shoes-vz-server", 10)
+
+	server, err := NewServerConfig(Files{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientConfig(Files{CAFile: caFile}, "shoes-vz-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serial, err := handshake(t, server, client); err != nil || serial != 10 {
+		t.Fatalf("handshake() = %v, %v, want serial 10", serial, err)
+	}
+
+	ca.issue(t, certFile, keyFile, "shoes-vz-server", 11)
+	if serial, err := handshake(t, server, client); err != nil || serial != 11 {
+		t.Errorf("handshake() after rotation = %v, %v, want serial 11", serial, err)
+	}
+
+	// A half-written rotation keeps the last good certificate
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if serial, err := handshake(t, server, client); err != nil || serial != 11 {
+		t.Errorf("handshake() with broken key = %v, %v, want serial 11", serial, err)
+	}
+}
+
+func TestConfig_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	_, caFile := newTestCA(t, dir)
+
+	tests := []struct {
+		name   string
+		server bool
+		files  Files
+	}{
+		{name: "server without certificate", server: true, files: Files{CAFile: caFile}},
+		{name: "certificate without key", server: true, files: Files{CertFile: filepath.Join(dir, "server.pem")}},
+		{name: "missing certificate file", server: true, files: Files{CertFile: filepath.Join(dir, "server.pem"), KeyFile: filepath.Join(dir, "server-key.pem")}},
+		{name: "client key without certificate", files: Files{KeyFile: filepath.Join(dir, "agent-key.pem")}},
+		{name: "CA file without certificates", files: Files{CAFile: filepath.Join(dir, "empty.pem")}},
+	}
+	if err := os.WriteFile(filepath.Join(dir, "empty.pem"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.server {
+				_, err = NewServerConfig(tt.files)
+			} else {
+				_, err = NewClientConfig(tt.files, "")
+			}
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Package tracing sets up OpenTelemetry tracing for shoes-vz components
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/stats"
+
+	agentv1 "github.com/whywaita/shoes-vz/gen/go/shoes/vz/agent/v1"
+)
+
+const instrumentationName = "github.com/whywaita/shoes-vz"
+
+// Attribute keys shared by all components
+const (
+	RunnerIDKey = attribute.Key("shoes_vz.runner_id")
+	AgentIDKey  = attribute.Key("shoes_vz.agent_id")
+	CloudIDKey  = attribute.Key("shoes_vz.cloud_id")
+)
+
+// Config configures trace export
+type Config struct {
+	// OTLPEndpoint is the host:port of an OTLP/gRPC collector.
+	// Spans are not exported if it is empty.
+	OTLPEndpoint string
+
+	// Insecure connects to the collector without TLS
+	Insecure bool
+
+	// ServiceName is reported as service.name
+	ServiceName string
+}
+
+// Setup installs the global tracer provider and W3C trace context
+// propagator. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer for a component
+func Tracer(component string) trace.Tracer {
+	return otel.Tracer(instrumentationName + "/" + component)
+}
+
+// End records err on span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject returns the trace context of ctx for sending inside a message
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx with the trace context sent by Inject
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// ServerHandler returns a gRPC stats handler that traces incoming calls.
+// The long-lived Sync stream is left out; its commands are traced instead.
+func ServerHandler() stats.Handler {
+	return otelgrpc.NewServerHandler(otelgrpc.WithFilter(notSync))
+}
+
+// ClientHandler returns a gRPC stats handler that traces outgoing calls
+func ClientHandler() stats.Handler {
+	return otelgrpc.NewClientHandler(otelgrpc.WithFilter(notSync))
+}
+
+func notSync(info *stats.RPCTagInfo) bool {
+	return info.FullMethodName != agentv1.AgentService_Sync_FullMethodName
+}
@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func setupTest(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	if _, err := Setup(context.Background(), Config{}); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return exporter
+}
+
+func TestInjectExtract(t *testing.T) {
+	exporter := setupTest(t)
+
+	// The server side of a command
+	ctx, span := Tracer("server").Start(context.Background(), "AddInstance")
+	carrier := Inject(ctx)
+	span.End()
+	if carrier["traceparent"] == "" {
+		t.Fatalf("Inject() = %v, want a traceparent", carrier)
+	}
+
+	// The agent side
+	agentCtx := Extract(context.Background(), carrier)
+	_, child := Tracer("agent").Start(agentCtx, "CreateRunner")
+	child.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if spans[1].Parent.SpanID() != spans[0].SpanContext.SpanID() {
+		t.Errorf("agent span parent = %v, want %v", spans[1].Parent.SpanID(), spans[0].SpanContext.SpanID())
+	}
+	if spans[1].SpanContext.TraceID() != spans[0].SpanContext.TraceID() {
+		t.Errorf("agent span is in trace %v, want %v", spans[1].SpanContext.TraceID(), spans[0].SpanContext.TraceID())
+	}
+}
+
+func TestInject_NoSpan(t *testing.T) {
+	setupTest(t)
+
+	if got := Inject(context.Background()); got != nil {
+		t.Errorf("Inject() = %v, want nil without a span", got)
+	}
+	ctx := context.Background()
+	if got := Extract(ctx, nil); got != ctx {
+		t.Error("Extract() should return ctx unchanged for an empty carrier")
+	}
+	if trace.SpanContextFromContext(Extract(ctx, map[string]string{"traceparent": "garbage"})).IsValid() {
+		t.Error("Extract() returned a valid span context for a malformed traceparent")
+	}
+}
+
+func TestEnd(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{name: "success", err: nil, want: codes.Unset},
+		{name: "failure", err: errors.New("SSH wait timeout"), want: codes.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := setupTest(t)
+
+			_, span := Tracer("vm").Start(context.Background(), "vm.WaitForSSH")
+			End(span, tt.err)
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("got %d spans, want 1", len(spans))
+			}
+			if spans[0].Status.Code != tt.want {
+				t.Errorf("End() status = %v, want %v", spans[0].Status.Code, tt.want)
+			}
+			if tt.err != nil && len(spans[0].Events) == 0 {
+				t.Error("End() did not record the error")
+			}
+		})
+	}
+}
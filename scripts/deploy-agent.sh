@@ -16,6 +16,7 @@ MAX_RUNNERS="2"
 TEMPLATE_PATH="/opt/myshoes/vz/templates/macos-26"
 RUNNERS_PATH="/opt/myshoes/vz/runners"
 IP_NOTIFY_PORT="8081"
+AUTH_SECRET_FILE="/opt/myshoes/vz/auth-secret"
 INSTALL_DIR="/usr/local/bin"
 PLIST_DIR="/Library/LaunchDaemons"
 PLIST_NAME="com.github.whywaita.shoes-vz-agent.plist"
@@ -132,6 +133,12 @@ mkdir -p "$WORK_DIR"
 mkdir -p "$RUNNERS_PATH"
 mkdir -p "$(dirname "$TEMPLATE_PATH")"
 
+# The agent refuses to start without a secret for runner-agent requests
+if [ ! -s "$AUTH_SECRET_FILE" ]; then
+    echo -e "${YELLOW}Generating auth secret at $AUTH_SECRET_FILE...${NC}"
+    (umask 077 && openssl rand -hex 32 > "$AUTH_SECRET_FILE")
+fi
+
 # Create plist file
 echo -e "${YELLOW}Creating LaunchDaemon plist...${NC}"
 cat > "$PLIST_DIR/$PLIST_NAME" <<EOF
@@ -155,6 +162,8 @@ cat > "$PLIST_DIR/$PLIST_NAME" <<EOF
         <string>$RUNNERS_PATH</string>
         <string>-ip-notify-port</string>
         <string>$IP_NOTIFY_PORT</string>
+        <string>-auth-secret-file</string>
+        <string>$AUTH_SECRET_FILE</string>
     </array>
 
     <key>RunAtLoad</key>
@@ -2,6 +2,9 @@
 # Script to convert Tart VM to shoes-vz template
 # Usage: deploy-tart-to-template.sh <source-vm-name> <template-name>
 #
+# Superseded by `shoes-vz-agent template import --from-tart <dir>`, which also
+# writes TemplateMetadata.json and validates the result.
+#
 # This script performs the following:
 # 1. Copy disk image and NVRAM from Tart VM using APFS clone
 # 2. Generate HardwareModel.json
@@ -86,6 +86,19 @@ else
     echo "Warning: shoes-vz-runner-agent not found at /tmp/shoes-vz-runner-agent"
 fi
 
+echo "=== Configuring sshd to use the runner-agent host key ==="
+# shoes-vz-runner-agent runs as runner and cannot write /etc/ssh, so it
+# keeps the per-clone host key in a directory runner owns. The key made
+# here keeps SSH working until a clone replaces it on first boot.
+sudo mkdir -p /var/db/shoes-vz
+sudo chown runner:staff /var/db/shoes-vz
+sudo chmod 700 /var/db/shoes-vz
+if [ ! -f /var/db/shoes-vz/ssh_host_ed25519_key ]; then
+    sudo -u runner ssh-keygen -q -t ed25519 -N "" -f /var/db/shoes-vz/ssh_host_ed25519_key
+fi
+sudo mkdir -p /etc/ssh/sshd_config.d
+echo "HostKey /var/db/shoes-vz/ssh_host_ed25519_key" | sudo tee /etc/ssh/sshd_config.d/100-shoes-vz.conf > /dev/null
+
 echo "=== Setting up runner-monitor LaunchDaemon ==="
 # Deploy as LaunchDaemon (runs at system boot without login)
 